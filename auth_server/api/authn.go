@@ -16,7 +16,10 @@
 
 package api
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 type Labels map[string][]string
 
@@ -39,9 +42,56 @@ type Authenticator interface {
 	Name() string
 }
 
+// ClientCert describes a verified TLS client certificate presented with a request.
+type ClientCert struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+}
+
+// Names returns the subject CN followed by all of the SANs.
+func (cc *ClientCert) Names() []string {
+	names := []string{cc.CommonName}
+	names = append(names, cc.DNSNames...)
+	names = append(names, cc.EmailAddresses...)
+	return append(names, cc.URIs...)
+}
+
+// Optional interface for authenticators that can authenticate a request by its client certificate.
+// It is only called for requests that came with a certificate verified against server.client_ca_file.
+type ClientCertAuthenticator interface {
+	// Same semantics as Authenticator.Authenticate, but with the certificate in place of the password.
+	AuthenticateClientCert(user string, cert *ClientCert) (bool, Labels, error)
+}
+
+// Optional interface for authenticators that make outbound requests and can use the context
+// of the incoming request, e.g. to propagate traces. If implemented, it is called instead of Authenticate.
+type ContextAuthenticator interface {
+	// Same semantics as Authenticator.Authenticate.
+	AuthenticateContext(ctx context.Context, user string, password PasswordString) (bool, Labels, error)
+}
+
+// Optional interface for authenticators and authorizers that depend on an external backend,
+// such as a database or a directory server. It is used by the readiness check.
+type HealthChecker interface {
+	// CheckHealth returns an error if the backend cannot be reached.
+	CheckHealth() error
+}
+
 var NoMatch = errors.New("did not match any rule")
 var WrongPass = errors.New("wrong password for user")
 
+// Like WrongPass, returned if the password is right but the one-time code that
+// has to be appended to it is missing or wrong.
+var NoTOTPCode = errors.New("one-time code required")
+var WrongTOTPCode = errors.New("wrong one-time code")
+
+// IsWrongCredentials tells if an error returned by Authenticate means that the credentials were wrong.
+func IsWrongCredentials(err error) bool {
+	return err == WrongPass || err == NoTOTPCode || err == WrongTOTPCode
+}
+
 type PasswordString string
 
 func (ps PasswordString) String() string {
@@ -48,11 +48,23 @@ type Authorizer interface {
 type AuthRequestInfo struct {
 	Account string
 	Type    string
+	// Resource class, e.g. "plugin" for "repository(plugin):foo:pull". Usually empty.
+	Class   string
 	Name    string
 	Service string
 	IP      net.IP
 	Actions []string
 	Labels  Labels
+	// Set when this is the source repository of a cross-repository blob mount: the name of the
+	// repository the blob is mounted into. Push to it has been granted in the same request.
+	MountTarget string
+
+	// Set by the authorizer that reached a decision to describe the rule that matched,
+	// for the audit log. Optional.
+	MatchedRule string `json:"-"`
+	// A short name for the matched rule, such as its comment, to tell the client why actions
+	// were denied. Optional, MatchedRule is used if not set.
+	MatchedRuleName string `json:"-"`
 }
 
 func (ai AuthRequestInfo) String() string {
@@ -16,7 +16,13 @@
 
 package authn
 
-import "embed"
+import (
+	"embed"
+
+	"go.opentelemetry.io/otel"
+)
 
 //go:embed data/*
 var static embed.FS
+
+var tracer = otel.Tracer("github.com/cesanta/docker_auth/auth_server/authn")
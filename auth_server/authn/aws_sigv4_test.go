@@ -0,0 +1,101 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Cases from the AWS Signature Version 4 test suite,
+// https://docs.aws.amazon.com/general/latest/gr/signature-v4-test-suite.html.
+func TestSignAWSRequest(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	cases := []struct {
+		name, method, body string
+		headers            map[string]string
+		token              string
+		signedHeaders      string
+		signature          string
+	}{
+		{
+			name: "get-vanilla", method: "GET",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "post-vanilla", method: "POST",
+			signedHeaders: "host;x-amz-date",
+			signature:     "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name: "post-header-key-sort", method: "POST",
+			headers:       map[string]string{"My-Header1": "value1"},
+			signedHeaders: "host;my-header1;x-amz-date",
+			signature:     "c5410059b04c1ee005303aed430f6e6645f61f4dc9e1461ec8f8916fdf18852c",
+		},
+		{
+			name: "post-x-www-form-urlencoded", method: "POST", body: "Param1=value1",
+			headers:       map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			signedHeaders: "content-type;host;x-amz-date",
+			signature:     "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name: "post-sts-header-before", method: "POST",
+			token:         "AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA==",
+			signedHeaders: "host;x-amz-date;x-amz-security-token",
+			signature:     "85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead",
+		},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, "https://example.amazonaws.com/", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		creds := creds
+		creds.SessionToken = c.token
+		signAWSRequest(req, []byte(c.body), creds, "us-east-1", "service", now)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=" + c.signedHeaders + ", Signature=" + c.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date %q", c.name, got)
+		}
+	}
+}
+
+func TestSignAWSRequestCredentialsFromEnv(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	SignAWSRequest(req, nil, "", "", "", "us-east-1", "service")
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDENV/") {
+		t.Errorf("Authorization %q does not use the key from the environment", auth)
+	}
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("X-Amz-Security-Token %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type ClientCertAuthConfig struct {
+	// Glob patterns of certificate names (CN or SAN) that are accepted. Any verified certificate if empty.
+	AllowedNames []string `mapstructure:"allowed_names,omitempty"`
+}
+
+func (c *ClientCertAuthConfig) Validate(configKey string) error {
+	for _, p := range c.AllowedNames {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%s.allowed_names: invalid pattern %q: %s", configKey, p, err)
+		}
+	}
+	return nil
+}
+
+type clientCertAuth struct {
+	config *ClientCertAuthConfig
+}
+
+func NewClientCertAuth(c *ClientCertAuthConfig) *clientCertAuth {
+	return &clientCertAuth{config: c}
+}
+
+// Password authentication is left to other authenticators.
+func (cca *clientCertAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	return false, nil, api.NoMatch
+}
+
+// AuthenticateClientCert succeeds if the user is the CN or one of the SANs of the certificate.
+// Otherwise NoMatch is returned so that the request can still be authenticated by password.
+func (cca *clientCertAuth) AuthenticateClientCert(user string, cert *api.ClientCert) (bool, api.Labels, error) {
+	found := false
+	for _, name := range cert.Names() {
+		if name != "" && name == user {
+			found = true
+			break
+		}
+	}
+	if !found || !cca.allowed(user) {
+		return false, nil, api.NoMatch
+	}
+	labels := api.Labels{"cert_cn": []string{cert.CommonName}}
+	if len(cert.DNSNames) > 0 {
+		labels["cert_dns"] = cert.DNSNames
+	}
+	if len(cert.EmailAddresses) > 0 {
+		labels["cert_email"] = cert.EmailAddresses
+	}
+	if len(cert.URIs) > 0 {
+		labels["cert_uri"] = cert.URIs
+	}
+	return true, labels, nil
+}
+
+func (cca *clientCertAuth) allowed(name string) bool {
+	if len(cca.config.AllowedNames) == 0 {
+		return true
+	}
+	for _, p := range cca.config.AllowedNames {
+		if matched, _ := path.Match(p, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (cca *clientCertAuth) Stop() {
+}
+
+func (cca *clientCertAuth) Name() string {
+	return "client certificate"
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestClientCertAuth(t *testing.T) {
+	cert := &api.ClientCert{
+		CommonName:     "ci-runner",
+		DNSNames:       []string{"runner.example.com"},
+		EmailAddresses: []string{"ci@example.com"},
+		URIs:           []string{"spiffe://example.com/ci"},
+	}
+	cca := NewClientCertAuth(&ClientCertAuthConfig{})
+	for _, user := range []string{"ci-runner", "runner.example.com", "ci@example.com", "spiffe://example.com/ci"} {
+		ok, labels, err := cca.AuthenticateClientCert(user, cert)
+		if !ok || err != nil {
+			t.Errorf("%s: expected to be accepted, got %t %v", user, ok, err)
+			continue
+		}
+		expected := api.Labels{
+			"cert_cn":    []string{"ci-runner"},
+			"cert_dns":   []string{"runner.example.com"},
+			"cert_email": []string{"ci@example.com"},
+			"cert_uri":   []string{"spiffe://example.com/ci"},
+		}
+		if !reflect.DeepEqual(labels, expected) {
+			t.Errorf("%s: expected labels %v, got %v", user, expected, labels)
+		}
+	}
+	for _, user := range []string{"", "other", "CI-RUNNER", "example.com"} {
+		if ok, _, err := cca.AuthenticateClientCert(user, cert); ok || err != api.NoMatch {
+			t.Errorf("%q: expected NoMatch, got %t %v", user, ok, err)
+		}
+	}
+	if ok, _, err := cca.Authenticate("ci-runner", "secret"); ok || err != api.NoMatch {
+		t.Errorf("expected passwords to be left to other authenticators, got %t %v", ok, err)
+	}
+	ok, labels, err := cca.AuthenticateClientCert("bob", &api.ClientCert{CommonName: "bob"})
+	if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"cert_cn": []string{"bob"}}) {
+		t.Errorf("expected only the CN label for a certificate without SANs, got %t %v %v", ok, labels, err)
+	}
+}
+
+func TestClientCertAuthAllowedNames(t *testing.T) {
+	cca := NewClientCertAuth(&ClientCertAuthConfig{AllowedNames: []string{"*.ci.example.com", "deploy"}})
+	for _, tc := range []struct {
+		cert    *api.ClientCert
+		user    string
+		allowed bool
+	}{
+		{&api.ClientCert{CommonName: "deploy"}, "deploy", true},
+		{&api.ClientCert{CommonName: "a.ci.example.com"}, "a.ci.example.com", true},
+		{&api.ClientCert{CommonName: "x", DNSNames: []string{"b.ci.example.com"}}, "b.ci.example.com", true},
+		// The user must be allowed, not just any of the names of the certificate.
+		{&api.ClientCert{CommonName: "x", DNSNames: []string{"b.ci.example.com"}}, "x", false},
+		{&api.ClientCert{CommonName: "ci.example.com"}, "ci.example.com", false},
+		{&api.ClientCert{CommonName: "deployer"}, "deployer", false},
+	} {
+		ok, _, err := cca.AuthenticateClientCert(tc.user, tc.cert)
+		if tc.allowed && (!ok || err != nil) {
+			t.Errorf("%s: expected to be accepted, got %t %v", tc.user, ok, err)
+		} else if !tc.allowed && (ok || err != api.NoMatch) {
+			t.Errorf("%s: expected NoMatch, got %t %v", tc.user, ok, err)
+		}
+	}
+}
+
+func TestClientCertAuthConfigValidate(t *testing.T) {
+	if err := (&ClientCertAuthConfig{AllowedNames: []string{"*.example.com", "ci-?"}}).Validate("client_cert_auth"); err != nil {
+		t.Errorf("expected valid patterns to be accepted, got %s", err)
+	}
+	if err := (&ClientCertAuthConfig{AllowedNames: []string{"[a-"}}).Validate("client_cert_auth"); err == nil {
+		t.Errorf("expected an invalid pattern to be rejected")
+	}
+}
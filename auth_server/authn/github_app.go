@@ -0,0 +1,210 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// GitHubAppConfig makes GitHub auth check organization and team membership as a GitHub App
+// installed in the organization, instead of with the user's own token.
+// Users still sign in with OAuth to prove who they are, but their token needs no org access,
+// and membership lookups count against the app's rate limit rather than the user's.
+// The app needs read-only access to organization members.
+type GitHubAppConfig struct {
+	AppID          int64 `mapstructure:"app_id,omitempty"`
+	InstallationID int64 `mapstructure:"installation_id,omitempty"`
+	// PEM-encoded private key of the app.
+	PrivateKey string `mapstructure:"private_key,omitempty"`
+}
+
+// githubAppTokenSource hands out installation access tokens for a GitHub App,
+// requesting a new one shortly before the current one expires.
+type githubAppTokenSource struct {
+	config *GitHubAppConfig
+	key    *rsa.PrivateKey
+	apiURI string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGitHubAppTokenSource(c *GitHubAppConfig, apiURI string, client *http.Client) (*githubAppTokenSource, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, errors.New("github_auth.app.private_key: no PEM data found")
+	}
+	// GitHub issues PKCS#1 keys, but accept PKCS#8 too in case the key was converted.
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		k, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, fmt.Errorf("github_auth.app.private_key: %s", err)
+		}
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("github_auth.app.private_key: not an RSA key")
+		}
+	}
+	return &githubAppTokenSource{config: c, key: key, apiURI: apiURI, client: client}, nil
+}
+
+// appJWT returns a short-lived JWT identifying the app, as described in
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func (ts *githubAppTokenSource) appJWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		// Backdated to allow for clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": ts.config.AppID,
+	})
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Token returns a valid installation access token.
+func (ts *githubAppTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := time.Now()
+	if ts.token != "" && now.Add(5*time.Minute).Before(ts.expires) {
+		return ts.token, nil
+	}
+	jwt, err := ts.appJWT(now)
+	if err != nil {
+		return "", fmt.Errorf("could not sign GitHub App JWT: %s", err)
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", ts.apiURI, ts.config.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+jwt)
+	req.Header.Add("Accept", "application/vnd.github+json")
+	glog.Infof("%sGithub API: Requesting an installation token for app %d", api.LogPrefix(ctx), ts.config.AppID)
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not get GitHub App installation token: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("could not get GitHub App installation token: %s %s", resp.Status, body)
+	}
+	var it struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &it); err != nil || it.Token == "" {
+		return "", fmt.Errorf("could not parse GitHub App installation token response: %v", err)
+	}
+	ts.token, ts.expires = it.Token, it.ExpiresAt
+	return ts.token, nil
+}
+
+// fetchTeamsAsApp lists the organization's teams with the app's token and checks the user's membership
+// in each of them. Returned teams have the organization filled in, like those from /user/teams.
+func (gha *GitHubAuth) fetchTeamsAsApp(ctx context.Context, user string) (GitHubTeamCollection, error) {
+	token, err := gha.app.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The installation belongs to a single organization.
+	org := gha.config.organizations()[0]
+	orgTeams, err := gha.fetchTeamPages(ctx, fmt.Sprintf("%s/orgs/%s/teams?per_page=%d", gha.getGithubApiUri(), org, gha.pageSize()), token)
+	if err != nil {
+		return nil, err
+	}
+	var teams GitHubTeamCollection
+	for _, t := range orgTeams {
+		role, err := gha.teamRole(ctx, token, org, t.Slug, user)
+		if err != nil {
+			return nil, err
+		}
+		if role != "" {
+			t.role = role
+			t.Organization = &GitHubOrganization{Login: org}
+			teams = append(teams, t)
+		}
+	}
+	return teams, nil
+}
+
+// teamRole returns the role of the user in the team, "member" or "maintainer",
+// or an empty string if they are not an active member.
+func (gha *GitHubAuth) teamRole(ctx context.Context, token, org, team, user string) (string, error) {
+	url := fmt.Sprintf("%s/orgs/%s/teams/%s/memberships/%s", gha.getGithubApiUri(), org, team, user)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request to get team membership: %s", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+	req.Header.Add("Accept", "application/json")
+	resp, err := gha.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := checkGitHubSSO(resp, org); err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var m struct {
+			State string `json:"state"`
+			Role  string `json:"role"`
+		}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return "", fmt.Errorf("could not parse membership of team %s: %s", team, err)
+		}
+		// Pending invitations do not count.
+		if m.State != "active" {
+			return "", nil
+		}
+		return m.Role, nil
+	case http.StatusNotFound:
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown status for membership of team %s: %s", team, resp.Status)
+}
@@ -18,6 +18,7 @@ package authn
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,7 +26,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cesanta/glog"
@@ -43,6 +46,9 @@ type GitHubTeam struct {
 	Slug         string              `json:"slug,omitempty"`
 	Organization *GitHubOrganization `json:"organization"`
 	Parent       *ParentGitHubTeam   `json:"parent,omitempty"`
+
+	// The user's role in the team, "member" or "maintainer", if fetched.
+	role string
 }
 
 type GitHubOrganization struct {
@@ -57,18 +63,112 @@ type ParentGitHubTeam struct {
 }
 
 type GitHubAuthConfig struct {
-	Organization     string                  `mapstructure:"organization,omitempty"`
-	ClientId         string                  `mapstructure:"client_id,omitempty"`
-	ClientSecret     string                  `mapstructure:"client_secret,omitempty"`
-	ClientSecretFile string                  `mapstructure:"client_secret_file,omitempty"`
-	TokenDB          string                  `mapstructure:"token_db,omitempty"`
-	GCSTokenDB       *GitHubGCSStoreConfig   `mapstructure:"gcs_token_db,omitempty"`
-	RedisTokenDB     *GitHubRedisStoreConfig `mapstructure:"redis_token_db,omitempty"`
-	HTTPTimeout      time.Duration           `mapstructure:"http_timeout,omitempty"`
-	RevalidateAfter  time.Duration           `mapstructure:"revalidate_after,omitempty"`
-	GithubWebUri     string                  `mapstructure:"github_web_uri,omitempty"`
-	GithubApiUri     string                  `mapstructure:"github_api_uri,omitempty"`
-	RegistryUrl      string                  `mapstructure:"registry_url,omitempty"`
+	Organization     string                      `mapstructure:"organization,omitempty"`
+	ClientId         string                      `mapstructure:"client_id,omitempty"`
+	ClientSecret     string                      `mapstructure:"client_secret,omitempty"`
+	ClientSecretFile string                      `mapstructure:"client_secret_file,omitempty"`
+	TokenDB          string                      `mapstructure:"token_db,omitempty"`
+	GCSTokenDB       *GitHubGCSStoreConfig       `mapstructure:"gcs_token_db,omitempty"`
+	RedisTokenDB     *GitHubRedisStoreConfig     `mapstructure:"redis_token_db,omitempty"`
+	PostgresTokenDB  *GitHubPostgresStoreConfig  `mapstructure:"postgres_token_db,omitempty"`
+	DynamoDBTokenDB  *GitHubDynamoDBStoreConfig  `mapstructure:"dynamodb_token_db,omitempty"`
+	MemcachedTokenDB *GitHubMemcachedStoreConfig `mapstructure:"memcached_token_db,omitempty"`
+	HTTPTimeout      time.Duration               `mapstructure:"http_timeout,omitempty"`
+	RevalidateAfter  time.Duration               `mapstructure:"revalidate_after,omitempty"`
+	GithubWebUri     string                      `mapstructure:"github_web_uri,omitempty"`
+	GithubApiUri     string                      `mapstructure:"github_api_uri,omitempty"`
+	RegistryUrl      string                      `mapstructure:"registry_url,omitempty"`
+	App              *GitHubAppConfig            `mapstructure:"app,omitempty"`
+	TeamCacheTTL     time.Duration               `mapstructure:"team_cache_ttl,omitempty"`
+	// How long a successful validation of an access token is reused, at most RevalidateAfter.
+	TokenCacheTTL time.Duration `mapstructure:"token_cache_ttl,omitempty"`
+	// How often to delete tokens from the token_db file that were due for revalidation more than
+	// TokenDBSweepGrace (default 30 days) ago. Off by default.
+	TokenDBSweepInterval time.Duration `mapstructure:"token_db_sweep_interval,omitempty"`
+	TokenDBSweepGrace    time.Duration `mapstructure:"token_db_sweep_grace,omitempty"`
+	// Base64-encoded 256-bit AES key to encrypt GitHub tokens in the token DB with.
+	TokenEncryptionKey string `mapstructure:"token_encryption_key,omitempty"`
+	// Previous keys, to read tokens encrypted before the key was rotated.
+	TokenEncryptionOldKeys []string `mapstructure:"token_encryption_old_keys,omitempty"`
+	// Rate limited requests are retried up to this many times in total, waiting up to
+	// RateLimitMaxDelay before each retry. The wait counts against HTTPTimeout.
+	RateLimitMaxAttempts int           `mapstructure:"rate_limit_max_attempts,omitempty"`
+	RateLimitMaxDelay    time.Duration `mapstructure:"rate_limit_max_delay,omitempty"`
+	// Proxy for requests to GitHub, e.g. "http://proxy.example.com:3128". Defaults to HTTPS_PROXY.
+	HTTPProxy string `mapstructure:"http_proxy,omitempty"`
+	// Hosts to connect to directly, in NO_PROXY format (e.g. "github.example.com", ".example.com").
+	NoProxy []string `mapstructure:"no_proxy,omitempty"`
+	// How many pages of teams to fetch at once, default is 4.
+	TeamPageConcurrency int `mapstructure:"team_page_concurrency,omitempty"`
+	// Number of items per page of lists fetched from the GitHub API, 1 to 100. Default is 100.
+	PageSize int `mapstructure:"page_size,omitempty"`
+	// Add the user's primary verified email address as the "email" label. Needs the user:email scope.
+	FetchEmail bool `mapstructure:"fetch_email,omitempty"`
+	// Also label teams with the user's role in them, e.g. "infrastructure:maintainer".
+	TeamRoles bool `mapstructure:"team_roles,omitempty"`
+	// Fetch the user's teams with the GraphQL API, in fewer requests than /user/teams for users in
+	// many teams of large organizations. Falls back to the REST API if GraphQL fails.
+	TeamsGraphQL bool `mapstructure:"teams_graphql,omitempty"`
+	// GraphQL endpoint. Default is derived from github_api_uri: <api>/graphql, or
+	// https://<host>/api/graphql if it is a GitHub Enterprise Server's https://<host>/api/v3.
+	GithubGraphQLUri string `mapstructure:"github_graphql_uri,omitempty"`
+	// Users who may sign out others via /github_auth/sign_out, e.g. when they leave the organization.
+	SignOutAdmins []string `mapstructure:"sign_out_admins,omitempty"`
+	// Accept GitHub personal access tokens (classic or fine-grained) as passwords, bypassing the token DB.
+	PersonalAccessTokens bool `mapstructure:"personal_access_tokens,omitempty"`
+	// Membership in any of these organizations grants access.
+	// Unlike with organization, team labels are qualified with the organization: "org/team".
+	Organizations []string `mapstructure:"organizations,omitempty"`
+	// OAuth scopes to request, default is user:email and read:org.
+	Scopes []string `mapstructure:"scopes,omitempty"`
+	// Template file for the page shown after signing in, instead of data/github_auth_result.tmpl.
+	// It gets the same fields: Organization, Username, Password and RegistryUrl.
+	ResultTemplate string `mapstructure:"result_template,omitempty"`
+	// Send users to this URL after signing in instead of showing the result page, e.g. a portal that
+	// sets up their docker login. The credentials are POSTed to it as a form, never put in the URL.
+	ResultRedirectURL string `mapstructure:"result_redirect_url,omitempty"`
+}
+
+// Scopes that include others, see https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/scopes-for-oauth-apps
+var gitHubParentScopes = map[string][]string{
+	"read:org":   {"write:org", "admin:org"},
+	"user:email": {"user"},
+}
+
+// hasGitHubScope reports whether the scope or one that includes it is among the scopes.
+func hasGitHubScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+		for _, p := range gitHubParentScopes[scope] {
+			if s == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingScopes returns the scopes needed for the configured checks that are not among the scopes.
+func (c *GitHubAuthConfig) missingScopes(scopes []string) []string {
+	var missing []string
+	// Membership is checked with the user's token unless it is checked as an app.
+	if len(c.organizations()) > 0 && c.App == nil && !hasGitHubScope(scopes, "read:org") {
+		missing = append(missing, "read:org")
+	}
+	if c.FetchEmail && !hasGitHubScope(scopes, "user:email") {
+		missing = append(missing, "user:email")
+	}
+	return missing
+}
+
+// organizations returns the organizations users must belong to, if any.
+func (c *GitHubAuthConfig) organizations() []string {
+	if c.Organization != "" {
+		return append([]string{c.Organization}, c.Organizations...)
+	}
+	return c.Organizations
 }
 
 type GitHubGCSStoreConfig struct {
@@ -79,6 +179,10 @@ type GitHubGCSStoreConfig struct {
 type GitHubRedisStoreConfig struct {
 	ClientOptions  *redis.Options        `mapstructure:"redis_options,omitempty"`
 	ClusterOptions *redis.ClusterOptions `mapstructure:"redis_cluster_options,omitempty"`
+	// Connection pool settings, applied to either of the above.
+	Pool *RedisPoolConfig `mapstructure:"pool,omitempty"`
+	// How often to ping Redis, reconnecting if it fails. Default is 30s.
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval,omitempty"`
 }
 
 type GitHubAuthRequest struct {
@@ -98,6 +202,16 @@ type GitHubAuth struct {
 	client     *http.Client
 	tmpl       *template.Template
 	tmplResult *template.Template
+	// Set if result_redirect_url is.
+	tmplRedirect *template.Template
+	// Set if membership is checked as a GitHub App.
+	app *githubAppTokenSource
+	// Set if team_cache_ttl is.
+	teamCache *githubTeamCache
+	// Set if token_cache_ttl is.
+	tokenCache *githubTokenCache
+	// Set by SetCaseInsensitive.
+	caseInsensitive bool
 }
 
 type linkHeader struct {
@@ -107,8 +221,8 @@ type linkHeader struct {
 	Prev  string
 }
 
-func execGHExperimentalApiRequest(url string, token string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func execGHExperimentalApiRequest(ctx context.Context, client *http.Client, url string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		err = fmt.Errorf("could not create an http request for uri: %s. Error: %s", url, err)
 		return nil, err
@@ -117,7 +231,6 @@ func execGHExperimentalApiRequest(url string, token string) (*http.Response, err
 	// Currently an "experimental" API; https://developer.github.com/v3/orgs/teams/#list-user-teams
 	req.Header.Add("Accept", "application/vnd.github.hellcat-preview+json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		err = fmt.Errorf("HTTP error while retrieving %s. Error : %s", url, err)
@@ -178,43 +291,118 @@ func NewGitHubAuth(c *GitHubAuthConfig) (*GitHubAuth, error) {
 	case c.RedisTokenDB != nil:
 		db, err = NewRedisTokenDB(c.RedisTokenDB)
 		dbName = db.(*redisTokenDB).String()
+	case c.PostgresTokenDB != nil:
+		db, err = NewPostgresTokenDB(c.PostgresTokenDB)
+		dbName = "Postgres: " + c.PostgresTokenDB.Table
+	case c.MemcachedTokenDB != nil:
+		db, err = NewMemcachedTokenDB(c.MemcachedTokenDB)
+		if err == nil {
+			dbName = db.(*memcachedTokenDB).String()
+		}
+	case c.DynamoDBTokenDB != nil:
+		db, err = NewDynamoDBTokenDB(c.DynamoDBTokenDB)
+		if err == nil {
+			dbName = db.(*dynamoDBTokenDB).String()
+		}
 	default:
 		db, err = NewTokenDB(c.TokenDB)
+		if impl, ok := db.(*TokenDBImpl); ok && err == nil && c.TokenDBSweepInterval > 0 {
+			grace := c.TokenDBSweepGrace
+			if grace <= 0 {
+				grace = DefaultTokenDBSweepGrace
+			}
+			impl.StartSweeper(c.TokenDBSweepInterval, grace)
+		}
 	}
 
 	if err != nil {
 		return nil, err
 	}
+	if c.TokenEncryptionKey != "" {
+		edb, err := NewEncryptedTokenDB(db, append([]string{c.TokenEncryptionKey}, c.TokenEncryptionOldKeys...)...)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("github_auth.token_encryption_key: %s", err)
+		}
+		db = edb
+		dbName += " (encrypted)"
+	}
 	glog.Infof("GitHub auth token DB at %s", dbName)
+	if missing := c.missingScopes(c.Scopes); len(missing) > 0 {
+		glog.Warningf("github_auth.scopes does not include %s, organization, team or email checks may fail", strings.Join(missing, ", "))
+	}
 	github_auth, _ := static.ReadFile("data/github_auth.tmpl")
 	github_auth_result, _ := static.ReadFile("data/github_auth_result.tmpl")
-	return &GitHubAuth{
+	gha := &GitHubAuth{
 		config:     c,
 		db:         db,
-		client:     &http.Client{Timeout: 10 * time.Second},
+		client:     newGitHubClient(c.HTTPTimeout, newGitHubTransport(c)),
 		tmpl:       template.Must(template.New("github_auth").Parse(string(github_auth))),
 		tmplResult: template.Must(template.New("github_auth_result").Parse(string(github_auth_result))),
-	}, nil
+	}
+	if c.ResultTemplate != "" {
+		if gha.tmplResult, err = template.ParseFiles(c.ResultTemplate); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("github_auth.result_template: %s", err)
+		}
+	}
+	if c.ResultRedirectURL != "" {
+		github_auth_redirect, _ := static.ReadFile("data/github_auth_redirect.tmpl")
+		gha.tmplRedirect = template.Must(template.New("github_auth_redirect").Parse(string(github_auth_redirect)))
+	}
+	if c.TeamCacheTTL > 0 {
+		gha.teamCache = newGitHubTeamCache(c.TeamCacheTTL)
+	}
+	if ttl := c.TokenCacheTTL; ttl > 0 {
+		if c.RevalidateAfter > 0 && ttl > c.RevalidateAfter {
+			ttl = c.RevalidateAfter
+		}
+		gha.tokenCache = newGitHubTokenCache(ttl)
+	}
+	if c.App != nil {
+		gha.app, err = newGitHubAppTokenSource(c.App, gha.getGithubApiUri(), gha.client)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		glog.Infof("GitHub membership checked as app %d, installation %d", c.App.AppID, c.App.InstallationID)
+	}
+	return gha, nil
 }
 
 func (gha *GitHubAuth) doGitHubAuthPage(rw http.ResponseWriter, req *http.Request) {
+	state, err := gha.newState(rw, req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if err := gha.tmpl.Execute(rw, struct {
-		ClientId, GithubWebUri, Organization string
+		ClientId, GithubWebUri, Organization, State, Scopes string
 	}{
 		ClientId:     gha.config.ClientId,
+		State:        state,
+		Scopes:       strings.Join(gha.config.Scopes, " "),
 		GithubWebUri: gha.getGithubWebUri(),
-		Organization: gha.config.Organization}); err != nil {
+		Organization: strings.Join(gha.config.organizations(), ", @")}); err != nil {
 		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
 	}
 }
 
 func (gha *GitHubAuth) doGitHubAuthResultPage(rw http.ResponseWriter, username string, password string) {
-	if err := gha.tmplResult.Execute(rw, struct {
-		Organization, Username, Password, RegistryUrl string
-	}{Organization: gha.config.Organization,
+	// The page has the password in it, so it must not be cached, nor the URL passed on to other sites.
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Referrer-Policy", "no-referrer")
+	tmpl := gha.tmplResult
+	if gha.tmplRedirect != nil {
+		tmpl = gha.tmplRedirect
+	}
+	if err := tmpl.Execute(rw, struct {
+		Organization, Username, Password, RegistryUrl, RedirectURL string
+	}{Organization: strings.Join(gha.config.organizations(), ", @"),
 		Username:    username,
 		Password:    password,
-		RegistryUrl: gha.config.RegistryUrl}); err != nil {
+		RegistryUrl: gha.config.RegistryUrl,
+		RedirectURL: gha.config.ResultRedirectURL}); err != nil {
 		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
 	}
 }
@@ -223,7 +411,12 @@ func (gha *GitHubAuth) DoGitHubAuth(rw http.ResponseWriter, req *http.Request) {
 	code := req.URL.Query().Get("code")
 
 	if code != "" {
-		gha.doGitHubAuthCreateToken(rw, code)
+		if err := gha.checkState(rw, req); err != nil {
+			glog.Warningf("%sGitHub auth callback rejected: %s", api.LogPrefix(req.Context()), err)
+			http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+		gha.doGitHubAuthCreateToken(req.Context(), rw, code)
 	} else if req.Method == "GET" {
 		gha.doGitHubAuthPage(rw, req)
 		return
@@ -246,14 +439,14 @@ func (gha *GitHubAuth) getGithubWebUri() string {
 	}
 }
 
-func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code string) {
+func (gha *GitHubAuth) doGitHubAuthCreateToken(ctx context.Context, rw http.ResponseWriter, code string) {
 	data := url.Values{
 		"code":          []string{string(code)},
 		"client_id":     []string{gha.config.ClientId},
 		"client_secret": []string{gha.config.ClientSecret},
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/login/oauth/access_token", gha.getGithubWebUri()), bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/login/oauth/access_token", gha.getGithubWebUri()), bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Error creating request to GitHub auth backend: %s", err), http.StatusServiceUnavailable)
 		return
@@ -267,7 +460,7 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 	}
 	codeResp, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	glog.V(2).Infof("Code to token resp: %s", strings.Replace(string(codeResp), "\n", " ", -1))
+	glog.V(2).Infof("%sCode to token resp: %s", api.LogPrefix(ctx), strings.Replace(string(codeResp), "\n", " ", -1))
 
 	var c2t CodeToTokenResponse
 	err = json.Unmarshal(codeResp, &c2t)
@@ -282,18 +475,27 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 		return
 	}
 
-	user, err := gha.validateAccessToken(c2t.AccessToken)
+	user, err := gha.validateAccessToken(ctx, c2t.AccessToken)
+	var ssoErr *GitHubSSOError
+	if errors.As(err, &ssoErr) {
+		glog.Warningf("%sNewly-acquired token is not authorized for SSO: %s", api.LogPrefix(ctx), err)
+		http.Error(rw, "Sign-in failed: "+ssoErr.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		glog.Errorf("Newly-acquired token is invalid: %+v %s", c2t, err)
+		glog.Errorf("%sNewly-acquired token is invalid: %+v %s", api.LogPrefix(ctx), c2t, err)
 		http.Error(rw, "Newly-acquired token is invalid", http.StatusInternalServerError)
 		return
 	}
 
-	glog.Infof("New GitHub auth token for %s", user)
+	glog.Infof("%sNew GitHub auth token for %s", api.LogPrefix(ctx), user)
+	if missing := gha.config.missingScopes(strings.Split(c2t.Scope, ",")); len(missing) > 0 {
+		glog.Warningf("%sThe token of %s was not granted %s (granted: %q), checks that need it will fail", api.LogPrefix(ctx), user, strings.Join(missing, ", "), c2t.Scope)
+	}
 
-	userTeams, err := gha.fetchTeams(c2t.AccessToken)
+	userTeams, err := gha.fetchTeams(ctx, c2t.AccessToken, user)
 	if err != nil {
-		glog.Errorf("could not fetch user teams: %s", err)
+		glog.Errorf("%scould not fetch user teams: %s", api.LogPrefix(ctx), err)
 	}
 
 	v := &TokenDBValue{
@@ -302,9 +504,10 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 		ValidUntil:  time.Now().Add(gha.config.RevalidateAfter),
 		Labels:      map[string][]string{"teams": userTeams},
 	}
-	dp, err := gha.db.StoreToken(user, v, true)
+	gha.addEmailLabel(ctx, c2t.AccessToken, v.Labels)
+	dp, err := gha.db.StoreToken(gha.dbUser(user), v, true)
 	if err != nil {
-		glog.Errorf("Failed to record server token: %s", err)
+		glog.Errorf("%sFailed to record server token: %s", api.LogPrefix(ctx), err)
 		http.Error(rw, "Failed to record server token: %s", http.StatusInternalServerError)
 		return
 	}
@@ -312,9 +515,27 @@ func (gha *GitHubAuth) doGitHubAuthCreateToken(rw http.ResponseWriter, code stri
 	gha.doGitHubAuthResultPage(rw, user, dp)
 }
 
-func (gha *GitHubAuth) validateAccessToken(token string) (user string, err error) {
-	glog.Infof("Github API: Fetching user info")
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/user", gha.getGithubApiUri()), nil)
+// validateAccessToken returns the user that the token belongs to, after checking that they are in
+// the organization. Recent successful validations are reused, if token_cache_ttl is set.
+func (gha *GitHubAuth) validateAccessToken(ctx context.Context, token string) (string, error) {
+	if user, ok := gha.tokenCache.get(token); ok {
+		glog.V(2).Infof("%sUsing cached validation of the token of %s", api.LogPrefix(ctx), user)
+		return user, nil
+	}
+	user, err := gha.fetchTokenUser(ctx, token)
+	if err != nil {
+		gha.tokenCache.invalidate(token)
+		return "", err
+	}
+	gha.tokenCache.set(token, user)
+	return user, nil
+}
+
+func (gha *GitHubAuth) fetchTokenUser(ctx context.Context, token string) (user string, err error) {
+	ctx, span := tracer.Start(ctx, "GitHub validateAccessToken")
+	defer span.End()
+	glog.Infof("%sGithub API: Fetching user info", api.LogPrefix(ctx))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/user", gha.getGithubApiUri()), nil)
 	if err != nil {
 		err = fmt.Errorf("could not create request to get information for token %s: %s", token, err)
 		return
@@ -336,24 +557,57 @@ func (gha *GitHubAuth) validateAccessToken(token string) (user string, err error
 		err = fmt.Errorf("could not unmarshal token user info %q: %s", string(body), err)
 		return
 	}
-	glog.V(2).Infof("Token user info: %+v", strings.Replace(string(body), "\n", " ", -1))
+	glog.V(2).Infof("%sToken user info: %+v", api.LogPrefix(ctx), strings.Replace(string(body), "\n", " ", -1))
 
-	err = gha.checkOrganization(token, ti.Login)
+	err = gha.checkOrganization(ctx, token, ti.Login)
 	if err != nil {
-		err = fmt.Errorf("could not validate organization: %s", err)
+		err = fmt.Errorf("could not validate organization: %w", err)
 		return
 	}
 
 	return ti.Login, nil
 }
 
-func (gha *GitHubAuth) checkOrganization(token, user string) (err error) {
-	if gha.config.Organization == "" {
+// checkOrganization checks that the user is a member of at least one of the configured organizations.
+func (gha *GitHubAuth) checkOrganization(ctx context.Context, token, user string) (err error) {
+	orgs := gha.config.organizations()
+	if len(orgs) == 0 {
 		return nil
 	}
-	glog.Infof("Github API: Fetching organization membership info")
-	url := fmt.Sprintf("%s/orgs/%s/members/%s", gha.getGithubApiUri(), gha.config.Organization, user)
-	req, err := http.NewRequest("GET", url, nil)
+	glog.Infof("%sGithub API: Fetching organization membership info", api.LogPrefix(ctx))
+	if gha.app != nil {
+		if token, err = gha.app.Token(ctx); err != nil {
+			return err
+		}
+	}
+	var firstErr, ssoErr error
+	for _, org := range orgs {
+		err = gha.checkOrganizationMember(ctx, token, org, user)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		var e *GitHubSSOError
+		if ssoErr == nil && errors.As(err, &e) {
+			ssoErr = err
+		}
+	}
+	// The user may well be a member, they have to act on this.
+	if ssoErr != nil {
+		return ssoErr
+	}
+	if len(orgs) > 1 {
+		glog.V(2).Infof("%sUser %s is not a member of any of %v: %s", api.LogPrefix(ctx), user, orgs, firstErr)
+		return fmt.Errorf("user %s is not a member of any of the organizations %s", user, strings.Join(orgs, ", "))
+	}
+	return firstErr
+}
+
+func (gha *GitHubAuth) checkOrganizationMember(ctx context.Context, token, org, user string) (err error) {
+	url := fmt.Sprintf("%s/orgs/%s/members/%s", gha.getGithubApiUri(), org, user)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		err = fmt.Errorf("could not create request to get organization membership: %s", err)
 		return
@@ -364,66 +618,142 @@ func (gha *GitHubAuth) checkOrganization(token, user string) (err error) {
 	if err != nil {
 		return
 	}
+	resp.Body.Close()
+	if err := checkGitHubSSO(resp, org); err != nil {
+		return err
+	}
 
 	switch resp.StatusCode {
 	case http.StatusNoContent:
 		return nil
 	case http.StatusNotFound:
-		return fmt.Errorf("user %s is not a member of organization %s", user, gha.config.Organization)
+		return fmt.Errorf("user %s is not a member of organization %s", user, org)
 	case http.StatusFound:
-		return fmt.Errorf("token %s could not get membership for organization %s", token, gha.config.Organization)
+		return fmt.Errorf("token %s could not get membership for organization %s", token, org)
 	}
 
-	return fmt.Errorf("Unknown status for membership of organization %s: %s", gha.config.Organization, resp.Status)
+	return fmt.Errorf("Unknown status for membership of organization %s: %s", org, resp.Status)
 }
 
-func (gha *GitHubAuth) fetchTeams(token string) ([]string, error) {
+// addEmailLabel sets the "email" label to the user's primary verified email address, if fetch_email is on.
+// If there is no such address, the label is removed. If it cannot be fetched, the label is left as it is.
+func (gha *GitHubAuth) addEmailLabel(ctx context.Context, token string, labels api.Labels) {
+	if !gha.config.FetchEmail {
+		return
+	}
+	email, err := gha.fetchPrimaryEmail(ctx, token)
+	if err != nil {
+		glog.Warningf("%sCould not fetch email addresses: %s", api.LogPrefix(ctx), err)
+		return
+	}
+	if email == "" {
+		delete(labels, "email")
+		return
+	}
+	labels["email"] = []string{email}
+}
+
+// fetchPrimaryEmail returns the primary email address of the token's owner if it is verified, or "".
+// Unlike the email returned by /user, it is there even if the user keeps it private.
+func (gha *GitHubAuth) fetchPrimaryEmail(ctx context.Context, token string) (string, error) {
+	glog.Infof("%sGithub API: Fetching user email addresses", api.LogPrefix(ctx))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/user/emails", gha.getGithubApiUri()), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+	req.Header.Add("Accept", "application/json")
+	resp, err := gha.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Most likely the token lacks the user:email scope.
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.Unmarshal(body, &emails); err != nil {
+		return "", fmt.Errorf("could not parse email addresses: %s", err)
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// fetchTeams returns the slugs of the organization's teams the user belongs to,
+// including parents of those teams.
+func (gha *GitHubAuth) fetchTeams(ctx context.Context, token, user string) ([]string, error) {
 	var allTeams GitHubTeamCollection
 
-	if gha.config.Organization == "" {
+	orgs := gha.config.organizations()
+	if len(orgs) == 0 {
 		return nil, nil
 	}
-	glog.Infof("Github API: Fetching user teams")
-	url := fmt.Sprintf("%s/user/teams?per_page=100", gha.getGithubApiUri())
+	if teams, ok := gha.teamCache.get(user); ok {
+		glog.V(2).Infof("%sUsing cached teams for %s: %v", api.LogPrefix(ctx), user, teams)
+		return teams, nil
+	}
+	ctx, span := tracer.Start(ctx, "GitHub fetchTeams")
+	defer span.End()
+	glog.Infof("%sGithub API: Fetching user teams", api.LogPrefix(ctx))
 	var err error
-
-	// Using an `i` iterator for debugging the results
-	for i := 1; url != ""; i++ {
-		var pagedTeams GitHubTeamCollection
-		resp, err := execGHExperimentalApiRequest(url, token)
-		if err != nil {
-			return nil, err
+	if gha.app != nil {
+		allTeams, err = gha.fetchTeamsAsApp(ctx, user)
+	} else {
+		if gha.config.TeamsGraphQL {
+			allTeams, err = gha.fetchTeamsGraphQL(ctx, token, user, orgs)
+			if err != nil {
+				glog.Warningf("%sGitHub GraphQL: could not fetch teams, falling back to REST: %s", api.LogPrefix(ctx), err)
+			}
 		}
-
-		respHeaders := resp.Header
-		body, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		err = json.Unmarshal(body, &pagedTeams)
-		if err != nil {
-			err = fmt.Errorf("Error parsing the JSON response while fetching teams: %s", err)
+		if !gha.config.TeamsGraphQL || err != nil {
+			allTeams, err = gha.fetchTeamPages(ctx, fmt.Sprintf("%s/user/teams?per_page=%d", gha.getGithubApiUri(), gha.pageSize()), token)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	wantOrgs := make(map[string]bool)
+	for _, org := range orgs {
+		wantOrgs[org] = true
+	}
+	if gha.config.TeamRoles && gha.app == nil {
+		// The app already fetched memberships, with roles, to find the user's teams.
+		if err := gha.fetchTeamRoles(ctx, token, user, allTeams, wantOrgs); err != nil {
 			return nil, err
 		}
+	}
 
-		allTeams = append(allTeams, pagedTeams...)
-
-		// Do we need to paginate?
-		if link, ok := respHeaders["Link"]; ok {
-			parsedLink, _ := parseLinkHeader(link)
-			url = parsedLink.Next
-			glog.V(2).Infof("--> Page <%d>\n", i)
-		} else {
-			url = ""
+	// With the organizations list, teams are qualified with the organization they belong to.
+	qualify := len(gha.config.Organizations) > 0
+	teamName := func(org, slug string) string {
+		if qualify {
+			return org + "/" + slug
 		}
+		return slug
 	}
-
 	// Use map instead of slice to ensure uniqueness of results
 	organizationTeamsMap := make(map[string]bool)
 	for _, item := range allTeams {
-		if item.Organization.Login == gha.config.Organization {
-			organizationTeamsMap[item.Slug] = true
+		if item.Organization == nil {
+			continue
+		}
+		if org := item.Organization.Login; wantOrgs[org] {
+			organizationTeamsMap[teamName(org, item.Slug)] = true
+			if gha.config.TeamRoles && item.role != "" {
+				organizationTeamsMap[teamName(org, item.Slug)+":"+item.role] = true
+			}
 			if item.Parent != nil {
-				organizationTeamsMap[item.Parent.Slug] = true
+				organizationTeamsMap[teamName(org, item.Parent.Slug)] = true
 			}
 		}
 	}
@@ -435,12 +765,160 @@ func (gha *GitHubAuth) fetchTeams(token string) ([]string, error) {
 		i++
 	}
 
-	glog.V(3).Infof("All teams for the user: %v", allTeams)
-	glog.Infof("Teams for the <%s> organization: %v", gha.config.Organization, organizationTeams)
+	glog.V(3).Infof("%sAll teams for the user: %v", api.LogPrefix(ctx), allTeams)
+	glog.Infof("%sTeams for the <%s> organization(s): %v", api.LogPrefix(ctx), strings.Join(orgs, ", "), organizationTeams)
+	gha.teamCache.set(user, organizationTeams)
 	return organizationTeams, err
 }
 
-func (gha *GitHubAuth) validateServerToken(user string) (*TokenDBValue, error) {
+// fetchTeamPages fetches a list of teams, following pagination links.
+// If GitHub tells how many pages there are, the rest are fetched concurrently.
+func (gha *GitHubAuth) fetchTeamPages(ctx context.Context, url, token string) (GitHubTeamCollection, error) {
+	allTeams, link, err := gha.fetchTeamPage(ctx, url, token)
+	if err != nil {
+		return nil, err
+	}
+	if link.Next == "" {
+		return allTeams, nil
+	}
+	pageURLs := teamPageURLs(link)
+	if pageURLs == nil {
+		// No last page to go by, walk the pages one by one.
+		for i := 2; link.Next != ""; i++ {
+			var pagedTeams GitHubTeamCollection
+			pagedTeams, link, err = gha.fetchTeamPage(ctx, link.Next, token)
+			if err != nil {
+				return nil, err
+			}
+			allTeams = append(allTeams, pagedTeams...)
+			glog.V(2).Infof("%s--> Page <%d>\n", api.LogPrefix(ctx), i)
+		}
+		return allTeams, nil
+	}
+
+	glog.V(2).Infof("%s--> Fetching %d more pages", api.LogPrefix(ctx), len(pageURLs))
+	pages := make([]GitHubTeamCollection, len(pageURLs))
+	errs := make([]error, len(pageURLs))
+	sem := make(chan struct{}, gha.teamPageConcurrency())
+	var wg sync.WaitGroup
+	for i, u := range pageURLs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, u string) {
+			defer func() { <-sem; wg.Done() }()
+			pages[i], _, errs[i] = gha.fetchTeamPage(ctx, u, token)
+		}(i, u)
+	}
+	wg.Wait()
+	for i := range pages {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		allTeams = append(allTeams, pages[i]...)
+	}
+	return allTeams, nil
+}
+
+// pageSize returns the per_page parameter for list requests. The links to further pages keep it.
+func (gha *GitHubAuth) pageSize() int {
+	if gha.config.PageSize < 1 || gha.config.PageSize > 100 {
+		return 100
+	}
+	return gha.config.PageSize
+}
+
+func (gha *GitHubAuth) teamPageConcurrency() int {
+	if gha.config.TeamPageConcurrency < 1 {
+		return 1
+	}
+	return gha.config.TeamPageConcurrency
+}
+
+// fetchTeamRoles fills in the user's role in the teams of the given organizations.
+// /user/teams does not say, so the membership of each team is looked up.
+func (gha *GitHubAuth) fetchTeamRoles(ctx context.Context, token, user string, teams GitHubTeamCollection, orgs map[string]bool) error {
+	errs := make([]error, len(teams))
+	sem := make(chan struct{}, gha.teamPageConcurrency())
+	var wg sync.WaitGroup
+	for i := range teams {
+		t := &teams[i]
+		if t.Organization == nil || !orgs[t.Organization.Login] {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			t.role, errs[i] = gha.teamRole(ctx, token, t.Organization.Login, t.Slug, user)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchTeamPage fetches a single page of a list of teams.
+func (gha *GitHubAuth) fetchTeamPage(ctx context.Context, url, token string) (GitHubTeamCollection, linkHeader, error) {
+	var pagedTeams GitHubTeamCollection
+	var lH linkHeader
+	resp, err := execGHExperimentalApiRequest(ctx, gha.client, url, token)
+	if err != nil {
+		return nil, lH, err
+	}
+
+	respHeaders := resp.Header
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := checkGitHubSSO(resp, ""); err != nil {
+		return nil, lH, err
+	}
+	warnGitHubSSOPartialResults(ctx, resp, "Teams")
+
+	err = json.Unmarshal(body, &pagedTeams)
+	if err != nil {
+		err = fmt.Errorf("Error parsing the JSON response while fetching teams: %s", err)
+		return nil, lH, err
+	}
+
+	// Do we need to paginate?
+	if link, ok := respHeaders["Link"]; ok {
+		lH, _ = parseLinkHeader(link)
+	}
+	return pagedTeams, lH, nil
+}
+
+// teamPageURLs returns the URLs of the pages after the first one, derived from the links
+// to the next and the last page, or nil if that is not possible.
+func teamPageURLs(link linkHeader) []string {
+	next, err := url.Parse(link.Next)
+	if err != nil {
+		return nil
+	}
+	last, err := url.Parse(link.Last)
+	if err != nil || link.Last == "" {
+		return nil
+	}
+	first, err1 := strconv.Atoi(next.Query().Get("page"))
+	n, err2 := strconv.Atoi(last.Query().Get("page"))
+	if err1 != nil || err2 != nil || first > n {
+		return nil
+	}
+	var urls []string
+	for p := first; p <= n; p++ {
+		q := next.Query()
+		q.Set("page", strconv.Itoa(p))
+		u := *next
+		u.RawQuery = q.Encode()
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+func (gha *GitHubAuth) validateServerToken(ctx context.Context, user string) (*TokenDBValue, error) {
 	v, err := gha.db.GetValue(user)
 	if err != nil || v == nil {
 		if err == nil {
@@ -450,42 +928,65 @@ func (gha *GitHubAuth) validateServerToken(user string) (*TokenDBValue, error) {
 	}
 
 	texp := v.ValidUntil.Sub(time.Now())
-	glog.V(3).Infof("Existing GitHub auth token for <%s> expires after: <%d> sec", user, int(texp.Seconds()))
+	glog.V(3).Infof("%sExisting GitHub auth token for <%s> expires after: <%d> sec", api.LogPrefix(ctx), user, int(texp.Seconds()))
 
-	glog.V(1).Infof("Token has expired. I will revalidate the access token.")
-	glog.V(3).Infof("Old token is: %+v", v)
-	tokenUser, err := gha.validateAccessToken(v.AccessToken)
+	glog.V(1).Infof("%sToken has expired. I will revalidate the access token.", api.LogPrefix(ctx))
+	glog.V(3).Infof("%sOld token is: %+v", api.LogPrefix(ctx), v)
+	tokenUser, err := gha.validateAccessToken(ctx, v.AccessToken)
 	if err != nil {
-		glog.Warningf("Token for %q failed validation: %s", user, err)
-		return nil, fmt.Errorf("server token invalid: %s", err)
+		glog.Warningf("%sToken for %q failed validation: %s", api.LogPrefix(ctx), user, err)
+		return nil, fmt.Errorf("server token invalid: %w", err)
 	}
-	if tokenUser != user {
-		glog.Errorf("token for wrong user: expected %s, found %s", user, tokenUser)
+	if tokenUser != user && !(gha.caseInsensitive && strings.EqualFold(tokenUser, user)) {
+		gha.tokenCache.invalidate(v.AccessToken)
+		glog.Errorf("%stoken for wrong user: expected %s, found %s", api.LogPrefix(ctx), user, tokenUser)
 		return nil, fmt.Errorf("found token for wrong user")
 	}
 
+	// Refresh teams, so that changes in membership take effect. Cached teams are fine if fresh.
+	if teams, err := gha.fetchTeams(ctx, v.AccessToken, user); err != nil {
+		glog.Warningf("%sCould not refresh teams for %s, keeping the old ones: %s", api.LogPrefix(ctx), user, err)
+	} else {
+		if v.Labels == nil {
+			v.Labels = api.Labels{}
+		}
+		v.Labels["teams"] = teams
+	}
+	if v.Labels != nil {
+		gha.addEmailLabel(ctx, v.AccessToken, v.Labels)
+	}
+
 	// Update revalidation timestamp
 	v.ValidUntil = time.Now().Add(gha.config.RevalidateAfter)
-	glog.V(3).Infof("New token is: %+v", v)
+	glog.V(3).Infof("%sNew token is: %+v", api.LogPrefix(ctx), v)
 
 	// Update token
 	_, err = gha.db.StoreToken(user, v, false)
 	if err != nil {
-		glog.Errorf("Failed to record server token: %s", err)
+		glog.Errorf("%sFailed to record server token: %s", api.LogPrefix(ctx), err)
 		return nil, fmt.Errorf("Unable to store renewed token expiry time: %s", err)
 	}
-	glog.V(2).Infof("Successfully revalidated token")
+	glog.V(2).Infof("%sSuccessfully revalidated token", api.LogPrefix(ctx))
 
 	texp = v.ValidUntil.Sub(time.Now())
-	glog.V(3).Infof("Re-validated GitHub auth token for %s. Next revalidation in %dsec.", user, int64(texp.Seconds()))
+	glog.V(3).Infof("%sRe-validated GitHub auth token for %s. Next revalidation in %dsec.", api.LogPrefix(ctx), user, int64(texp.Seconds()))
 	return v, nil
 }
 
 func (gha *GitHubAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	return gha.AuthenticateContext(context.Background(), user, password)
+}
+
+func (gha *GitHubAuth) AuthenticateContext(ctx context.Context, user string, password api.PasswordString) (bool, api.Labels, error) {
+	if gha.config.PersonalAccessTokens && isPersonalAccessToken(string(password)) {
+		return gha.authenticatePersonalAccessToken(ctx, user, password)
+	}
+	user = gha.dbUser(user)
 	err := gha.db.ValidateToken(user, password)
 	if err == ExpiredToken {
-		_, err = gha.validateServerToken(user)
+		_, err = gha.validateServerToken(ctx, user)
 		if err != nil {
+			gha.teamCache.invalidate(user)
 			return false, nil, err
 		}
 	} else if err != nil {
@@ -503,6 +1004,71 @@ func (gha *GitHubAuth) Authenticate(user string, password api.PasswordString) (b
 	return true, v.Labels, nil
 }
 
+// isPersonalAccessToken tells GitHub personal access tokens, classic and fine-grained,
+// from the passwords handed out by the sign-in page.
+func isPersonalAccessToken(password string) bool {
+	return strings.HasPrefix(password, "ghp_") || strings.HasPrefix(password, "github_pat_")
+}
+
+// authenticatePersonalAccessToken checks that the token belongs to the user and that they are in the
+// organization, then fetches their teams. The token DB is not involved.
+func (gha *GitHubAuth) authenticatePersonalAccessToken(ctx context.Context, user string, pat api.PasswordString) (bool, api.Labels, error) {
+	token := string(pat)
+	login, err := gha.validateAccessToken(ctx, token)
+	var ssoErr *GitHubSSOError
+	if errors.As(err, &ssoErr) {
+		// Not a wrong token, tell the user what to do about it.
+		return false, nil, ssoErr
+	}
+	if err != nil {
+		// Errors may quote the token, keep it out of the logs.
+		glog.Warningf("%sGitHub personal access token for %s rejected: %s", api.LogPrefix(ctx), user, strings.Replace(err.Error(), token, pat.String(), -1))
+		return false, nil, nil
+	}
+	// GitHub logins are case-insensitive.
+	if login == "" || !strings.EqualFold(login, user) {
+		glog.Warningf("%sGitHub personal access token for %s belongs to %q", api.LogPrefix(ctx), user, login)
+		return false, nil, nil
+	}
+	teams, err := gha.fetchTeams(ctx, token, login)
+	if err != nil {
+		return false, nil, fmt.Errorf("could not fetch teams: %s", strings.Replace(err.Error(), token, pat.String(), -1))
+	}
+	labels := api.Labels{"teams": teams}
+	gha.addEmailLabel(ctx, token, labels)
+	return true, labels, nil
+}
+
+// SetCaseInsensitive makes user names match GitHub logins regardless of case.
+// Server tokens are then stored under the lowercased login.
+func (gha *GitHubAuth) SetCaseInsensitive() {
+	gha.caseInsensitive = true
+}
+
+// dbUser returns the name the server token of the user is stored under.
+func (gha *GitHubAuth) dbUser(user string) string {
+	if gha.caseInsensitive {
+		return strings.ToLower(user)
+	}
+	return user
+}
+
+// SignOut deletes the server token of the user, so that the password they were given stops working
+// until they sign in again.
+func (gha *GitHubAuth) SignOut(user string) error {
+	user = gha.dbUser(user)
+	gha.teamCache.invalidate(user)
+	return gha.db.DeleteToken(user)
+}
+
+// CheckHealth checks the token DB, if it has a remote backend.
+func (gha *GitHubAuth) CheckHealth() error {
+	if hc, ok := gha.db.(api.HealthChecker); ok {
+		return hc.CheckHealth()
+	}
+	return nil
+}
+
 func (gha *GitHubAuth) Stop() {
 	gha.db.Close()
 	glog.Info("Token DB closed")
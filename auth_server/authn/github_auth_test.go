@@ -0,0 +1,976 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeGitHub serves the parts of the GitHub API used by GitHubAuth.
+type fakeGitHub struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// Logins of the owners of access tokens.
+	logins map[string]string
+	// Members of organizations.
+	members map[string][]string
+	// Teams of users.
+	teams map[string]GitHubTeamCollection
+	// Email addresses of users, /user/emails is forbidden for those without any.
+	emails map[string][]fakeGitHubEmail
+	// Organizations enforcing SAML single sign-on, with the URL to authorize tokens at.
+	sso map[string]string
+	// Access tokens handed out for OAuth codes, and the scopes they are granted.
+	codes  map[string]string
+	scopes string
+	// Number of requests by path.
+	requests map[string]int
+	// How long to take to answer.
+	delay time.Duration
+	// Most requests in flight at once.
+	inFlight, maxInFlight int
+	// Leave out the link to the last page, like GitHub does for some lists.
+	noLastLink bool
+	// Page of lists to answer with garbage.
+	brokenPage int
+	// Answer GraphQL queries like a server without GraphQL.
+	noGraphQL bool
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	gh := &fakeGitHub{
+		logins:   map[string]string{},
+		members:  map[string][]string{},
+		emails:   map[string][]fakeGitHubEmail{},
+		sso:      map[string]string{},
+		codes:    map[string]string{},
+		scopes:   "read:org,user:email",
+		teams:    map[string]GitHubTeamCollection{},
+		requests: map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(rw http.ResponseWriter, req *http.Request) {
+		login := gh.tokenLogin(req)
+		if login == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"message": "Bad credentials"}`))
+			return
+		}
+		json.NewEncoder(rw).Encode(GitHubTokenUser{Login: login})
+	})
+	mux.HandleFunc("/orgs/", func(rw http.ResponseWriter, req *http.Request) {
+		// /orgs/<org>/members/<user> or /orgs/<org>/teams/<team>/memberships/<user>
+		parts := strings.Split(req.URL.Path, "/")
+		gh.mu.Lock()
+		ssoURL, sso := gh.sso[parts[2]]
+		gh.mu.Unlock()
+		if sso {
+			rw.Header().Set(gitHubSSOHeader, "required; url="+ssoURL)
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if len(parts) == 7 && parts[3] == "teams" && parts[5] == "memberships" {
+			gh.writeTeamMembership(rw, parts[2], parts[4], parts[6])
+			return
+		}
+		if len(parts) != 5 || parts[3] != "members" {
+			http.NotFound(rw, req)
+			return
+		}
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		for _, m := range gh.members[parts[2]] {
+			if m == parts[4] {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/user/teams", func(rw http.ResponseWriter, req *http.Request) {
+		login := gh.tokenLogin(req)
+		gh.mu.Lock()
+		teams := gh.teams[login]
+		gh.mu.Unlock()
+		gh.writePage(rw, req, teams)
+	})
+	mux.HandleFunc("/user/emails", func(rw http.ResponseWriter, req *http.Request) {
+		login := gh.tokenLogin(req)
+		gh.mu.Lock()
+		emails := gh.emails[login]
+		gh.mu.Unlock()
+		if emails == nil {
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte(`{"message": "Resource not accessible by integration"}`))
+			return
+		}
+		json.NewEncoder(rw).Encode(emails)
+	})
+	mux.HandleFunc("/graphql", gh.graphQL)
+	mux.HandleFunc("/login/oauth/access_token", func(rw http.ResponseWriter, req *http.Request) {
+		// The form is posted without a content type, which GitHub does not mind.
+		body, _ := ioutil.ReadAll(req.Body)
+		form, _ := url.ParseQuery(string(body))
+		code := form.Get("code")
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		token, ok := gh.codes[code]
+		if !ok {
+			json.NewEncoder(rw).Encode(CodeToTokenResponse{Error: "bad_verification_code", ErrorDescription: "The code passed is incorrect or expired."})
+			return
+		}
+		delete(gh.codes, code)
+		json.NewEncoder(rw).Encode(CodeToTokenResponse{AccessToken: token, TokenType: "bearer", Scope: gh.scopes})
+	})
+	gh.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gh.mu.Lock()
+		gh.requests[req.URL.Path]++
+		delay := gh.delay
+		gh.inFlight++
+		if gh.inFlight > gh.maxInFlight {
+			gh.maxInFlight = gh.inFlight
+		}
+		gh.mu.Unlock()
+		defer func() {
+			gh.mu.Lock()
+			gh.inFlight--
+			gh.mu.Unlock()
+		}()
+		time.Sleep(delay)
+		mux.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(gh.Close)
+	return gh
+}
+
+// tokenLogin returns the owner of the token the request was made with, or "".
+func (gh *fakeGitHub) tokenLogin(req *http.Request) string {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	return gh.logins[strings.TrimPrefix(req.Header.Get("Authorization"), "token ")]
+}
+
+// graphQL answers the query for the teams of a user in an organization, with cursors that are
+// indexes into the list of teams.
+func (gh *fakeGitHub) graphQL(rw http.ResponseWriter, req *http.Request) {
+	var q struct {
+		Query     string
+		Variables struct {
+			Org, Login, After string
+			First             int
+		}
+	}
+	if err := json.NewDecoder(req.Body).Decode(&q); err != nil || !strings.Contains(q.Query, "teams(") {
+		http.Error(rw, "bad query", http.StatusBadRequest)
+		return
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	if gh.noGraphQL {
+		http.NotFound(rw, req)
+		return
+	}
+	if gh.logins[strings.TrimPrefix(req.Header.Get("Authorization"), "bearer ")] == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if _, ok := gh.members[q.Variables.Org]; !ok {
+		rw.Write([]byte(`{"data": {"organization": null}, "errors": [{"type": "NOT_FOUND", "message": "Could not resolve to an Organization"}]}`))
+		return
+	}
+	type node struct {
+		Slug       string            `json:"slug"`
+		ParentTeam map[string]string `json:"parentTeam"`
+	}
+	var nodes []node
+	for _, t := range gh.teams[q.Variables.Login] {
+		if t.Organization.Login != q.Variables.Org {
+			continue
+		}
+		n := node{Slug: t.Slug}
+		if t.Parent != nil {
+			n.ParentTeam = map[string]string{"slug": t.Parent.Slug}
+		}
+		nodes = append(nodes, n)
+	}
+	start, _ := strconv.Atoi(q.Variables.After)
+	end := start + q.Variables.First
+	if end > len(nodes) {
+		end = len(nodes)
+	}
+	var resp gitHubTeamsResponse
+	json.Unmarshal([]byte(`{"data": {"organization": {}}}`), &resp)
+	b, _ := json.Marshal(nodes[start:end])
+	json.Unmarshal(b, &resp.Data.Organization.Teams.Nodes)
+	resp.Data.Organization.Teams.PageInfo.HasNextPage = end < len(nodes)
+	resp.Data.Organization.Teams.PageInfo.EndCursor = strconv.Itoa(end)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// writeTeamMembership writes the membership of the user in the team, with the role the team was set
+// up with. Role "pending" stands for an invitation that has not been accepted.
+func (gh *fakeGitHub) writeTeamMembership(rw http.ResponseWriter, org, team, user string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for _, t := range gh.teams[user] {
+		if t.Organization.Login != org || t.Slug != team || t.role == "" {
+			continue
+		}
+		if t.role == "pending" {
+			json.NewEncoder(rw).Encode(map[string]string{"state": "pending", "role": "member"})
+		} else {
+			json.NewEncoder(rw).Encode(map[string]string{"state": "active", "role": t.role})
+		}
+		return
+	}
+	http.NotFound(rw, nil)
+}
+
+// writePage writes the page of the list selected by the page and per_page parameters,
+// with links to the next and the last page like GitHub does.
+func (gh *fakeGitHub) writePage(rw http.ResponseWriter, req *http.Request, list GitHubTeamCollection) {
+	q := req.URL.Query()
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 {
+		perPage = 30
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	gh.mu.Lock()
+	noLastLink, brokenPage := gh.noLastLink, gh.brokenPage
+	gh.mu.Unlock()
+	if page == brokenPage {
+		rw.Write([]byte("<html>"))
+		return
+	}
+	last := (len(list) + perPage - 1) / perPage
+	if page < last {
+		link := func(p int) string {
+			q.Set("page", strconv.Itoa(p))
+			return fmt.Sprintf("<%s%s?%s>", gh.URL, req.URL.Path, q.Encode())
+		}
+		if noLastLink {
+			rw.Header().Set("Link", fmt.Sprintf(`%s; rel="next"`, link(page+1)))
+		} else {
+			rw.Header().Set("Link", fmt.Sprintf(`%s; rel="next", %s; rel="last"`, link(page+1), link(last)))
+		}
+	}
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(list) {
+		start = len(list)
+	}
+	if end > len(list) {
+		end = len(list)
+	}
+	json.NewEncoder(rw).Encode(list[start:end])
+}
+
+func (gh *fakeGitHub) addUser(token, login string, orgs ...string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.logins[token] = login
+	for _, org := range orgs {
+		gh.members[org] = append(gh.members[org], login)
+	}
+}
+
+type fakeGitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func (gh *fakeGitHub) setEmails(login string, emails ...fakeGitHubEmail) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.emails[login] = emails
+}
+
+// addCode makes the OAuth code good for the access token, once.
+func (gh *fakeGitHub) addCode(code, token string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.codes[code] = token
+}
+
+func (gh *fakeGitHub) setTeams(login string, teams ...GitHubTeam) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.teams[login] = teams
+}
+
+func (gh *fakeGitHub) requestCount(path string) int {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	return gh.requests[path]
+}
+
+func testGitHubTeam(org, slug string) GitHubTeam {
+	return GitHubTeam{Slug: slug, Organization: &GitHubOrganization{Login: org}}
+}
+
+func testGitHubTeamWithRole(org, slug, role string) GitHubTeam {
+	t := testGitHubTeam(org, slug)
+	t.role = role
+	return t
+}
+
+// newTestGitHubAuth returns a GitHubAuth talking to gh with an in-memory token DB.
+func newTestGitHubAuth(t *testing.T, gh *fakeGitHub, c *GitHubAuthConfig) *GitHubAuth {
+	c.GithubApiUri, c.GithubWebUri = gh.URL, gh.URL
+	if c.TokenDB == "" {
+		c.TokenDB = MemoryTokenDB
+	}
+	gha, err := NewGitHubAuth(c)
+	if err != nil {
+		t.Fatalf("NewGitHubAuth: %s", err)
+	}
+	t.Cleanup(gha.Stop)
+	return gha
+}
+
+// expireGitHubToken makes the server token of the user due for revalidation.
+func expireGitHubToken(t *testing.T, gha *GitHubAuth, user string) {
+	v, err := gha.db.GetValue(user)
+	if err != nil || v == nil {
+		t.Fatalf("no token for %s: %v", user, err)
+	}
+	v.ValidUntil = time.Now().Add(-time.Minute)
+	if _, err := gha.db.StoreToken(user, v, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signInGitHub completes the sign-in with the OAuth code, returning the response of the callback.
+func signInGitHub(t *testing.T, gha *GitHubAuth, code string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	state, err := gha.newState(rw, httptest.NewRequest("GET", "/github_auth", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/github_auth?code="+code+"&state="+state, nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	rw = httptest.NewRecorder()
+	gha.DoGitHubAuth(rw, req)
+	return rw
+}
+
+var githubResultPasswordRE = regexp.MustCompile(`docker login -u \S+ -p (\S+)`)
+
+// githubResultPassword returns the password from the sign-in result page.
+func githubResultPassword(t *testing.T, rw *httptest.ResponseRecorder) string {
+	m := githubResultPasswordRE.FindStringSubmatch(rw.Body.String())
+	if rw.Code != http.StatusOK || m == nil {
+		t.Fatalf("expected the sign-in to succeed, got %d %s", rw.Code, rw.Body)
+	}
+	return m[1]
+}
+
+func sortedTeams(teams []string) []string {
+	sorted := append([]string{}, teams...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestGitHubTeamCache(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	gh.setTeams("alice", testGitHubTeam("acme", "dev"))
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", TeamCacheTTL: 200 * time.Millisecond})
+	fetch := func() []string {
+		teams, err := gha.fetchTeams(context.Background(), "alice-token", "alice")
+		if err != nil {
+			t.Fatalf("fetchTeams: %s", err)
+		}
+		return teams
+	}
+	if teams := fetch(); !reflect.DeepEqual(teams, []string{"dev"}) {
+		t.Errorf("expected [dev], got %v", teams)
+	}
+	gh.setTeams("alice", testGitHubTeam("acme", "ops"))
+	if teams := fetch(); !reflect.DeepEqual(teams, []string{"dev"}) || gh.requestCount("/user/teams") != 1 {
+		t.Errorf("expected the cached teams without asking GitHub, got %v after %d requests", teams, gh.requestCount("/user/teams"))
+	}
+	if teams, err := gha.fetchTeams(context.Background(), "bob-token", "bob"); err != nil || len(teams) != 0 {
+		t.Errorf("expected the teams of other users not to be cached, got %v %v", teams, err)
+	}
+
+	// Signing out forgets the teams.
+	gha.SignOut("alice")
+	if teams := fetch(); !reflect.DeepEqual(teams, []string{"ops"}) {
+		t.Errorf("expected the teams to be fetched after signing out, got %v", teams)
+	}
+	gh.setTeams("alice", testGitHubTeam("acme", "dev"))
+	time.Sleep(300 * time.Millisecond)
+	if teams := fetch(); !reflect.DeepEqual(teams, []string{"dev"}) {
+		t.Errorf("expected the teams to be fetched after team_cache_ttl, got %v", teams)
+	}
+
+	// Without team_cache_ttl, every sign-in and revalidation asks GitHub.
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme"})
+	before := gh.requestCount("/user/teams")
+	for i := 0; i < 2; i++ {
+		if _, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); err != nil {
+			t.Fatalf("fetchTeams: %s", err)
+		}
+	}
+	if n := gh.requestCount("/user/teams") - before; n != 2 {
+		t.Errorf("expected the teams not to be cached, got %d requests", n)
+	}
+}
+
+func TestGitHubTeamCacheInvalidatedOnFailedRevalidation(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	gh.setTeams("alice", testGitHubTeam("acme", "dev"))
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", TeamCacheTTL: time.Hour})
+	password, err := gha.db.StoreToken("alice", &TokenDBValue{
+		AccessToken: "alice-token",
+		ValidUntil:  time.Now().Add(-time.Minute),
+		Labels:      map[string][]string{"teams": {"dev"}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, labels, err := gha.Authenticate("alice", api.PasswordString(password)); !ok || err != nil || !reflect.DeepEqual(labels["teams"], []string{"dev"}) {
+		t.Fatalf("expected alice to be revalidated, got %t %v %v", ok, labels, err)
+	}
+
+	// Once GitHub rejects the token, the cached teams are not used again.
+	gh.mu.Lock()
+	delete(gh.logins, "alice-token")
+	gh.mu.Unlock()
+	expireGitHubToken(t, gha, "alice")
+	if ok, _, err := gha.Authenticate("alice", api.PasswordString(password)); ok || err == nil {
+		t.Errorf("expected a revoked token to be rejected, got %t %v", ok, err)
+	}
+	if _, ok := gha.teamCache.get("alice"); ok {
+		t.Errorf("expected the cached teams to be dropped")
+	}
+}
+
+func TestGitHubMultipleOrganizations(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "widgets")
+	gh.addUser("bob-token", "bob", "other")
+	dev := testGitHubTeam("acme", "dev")
+	dev.Parent = &ParentGitHubTeam{Slug: "eng"}
+	gh.setTeams("alice", dev, testGitHubTeam("widgets", "ops"), testGitHubTeam("other", "dev"))
+	for _, c := range []*GitHubAuthConfig{
+		{Organizations: []string{"acme", "widgets"}},
+		{Organization: "acme", Organizations: []string{"widgets"}},
+	} {
+		gha := newTestGitHubAuth(t, gh, c)
+		if user, err := gha.validateAccessToken(context.Background(), "alice-token"); user != "alice" || err != nil {
+			t.Errorf("%v: expected a member of any of the organizations to be accepted, got %q %v", c.organizations(), user, err)
+		}
+		_, err := gha.validateAccessToken(context.Background(), "bob-token")
+		if err == nil || !strings.Contains(err.Error(), "user bob is not a member of any of the organizations acme, widgets") {
+			t.Errorf("%v: expected a non-member to be rejected, got %v", c.organizations(), err)
+		}
+		teams, err := gha.fetchTeams(context.Background(), "alice-token", "alice")
+		if expected := []string{"acme/dev", "acme/eng", "widgets/ops"}; err != nil || !reflect.DeepEqual(sortedTeams(teams), expected) {
+			t.Errorf("%v: expected teams qualified with the organization %v, got %v %v", c.organizations(), expected, teams, err)
+		}
+	}
+
+	// With a single organization team names stay as they were.
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme"})
+	if _, err := gha.validateAccessToken(context.Background(), "alice-token"); err == nil || !strings.Contains(err.Error(), "user alice is not a member of organization acme") {
+		t.Errorf("expected a non-member to be rejected, got %v", err)
+	}
+	teams, err := gha.fetchTeams(context.Background(), "alice-token", "alice")
+	if expected := []string{"dev", "eng"}; err != nil || !reflect.DeepEqual(sortedTeams(teams), expected) {
+		t.Errorf("expected %v, got %v %v", expected, teams, err)
+	}
+
+	// Without organizations anyone is accepted and teams are not fetched.
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{})
+	before := gh.requestCount("/user/teams")
+	if user, err := gha.validateAccessToken(context.Background(), "bob-token"); user != "bob" || err != nil {
+		t.Errorf("expected any user to be accepted, got %q %v", user, err)
+	}
+	if teams, err := gha.fetchTeams(context.Background(), "bob-token", "bob"); teams != nil || err != nil || gh.requestCount("/user/teams") != before {
+		t.Errorf("expected no teams, got %v %v", teams, err)
+	}
+}
+
+func TestGitHubHTTPTimeout(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	gh.setTeams("alice", testGitHubTeam("acme", "dev"))
+	gh.delay = 500 * time.Millisecond
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", HTTPTimeout: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := gha.validateAccessToken(context.Background(), "alice-token"); err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+		t.Errorf("expected the user request to time out, got %v", err)
+	}
+	if _, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+		t.Errorf("expected the teams request to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("expected requests to be cut short after http_timeout, took %s", d)
+	}
+
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", HTTPTimeout: 5 * time.Second})
+	if user, err := gha.validateAccessToken(context.Background(), "alice-token"); user != "alice" || err != nil {
+		t.Errorf("expected slow requests within http_timeout to succeed, got %q %v", user, err)
+	}
+}
+
+func TestGitHubTeamPages(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	var teams GitHubTeamCollection
+	var expected []string
+	for i := 0; i < 95; i++ {
+		teams = append(teams, testGitHubTeam("acme", fmt.Sprintf("team-%02d", i)))
+		expected = append(expected, fmt.Sprintf("team-%02d", i))
+	}
+	gh.setTeams("alice", teams...)
+	gh.delay = 20 * time.Millisecond
+	for _, c := range []struct {
+		name        string
+		concurrency int
+		noLastLink  bool
+		maxInFlight int
+	}{
+		{"concurrent", 4, false, 4},
+		{"sequential", 1, false, 1},
+		{"without the last page", 4, true, 1},
+	} {
+		gh.mu.Lock()
+		gh.noLastLink, gh.maxInFlight = c.noLastLink, 0
+		gh.mu.Unlock()
+		before := gh.requestCount("/user/teams")
+		gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", PageSize: 10, TeamPageConcurrency: c.concurrency})
+		got, err := gha.fetchTeams(context.Background(), "alice-token", "alice")
+		if err != nil || !reflect.DeepEqual(sortedTeams(got), expected) {
+			t.Errorf("%s: expected all %d teams, got %d %v", c.name, len(expected), len(got), err)
+		}
+		if n := gh.requestCount("/user/teams") - before; n != 10 {
+			t.Errorf("%s: expected 10 pages to be fetched, got %d", c.name, n)
+		}
+		gh.mu.Lock()
+		if gh.maxInFlight != c.maxInFlight {
+			t.Errorf("%s: expected at most %d requests at once, got %d", c.name, c.maxInFlight, gh.maxInFlight)
+		}
+		gh.mu.Unlock()
+	}
+}
+
+func TestGitHubTeamPageURLs(t *testing.T) {
+	for _, c := range []struct {
+		link     linkHeader
+		expected []string
+	}{
+		{linkHeader{Next: "https://api.github.com/user/teams?page=2&per_page=10", Last: "https://api.github.com/user/teams?page=4&per_page=10"},
+			[]string{
+				"https://api.github.com/user/teams?page=2&per_page=10",
+				"https://api.github.com/user/teams?page=3&per_page=10",
+				"https://api.github.com/user/teams?page=4&per_page=10",
+			}},
+		{linkHeader{Next: "https://api.github.com/user/teams?page=2"}, nil},
+		{linkHeader{Next: "https://api.github.com/user/teams?page=2", Last: "https://api.github.com/user/teams?cursor=x"}, nil},
+		{linkHeader{Next: "https://api.github.com/user/teams?page=3", Last: "https://api.github.com/user/teams?page=2"}, nil},
+	} {
+		if got := teamPageURLs(c.link); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%+v: expected %v, got %v", c.link, c.expected, got)
+		}
+	}
+}
+
+func TestGitHubTeamPagesError(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	var teams GitHubTeamCollection
+	for i := 0; i < 30; i++ {
+		teams = append(teams, testGitHubTeam("acme", fmt.Sprintf("team-%02d", i)))
+	}
+	gh.setTeams("alice", teams...)
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", PageSize: 10, TeamPageConcurrency: 4})
+	// A page that cannot be fetched fails the whole list rather than leaving teams out.
+	gh.brokenPage = 3
+	if got, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); err == nil {
+		t.Errorf("expected an error, got %v", got)
+	}
+}
+
+func TestGitHubPersonalAccessTokens(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("ghp_alice", "alice", "acme")
+	gh.addUser("github_pat_bob", "bob", "acme")
+	gh.addUser("ghp_carol", "carol")
+	gh.setTeams("alice", testGitHubTeam("acme", "dev"))
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", PersonalAccessTokens: true})
+	for _, c := range []struct {
+		user, token string
+		ok          bool
+	}{
+		{"alice", "ghp_alice", true},
+		// GitHub logins are case-insensitive.
+		{"Alice", "ghp_alice", true},
+		{"bob", "github_pat_bob", true},
+		{"bob", "ghp_alice", false},
+		{"alice", "ghp_unknown", false},
+		{"carol", "ghp_carol", false},
+	} {
+		ok, labels, err := gha.Authenticate(c.user, api.PasswordString(c.token))
+		if ok != c.ok || err != nil {
+			t.Errorf("%s with %s: expected %t, got %t %v", c.user, c.token, c.ok, ok, err)
+		}
+		if c.user == "alice" && ok && !reflect.DeepEqual(labels, api.Labels{"teams": {"dev"}}) {
+			t.Errorf("expected the teams of alice, got %v", labels)
+		}
+	}
+	// Tokens are not kept.
+	if v, err := gha.db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("expected nothing in the token DB, got %+v %v", v, err)
+	}
+
+	// Organizations enforcing SSO tell the user what to do.
+	gh.mu.Lock()
+	gh.sso["acme"] = "https://github.com/orgs/acme/sso"
+	gh.mu.Unlock()
+	_, _, err := gha.Authenticate("alice", "ghp_alice")
+	var ssoErr *GitHubSSOError
+	if !errors.As(err, &ssoErr) || ssoErr.URL != "https://github.com/orgs/acme/sso" {
+		t.Errorf("expected an SSO error, got %v", err)
+	}
+
+	// Otherwise they are passwords like any other.
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme"})
+	before := gh.requestCount("/user")
+	if ok, _, err := gha.Authenticate("alice", "ghp_alice"); ok || err != api.NoMatch {
+		t.Errorf("expected personal access tokens to be looked up in the token DB, got %t %v", ok, err)
+	}
+	if n := gh.requestCount("/user") - before; n != 0 {
+		t.Errorf("expected GitHub not to be asked about passwords, got %d requests", n)
+	}
+}
+
+func TestGitHubEmailLabel(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	gh.setEmails("alice",
+		fakeGitHubEmail{Email: "alice@users.noreply.github.com", Verified: true},
+		fakeGitHubEmail{Email: "alice@example.com", Primary: true, Verified: true})
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", FetchEmail: true})
+	gh.addCode("code", "alice-token")
+	password := api.PasswordString(githubResultPassword(t, signInGitHub(t, gha, "code")))
+	authenticate := func() api.Labels {
+		expireGitHubToken(t, gha, "alice")
+		ok, labels, err := gha.Authenticate("alice", password)
+		if !ok || err != nil {
+			t.Fatalf("expected alice to be authenticated, got %t %v", ok, err)
+		}
+		return labels
+	}
+	if v, _ := gha.db.GetValue("alice"); v == nil || !reflect.DeepEqual(v.Labels["email"], []string{"alice@example.com"}) {
+		t.Errorf("expected the primary email to be stored on sign-in, got %+v", v)
+	}
+
+	// The label follows changes on revalidation.
+	gh.setEmails("alice", fakeGitHubEmail{Email: "alice@acme.example.com", Primary: true, Verified: true})
+	if labels := authenticate(); !reflect.DeepEqual(labels["email"], []string{"alice@acme.example.com"}) {
+		t.Errorf("expected the new primary email, got %v", labels)
+	}
+	// If it cannot be fetched, the label is kept.
+	gh.setEmails("alice")
+	if labels := authenticate(); !reflect.DeepEqual(labels["email"], []string{"alice@acme.example.com"}) {
+		t.Errorf("expected the email to be kept, got %v", labels)
+	}
+	// Unverified addresses are not used.
+	gh.setEmails("alice", fakeGitHubEmail{Email: "alice@evil.example.com", Primary: true})
+	if labels := authenticate(); labels["email"] != nil {
+		t.Errorf("expected the email label to be removed, got %v", labels)
+	}
+
+	// Off by default.
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme"})
+	before := gh.requestCount("/user/emails")
+	gh.addCode("code", "alice-token")
+	githubResultPassword(t, signInGitHub(t, gha, "code"))
+	if v, _ := gha.db.GetValue("alice"); v == nil || v.Labels["email"] != nil || gh.requestCount("/user/emails") != before {
+		t.Errorf("expected no email without fetch_email, got %+v", v)
+	}
+}
+
+func TestGitHubSignOut(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "Alice", "acme")
+	gh.setTeams("Alice", testGitHubTeam("acme", "dev"))
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", RevalidateAfter: time.Hour, TeamCacheTTL: time.Hour})
+	gha.SetCaseInsensitive()
+	gh.addCode("code", "alice-token")
+	password := api.PasswordString(githubResultPassword(t, signInGitHub(t, gha, "code")))
+	if ok, _, err := gha.Authenticate("alice", password); !ok || err != nil {
+		t.Fatalf("expected alice to be authenticated, got %t %v", ok, err)
+	}
+	if err := gha.SignOut("ALICE"); err != nil {
+		t.Fatalf("SignOut: %s", err)
+	}
+	if ok, _, err := gha.Authenticate("alice", password); ok || err != api.NoMatch {
+		t.Errorf("expected the password to stop working, got %t %v", ok, err)
+	}
+	if _, ok := gha.teamCache.get("alice"); ok {
+		t.Errorf("expected the cached teams to be dropped")
+	}
+	// Signing out again is not an error.
+	if err := gha.SignOut("alice"); err != nil {
+		t.Errorf("SignOut: %s", err)
+	}
+
+	// Signing in again hands out a new password.
+	gh.addCode("code", "alice-token")
+	newPassword := api.PasswordString(githubResultPassword(t, signInGitHub(t, gha, "code")))
+	if ok, _, err := gha.Authenticate("alice", newPassword); !ok || err != nil || newPassword == password {
+		t.Errorf("expected alice to be able to sign in again, got %t %v", ok, err)
+	}
+}
+
+func TestGitHubTeamRoles(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme")
+	gh.setTeams("alice",
+		testGitHubTeamWithRole("acme", "dev", "maintainer"),
+		testGitHubTeamWithRole("acme", "ops", "member"),
+		testGitHubTeamWithRole("acme", "qa", "pending"),
+		testGitHubTeamWithRole("other", "x", "maintainer"))
+	for _, c := range []struct {
+		config   *GitHubAuthConfig
+		expected []string
+	}{
+		{&GitHubAuthConfig{Organization: "acme", TeamRoles: true},
+			[]string{"dev", "dev:maintainer", "ops", "ops:member", "qa"}},
+		{&GitHubAuthConfig{Organizations: []string{"acme"}, TeamRoles: true},
+			[]string{"acme/dev", "acme/dev:maintainer", "acme/ops", "acme/ops:member", "acme/qa"}},
+		{&GitHubAuthConfig{Organization: "acme"},
+			[]string{"dev", "ops", "qa"}},
+	} {
+		gh.mu.Lock()
+		gh.requests = map[string]int{}
+		gh.mu.Unlock()
+		gha := newTestGitHubAuth(t, gh, c.config)
+		teams, err := gha.fetchTeams(context.Background(), "alice-token", "alice")
+		if err != nil || !reflect.DeepEqual(sortedTeams(teams), c.expected) {
+			t.Errorf("%+v: expected %v, got %v %v", c.config, c.expected, teams, err)
+		}
+		// Memberships of teams of other organizations are not looked up.
+		if n := gh.requestCount("/orgs/other/teams/x/memberships/alice"); n != 0 {
+			t.Errorf("%+v: expected no request for other organizations, got %d", c.config, n)
+		}
+		if n, expected := gh.requestCount("/orgs/acme/teams/dev/memberships/alice"), map[bool]int{true: 1}[c.config.TeamRoles]; n != expected {
+			t.Errorf("%+v: expected %d requests for the role, got %d", c.config, expected, n)
+		}
+	}
+
+	// Roles that cannot be looked up fail the teams rather than being left out.
+	gh.mu.Lock()
+	gh.sso["acme"] = "https://github.com/orgs/acme/sso"
+	gh.mu.Unlock()
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", TeamRoles: true})
+	var ssoErr *GitHubSSOError
+	if teams, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); !errors.As(err, &ssoErr) {
+		t.Errorf("expected an SSO error, got %v %v", teams, err)
+	}
+}
+
+func TestGitHubMissingScopes(t *testing.T) {
+	for _, tc := range []struct {
+		config  GitHubAuthConfig
+		scopes  []string
+		missing string
+	}{
+		{GitHubAuthConfig{}, nil, ""},
+		{GitHubAuthConfig{Organization: "acme", FetchEmail: true}, []string{"read:org", "user:email"}, ""},
+		{GitHubAuthConfig{Organization: "acme", FetchEmail: true}, []string{"repo"}, "read:org,user:email"},
+		// Scopes that include the needed ones.
+		{GitHubAuthConfig{Organization: "acme", FetchEmail: true}, []string{"admin:org", "user"}, ""},
+		{GitHubAuthConfig{Organizations: []string{"acme", "other"}}, []string{"write:org"}, ""},
+		{GitHubAuthConfig{Organizations: []string{"acme"}}, []string{"user:email"}, "read:org"},
+		// Membership is checked as the app.
+		{GitHubAuthConfig{Organization: "acme", App: &GitHubAppConfig{}}, nil, ""},
+	} {
+		if missing := strings.Join(tc.config.missingScopes(tc.scopes), ","); missing != tc.missing {
+			t.Errorf("%+v with %q: got %q, want %q", tc.config, tc.scopes, missing, tc.missing)
+		}
+	}
+}
+
+func TestGitHubScopes(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("t1", "alice", "acme")
+	gh.addCode("c1", "t1")
+	gh.scopes = "repo"
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", Scopes: []string{"read:org", "repo"}})
+
+	rw := httptest.NewRecorder()
+	gha.DoGitHubAuth(rw, httptest.NewRequest("GET", "/github_auth", nil))
+	if !strings.Contains(rw.Body.String(), gh.URL+"/login/oauth/authorize?scope=read%3aorg%20repo&") {
+		t.Errorf("expected the configured scopes to be requested, got %s", rw.Body)
+	}
+	// Not being granted a scope is only warned about, checks that need it fail on their own.
+	githubResultPassword(t, signInGitHub(t, gha, "c1"))
+}
+
+func TestGitHubGraphQLUri(t *testing.T) {
+	for _, c := range []struct {
+		api, graphQL, want string
+	}{
+		{"", "", "https://api.github.com/graphql"},
+		// GitHub Enterprise Server.
+		{"https://ghe.example.com/api/v3/", "", "https://ghe.example.com/api/graphql"},
+		{"https://ghe.example.com/api/v3", "https://graphql.example.com", "https://graphql.example.com"},
+	} {
+		gha := &GitHubAuth{config: &GitHubAuthConfig{GithubApiUri: c.api, GithubGraphQLUri: c.graphQL}}
+		if got := gha.getGithubGraphQLUri(); got != c.want {
+			t.Errorf("%q %q: got %s, want %s", c.api, c.graphQL, got, c.want)
+		}
+	}
+}
+
+func TestGitHubTeamsGraphQL(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("alice-token", "alice", "acme", "other")
+	var teams GitHubTeamCollection
+	var expected []string
+	for i := 0; i < 25; i++ {
+		teams = append(teams, testGitHubTeam("acme", fmt.Sprintf("team-%02d", i)))
+		expected = append(expected, fmt.Sprintf("acme/team-%02d", i))
+	}
+	child := testGitHubTeam("other", "child")
+	child.Parent = &ParentGitHubTeam{Slug: "parent"}
+	teams = append(teams, child, testGitHubTeam("unrelated", "team"))
+	expected = append(expected, "other/child")
+	gh.setTeams("alice", teams...)
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organizations: []string{"acme", "other"}, PageSize: 10, TeamsGraphQL: true})
+
+	got, err := gha.fetchTeamsGraphQL(context.Background(), "alice-token", "alice", []string{"acme", "other"})
+	var slugs []string
+	for _, t := range got {
+		slugs = append(slugs, t.Organization.Login+"/"+t.Slug)
+	}
+	if err != nil || !reflect.DeepEqual(slugs, expected) {
+		t.Fatalf("expected %v, got %v %v", expected, slugs, err)
+	}
+	if p := got[len(got)-1].Parent; p == nil || p.Slug != "parent" {
+		t.Errorf("expected the parent team, got %+v", p)
+	}
+	// Three pages of acme, one of other.
+	if n := gh.requestCount("/graphql"); n != 4 {
+		t.Errorf("expected 4 GraphQL requests, got %d", n)
+	}
+	if _, err := gha.fetchTeamsGraphQL(context.Background(), "alice-token", "alice", []string{"nonexistent"}); err == nil {
+		t.Errorf("expected GraphQL errors to be returned")
+	}
+
+	// Parents are labels too, teams in other organizations are not.
+	labels := sortedTeams(append(expected, "other/parent"))
+	if got, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); err != nil || !reflect.DeepEqual(sortedTeams(got), labels) {
+		t.Errorf("expected %v, got %v %v", labels, got, err)
+	}
+	if n := gh.requestCount("/user/teams"); n != 0 {
+		t.Errorf("expected the REST API not to be used, got %d requests", n)
+	}
+
+	// The REST API is used if GraphQL fails.
+	gh.mu.Lock()
+	gh.noGraphQL = true
+	gh.mu.Unlock()
+	if got, err := gha.fetchTeams(context.Background(), "alice-token", "alice"); err != nil || !reflect.DeepEqual(sortedTeams(got), labels) {
+		t.Errorf("expected %v from the REST API, got %v %v", labels, got, err)
+	}
+	if gh.requestCount("/user/teams") == 0 {
+		t.Errorf("expected the REST API to be used")
+	}
+}
+
+func TestGitHubResultTemplate(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("t1", "alice")
+	gh.addCode("c1", "t1")
+	tmpl := filepath.Join(t.TempDir(), "result.tmpl")
+	if err := ioutil.WriteFile(tmpl, []byte("{{.Username}} {{.Password}} {{.RegistryUrl}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{ResultTemplate: tmpl, RegistryUrl: "registry.example.com"})
+	rw := signInGitHub(t, gha, "c1")
+	f := strings.Fields(rw.Body.String())
+	if rw.Code != http.StatusOK || len(f) != 3 || f[0] != "alice" || f[2] != "registry.example.com" {
+		t.Fatalf("expected the custom result page, got %d %s", rw.Code, rw.Body)
+	}
+	if ok, _, err := gha.Authenticate("alice", api.PasswordString(f[1])); !ok || err != nil {
+		t.Errorf("expected the password on the page to work, got %t %v", ok, err)
+	}
+	if h := rw.Header(); h.Get("Cache-Control") != "no-store" || h.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("expected the result page not to be cached or referred to, got %v", h)
+	}
+
+	if _, err := NewGitHubAuth(&GitHubAuthConfig{TokenDB: MemoryTokenDB, ResultTemplate: tmpl + ".missing"}); err == nil ||
+		!strings.Contains(err.Error(), "github_auth.result_template") {
+		t.Errorf("expected a missing template to be reported, got %v", err)
+	}
+}
+
+var githubRedirectFieldRE = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+
+func TestGitHubResultRedirect(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("t1", "alice")
+	gh.addCode("c1", "t1")
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{ResultRedirectURL: "https://portal.example.com/docker?from=auth"})
+	rw := signInGitHub(t, gha, "c1")
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.Contains(body, `<form method="post" action="https://portal.example.com/docker?from=auth">`) {
+		t.Fatalf("expected a form posting to the portal, got %d %s", rw.Code, body)
+	}
+	fields := map[string]string{}
+	for _, m := range githubRedirectFieldRE.FindAllStringSubmatch(body, -1) {
+		fields[m[1]] = m[2]
+	}
+	if _, found := fields["registry_url"]; fields["username"] != "alice" || found {
+		t.Errorf("unexpected form fields %v", fields)
+	}
+	if ok, _, err := gha.Authenticate("alice", api.PasswordString(fields["password"])); !ok || err != nil {
+		t.Errorf("expected the posted password to work, got %t %v", ok, err)
+	}
+	if strings.Contains(body, "docker login") {
+		t.Errorf("expected the result page not to be shown")
+	}
+}
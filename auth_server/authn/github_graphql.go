@@ -0,0 +1,148 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// The user's teams in an organization, a page at a time. Like /user/teams, only teams
+// the user is a direct member of are listed, with their immediate parents.
+const gitHubTeamsQuery = `query($org: String!, $login: String!, $first: Int!, $after: String) {
+  organization(login: $org) {
+    teams(first: $first, after: $after, userLogins: [$login]) {
+      nodes { slug parentTeam { slug } }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}`
+
+type gitHubTeamsResponse struct {
+	Data struct {
+		Organization *struct {
+			Teams struct {
+				Nodes []struct {
+					Slug       string `json:"slug"`
+					ParentTeam *struct {
+						Slug string `json:"slug"`
+					} `json:"parentTeam"`
+				} `json:"nodes"`
+				PageInfo struct {
+					HasNextPage bool   `json:"hasNextPage"`
+					EndCursor   string `json:"endCursor"`
+				} `json:"pageInfo"`
+			} `json:"teams"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// getGithubGraphQLUri returns the GraphQL endpoint: https://api.github.com/graphql on github.com,
+// and https://<host>/api/graphql on GitHub Enterprise Server, whose REST API is at /api/v3.
+func (gha *GitHubAuth) getGithubGraphQLUri() string {
+	if gha.config.GithubGraphQLUri != "" {
+		return gha.config.GithubGraphQLUri
+	}
+	apiUri := strings.TrimSuffix(gha.getGithubApiUri(), "/")
+	if strings.HasSuffix(apiUri, "/api/v3") {
+		return strings.TrimSuffix(apiUri, "/v3") + "/graphql"
+	}
+	return apiUri + "/graphql"
+}
+
+// fetchTeamsGraphQL fetches the user's teams in the organizations with the GraphQL API,
+// in one request per organization and page of up to page_size teams.
+func (gha *GitHubAuth) fetchTeamsGraphQL(ctx context.Context, token, user string, orgs []string) (GitHubTeamCollection, error) {
+	var allTeams GitHubTeamCollection
+	for _, org := range orgs {
+		after := ""
+		for {
+			vars := map[string]interface{}{"org": org, "login": user, "first": gha.pageSize()}
+			if after != "" {
+				vars["after"] = after
+			}
+			var resp gitHubTeamsResponse
+			if err := gha.graphQL(ctx, token, gitHubTeamsQuery, vars, &resp); err != nil {
+				return nil, err
+			}
+			if len(resp.Errors) > 0 {
+				return nil, fmt.Errorf("GraphQL error fetching teams of %s: %s", org, resp.Errors[0].Message)
+			}
+			if resp.Data.Organization == nil {
+				return nil, fmt.Errorf("organization %s not found", org)
+			}
+			teams := resp.Data.Organization.Teams
+			for _, n := range teams.Nodes {
+				t := GitHubTeam{Slug: n.Slug, Organization: &GitHubOrganization{Login: org}}
+				if n.ParentTeam != nil {
+					t.Parent = &ParentGitHubTeam{Slug: n.ParentTeam.Slug}
+				}
+				allTeams = append(allTeams, t)
+			}
+			if !teams.PageInfo.HasNextPage || teams.PageInfo.EndCursor == "" {
+				break
+			}
+			after = teams.PageInfo.EndCursor
+			glog.V(2).Infof("%s--> Next page of teams in %s", api.LogPrefix(ctx), org)
+		}
+	}
+	return allTeams, nil
+}
+
+// graphQL runs a GraphQL query. GraphQL errors are left in out, only the request failing is an error.
+func (gha *GitHubAuth) graphQL(ctx context.Context, token, query string, vars map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": vars})
+	if err != nil {
+		return err
+	}
+	uri := gha.getGithubGraphQLUri()
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create an http request for uri: %s. Error: %s", uri, err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("bearer %s", token))
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := gha.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP error while retrieving %s. Error : %s", uri, err)
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := checkGitHubSSO(resp, ""); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, uri)
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("Error parsing the JSON response from %s: %s", uri, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	githubStateCookie = "docker_auth_github_state"
+	githubStateTTL    = 10 * time.Minute
+)
+
+// The OAuth state is a random nonce, passed to GitHub in the sign-in link and echoed back to the
+// callback, and also kept in a cookie in the browser. A callback whose state does not match the
+// cookie did not start from our sign-in page and is rejected, which prevents login CSRF.
+// The cookie is signed with a key derived from the client secret, so it can be checked by any
+// replica and the state cannot be forged without it.
+
+func (gha *GitHubAuth) stateKey() []byte {
+	k := sha256.Sum256([]byte("docker_auth github oauth state\x00" + gha.config.ClientSecret))
+	return k[:]
+}
+
+func (gha *GitHubAuth) signState(state string, expires int64) string {
+	mac := hmac.New(sha256.New, gha.stateKey())
+	fmt.Fprintf(mac, "%s.%d", state, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newState generates a state and sets the cookie that the callback checks it against.
+func (gha *GitHubAuth) newState(rw http.ResponseWriter, req *http.Request) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate state: %s", err)
+	}
+	state := hex.EncodeToString(b)
+	expires := time.Now().Add(githubStateTTL).Unix()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     githubStateCookie,
+		Value:    fmt.Sprintf("%s.%d.%s", state, expires, gha.signState(state, expires)),
+		Path:     req.URL.Path,
+		MaxAge:   int(githubStateTTL / time.Second),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		// Lax, so that the cookie is sent on the top-level redirect back from GitHub.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return state, nil
+}
+
+// checkState verifies the state of a callback against the cookie and clears the cookie.
+func (gha *GitHubAuth) checkState(rw http.ResponseWriter, req *http.Request) error {
+	state := req.URL.Query().Get("state")
+	if state == "" {
+		return errors.New("missing state")
+	}
+	c, err := req.Cookie(githubStateCookie)
+	if err != nil {
+		return errors.New("missing state cookie, sign-in must be started from the sign-in page")
+	}
+	http.SetCookie(rw, &http.Cookie{Name: githubStateCookie, Path: req.URL.Path, MaxAge: -1})
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed state cookie")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed state cookie")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(gha.signState(parts[0], expires))) {
+		return errors.New("invalid state cookie signature")
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("state expired, please sign in again")
+	}
+	if !hmac.Equal([]byte(parts[0]), []byte(state)) {
+		return errors.New("state mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitHubCheckState(t *testing.T) {
+	gha := &GitHubAuth{config: &GitHubAuthConfig{ClientSecret: "secret"}}
+	rw := httptest.NewRecorder()
+	state, err := gha.newState(rw, httptest.NewRequest("GET", "/github_auth", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := rw.Result().Cookies()[0]
+	if cookie.Name != githubStateCookie || !strings.HasPrefix(cookie.Value, state+".") || !cookie.HttpOnly {
+		t.Fatalf("unexpected cookie %+v", cookie)
+	}
+
+	check := func(gha *GitHubAuth, state string, c *http.Cookie) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest("GET", "/github_auth?code=c&state="+url.QueryEscape(state), nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		return rw, gha.checkState(rw, req)
+	}
+	rw, err = check(gha, state, cookie)
+	if err != nil {
+		t.Fatalf("checkState: %s", err)
+	}
+	if cleared := rw.Result().Cookies(); len(cleared) != 1 || cleared[0].Name != githubStateCookie || cleared[0].MaxAge >= 0 {
+		t.Errorf("expected the state cookie to be cleared, got %v", cleared)
+	}
+
+	withValue := func(v string) *http.Cookie { return &http.Cookie{Name: githubStateCookie, Value: v} }
+	parts := strings.Split(cookie.Value, ".")
+	expired := time.Now().Add(-time.Minute).Unix()
+	otherSecret := &GitHubAuth{config: &GitHubAuthConfig{ClientSecret: "other"}}
+	for _, c := range []struct {
+		name   string
+		gha    *GitHubAuth
+		state  string
+		cookie *http.Cookie
+		err    string
+	}{
+		{"missing state", gha, "", cookie, "missing state"},
+		{"missing cookie", gha, state, nil, "missing state cookie"},
+		{"malformed cookie", gha, state, withValue(state), "malformed state cookie"},
+		{"malformed expiry", gha, state, withValue(state + ".x." + parts[2]), "malformed state cookie"},
+		{"bad signature", gha, state, withValue(parts[0] + "." + parts[1] + ".AAAA"), "invalid state cookie signature"},
+		{"other secret", otherSecret, state, cookie, "invalid state cookie signature"},
+		{"forged state", gha, "forged", withValue("forged." + parts[1] + "." + parts[2]), "invalid state cookie signature"},
+		{"extended expiry", gha, state, withValue(fmt.Sprintf("%s.%d.%s", parts[0], time.Now().Add(time.Hour).Unix(), parts[2])),
+			"invalid state cookie signature"},
+		{"expired", gha, state, withValue(fmt.Sprintf("%s.%d.%s", state, expired, gha.signState(state, expired))), "state expired"},
+		{"state mismatch", gha, "other", cookie, "state mismatch"},
+	} {
+		if _, err := check(c.gha, c.state, c.cookie); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
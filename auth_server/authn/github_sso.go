@@ -0,0 +1,80 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Set by GitHub when SAML single sign-on of an organization gets in the way of a request, see
+// https://docs.github.com/en/rest/overview/other-authentication-methods#authenticating-for-saml-sso
+const gitHubSSOHeader = "X-GitHub-SSO"
+
+// GitHubSSOError is returned when an organization enforces SAML single sign-on and the user's token
+// has not been authorized for it.
+type GitHubSSOError struct {
+	Organization string
+	// Where the user can authorize the token, if GitHub told.
+	URL string
+}
+
+func (e *GitHubSSOError) Error() string {
+	msg := "the GitHub token is not authorized for SAML single sign-on"
+	if e.Organization != "" {
+		msg += " of organization " + e.Organization
+	}
+	if e.URL != "" {
+		return msg + ", authorize it at " + e.URL
+	}
+	return msg + ", authorize it in the GitHub settings"
+}
+
+// checkGitHubSSO returns a GitHubSSOError if GitHub refused the request because of SAML single sign-on.
+func checkGitHubSSO(resp *http.Response, org string) error {
+	h := resp.Header.Get(gitHubSSOHeader)
+	if resp.StatusCode != http.StatusForbidden || !strings.HasPrefix(h, "required") {
+		return nil
+	}
+	e := &GitHubSSOError{Organization: org}
+	for _, p := range strings.Split(h, ";") {
+		if p = strings.TrimSpace(p); strings.HasPrefix(p, "url=") {
+			e.URL = strings.TrimPrefix(p, "url=")
+		}
+	}
+	return e
+}
+
+// warnGitHubSSOPartialResults logs that a list is missing the items of organizations for which
+// the token is not authorized.
+func warnGitHubSSOPartialResults(ctx context.Context, resp *http.Response, what string) {
+	h := resp.Header.Get(gitHubSSOHeader)
+	if !strings.HasPrefix(h, "partial-results") {
+		return
+	}
+	orgs := h
+	if i := strings.Index(h, "organizations="); i >= 0 {
+		orgs = "with IDs " + h[i+len("organizations="):]
+	}
+	glog.Warningf("%s%s of organizations %s are missing, the token is not authorized for their SAML single sign-on",
+		api.LogPrefix(ctx), what, orgs)
+}
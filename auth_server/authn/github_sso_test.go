@@ -0,0 +1,68 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckGitHubSSO(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		header string
+		err    string
+	}{
+		{http.StatusOK, "", ""},
+		{http.StatusForbidden, "", ""},
+		// Only lists are partial, they are not an error.
+		{http.StatusOK, "partial-results; organizations=21955855,20582480", ""},
+		{http.StatusForbidden, "required; url=https://github.com/orgs/acme/sso?authorization_request=x",
+			"the GitHub token is not authorized for SAML single sign-on of organization acme, authorize it at https://github.com/orgs/acme/sso?authorization_request=x"},
+		{http.StatusForbidden, "required",
+			"the GitHub token is not authorized for SAML single sign-on of organization acme, authorize it in the GitHub settings"},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set(gitHubSSOHeader, tc.header)
+		}
+		err := checkGitHubSSO(resp, "acme")
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("%d %q: got %v, want %q", tc.status, tc.header, err, tc.err)
+		}
+	}
+	if err := (&GitHubSSOError{}).Error(); err != "the GitHub token is not authorized for SAML single sign-on, authorize it in the GitHub settings" {
+		t.Errorf("unexpected error without an organization: %s", err)
+	}
+}
+
+func TestGitHubSSOSignIn(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("t1", "alice", "acme")
+	gh.addCode("c1", "t1")
+	gh.sso["acme"] = "https://github.com/orgs/acme/sso"
+	// The user is not a member of the first organization, what they have to do about the second one is reported.
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organizations: []string{"other", "acme"}})
+	rw := signInGitHub(t, gha, "c1")
+	if rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "authorize it at https://github.com/orgs/acme/sso") {
+		t.Errorf("expected the SSO authorization URL, got %d %s", rw.Code, rw.Body)
+	}
+	if v, err := gha.db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("expected no token to be stored, got %+v %v", v, err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"sync"
+	"time"
+)
+
+// githubTeamCache remembers the teams of users for a while, to avoid paginating through
+// GitHub's team lists on every sign-in and token revalidation.
+type githubTeamCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]githubTeamCacheEntry
+}
+
+type githubTeamCacheEntry struct {
+	teams   []string
+	expires time.Time
+}
+
+func newGitHubTeamCache(ttl time.Duration) *githubTeamCache {
+	return &githubTeamCache{ttl: ttl, entries: make(map[string]githubTeamCacheEntry)}
+}
+
+// get returns the cached teams of the user, if they are still fresh.
+// A nil cache never has anything.
+func (tc *githubTeamCache) get(user string) ([]string, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	e, ok := tc.entries[user]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(tc.entries, user)
+		return nil, false
+	}
+	return e.teams, true
+}
+
+func (tc *githubTeamCache) set(user string, teams []string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entries[user] = githubTeamCacheEntry{teams: teams, expires: time.Now().Add(tc.ttl)}
+}
+
+func (tc *githubTeamCache) invalidate(user string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.entries, user)
+}
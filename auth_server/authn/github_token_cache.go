@@ -0,0 +1,89 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// githubTokenCache remembers for a while which user an access token that passed validation
+// belongs to, so that bursts of registry requests (e.g. a push of many layers) do not each
+// ask GitHub. Tokens are kept hashed.
+type githubTokenCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]githubTokenCacheEntry
+}
+
+type githubTokenCacheEntry struct {
+	user    string
+	expires time.Time
+}
+
+func newGitHubTokenCache(ttl time.Duration) *githubTokenCache {
+	return &githubTokenCache{ttl: ttl, entries: make(map[[sha256.Size]byte]githubTokenCacheEntry)}
+}
+
+// get returns the user of the token, if it was validated recently enough.
+// A nil cache never has anything.
+func (tc *githubTokenCache) get(token string) (string, bool) {
+	if tc == nil {
+		return "", false
+	}
+	key := sha256.Sum256([]byte(token))
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	e, ok := tc.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.expires) {
+		delete(tc.entries, key)
+		return "", false
+	}
+	return e.user, true
+}
+
+func (tc *githubTokenCache) set(token, user string) {
+	if tc == nil {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	// Tokens of users who went away would otherwise stay forever.
+	for k, e := range tc.entries {
+		if now.After(e.expires) {
+			delete(tc.entries, k)
+		}
+	}
+	tc.entries[key] = githubTokenCacheEntry{user: user, expires: now.Add(tc.ttl)}
+}
+
+func (tc *githubTokenCache) invalidate(token string) {
+	if tc == nil {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.entries, key)
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGitHubTokenCache(t *testing.T) {
+	tc := newGitHubTokenCache(time.Hour)
+	if _, ok := tc.get("t1"); ok {
+		t.Errorf("expected an empty cache")
+	}
+	tc.set("t1", "alice")
+	if user, ok := tc.get("t1"); !ok || user != "alice" {
+		t.Errorf("got %q, %t", user, ok)
+	}
+	tc.invalidate("t1")
+	if _, ok := tc.get("t1"); ok {
+		t.Errorf("expected an invalidated token to be gone")
+	}
+
+	// Expired entries are dropped when looked up, or when others are added.
+	tc = newGitHubTokenCache(-time.Minute)
+	tc.set("t1", "alice")
+	if _, ok := tc.get("t1"); ok || len(tc.entries) != 0 {
+		t.Errorf("expected an expired token to be dropped, got %d entries", len(tc.entries))
+	}
+	tc.set("t2", "bob")
+	tc.set("t3", "carol")
+	if len(tc.entries) != 1 {
+		t.Errorf("expected expired entries to be dropped, got %d", len(tc.entries))
+	}
+
+	// Tokens are not kept in the clear.
+	tc = newGitHubTokenCache(time.Hour)
+	tc.set("secret-token", "alice")
+	for k := range tc.entries {
+		if string(k[:len("secret-token")]) == "secret-token" {
+			t.Errorf("expected the token to be hashed")
+		}
+	}
+
+	var none *githubTokenCache
+	none.set("t1", "alice")
+	none.invalidate("t1")
+	if _, ok := none.get("t1"); ok {
+		t.Errorf("expected a nil cache to have nothing")
+	}
+}
+
+func TestGitHubTokenCacheTTL(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{TokenCacheTTL: time.Hour, RevalidateAfter: time.Minute})
+	if gha.tokenCache.ttl != time.Minute {
+		t.Errorf("expected the TTL to be capped at revalidate_after, got %s", gha.tokenCache.ttl)
+	}
+	gha = newTestGitHubAuth(t, gh, &GitHubAuthConfig{})
+	if gha.tokenCache != nil {
+		t.Errorf("expected no cache by default")
+	}
+}
+
+func TestGitHubTokenCacheValidations(t *testing.T) {
+	gh := newFakeGitHub(t)
+	gh.addUser("ghp_alice", "alice", "acme")
+	gha := newTestGitHubAuth(t, gh, &GitHubAuthConfig{Organization: "acme", PersonalAccessTokens: true, TokenCacheTTL: time.Hour})
+	before := gh.requestCount("/user")
+	for i := 0; i < 3; i++ {
+		if ok, _, err := gha.Authenticate("alice", "ghp_alice"); !ok || err != nil {
+			t.Fatalf("Authenticate: %t %v", ok, err)
+		}
+	}
+	if n := gh.requestCount("/user") - before; n != 1 {
+		t.Errorf("expected the token to be validated once, got %d requests", n)
+	}
+	if n := gh.requestCount("/orgs/acme/members/alice"); n != 1 {
+		t.Errorf("expected the membership to be checked once, got %d requests", n)
+	}
+
+	// Failed validations are not cached.
+	before = gh.requestCount("/user")
+	for i := 0; i < 2; i++ {
+		if ok, _, err := gha.Authenticate("alice", "ghp_unknown"); ok || err != nil {
+			t.Errorf("expected an unknown token to be rejected, got %t %v", ok, err)
+		}
+	}
+	if n := gh.requestCount("/user") - before; n != 2 {
+		t.Errorf("expected failed validations to be repeated, got %d requests", n)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+var (
+	githubAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_auth_github_api_requests_total",
+		Help: "Requests made to the GitHub API, by response status code.",
+	}, []string{"code"})
+	githubAPIRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "docker_auth_github_api_rate_limited_total",
+		Help: "GitHub API responses indicating that the rate limit was exceeded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(githubAPIRequests, githubAPIRateLimited)
+}
+
+// githubTransport counts requests to GitHub and rate limit responses.
+// It also traces the requests and propagates the trace context to GitHub.
+// Rate limited requests are retried, waiting as long as GitHub asks or backing off exponentially,
+// up to maxAttempts attempts and waiting no more than maxDelay at a time.
+type githubTransport struct {
+	base        http.RoundTripper
+	maxAttempts int
+	maxDelay    time.Duration
+}
+
+func newGitHubTransport(c *GitHubAuthConfig) *githubTransport {
+	// The default transport already honours HTTP(S)_PROXY and NO_PROXY.
+	base := http.DefaultTransport
+	if c.HTTPProxy != "" || len(c.NoProxy) > 0 {
+		pc := httpproxy.FromEnvironment()
+		if c.HTTPProxy != "" {
+			pc.HTTPProxy, pc.HTTPSProxy = c.HTTPProxy, c.HTTPProxy
+		}
+		if len(c.NoProxy) > 0 {
+			pc.NoProxy = strings.Join(c.NoProxy, ",")
+		}
+		proxy := pc.ProxyFunc()
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		}
+		base = tr
+	}
+	return &githubTransport{
+		base:        base,
+		maxAttempts: c.RateLimitMaxAttempts,
+		maxDelay:    c.RateLimitMaxDelay,
+	}
+}
+
+func (t *githubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.roundTrip(req)
+		if err != nil || !isRateLimited(resp) {
+			return resp, err
+		}
+		githubAPIRateLimited.Inc()
+		delay, reset := t.retryDelay(resp, attempt)
+		// Requests with a body can only be retried if the body can be recreated.
+		if attempt >= t.maxAttempts || delay > t.maxDelay || (req.Body != nil && req.GetBody == nil) {
+			resp.Body.Close()
+			if !reset.IsZero() {
+				return nil, fmt.Errorf("GitHub API rate limit exceeded, try again after %s", reset.Format(time.RFC3339))
+			}
+			return nil, fmt.Errorf("GitHub API rate limit exceeded, gave up after %d attempt(s)", attempt)
+		}
+		resp.Body.Close()
+		glog.Warningf("%sGitHub API: rate limited on %s, retrying in %s", api.LogPrefix(req.Context()), req.URL.Path, delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func (t *githubTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "GitHub "+req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPURLKey.String(req.URL.String())))
+	defer span.End()
+	// RoundTrippers must not modify the request.
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		githubAPIRequests.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	glog.V(2).Infof("%sGitHub API: %s %s -> %d", api.LogPrefix(ctx), req.Method, req.URL.Path, resp.StatusCode)
+	githubAPIRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// isRateLimited tells primary and secondary rate limit responses apart from other errors, see
+// https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api#exceeding-the-rate-limit
+func isRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		return resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before retrying a rate limited request and, if GitHub said so,
+// when the limit resets. Without guidance from GitHub, the delay doubles with every attempt.
+func (t *githubTransport) retryDelay(resp *http.Response, attempt int) (time.Duration, time.Time) {
+	now := time.Now()
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		d := time.Duration(s) * time.Second
+		return d, now.Add(d)
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if s, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			reset := time.Unix(s, 0)
+			return reset.Sub(now), reset
+		}
+	}
+	d := time.Second << uint(attempt-1)
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+	return d, time.Time{}
+}
+
+// newGitHubClient returns an HTTP client for talking to GitHub through t.
+func newGitHubClient(timeout time.Duration, t *githubTransport) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: t,
+	}
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a global tracer provider that records spans. The provider can only be
+// set once for the package tracer, so all tests share the recorder.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spanRecorder
+}
+
+func TestGitHubTransportTracing(t *testing.T) {
+	sr := recordSpans()
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "test")
+	client := newGitHubClient(time.Second, newGitHubTransport(&GitHubAuthConfig{}))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/user", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	var span sdktrace.ReadOnlySpan
+	for _, s := range sr.Ended() {
+		if s.Name() == "GitHub GET /user" {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatalf("expected a span for the request, got %v", sr.Ended())
+	}
+	traceID := parent.SpanContext().TraceID()
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() || span.SpanContext().TraceID() != traceID {
+		t.Errorf("expected the span to be a child of the request span")
+	}
+	expected := "00-" + traceID.String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if traceparent != expected {
+		t.Errorf("expected the trace context to be propagated as %q, got %q", expected, traceparent)
+	}
+	found := false
+	for _, a := range span.Attributes() {
+		if a.Key == "http.status_code" && a.Value.AsInt64() == http.StatusNotFound {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the status code to be recorded, got %v", span.Attributes())
+	}
+}
+
+// rateLimitedServer answers the first limited requests with the given status and headers, then with 200.
+func rateLimitedServer(t *testing.T, limited int, status int, header http.Header) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		n := len(bodies)
+		mu.Unlock()
+		if n <= limited {
+			for k, v := range header {
+				rw.Header()[k] = v
+			}
+			rw.WriteHeader(status)
+			return
+		}
+		rw.Write([]byte("ok"))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &bodies
+}
+
+func TestGitHubTransportRateLimitRetry(t *testing.T) {
+	client := newGitHubClient(5*time.Second, newGitHubTransport(&GitHubAuthConfig{
+		RateLimitMaxAttempts: 3,
+		RateLimitMaxDelay:    time.Second,
+	}))
+	for _, c := range []struct {
+		name   string
+		status int
+		header http.Header
+	}{
+		{"too many requests", http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}}},
+		{"secondary rate limit", http.StatusForbidden, http.Header{"Retry-After": {"0"}}},
+		{"primary rate limit", http.StatusForbidden, http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {fmt.Sprint(time.Now().Unix())},
+		}},
+	} {
+		ts, bodies := rateLimitedServer(t, 2, c.status, c.header)
+		resp, err := client.Post(ts.URL, "text/plain", bytes.NewBufferString("body"))
+		if err != nil {
+			t.Errorf("%s: expected the request to be retried, got %s", c.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(*bodies) != 3 {
+			t.Errorf("%s: expected success on the third attempt, got %d after %d", c.name, resp.StatusCode, len(*bodies))
+		}
+		for _, b := range *bodies {
+			if b != "body" {
+				t.Errorf("%s: expected the body to be sent with every attempt, got %q", c.name, *bodies)
+				break
+			}
+		}
+	}
+
+	// Other errors are returned as they are.
+	ts, bodies := rateLimitedServer(t, 1, http.StatusForbidden, nil)
+	resp, err := client.Get(ts.URL)
+	if err != nil || resp.StatusCode != http.StatusForbidden || len(*bodies) != 1 {
+		t.Errorf("expected a plain 403 not to be retried, got %v %v after %d", resp, err, len(*bodies))
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestGitHubTransportRateLimitGiveUp(t *testing.T) {
+	client := newGitHubClient(5*time.Second, newGitHubTransport(&GitHubAuthConfig{
+		RateLimitMaxAttempts: 3,
+		RateLimitMaxDelay:    10 * time.Millisecond,
+	}))
+	// Without guidance from GitHub the transport backs off up to the max delay.
+	ts, bodies := rateLimitedServer(t, 10, http.StatusTooManyRequests, nil)
+	_, err := client.Get(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "GitHub API rate limit exceeded, gave up after 3 attempt(s)") || len(*bodies) != 3 {
+		t.Errorf("expected to give up after 3 attempts, got %v after %d", err, len(*bodies))
+	}
+
+	// Waits longer than the max delay are not waited out.
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	ts, bodies = rateLimitedServer(t, 10, http.StatusForbidden, http.Header{
+		"X-Ratelimit-Remaining": {"0"},
+		"X-Ratelimit-Reset":     {fmt.Sprint(reset.Unix())},
+	})
+	_, err = client.Get(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "try again after "+reset.Format(time.RFC3339)) || len(*bodies) != 1 {
+		t.Errorf("expected to fail right away with the reset time, got %v after %d", err, len(*bodies))
+	}
+
+	// Bodies that cannot be sent again are not retried.
+	ts, bodies = rateLimitedServer(t, 10, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, ioutil.NopCloser(strings.NewReader("body")))
+	if _, err := client.Do(req); err == nil || len(*bodies) != 1 {
+		t.Errorf("expected a request with a one-off body not to be retried, got %v after %d", err, len(*bodies))
+	}
+
+	// Cancelling the request stops the wait.
+	client = newGitHubClient(5*time.Second, newGitHubTransport(&GitHubAuthConfig{
+		RateLimitMaxAttempts: 3,
+		RateLimitMaxDelay:    time.Minute,
+	}))
+	ts, _ = rateLimitedServer(t, 10, http.StatusTooManyRequests, http.Header{"Retry-After": {"30"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	start := time.Now()
+	if _, err := client.Do(req); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the wait to end with the request, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestGitHubTransportProxy(t *testing.T) {
+	for _, v := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		t.Setenv(v, "")
+	}
+	var proxied []string
+	var mu sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, req.URL.String())
+		mu.Unlock()
+		rw.Write([]byte(`{"login": "alice"}`))
+	}))
+	defer proxy.Close()
+
+	tr := newGitHubTransport(&GitHubAuthConfig{HTTPProxy: proxy.URL})
+	resp, err := newGitHubClient(time.Second, tr).Get("http://github.example.com/user")
+	if err != nil {
+		t.Fatalf("expected the request to go through the proxy, got %s", err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != "http://github.example.com/user" {
+		t.Errorf("expected the proxy to be asked for the GitHub URL, got %v", proxied)
+	}
+
+	proxyFor := func(tr *githubTransport, target string) string {
+		base, ok := tr.base.(*http.Transport)
+		if !ok || base.Proxy == nil {
+			t.Fatalf("expected an HTTP transport with a proxy function, got %T", tr.base)
+		}
+		u, err := base.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: target}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+	tr = newGitHubTransport(&GitHubAuthConfig{HTTPProxy: proxy.URL, NoProxy: []string{"github.example.com", ".corp.example.com"}})
+	for target, expected := range map[string]string{
+		"api.github.com":        proxy.URL,
+		"github.example.com":    "",
+		"ghe.corp.example.com":  "",
+		"github.example.com.au": proxy.URL,
+	} {
+		if got := proxyFor(tr, target); got != expected {
+			t.Errorf("%s: expected proxy %q, got %q", target, expected, got)
+		}
+	}
+
+	// Without settings, the environment is used as usual.
+	if tr := newGitHubTransport(&GitHubAuthConfig{}); tr.base != http.DefaultTransport {
+		t.Errorf("expected the default transport, got %v", tr.base)
+	}
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.example.com:3128")
+	tr = newGitHubTransport(&GitHubAuthConfig{NoProxy: []string{"github.example.com"}})
+	if got := proxyFor(tr, "api.github.com"); got != "http://env-proxy.example.com:3128" {
+		t.Errorf("expected HTTPS_PROXY to be used, got %q", got)
+	}
+	if got := proxyFor(tr, "github.example.com"); got != "" {
+		t.Errorf("expected no_proxy to be honoured, got %q", got)
+	}
+}
@@ -93,6 +93,10 @@ type GitlabGCSStoreConfig struct {
 type GitlabRedisStoreConfig struct {
 	ClientOptions  *redis.Options        `mapstructure:"redis_options,omitempty"`
 	ClusterOptions *redis.ClusterOptions `mapstructure:"redis_cluster_options,omitempty"`
+	// Connection pool settings, applied to either of the above.
+	Pool *RedisPoolConfig `mapstructure:"pool,omitempty"`
+	// How often to ping Redis, reconnecting if it fails. Default is 30s.
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval,omitempty"`
 }
 
 type GitlabAuthRequest struct {
@@ -373,6 +377,14 @@ func (glab *GitlabAuth) Authenticate(user string, password api.PasswordString) (
 	return true, v.Labels, nil
 }
 
+// CheckHealth checks the token DB, if it has a remote backend.
+func (glab *GitlabAuth) CheckHealth() error {
+	if hc, ok := glab.db.(api.HealthChecker); ok {
+		return hc.CheckHealth()
+	}
+	return nil
+}
+
 func (glab *GitlabAuth) Stop() {
 	glab.db.Close()
 	glog.Info("Token DB closed")
@@ -94,6 +94,8 @@ type CodeToTokenResponse struct {
 	RefreshToken string `json:"refresh_token,omitempty"`
 	ExpiresIn    int64  `json:"expires_in,omitempty"`
 	TokenType    string `json:"token_type,omitempty"`
+	// Granted scopes, comma-separated (GitHub) or space-separated (Google).
+	Scope string `json:"scope,omitempty"`
 
 	// Returned in case of error.
 	Error            string `json:"error,omitempty"`
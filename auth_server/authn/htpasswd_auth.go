@@ -0,0 +1,304 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	fsnotify "gopkg.in/fsnotify.v1"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type HtpasswdAuthConfig struct {
+	// An Apache htpasswd file with bcrypt or MD5-crypt ($apr1$) entries.
+	File string `mapstructure:"file,omitempty"`
+	// Optional YAML file mapping user names to labels.
+	LabelsFile string `mapstructure:"labels_file,omitempty"`
+}
+
+func (c *HtpasswdAuthConfig) Validate(configKey string) error {
+	if c.File == "" {
+		return fmt.Errorf("%s.file is required", configKey)
+	}
+	if _, _, err := c.read(); err != nil {
+		return fmt.Errorf("%s: %s", configKey, err)
+	}
+	return nil
+}
+
+type htpasswdData struct {
+	hashes map[string]string
+	labels map[string]api.Labels
+}
+
+// read reads and parses the htpasswd and labels files, returning their contents as well.
+func (c *HtpasswdAuthConfig) read() (*htpasswdData, [][]byte, error) {
+	data, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes, err := parseHtpasswd(c.File, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	hd := &htpasswdData{hashes: hashes}
+	contents := [][]byte{data}
+	if c.LabelsFile != "" {
+		ldata, err := ioutil.ReadFile(c.LabelsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := yaml.UnmarshalStrict(ldata, &hd.labels); err != nil {
+			return nil, nil, fmt.Errorf("could not parse %s: %s", c.LabelsFile, err)
+		}
+		contents = append(contents, ldata)
+	}
+	return hd, contents, nil
+}
+
+func parseHtpasswd(file string, data []byte) (map[string]string, error) {
+	hashes := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		user, hash := parts[0], parts[1]
+		if !isBcryptHash(hash) && !isMD5CryptHash(hash) {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s, only bcrypt and MD5 (htpasswd -B or -m) are supported", file, n, user)
+		}
+		hashes[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", file, err)
+	}
+	return hashes, nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func isMD5CryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$")
+}
+
+type htpasswdAuth struct {
+	config  *HtpasswdAuthConfig
+	mu      sync.RWMutex
+	data    *htpasswdData
+	watcher *fsnotify.Watcher
+}
+
+// NewHtpasswdAuth creates an authenticator for the users in an htpasswd file. The file, and the labels file
+// if there is one, are watched and reloaded when they change; if they cannot be read or parsed, the previous
+// set of users remains in effect.
+func NewHtpasswdAuth(c *HtpasswdAuthConfig) (*htpasswdAuth, error) {
+	data, contents, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	ha := &htpasswdAuth{config: c, data: data}
+	ha.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher for %s: %s", c.File, err)
+	}
+	// Watch the directories rather than the files, so that replacing them is noticed too.
+	for _, file := range []string{c.File, c.LabelsFile} {
+		if file == "" {
+			continue
+		}
+		if err := ha.watcher.Add(filepath.Dir(file)); err != nil {
+			ha.watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %s", file, err)
+		}
+	}
+	go ha.watch(contents)
+	return ha, nil
+}
+
+func (ha *htpasswdAuth) watch(loaded [][]byte) {
+	var reload <-chan time.Time
+	for {
+		select {
+		case _, ok := <-ha.watcher.Events:
+			if !ok {
+				return
+			}
+			reload = time.After(usersFileReloadDelay)
+		case err, ok := <-ha.watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("Error watching %s: %s", ha.config.File, err)
+		case <-reload:
+			reload = nil
+			data, contents, err := ha.config.read()
+			if err != nil {
+				glog.Errorf("Failed to reload htpasswd users, keeping the previous ones: %s", err)
+				continue
+			}
+			if equalContents(contents, loaded) {
+				continue
+			}
+			ha.mu.Lock()
+			ha.data = data
+			ha.mu.Unlock()
+			loaded = contents
+			glog.Infof("Reloaded %d users from %s", len(data.hashes), ha.config.File)
+		}
+	}
+}
+
+func equalContents(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ha *htpasswdAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	ha.mu.RLock()
+	hash, found := ha.data.hashes[user]
+	labels := ha.data.labels[user]
+	ha.mu.RUnlock()
+	if !found {
+		return false, nil, api.NoMatch
+	}
+	var ok bool
+	var err error
+	if isMD5CryptHash(hash) {
+		ok, err = checkMD5CryptHash(hash, []byte(password))
+	} else {
+		ok, err = checkPasswordHash(hash, []byte(password))
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("bad password hash for %s: %s", user, err)
+	}
+	if !ok {
+		return false, nil, nil
+	}
+	return true, labels, nil
+}
+
+func (ha *htpasswdAuth) Stop() {
+	ha.watcher.Close()
+}
+
+func (ha *htpasswdAuth) Name() string {
+	return "htpasswd"
+}
+
+const md5CryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// checkMD5CryptHash checks a hash in the MD5-crypt format, $1$<salt>$<hash>, or its Apache variant
+// $apr1$<salt>$<hash>, which only differs in the magic string.
+func checkMD5CryptHash(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || len(parts[2]) > 8 {
+		return false, fmt.Errorf("malformed MD5-crypt hash")
+	}
+	magic, salt := []byte("$"+parts[1]+"$"), []byte(parts[2])
+	computed := md5Crypt(password, salt, magic)
+	return subtle.ConstantTimeCompare(computed, []byte(parts[3])) == 1, nil
+}
+
+// md5Crypt implements the algorithm of FreeBSD's crypt_md5, returning the encoded hash without the magic and salt.
+func md5Crypt(password, salt, magic []byte) []byte {
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(password)
+	d.Write(magic)
+	d.Write(salt)
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(altSum)
+		} else {
+			d.Write(altSum[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(password[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	// Stretching, to slow down brute force attacks.
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(password)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write(salt)
+		}
+		if i%7 != 0 {
+			d.Write(password)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(password)
+		}
+		sum = d.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, md5CryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return out
+}
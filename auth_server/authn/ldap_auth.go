@@ -45,6 +45,24 @@ type LDAPAuthConfig struct {
 	BindPasswordFile      string              `mapstructure:"bind_password_file,omitempty"`
 	LabelMaps             map[string]LabelMap `mapstructure:"labels,omitempty"`
 	InitialBindAsUser     bool                `mapstructure:"initial_bind_as_user,omitempty"`
+	GroupSearch           *LDAPGroupSearch    `mapstructure:"group_search,omitempty"`
+}
+
+// LDAPGroupSearch looks up the groups of a user, for directories that do not have memberOf
+// or where it does not list nested groups.
+type LDAPGroupSearch struct {
+	// Defaults to the base of the user search.
+	Base string `mapstructure:"base,omitempty"`
+	// ${dn} is expanded to the user's DN, ${account} to the account. Default is (member=${dn}).
+	Filter string `mapstructure:"filter,omitempty"`
+	// The attribute of the group entries to use as the label value, default is cn.
+	Attribute string `mapstructure:"attribute,omitempty"`
+	// The label to add the groups to, default is groups.
+	Label string `mapstructure:"label,omitempty"`
+	// Also add the groups that the groups are members of, with ${dn} expanded to theirs.
+	Nested bool `mapstructure:"nested,omitempty"`
+	// How many levels of nested groups to follow, default is 10.
+	MaxDepth int `mapstructure:"max_depth,omitempty"`
 }
 
 type LDAPAuth struct {
@@ -55,6 +73,26 @@ func NewLDAPAuth(c *LDAPAuthConfig) (*LDAPAuth, error) {
 	if c.TLS == "" && strings.HasSuffix(c.Addr, ":636") {
 		c.TLS = "always"
 	}
+	if gs := c.GroupSearch; gs != nil {
+		if gs.Base == "" {
+			gs.Base = c.Base
+		}
+		if gs.Filter == "" {
+			gs.Filter = "(member=${dn})"
+		}
+		if gs.Attribute == "" {
+			gs.Attribute = "cn"
+		}
+		if gs.Label == "" {
+			gs.Label = "groups"
+		}
+		if gs.MaxDepth == 0 {
+			gs.MaxDepth = 10
+		}
+		if _, err := ldap.CompileFilter(strings.NewReplacer("${dn}", "x", "${account}", "x").Replace(gs.Filter)); err != nil {
+			return nil, fmt.Errorf("bad ldap_auth.group_search.filter: %s", err)
+		}
+	}
 	return &LDAPAuth{
 		config: c,
 	}, nil
@@ -123,10 +161,63 @@ func (la *LDAPAuth) Authenticate(account string, password api.PasswordString) (b
 	if labelsExtractErr != nil {
 		return false, nil, labelsExtractErr
 	}
+	if la.config.GroupSearch != nil {
+		groups, err := la.searchGroups(l, account, accountEntryDN)
+		if err != nil {
+			return false, nil, fmt.Errorf("could not search groups of %s: %s", accountEntryDN, err)
+		}
+		labels[la.config.GroupSearch.Label] = append(labels[la.config.GroupSearch.Label], groups...)
+	}
 
 	return true, labels, nil
 }
 
+// searchGroups returns the groups that the user is a member of, including those it is a member of
+// through other groups if configured. Each level of nesting is one search for all groups found
+// at the previous one.
+func (la *LDAPAuth) searchGroups(l *ldap.Conn, account, userDN string) ([]string, error) {
+	gs := la.config.GroupSearch
+	var groups []string
+	seen := map[string]bool{userDN: true}
+	members := []string{userDN}
+	for depth := 0; len(members) > 0; depth++ {
+		if depth > 0 && (!gs.Nested || depth > gs.MaxDepth) {
+			break
+		}
+		filters := make([]string, len(members))
+		for i, dn := range members {
+			// account has been escaped already.
+			filters[i] = strings.NewReplacer("${dn}", ldap.EscapeFilter(dn), "${account}", account).Replace(gs.Filter)
+		}
+		filter := filters[0]
+		if len(filters) > 1 {
+			filter = "(|" + strings.Join(filters, "") + ")"
+		}
+		glog.V(2).Infof("Searching groups...baseDN:%s, filter:%s", gs.Base, filter)
+		sr, err := l.Search(ldap.NewSearchRequest(
+			gs.Base,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{gs.Attribute},
+			nil))
+		if err != nil {
+			return nil, err
+		}
+		members = nil
+		for _, entry := range sr.Entries {
+			// Membership loops are not unheard of.
+			if seen[entry.DN] {
+				continue
+			}
+			seen[entry.DN] = true
+			members = append(members, entry.DN)
+			groups = append(groups, entry.GetAttributeValues(gs.Attribute)...)
+		}
+	}
+	glog.V(2).Infof("Groups of %s: %v", userDN, groups)
+	return groups, nil
+}
+
 func (la *LDAPAuth) bindReadOnlyUser(l *ldap.Conn) error {
 	if la.config.BindDN != "" {
 		password, err := ioutil.ReadFile(la.config.BindPasswordFile)
@@ -321,6 +412,19 @@ func (la *LDAPAuth) getCNFromDN(dn string) string {
 	return dn
 }
 
+// CheckHealth connects to the LDAP server and binds as the read-only user, if configured.
+func (la *LDAPAuth) CheckHealth() error {
+	l, err := la.ldapConnection()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if !la.config.InitialBindAsUser {
+		return la.bindReadOnlyUser(l)
+	}
+	return nil
+}
+
 func (la *LDAPAuth) Stop() {
 }
 
@@ -0,0 +1,242 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeLDAP serves simple binds and searches of a fixed directory.
+type fakeLDAP struct {
+	addr string
+	// Attributes of entries by DN.
+	entries map[string]map[string][]string
+	// Passwords of the entries that can bind.
+	passwords map[string]string
+
+	mu sync.Mutex
+	// Filters of the searches, in order.
+	searches []string
+}
+
+func newFakeLDAP(t *testing.T, entries map[string]map[string][]string, passwords map[string]string) *fakeLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fl := &fakeLDAP{addr: l.Addr().String(), entries: entries, passwords: passwords}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fl.serve(c)
+		}
+	}()
+	return fl
+}
+
+func (fl *fakeLDAP) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, op := p.Children[0].Value.(int64), p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Value.(string), op.Children[2].Data.String()
+			code := ldap.LDAPResultSuccess
+			if pw, ok := fl.passwords[dn]; !ok || pw != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			c.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base, filter, attrs := op.Children[0].Value.(string), op.Children[6], op.Children[7]
+			f, _ := ldap.DecompileFilter(filter)
+			fl.mu.Lock()
+			fl.searches = append(fl.searches, f)
+			fl.mu.Unlock()
+			for dn, entry := range fl.entries {
+				if !strings.HasSuffix(dn, base) || !ldapMatch(filter, entry) {
+					continue
+				}
+				c.Write(ldapEntry(id, dn, entry, attrs).Bytes())
+			}
+			c.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func (fl *fakeLDAP) searchFilters() []string {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return append([]string{}, fl.searches...)
+}
+
+// ldapMatch evaluates the and, or and equality parts of search filters.
+func ldapMatch(f *ber.Packet, entry map[string][]string) bool {
+	switch f.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, c := range f.Children {
+			if ldapMatch(c, entry) == (f.Tag == ldap.FilterOr) {
+				return f.Tag == ldap.FilterOr
+			}
+		}
+		return f.Tag == ldap.FilterAnd
+	case ldap.FilterEqualityMatch:
+		for _, v := range entry[f.Children[0].Data.String()] {
+			if v == f.Children[1].Data.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapResponse(id int64, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return ldapMessage(id, op)
+}
+
+func ldapEntry(id int64, dn string, entry map[string][]string, attrs *ber.Packet) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, a := range attrs.Children {
+		name := a.Data.String()
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range entry[name] {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(values)
+		list.AppendChild(attr)
+	}
+	op.AppendChild(list)
+	return ldapMessage(id, op)
+}
+
+const (
+	testLDAPAlice = "uid=alice,ou=people,dc=example,dc=com"
+	testLDAPDev   = "cn=dev,ou=groups,dc=example,dc=com"
+	testLDAPEng   = "cn=eng,ou=groups,dc=example,dc=com"
+	testLDAPAll   = "cn=all,ou=groups,dc=example,dc=com"
+)
+
+func newTestLDAP(t *testing.T) *fakeLDAP {
+	return newFakeLDAP(t, map[string]map[string][]string{
+		testLDAPAlice: {"uid": {"alice"}},
+		testLDAPDev:   {"cn": {"dev"}, "member": {testLDAPAlice}},
+		testLDAPEng:   {"cn": {"eng"}, "member": {testLDAPDev, testLDAPAll}},
+		// Loops back to eng.
+		testLDAPAll:                            {"cn": {"all"}, "member": {testLDAPEng}},
+		"cn=posix,ou=groups,dc=example,dc=com": {"cn": {"posix"}, "memberUid": {"alice"}},
+	}, map[string]string{testLDAPAlice: "secret"})
+}
+
+func newTestLDAPAuth(t *testing.T, fl *fakeLDAP, gs *LDAPGroupSearch) *LDAPAuth {
+	la, err := NewLDAPAuth(&LDAPAuthConfig{
+		Addr:        fl.addr,
+		TLS:         "none",
+		Base:        "dc=example,dc=com",
+		Filter:      "(uid=${account})",
+		GroupSearch: gs,
+	})
+	if err != nil {
+		t.Fatalf("NewLDAPAuth: %s", err)
+	}
+	return la
+}
+
+func TestLDAPGroupSearchConfig(t *testing.T) {
+	gs := &LDAPGroupSearch{}
+	newTestLDAPAuth(t, &fakeLDAP{}, gs)
+	if !reflect.DeepEqual(gs, &LDAPGroupSearch{Base: "dc=example,dc=com", Filter: "(member=${dn})", Attribute: "cn", Label: "groups", MaxDepth: 10}) {
+		t.Errorf("unexpected defaults: %+v", gs)
+	}
+	c := &LDAPAuthConfig{GroupSearch: &LDAPGroupSearch{Filter: "(member=${dn}"}}
+	if _, err := NewLDAPAuth(c); err == nil || !strings.Contains(err.Error(), "group_search.filter") {
+		t.Errorf("expected a bad filter to be rejected, got %v", err)
+	}
+}
+
+func TestLDAPGroupSearch(t *testing.T) {
+	fl := newTestLDAP(t)
+	for _, tc := range []struct {
+		gs     LDAPGroupSearch
+		groups []string
+	}{
+		{LDAPGroupSearch{}, []string{"dev"}},
+		{LDAPGroupSearch{Nested: true}, []string{"dev", "eng", "all"}},
+		{LDAPGroupSearch{Nested: true, MaxDepth: 1}, []string{"dev", "eng"}},
+		{LDAPGroupSearch{Base: "ou=groups,dc=example,dc=com", Filter: "(memberUid=${account})", Label: "posix"}, []string{"posix"}},
+	} {
+		gs := tc.gs
+		la := newTestLDAPAuth(t, fl, &gs)
+		ok, labels, err := la.Authenticate("alice", "secret")
+		if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{gs.Label: tc.groups}) {
+			t.Errorf("%+v: got %t, %v, %v, want %q", tc.gs, ok, labels, err, tc.groups)
+		}
+	}
+	if ok, labels, err := newTestLDAPAuth(t, fl, &LDAPGroupSearch{}).Authenticate("alice", "wrong"); ok || labels != nil || err != nil {
+		t.Errorf("expected a wrong password to be rejected, got %t, %v, %v", ok, labels, err)
+	}
+}
+
+func TestLDAPGroupSearchFilters(t *testing.T) {
+	fl := newTestLDAP(t)
+	la := newTestLDAPAuth(t, fl, &LDAPGroupSearch{Nested: true})
+	if ok, _, err := la.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Fatalf("Authenticate: %t, %v", ok, err)
+	}
+	// The user, then one search per level of nesting, the last one finding only the loop.
+	if got := fl.searchFilters(); !reflect.DeepEqual(got, []string{
+		"(uid=alice)",
+		"(member=" + testLDAPAlice + ")",
+		"(member=" + testLDAPDev + ")",
+		"(member=" + testLDAPEng + ")",
+		"(member=" + testLDAPAll + ")",
+	}) {
+		t.Errorf("unexpected searches: %q", got)
+	}
+}
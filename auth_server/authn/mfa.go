@@ -0,0 +1,110 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// MFAConfig requires a second factor from users with certain labels, e.g. members of privileged
+// groups, whichever authenticator accepted them. Other users are unaffected.
+type MFAConfig struct {
+	// Users with any of these label values need a second factor, e.g. {"groups": ["admins"]}.
+	RequiredLabels map[string][]string `mapstructure:"required_labels,omitempty"`
+	// TOTP secrets of users of authenticators other than the static users, by account.
+	// Static users set totp_secret instead.
+	TOTPSecrets map[string]string `mapstructure:"totp_secrets,omitempty"`
+}
+
+// Validate checks the config.
+func (c *MFAConfig) Validate(configKey string) error {
+	if len(c.RequiredLabels) == 0 {
+		return fmt.Errorf("%s.required_labels is required", configKey)
+	}
+	for account, secret := range c.TOTPSecrets {
+		if _, err := decodeTOTPSecret(secret); err != nil {
+			return fmt.Errorf("%s.totp_secrets: %s: %s", configKey, account, err)
+		}
+	}
+	return nil
+}
+
+// MFA enforces a second factor for users with the labels of MFAConfig.
+type MFA struct {
+	config *MFAConfig
+	// Static users with a TOTP secret have already entered a code when they are authenticated.
+	staticUsers *staticUsersAuth
+}
+
+// NewMFA returns the enforcement for c. staticUsers is the static users authenticator, if configured.
+func NewMFA(c *MFAConfig, staticUsers *staticUsersAuth) *MFA {
+	return &MFA{config: c, staticUsers: staticUsers}
+}
+
+// SplitCode removes a TOTP code appended to the password, "password:123456", if the account
+// has a secret in totp_secrets. Otherwise the password is returned as it is, with no code.
+func (m *MFA) SplitCode(account string, password api.PasswordString) (api.PasswordString, string) {
+	if _, found := m.config.TOTPSecrets[account]; !found {
+		return password, ""
+	}
+	i := strings.LastIndex(string(password), ":")
+	if i < 0 || !isTOTPCode(string(password[i+1:])) {
+		return password, ""
+	}
+	return password[:i], string(password[i+1:])
+}
+
+// Required tells if the labels of an authenticated user call for a second factor.
+func (m *MFA) Required(labels api.Labels) bool {
+	for label, values := range m.config.RequiredLabels {
+		for _, want := range values {
+			for _, v := range labels[label] {
+				if v == want {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Check verifies the second factor of a user authenticated by a, given the code split off the password.
+// It returns api.NoTOTPCode or api.WrongTOTPCode if the user did not pass.
+func (m *MFA) Check(a api.Authenticator, account, code string) error {
+	if m.staticUsers != nil && a == api.Authenticator(m.staticUsers) {
+		if reqs := m.staticUsers.lookup(account); reqs != nil && reqs.TOTPSecret != "" {
+			// Checked by the static users authenticator.
+			return nil
+		}
+	}
+	secret, found := m.config.TOTPSecrets[account]
+	if !found || code == "" {
+		return api.NoTOTPCode
+	}
+	ok, err := checkTOTP(secret, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return api.WrongTOTPCode
+	}
+	return nil
+}
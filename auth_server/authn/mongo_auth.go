@@ -139,6 +139,13 @@ func (c *MongoAuthConfig) Validate(configKey string) error {
 	return nil
 }
 
+// CheckHealth pings the MongoDB server.
+func (mauth *MongoAuth) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return mauth.session.Ping(ctx, nil)
+}
+
 func (ma *MongoAuth) Stop() {
 
 }
@@ -18,6 +18,7 @@ package authn
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -53,6 +54,9 @@ type OIDCAuthConfig struct {
 	HTTPTimeout int `mapstructure:"http_timeout,omitempty"`
 	// the URL of the docker registry. Used to generate a full docker login command after authentication
 	RegistryURL string `mapstructure:"registry_url,omitempty"`
+	// Labels to set from claims of the ID token, e.g. {"groups": "realm_access.roles"}. Nested claims are
+	// addressed with dots, array claims give a label with several values.
+	LabelClaims map[string]string `mapstructure:"label_claims,omitempty"`
 }
 
 // OIDCRefreshTokenResponse is sent by OIDC provider in response to the grant_type=refresh_token request.
@@ -61,6 +65,8 @@ type OIDCRefreshTokenResponse struct {
 	ExpiresIn    int64  `json:"expires_in,omitempty"`
 	TokenType    string `json:"token_type,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	// Not all providers send a new ID token on refresh.
+	IDToken string `json:"id_token,omitempty"`
 
 	// Returned in case of error.
 	Error            string `json:"error,omitempty"`
@@ -132,9 +138,15 @@ requests an access token by using the code given by the OIDC provider.
 func (ga *OIDCAuth) DoOIDCAuth(rw http.ResponseWriter, req *http.Request) {
 	code := req.URL.Query().Get("code")
 	if code != "" {
-		ga.doOIDCAuthCreateToken(rw, code)
+		ar, err := oidcAuthRequestFromCallback(rw, req)
+		if err != nil {
+			glog.Warningf("OIDC auth callback rejected: %s", err)
+			http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+		ga.doOIDCAuthCreateToken(rw, code, ar)
 	} else if req.Method == "GET" {
-		ga.doOIDCAuthPage(rw)
+		ga.doOIDCAuthPage(rw, req)
 	} else {
 		http.Error(rw, "Invalid auth request", http.StatusBadRequest)
 	}
@@ -143,13 +155,19 @@ func (ga *OIDCAuth) DoOIDCAuth(rw http.ResponseWriter, req *http.Request) {
 /*
 Executes tmpl for the OIDC login page.
 */
-func (ga *OIDCAuth) doOIDCAuthPage(rw http.ResponseWriter) {
+func (ga *OIDCAuth) doOIDCAuthPage(rw http.ResponseWriter, req *http.Request) {
+	ar, err := newOIDCAuthRequest(rw, req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if err := ga.tmpl.Execute(rw, struct {
-		AuthEndpoint, RedirectURI, ClientId string
+		AuthURL string
 	}{
-		AuthEndpoint: ga.provider.Endpoint().AuthURL,
-		RedirectURI:  ga.oauth.RedirectURL,
-		ClientId:     ga.oauth.ClientID,
+		AuthURL: ga.oauth.AuthCodeURL(ar.State,
+			oauth2.SetAuthURLParam("code_challenge", ar.codeChallenge()),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+			oidc.Nonce(ar.Nonce)),
 	}); err != nil {
 		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
 	}
@@ -175,9 +193,15 @@ Requests an OIDC token by using the code that was provided by the OIDC provider.
 the access token and refresh token is used to create a new token for the users mail address, which is taken from the ID
 token.
 */
-func (ga *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, code string) {
+func (ga *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, code string, ar *oidcAuthRequest) {
 
-	tok, err := ga.oauth.Exchange(ga.ctx, code)
+	tok, err := ga.oauth.Exchange(ga.ctx, code, oauth2.SetAuthURLParam("code_verifier", ar.Verifier))
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) {
+		glog.Warningf("OIDC provider rejected the code: %s", err)
+		http.Error(rw, fmt.Sprintf("The OIDC provider rejected the code, e.g. because PKCE verification failed: %s", err), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Error talking to OIDC auth backend: %s", err), http.StatusInternalServerError)
 		return
@@ -192,6 +216,11 @@ func (ga *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, code string) {
 		http.Error(rw, fmt.Sprintf("Failed to verify ID token: %s", err), http.StatusInternalServerError)
 		return
 	}
+	if subtle.ConstantTimeCompare([]byte(idTok.Nonce), []byte(ar.Nonce)) != 1 {
+		glog.Warningf("OIDC ID token nonce mismatch")
+		http.Error(rw, "Bad request: nonce mismatch, the ID token was not issued for this sign-in", http.StatusBadRequest)
+		return
+	}
 	var prof OIDCProfileResponse
 	if err := idTok.Claims(&prof); err != nil {
 		http.Error(rw, fmt.Sprintf("Failed to get mail information from ID token: %s", err), http.StatusInternalServerError)
@@ -210,6 +239,10 @@ func (ga *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, code string) {
 		RefreshToken: tok.RefreshToken,
 		ValidUntil:   tok.Expiry.Add(time.Duration(-30) * time.Second),
 	}
+	if dbVal.Labels, err = ga.claimLabels(idTok); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get claims from ID token: %s", err), http.StatusInternalServerError)
+		return
+	}
 	dp, err := ga.db.StoreToken(prof.Email, dbVal, true)
 	if err != nil {
 		glog.Errorf("Failed to record server token: %s", err)
@@ -220,6 +253,48 @@ func (ga *OIDCAuth) doOIDCAuthCreateToken(rw http.ResponseWriter, code string) {
 	ga.doOIDCAuthResultPage(rw, prof.Email, dp)
 }
 
+// claimLabels returns the labels configured in label_claims. Claims that are missing or are objects are left out.
+func (ga *OIDCAuth) claimLabels(idTok *oidc.IDToken) (api.Labels, error) {
+	if len(ga.config.LabelClaims) == 0 {
+		return nil, nil
+	}
+	var claims map[string]interface{}
+	if err := idTok.Claims(&claims); err != nil {
+		return nil, err
+	}
+	labels := api.Labels{}
+	for label, path := range ga.config.LabelClaims {
+		if values := claimValues(claims, path); len(values) > 0 {
+			labels[label] = values
+		}
+	}
+	return labels, nil
+}
+
+// claimValues looks up a dot-separated claim path and returns its value as strings.
+func claimValues(claims map[string]interface{}, path string) []string {
+	var v interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	var values []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			values = append(values, claimValues(map[string]interface{}{"": e}, "")...)
+		}
+	case string:
+		values = []string{v}
+	case float64, bool:
+		values = []string{fmt.Sprint(v)}
+	}
+	return values
+}
+
 /*
 Refreshes the access token of the user. Not usable with all OIDC provider, since not all provide refresh tokens.
 */
@@ -280,6 +355,16 @@ func (ga *OIDCAuth) validateServerToken(user string) (*TokenDBValue, error) {
 	}
 	v.AccessToken = rtr.AccessToken
 	v.ValidUntil = time.Now().Add(time.Duration(rtr.ExpiresIn-30) * time.Second)
+	if rtr.IDToken != "" && len(ga.config.LabelClaims) > 0 {
+		// Pick up changes of group memberships and the like.
+		idTok, err := ga.verifier.Verify(ga.ctx, rtr.IDToken)
+		if err == nil {
+			v.Labels, err = ga.claimLabels(idTok)
+		}
+		if err != nil {
+			glog.Warningf("Failed to update labels of %q from the refreshed ID token, keeping them: %s", user, err)
+		}
+	}
 	glog.Infof("Refreshed auth token for %s (exp %d)", user, rtr.ExpiresIn)
 	_, err = ga.db.StoreToken(user, v, false)
 	if err != nil {
@@ -336,7 +421,14 @@ func (ga *OIDCAuth) Authenticate(user string, password api.PasswordString) (bool
 	} else if err != nil {
 		return false, nil, err
 	}
-	return true, nil, nil
+	v, err := ga.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign out and sign in again")
+		}
+		return false, nil, err
+	}
+	return true, v.Labels, nil
 }
 
 func (ga *OIDCAuth) Stop() {
@@ -0,0 +1,270 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeOIDCProvider issues ID tokens for codes whose PKCE verifier matches the challenge of the sign-in.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	// Nonce of the next ID token, left out if nil.
+	nonce *string
+	// Other claims of the next ID token.
+	claims map[string]interface{}
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"userinfo_endpoint":                     p.URL + "/userinfo",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, req *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+			"n": b64(key.PublicKey.N.Bytes()), "e": b64(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"sub": "1", "email": "alice@example.com"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) token(rw http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	// Refresh tokens are not checked, the code is bound to the challenge.
+	if req.PostFormValue("grant_type") != "refresh_token" &&
+		(&oidcAuthRequest{Verifier: req.PostFormValue("code_verifier")}).codeChallenge() != p.challenge {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"error": "invalid_grant", "error_description": "PKCE verification failed"}`))
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":   p.URL,
+		"aud":   "client",
+		"sub":   "1",
+		"email": "alice@example.com",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	if p.nonce != nil {
+		claims["nonce"] = *p.nonce
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k1","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, h[:])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken := signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"access_token":  "at",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": "rt",
+		"id_token":      idToken,
+	})
+}
+
+var authURLRegexp = regexp.MustCompile(`href="([^"]*/authorize[^"]*)"`)
+
+// startOIDCSignIn loads the sign-in page and returns the cookie it sets and the query of the link to the provider.
+func startOIDCSignIn(t *testing.T, ga *OIDCAuth) (*http.Cookie, url.Values) {
+	rw := httptest.NewRecorder()
+	ga.DoOIDCAuth(rw, httptest.NewRequest("GET", "/oidc_auth", nil))
+	m := authURLRegexp.FindStringSubmatch(rw.Body.String())
+	if m == nil {
+		t.Fatalf("no link to the provider in %s", rw.Body.String())
+	}
+	u, err := url.Parse(html.UnescapeString(m[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+	return cookies[0], u.Query()
+}
+
+func oidcCallback(ga *OIDCAuth, cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/oidc_auth?code=c&state="+url.QueryEscape(state), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rw := httptest.NewRecorder()
+	ga.DoOIDCAuth(rw, req)
+	return rw
+}
+
+func TestOIDCAuthCallback(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	ga, err := NewOIDCAuth(&OIDCAuthConfig{Issuer: p.URL, RedirectURL: "https://auth.example.com/oidc_auth",
+		ClientId: "client", ClientSecret: "secret", TokenDB: MemoryTokenDB})
+	if err != nil {
+		t.Fatalf("NewOIDCAuth: %s", err)
+	}
+
+	cases := []struct {
+		name string
+		// The nonce of the ID token and the challenge the provider expects (by default the one sent),
+		// given those sent by the sign-in page.
+		nonce     func(sent string) *string
+		challenge func(sent string) string
+		status    int
+		body      string
+	}{
+		{"ok", func(s string) *string { return &s }, nil, http.StatusOK, "alice@example.com"},
+		{"nonce mismatch", func(string) *string { n := "other"; return &n }, nil, http.StatusBadRequest, "nonce mismatch"},
+		{"missing nonce", func(string) *string { return nil }, nil, http.StatusBadRequest, "nonce mismatch"},
+		{"PKCE mismatch", func(s string) *string { return &s }, func(string) string { return "other" },
+			http.StatusBadRequest, "PKCE verification failed"},
+	}
+	for _, c := range cases {
+		cookie, q := startOIDCSignIn(t, ga)
+		if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || q.Get("state") == "" {
+			t.Fatalf("%s: unexpected authorization request %v", c.name, q)
+		}
+		p.mu.Lock()
+		p.nonce = c.nonce(q.Get("nonce"))
+		p.challenge = q.Get("code_challenge")
+		if c.challenge != nil {
+			p.challenge = c.challenge(p.challenge)
+		}
+		p.mu.Unlock()
+		rw := oidcCallback(ga, cookie, q.Get("state"))
+		if rw.Code != c.status || !strings.Contains(rw.Body.String(), c.body) {
+			t.Errorf("%s: got %d %s", c.name, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestOIDCClaimValues(t *testing.T) {
+	var claims map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"groups": ["dev", "ops"],
+		"realm_access": {"roles": ["admin", 1, true, {"name": "x"}]},
+		"org": "acme",
+		"level": 3,
+		"verified": false,
+		"address": {"country": "NL"}
+	}`), &claims)
+	for path, want := range map[string]string{
+		"groups":             "dev,ops",
+		"realm_access.roles": "admin,1,true",
+		"org":                "acme",
+		"level":              "3",
+		"verified":           "false",
+		"address.country":    "NL",
+		// Objects and missing claims give no values.
+		"address":         "",
+		"missing":         "",
+		"org.name":        "",
+		"realm_access.id": "",
+	} {
+		if got := strings.Join(claimValues(claims, path), ","); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestOIDCClaimLabels(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	ga, err := NewOIDCAuth(&OIDCAuthConfig{Issuer: p.URL, RedirectURL: "https://auth.example.com/oidc_auth",
+		ClientId: "client", ClientSecret: "secret", TokenDB: MemoryTokenDB,
+		LabelClaims: map[string]string{"groups": "groups", "roles": "realm_access.roles", "missing": "nope"}})
+	if err != nil {
+		t.Fatalf("NewOIDCAuth: %s", err)
+	}
+	cookie, q := startOIDCSignIn(t, ga)
+	p.mu.Lock()
+	nonce := q.Get("nonce")
+	p.nonce = &nonce
+	p.challenge = q.Get("code_challenge")
+	p.claims = map[string]interface{}{"groups": []string{"dev", "ops"}, "realm_access": map[string]interface{}{"roles": []string{"admin"}}}
+	p.mu.Unlock()
+	rw := oidcCallback(ga, cookie, q.Get("state"))
+	m := regexp.MustCompile(`docker login -u \S+ -p (\S+)`).FindStringSubmatch(rw.Body.String())
+	if rw.Code != http.StatusOK || m == nil {
+		t.Fatalf("expected the sign-in to succeed, got %d %s", rw.Code, rw.Body)
+	}
+	ok, labels, err := ga.Authenticate("alice@example.com", api.PasswordString(m[1]))
+	if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"groups": {"dev", "ops"}, "roles": {"admin"}}) {
+		t.Errorf("Authenticate: %t, %v, %v", ok, labels, err)
+	}
+
+	// Labels are updated from the ID token sent on refresh.
+	p.mu.Lock()
+	p.claims = map[string]interface{}{"groups": []string{"dev"}}
+	p.mu.Unlock()
+	v, _ := ga.db.GetValue("alice@example.com")
+	v.ValidUntil = time.Now().Add(-time.Minute)
+	ga.db.StoreToken("alice@example.com", v, false)
+	ok, labels, err = ga.Authenticate("alice@example.com", api.PasswordString(m[1]))
+	if !ok || err != nil || !reflect.DeepEqual(labels, api.Labels{"groups": {"dev"}}) {
+		t.Errorf("Authenticate after refresh: %t, %v, %v", ok, labels, err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	oidcStateCookie = "docker_auth_oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// oidcAuthRequest holds the secrets of a sign-in in progress, kept in a cookie between the sign-in page
+// and the callback. The state ties the callback to the browser that started the sign-in, the PKCE
+// verifier ties the code to it (RFC 7636) and the nonce ties the ID token to it.
+// Only the browser's own values are compared, so the cookie does not need to be signed.
+type oidcAuthRequest struct {
+	State, Verifier, Nonce string
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge returns the S256 PKCE challenge for the verifier.
+func (r *oidcAuthRequest) codeChallenge() string {
+	h := sha256.Sum256([]byte(r.Verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// newOIDCAuthRequest generates a sign-in request and sets the cookie that the callback reads it from.
+func newOIDCAuthRequest(rw http.ResponseWriter, req *http.Request) (*oidcAuthRequest, error) {
+	var r oidcAuthRequest
+	for _, v := range []*string{&r.State, &r.Verifier, &r.Nonce} {
+		var err error
+		if *v, err = randomString(); err != nil {
+			return nil, fmt.Errorf("failed to generate sign-in request: %s", err)
+		}
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    strings.Join([]string{r.State, r.Verifier, r.Nonce}, "."),
+		Path:     req.URL.Path,
+		MaxAge:   int(oidcStateTTL / time.Second),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		// Lax, so that the cookie is sent on the top-level redirect back from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return &r, nil
+}
+
+// oidcAuthRequestFromCallback returns the sign-in request that the callback completes, after checking
+// its state, and clears the cookie.
+func oidcAuthRequestFromCallback(rw http.ResponseWriter, req *http.Request) (*oidcAuthRequest, error) {
+	state := req.URL.Query().Get("state")
+	if state == "" {
+		return nil, errors.New("missing state")
+	}
+	c, err := req.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, errors.New("missing state cookie, sign-in must be started from the sign-in page and completed within 10 minutes")
+	}
+	http.SetCookie(rw, &http.Cookie{Name: oidcStateCookie, Path: req.URL.Path, MaxAge: -1})
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed state cookie")
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return nil, errors.New("state mismatch")
+	}
+	return &oidcAuthRequest{State: parts[0], Verifier: parts[1], Nonce: parts[2]}, nil
+}
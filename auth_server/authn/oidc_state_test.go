@@ -0,0 +1,71 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOIDCAuthRequestFromCallback(t *testing.T) {
+	rw := httptest.NewRecorder()
+	ar, err := newOIDCAuthRequest(rw, httptest.NewRequest("GET", "/oidc_auth", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := rw.Result().Cookies()[0]
+	if cookie.Value != ar.State+"."+ar.Verifier+"."+ar.Nonce || !cookie.HttpOnly || cookie.Path != "/oidc_auth" {
+		t.Errorf("unexpected cookie %+v", cookie)
+	}
+
+	callback := func(state string, c *http.Cookie) (*oidcAuthRequest, error) {
+		req := httptest.NewRequest("GET", "/oidc_auth?code=c&state="+url.QueryEscape(state), nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		return oidcAuthRequestFromCallback(httptest.NewRecorder(), req)
+	}
+	if got, err := callback(ar.State, cookie); err != nil || *got != *ar {
+		t.Errorf("got %+v, %v, want %+v", got, err, ar)
+	}
+	for _, c := range []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+		err    string
+	}{
+		{"missing state", "", cookie, "missing state"},
+		{"missing cookie", ar.State, nil, "missing state cookie"},
+		{"state mismatch", "other", cookie, "state mismatch"},
+		{"malformed cookie", ar.State, &http.Cookie{Name: oidcStateCookie, Value: ar.State + "." + ar.Verifier}, "malformed"},
+	} {
+		if _, err := callback(c.state, c.cookie); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestOIDCCodeChallenge(t *testing.T) {
+	// The example in appendix B of RFC 7636.
+	r := &oidcAuthRequest{Verifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+	if got, want := r.codeChallenge(), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+type PAMAuthConfig struct {
+	// Name of the PAM service, i.e. of the file in /etc/pam.d. Default is docker_auth.
+	Service string `mapstructure:"service,omitempty"`
+	// If set, the names of the system groups of the user are added to the labels under this name.
+	GroupLabel string `mapstructure:"group_label,omitempty"`
+}
+
+var (
+	// Set when built with the pam tag, see pam_auth_pam.go.
+	pamAuthenticate func(service, user, password string) error
+	// Returned by pamAuthenticate when the password is wrong or the account cannot be used.
+	errPAMDenied = errors.New("denied by PAM")
+)
+
+func (c *PAMAuthConfig) Validate(configKey string) error {
+	if pamAuthenticate == nil {
+		return fmt.Errorf("%s: auth_server is built without PAM support, rebuild it with -tags pam", configKey)
+	}
+	if c.Service == "" {
+		c.Service = "docker_auth"
+	}
+	return nil
+}
+
+type PAMAuth struct {
+	config *PAMAuthConfig
+}
+
+func NewPAMAuth(c *PAMAuthConfig) (*PAMAuth, error) {
+	if pamAuthenticate == nil {
+		return nil, errors.New("auth_server is built without PAM support")
+	}
+	return &PAMAuth{config: c}, nil
+}
+
+func (pa *PAMAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	if user == "" {
+		return false, nil, api.NoMatch
+	}
+	if password == "" {
+		return false, nil, nil
+	}
+	switch err := pamAuthenticate(pa.config.Service, user, string(password)); err {
+	case nil:
+	case api.NoMatch:
+		return false, nil, api.NoMatch
+	case errPAMDenied:
+		return false, nil, nil
+	default:
+		return false, nil, err
+	}
+	if pa.config.GroupLabel == "" {
+		return true, nil, nil
+	}
+	groups, err := userGroups(user)
+	if err != nil {
+		return false, nil, fmt.Errorf("could not get the groups of %s: %s", user, err)
+	}
+	return true, api.Labels{pa.config.GroupLabel: groups}, nil
+}
+
+// userGroups returns the names of the groups the system user is a member of,
+// or their IDs if they have no name.
+func userGroups(name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		if g, err := user.LookupGroupId(gid); err == nil {
+			groups = append(groups, g.Name)
+		} else {
+			groups = append(groups, gid)
+		}
+	}
+	return groups, nil
+}
+
+func (pa *PAMAuth) Stop() {
+}
+
+func (pa *PAMAuth) Name() string {
+	return "PAM"
+}
@@ -0,0 +1,105 @@
+//go:build pam
+// +build pam
+
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// conv answers the password prompt with the password passed as appdata_ptr. The user name is given
+// to pam_start, so a stack that checks passwords asks nothing else; other prompts fail the conversation.
+static int conv(int n, const struct pam_message **msg, struct pam_response **resp, void *appdata_ptr) {
+	struct pam_response *r;
+	int i;
+	if (n <= 0 || n > 32) return PAM_CONV_ERR;
+	r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) return PAM_BUF_ERR;
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			r[i].resp = strdup((const char *) appdata_ptr);
+			if (r[i].resp == NULL) goto fail;
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+fail:
+	for (i = 0; i < n; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+static int check_password(const char *service, const char *user, const char *password) {
+	struct pam_conv c = {conv, (void *) password};
+	pam_handle_t *h = NULL;
+	int ret = pam_start(service, user, &c, &h);
+	if (ret != PAM_SUCCESS) return ret;
+	ret = pam_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	// Also check that the account is not locked or expired.
+	if (ret == PAM_SUCCESS) ret = pam_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	pam_end(h, ret);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func init() {
+	pamAuthenticate = checkPAMPassword
+}
+
+func checkPAMPassword(service, user, password string) error {
+	cs, cu, cp := C.CString(service), C.CString(user), C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(cp), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cp))
+		C.free(unsafe.Pointer(cu))
+		C.free(unsafe.Pointer(cs))
+	}()
+	switch ret := C.check_password(cs, cu, cp); ret {
+	case C.PAM_SUCCESS:
+		return nil
+	case C.PAM_USER_UNKNOWN:
+		return api.NoMatch
+	case C.PAM_AUTH_ERR, C.PAM_MAXTRIES, C.PAM_ACCT_EXPIRED, C.PAM_NEW_AUTHTOK_REQD, C.PAM_PERM_DENIED:
+		return errPAMDenied
+	default:
+		return fmt.Errorf("PAM error %d", int(ret))
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"errors"
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakePAM replaces the PAM library for the duration of the test.
+func fakePAM(t *testing.T, users map[string]string) *[]string {
+	var services []string
+	saved := pamAuthenticate
+	pamAuthenticate = func(service, user, password string) error {
+		services = append(services, service)
+		switch pw, found := users[user]; {
+		case user == "broken":
+			return errors.New("PAM is misconfigured")
+		case !found:
+			return api.NoMatch
+		case pw != password:
+			return errPAMDenied
+		}
+		return nil
+	}
+	t.Cleanup(func() { pamAuthenticate = saved })
+	return &services
+}
+
+func TestPAMAuthNotBuiltIn(t *testing.T) {
+	saved := pamAuthenticate
+	pamAuthenticate = nil
+	defer func() { pamAuthenticate = saved }()
+	if err := (&PAMAuthConfig{}).Validate("pam_auth"); err == nil || !strings.Contains(err.Error(), "-tags pam") {
+		t.Errorf("expected PAM support to be required, got %v", err)
+	}
+	if _, err := NewPAMAuth(&PAMAuthConfig{}); err == nil {
+		t.Errorf("expected NewPAMAuth to fail without PAM support")
+	}
+}
+
+func TestPAMAuth(t *testing.T) {
+	services := fakePAM(t, map[string]string{"alice": "secret"})
+	c := &PAMAuthConfig{}
+	if err := c.Validate("pam_auth"); err != nil || c.Service != "docker_auth" {
+		t.Fatalf("Validate: %q, %v", c.Service, err)
+	}
+	pa, err := NewPAMAuth(c)
+	if err != nil {
+		t.Fatalf("NewPAMAuth: %s", err)
+	}
+	for _, tc := range []struct {
+		user, password string
+		ok             bool
+		err            error
+	}{
+		{"alice", "secret", true, nil},
+		{"alice", "wrong", false, nil},
+		{"bob", "secret", false, api.NoMatch},
+		// Not passed to PAM.
+		{"", "secret", false, api.NoMatch},
+		{"alice", "", false, nil},
+	} {
+		ok, labels, err := pa.Authenticate(tc.user, api.PasswordString(tc.password))
+		if ok != tc.ok || err != tc.err || labels != nil {
+			t.Errorf("%q/%q: got %t, %v, %v", tc.user, tc.password, ok, labels, err)
+		}
+	}
+	if len(*services) != 3 || (*services)[0] != "docker_auth" {
+		t.Errorf("unexpected PAM calls: %q", *services)
+	}
+	if ok, _, err := pa.Authenticate("broken", "secret"); ok || err == nil || err == api.NoMatch {
+		t.Errorf("expected a PAM error to be returned, got %t, %v", ok, err)
+	}
+}
+
+func TestPAMAuthGroupLabel(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %s", err)
+	}
+	groups, err := userGroups(u.Username)
+	if err != nil || len(groups) == 0 {
+		t.Skipf("no groups of %s: %v", u.Username, err)
+	}
+	fakePAM(t, map[string]string{u.Username: "secret", "nosuchuser-docker-auth": "secret"})
+	pa, _ := NewPAMAuth(&PAMAuthConfig{Service: "registry", GroupLabel: "groups"})
+	ok, labels, err := pa.Authenticate(u.Username, "secret")
+	if !ok || err != nil || strings.Join(labels["groups"], ",") != strings.Join(groups, ",") {
+		t.Errorf("expected %q, got %t, %v, %v", groups, ok, labels, err)
+	}
+	// Users that PAM knows but the system does not cannot be labeled.
+	if ok, _, err := pa.Authenticate("nosuchuser-docker-auth", "secret"); ok || err == nil {
+		t.Errorf("expected the groups lookup to fail, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithms that HashPassword can produce hashes with.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Parameters of new argon2id hashes, those recommended by RFC 9106 for memory-constrained environments.
+const (
+	argon2idMemory  = 64 * 1024
+	argon2idTime    = 3
+	argon2idThreads = 4
+	argon2idKeyLen  = 32
+)
+
+// Limits on the parameters of the hashes that are checked, so that a single login
+// cannot take more than 1 GiB of memory or minutes of CPU time.
+const (
+	maxArgon2idMemory  = 1024 * 1024 // In KiB.
+	maxArgon2idTime    = 10
+	maxArgon2idThreads = 16
+	maxScryptMemory    = 1 << 30 // 128 * N * r bytes.
+	maxScryptR         = 32
+	maxScryptP         = 16
+)
+
+// HashPassword returns a hash of the password in a format that checkPasswordHash accepts.
+// The cost only applies to bcrypt.
+func HashPassword(algo string, password []byte, cost int) (string, error) {
+	switch algo {
+	case HashBcrypt:
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return "", fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		hash, err := bcrypt.GenerateFromPassword(password, cost)
+		return string(hash), err
+	case HashArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(password, salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("unsupported hash algorithm %q, must be %s or %s", algo, HashBcrypt, HashArgon2id)
+}
+
+// checkPasswordHash checks the password against a hash in one of the supported formats,
+// told apart by their prefix: bcrypt ("$2a$", "$2b$", "$2y$"), "$argon2id$", "$scrypt$"
+// and "$pbkdf2-sha256$".
+// An error is returned if the hash is malformed or of an unknown format, not if the password is wrong.
+func checkPasswordHash(hash string, password []byte) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+		if err != nil && err != bcrypt.ErrMismatchedHashAndPassword {
+			return false, err
+		}
+		return err == nil, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2idHash(hash, password)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return checkScryptHash(hash, password)
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return checkPBKDF2SHA256Hash(hash, password)
+	}
+	if parts := strings.SplitN(hash, "$", 3); len(parts) == 3 && parts[0] == "" {
+		return false, fmt.Errorf("unrecognized password hash format %q", parts[1])
+	}
+	return false, fmt.Errorf("unrecognized password hash format, must be bcrypt, argon2id, scrypt or pbkdf2-sha256")
+}
+
+// decodeAB64 decodes the unpadded base64 variant used by passlib, with "." instead of "+".
+// Plain unpadded base64 is accepted too.
+func decodeAB64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(strings.TrimRight(s, "="), ".", "+"))
+}
+
+// checkArgon2idHash checks a hash in the PHC string format produced by the reference
+// implementation and most libraries: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>,
+// with the salt and hash in unpadded base64.
+func checkArgon2idHash(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("malformed argon2id hash version: %s", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	var memory, time, threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2id hash parameters: %s", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %s", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id hash: %s", err)
+	}
+	if len(key) == 0 || time == 0 || threads == 0 {
+		return false, fmt.Errorf("malformed argon2id hash parameters")
+	}
+	if memory > maxArgon2idMemory || time > maxArgon2idTime || threads > maxArgon2idThreads {
+		return false, fmt.Errorf("malformed argon2id hash parameters m=%d,t=%d,p=%d, must be at most m=%d,t=%d,p=%d",
+			memory, time, threads, maxArgon2idMemory, maxArgon2idTime, maxArgon2idThreads)
+	}
+	derived := argon2.IDKey(password, salt, time, memory, uint8(threads), uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// checkScryptHash checks a hash in the passlib format: $scrypt$ln=16,r=8,p=1$<salt>$<hash>,
+// where N is 2^ln.
+func checkScryptHash(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false, fmt.Errorf("malformed scrypt hash")
+	}
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return false, fmt.Errorf("malformed scrypt hash parameters: %s", err)
+	}
+	if logN < 1 || logN > 30 {
+		return false, fmt.Errorf("unsupported scrypt cost ln=%d", logN)
+	}
+	if r < 1 || r > maxScryptR || p < 1 || p > maxScryptP || 128*r<<uint(logN) > maxScryptMemory {
+		return false, fmt.Errorf("malformed scrypt hash parameters ln=%d,r=%d,p=%d, must be at most r=%d,p=%d and use at most %d bytes",
+			logN, r, p, maxScryptR, maxScryptP, maxScryptMemory)
+	}
+	salt, err := decodeAB64(parts[3])
+	if err != nil {
+		return false, fmt.Errorf("malformed scrypt salt: %s", err)
+	}
+	key, err := decodeAB64(parts[4])
+	if err != nil || len(key) == 0 {
+		return false, fmt.Errorf("malformed scrypt hash")
+	}
+	derived, err := scrypt.Key(password, salt, 1<<uint(logN), r, p, len(key))
+	if err != nil {
+		return false, fmt.Errorf("invalid scrypt hash parameters: %s", err)
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// checkPBKDF2SHA256Hash checks a hash in the passlib format: $pbkdf2-sha256$<rounds>$<salt>$<hash>.
+func checkPBKDF2SHA256Hash(hash string, password []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false, fmt.Errorf("malformed pbkdf2-sha256 hash")
+	}
+	rounds, err := strconv.Atoi(parts[2])
+	if err != nil || rounds < 1 {
+		return false, fmt.Errorf("malformed pbkdf2-sha256 rounds %q", parts[2])
+	}
+	salt, err := decodeAB64(parts[3])
+	if err != nil {
+		return false, fmt.Errorf("malformed pbkdf2-sha256 salt: %s", err)
+	}
+	key, err := decodeAB64(parts[4])
+	if err != nil || len(key) == 0 {
+		return false, fmt.Errorf("malformed pbkdf2-sha256 hash")
+	}
+	derived := pbkdf2.Key(password, salt, rounds, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+var testHashSalt = []byte("0123456789abcdef")
+
+func scryptHash(t *testing.T, password string, logN, r, p int) string {
+	key, err := scrypt.Key([]byte(password), testHashSalt, 1<<uint(logN), r, p, 32)
+	if err != nil {
+		t.Fatalf("scrypt.Key: %s", err)
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", logN, r, p,
+		base64.RawStdEncoding.EncodeToString(testHashSalt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func pbkdf2SHA256Hash(password string, rounds int) string {
+	key := pbkdf2.Key([]byte(password), testHashSalt, rounds, 32, sha256.New)
+	ab64 := func(b []byte) string { return strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(b), "+", ".") }
+	return fmt.Sprintf("$pbkdf2-sha256$%d$%s$%s", rounds, ab64(testHashSalt), ab64(key))
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	for _, algo := range []string{HashBcrypt, HashArgon2id} {
+		hash, err := HashPassword(algo, []byte("secret"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("HashPassword(%s): %s", algo, err)
+		}
+		if ok, err := checkPasswordHash(hash, []byte("secret")); !ok || err != nil {
+			t.Errorf("%s: correct password: %t, %v", algo, ok, err)
+		}
+		if ok, err := checkPasswordHash(hash, []byte("wrong")); ok || err != nil {
+			t.Errorf("%s: wrong password: %t, %v", algo, ok, err)
+		}
+	}
+	for _, hash := range []string{scryptHash(t, "secret", 10, 8, 1), pbkdf2SHA256Hash("secret", 1000)} {
+		if ok, err := checkPasswordHash(hash, []byte("secret")); !ok || err != nil {
+			t.Errorf("%s: correct password: %t, %v", hash, ok, err)
+		}
+		if ok, err := checkPasswordHash(hash, []byte("wrong")); ok || err != nil {
+			t.Errorf("%s: wrong password: %t, %v", hash, ok, err)
+		}
+	}
+	if _, err := HashPassword("md5", []byte("secret"), 0); err == nil {
+		t.Errorf("expected an unsupported algorithm to be rejected")
+	}
+	if _, err := HashPassword(HashBcrypt, []byte("secret"), bcrypt.MaxCost+1); err == nil {
+		t.Errorf("expected an out of range bcrypt cost to be rejected")
+	}
+}
+
+func TestPasswordHashMalformed(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString(testHashSalt)
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	argon2id := func(params string) string { return "$argon2id$v=19$" + params + "$" + salt + "$" + key }
+	scryptParams := func(params string) string { return "$scrypt$" + params + "$" + salt + "$" + key }
+	for _, hash := range []string{
+		"",
+		"secret",
+		"$md5$salt$hash",
+		"$2a$10$short",
+		"$argon2id$v=19$m=65536,t=3,p=4$" + salt,
+		"$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key,
+		argon2id("m=65536,t=3"),
+		argon2id("m=65536,t=0,p=4"),
+		argon2id("m=65536,t=3,p=0"),
+		"$argon2id$v=19$m=65536,t=3,p=4$!!$" + key,
+		"$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$",
+		// Too expensive to check.
+		argon2id("m=1048577,t=3,p=4"),
+		argon2id("m=4294967295,t=3,p=4"),
+		argon2id("m=65536,t=11,p=4"),
+		argon2id("m=65536,t=3,p=17"),
+		argon2id("m=65536,t=3,p=256"),
+		scryptParams("ln=16,r=8"),
+		scryptParams("ln=0,r=8,p=1"),
+		scryptParams("ln=31,r=8,p=1"),
+		scryptParams("ln=16,r=0,p=1"),
+		scryptParams("ln=16,r=8,p=0"),
+		"$scrypt$ln=16,r=8,p=1$" + salt + "$",
+		// Too expensive to check.
+		scryptParams("ln=21,r=8,p=1"),
+		scryptParams("ln=16,r=33,p=1"),
+		scryptParams("ln=16,r=8,p=17"),
+		scryptParams("ln=16,r=1073741824,p=1073741824"),
+		"$pbkdf2-sha256$0$" + salt + "$" + key,
+		"$pbkdf2-sha256$x$" + salt + "$" + key,
+		"$pbkdf2-sha256$1000$" + salt + "$",
+	} {
+		if ok, err := checkPasswordHash(hash, []byte("secret")); ok || err == nil {
+			t.Errorf("expected %q to be rejected as malformed, got %t, %v", hash, ok, err)
+		}
+	}
+	// The limits themselves are allowed.
+	if ok, err := checkPasswordHash(scryptHash(t, "secret", 1, maxScryptR, maxScryptP), []byte("secret")); !ok || err != nil {
+		t.Errorf("scrypt with r=%d,p=%d: %t, %v", maxScryptR, maxScryptP, ok, err)
+	}
+}
+
+func TestStaticUserAuthPasswordHashes(t *testing.T) {
+	users := map[string]*Requirements{}
+	for user, hash := range map[string]string{
+		"scrypt": scryptHash(t, "secret", 10, 8, 1),
+		"pbkdf2": pbkdf2SHA256Hash("secret", 1000),
+		"broken": "$scrypt$ln=16,r=8$" + base64.RawStdEncoding.EncodeToString(testHashSalt) + "$hash",
+	} {
+		pw := api.PasswordString(hash)
+		users[user] = &Requirements{Password: &pw}
+	}
+	sua := NewStaticUserAuth(users)
+	// Only bcrypt hashes are upgraded, others must be left alone.
+	sua.SetRehashCost(bcrypt.MinCost + 1)
+	for _, user := range []string{"scrypt", "pbkdf2"} {
+		if ok, _, err := sua.Authenticate(user, "secret"); !ok || err != nil {
+			t.Errorf("%s: correct password: %t, %v", user, ok, err)
+		}
+		if ok, _, err := sua.Authenticate(user, "wrong"); ok || err != nil {
+			t.Errorf("%s: wrong password: %t, %v", user, ok, err)
+		}
+	}
+	if ok, _, err := sua.Authenticate("broken", "secret"); ok || err == nil || !strings.Contains(err.Error(), "bad password hash for broken") {
+		t.Errorf("expected a malformed hash to be reported, got %t, %v", ok, err)
+	}
+	if len(sua.rehashed) != 0 {
+		t.Errorf("expected no hashes to be upgraded, got %v", sua.rehashed)
+	}
+}
@@ -0,0 +1,581 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/cesanta/glog"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	samlProtocolNS      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlStatusOK        = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// Cookie that ties the response of the IdP to the request we sent it to.
+	samlRequestCookie = "docker_auth_saml_request"
+	// How long users have to sign in with the IdP.
+	samlRequestTTL = 10 * time.Minute
+)
+
+type SAMLAuthConfig struct {
+	// Metadata of the identity provider, fetched from a URL or read from a file.
+	IDPMetadataURL  string `mapstructure:"idp_metadata_url,omitempty"`
+	IDPMetadataFile string `mapstructure:"idp_metadata_file,omitempty"`
+	// Entity ID of the auth server, as registered with the IdP. Assertions must be for this audience.
+	EntityID string `mapstructure:"entity_id,omitempty"`
+	// URL of the assertion consumer service. Has to end with /saml_auth/acs
+	ACSURL string `mapstructure:"acs_url,omitempty"`
+	// Attribute to take the user name from. By default, the subject's NameID is used.
+	UsernameAttribute string `mapstructure:"username_attribute,omitempty"`
+	// Assertion attributes to expose as labels.
+	LabelAttributes []SAMLLabelAttribute `mapstructure:"label_attributes,omitempty"`
+	TokenDB         string               `mapstructure:"token_db,omitempty"`
+	// How long the password handed out after signing in is valid for.
+	SessionTTL time.Duration `mapstructure:"session_ttl,omitempty"`
+	// Allowed difference between our clock and that of the IdP.
+	ClockSkew   time.Duration `mapstructure:"clock_skew,omitempty"`
+	HTTPTimeout time.Duration `mapstructure:"http_timeout,omitempty"`
+	// The URL of the docker registry. Used to generate a full docker login command after authentication
+	RegistryURL string `mapstructure:"registry_url,omitempty"`
+}
+
+// SAMLLabelAttribute maps an assertion attribute to a label. Attribute names are often URIs,
+// which cannot be used as map keys in the config, so these are given as a list.
+type SAMLLabelAttribute struct {
+	Attribute string `mapstructure:"attribute,omitempty"`
+	Label     string `mapstructure:"label,omitempty"`
+}
+
+func (c *SAMLAuthConfig) Validate(configKey string) error {
+	if (c.IDPMetadataURL == "") == (c.IDPMetadataFile == "") {
+		return fmt.Errorf("%s: exactly one of idp_metadata_url and idp_metadata_file is required", configKey)
+	}
+	if c.EntityID == "" || c.ACSURL == "" || c.TokenDB == "" {
+		return fmt.Errorf("%s.{entity_id,acs_url,token_db} are required", configKey)
+	}
+	if u, err := url.Parse(c.ACSURL); err != nil || u.Host == "" || !strings.HasSuffix(u.Path, "/saml_auth/acs") {
+		return fmt.Errorf("%s.acs_url must be an absolute URL ending with /saml_auth/acs, got %q", configKey, c.ACSURL)
+	}
+	for i, la := range c.LabelAttributes {
+		if la.Attribute == "" || la.Label == "" {
+			return fmt.Errorf("%s.label_attributes[%d]: attribute and label are required", configKey, i)
+		}
+	}
+	if c.SessionTTL <= 0 {
+		c.SessionTTL = 12 * time.Hour
+	}
+	if c.ClockSkew <= 0 {
+		c.ClockSkew = time.Minute
+	}
+	if c.HTTPTimeout <= 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+// samlIDPMetadata is the part of the IdP's EntityDescriptor we need.
+type samlIDPMetadata struct {
+	EntityID         string `xml:"entityID,attr"`
+	IDPSSODescriptor struct {
+		KeyDescriptors []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+type SAMLAuth struct {
+	config     *SAMLAuthConfig
+	db         TokenDB
+	tmplResult *template.Template
+	// From the IdP metadata.
+	idpEntityID string
+	ssoURL      string
+	validator   *dsig.ValidationContext
+
+	// IDs of the assertions that have been used, until they expire.
+	mu        sync.Mutex
+	seenUntil map[string]time.Time
+}
+
+func NewSAMLAuth(c *SAMLAuthConfig) (*SAMLAuth, error) {
+	md, err := readSAMLMetadata(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load IdP metadata: %s", err)
+	}
+	sa := &SAMLAuth{config: c, idpEntityID: md.EntityID, seenUntil: make(map[string]time.Time)}
+	for _, sso := range md.IDPSSODescriptor.SingleSignOnServices {
+		if sso.Binding == samlBindingRedirect {
+			sa.ssoURL = sso.Location
+		}
+	}
+	if sa.ssoURL == "" {
+		return nil, errors.New("IdP metadata has no HTTP-Redirect SingleSignOnService")
+	}
+	var certs []*x509.Certificate
+	for _, kd := range md.IDPSSODescriptor.KeyDescriptors {
+		if kd.Use != "" && kd.Use != "signing" {
+			continue
+		}
+		for _, data := range kd.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			if err != nil {
+				return nil, fmt.Errorf("bad certificate in IdP metadata: %s", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("bad certificate in IdP metadata: %s", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("IdP metadata has no signing certificates")
+	}
+	sa.validator = dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+
+	sa.db, err = NewTokenDB(c.TokenDB)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("SAML auth token DB at %s", c.TokenDB)
+	samlAuthResult, _ := static.ReadFile("data/saml_auth_result.tmpl")
+	sa.tmplResult = template.Must(template.New("saml_auth_result").Parse(string(samlAuthResult)))
+	return sa, nil
+}
+
+func readSAMLMetadata(c *SAMLAuthConfig) (*samlIDPMetadata, error) {
+	var data []byte
+	var err error
+	if c.IDPMetadataFile != "" {
+		data, err = ioutil.ReadFile(c.IDPMetadataFile)
+	} else {
+		data, err = fetchSAMLMetadata(c.IDPMetadataURL, c.HTTPTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var md samlIDPMetadata
+	if err := xml.Unmarshal(data, &md); err != nil {
+		return nil, err
+	}
+	if md.EntityID == "" {
+		return nil, errors.New("no entityID, expected an EntityDescriptor")
+	}
+	return &md, nil
+}
+
+func fetchSAMLMetadata(u string, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+This function will be used by the server if the SAML auth method is selected. GET /saml_auth sends the user to the
+IdP, which posts the response back to /saml_auth/acs.
+*/
+func (sa *SAMLAuth) DoSAMLAuth(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, redirect, err := sa.authnRequest()
+	if err != nil {
+		glog.Errorf("Failed to create SAML request: %s", err)
+		http.Error(rw, "Failed to create SAML request", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(rw, sa.requestCookie(id, int(samlRequestTTL.Seconds())))
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+// requestCookie returns the cookie that holds the ID of the pending request. The response of the IdP is a
+// cross-site POST, so unless the ACS is served over HTTPS the browser will not send it back.
+func (sa *SAMLAuth) requestCookie(id string, maxAge int) *http.Cookie {
+	c := &http.Cookie{
+		Name:     samlRequestCookie,
+		Value:    id,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if u, _ := url.Parse(sa.config.ACSURL); u != nil {
+		c.Path = u.Path
+		if u.Scheme == "https" {
+			c.Secure = true
+			c.SameSite = http.SameSiteNoneMode
+		}
+	}
+	return c
+}
+
+// authnRequest returns the ID of a new AuthnRequest and the URL that sends it to the IdP (HTTP-Redirect binding).
+func (sa *SAMLAuth) authnRequest() (string, string, error) {
+	rnd := make([]byte, 20)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", "", err
+	}
+	id := "id-" + hex.EncodeToString(rnd)
+	doc := etree.NewDocument()
+	ar := doc.CreateElement("samlp:AuthnRequest")
+	ar.CreateAttr("xmlns:samlp", samlProtocolNS)
+	ar.CreateAttr("xmlns:saml", samlAssertionNS)
+	ar.CreateAttr("ID", id)
+	ar.CreateAttr("Version", "2.0")
+	ar.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	ar.CreateAttr("Destination", sa.ssoURL)
+	ar.CreateAttr("AssertionConsumerServiceURL", sa.config.ACSURL)
+	ar.CreateAttr("ProtocolBinding", samlBindingPOST)
+	ar.CreateElement("saml:Issuer").SetText(sa.config.EntityID)
+	ar.CreateElement("samlp:NameIDPolicy").CreateAttr("AllowCreate", "true")
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+	u, err := url.Parse(sa.ssoURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	u.RawQuery = q.Encode()
+	return id, u.String(), nil
+}
+
+/*
+Consumes the response of the IdP and, if the assertion in it checks out, creates a token for the user.
+*/
+func (sa *SAMLAuth) DoSAMLAuthACS(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cookie, err := req.Cookie(samlRequestCookie)
+	if err != nil || cookie.Value == "" {
+		http.Error(rw, "No pending SAML request, please sign in again", http.StatusBadRequest)
+		return
+	}
+	// The request ID is good for one response only.
+	http.SetCookie(rw, sa.requestCookie("", -1))
+	data, err := base64.StdEncoding.DecodeString(req.PostFormValue("SAMLResponse"))
+	if err != nil || len(data) == 0 {
+		http.Error(rw, "Bad SAMLResponse", http.StatusBadRequest)
+		return
+	}
+	user, labels, err := sa.parseResponse(data, cookie.Value, time.Now())
+	if err != nil {
+		glog.Warningf("Rejected SAML response: %s", err)
+		http.Error(rw, fmt.Sprintf("Invalid SAML response: %s", err), http.StatusForbidden)
+		return
+	}
+
+	glog.V(2).Infof("New SAML auth token for %s, labels %v", user, labels)
+	dbVal := &TokenDBValue{
+		ValidUntil: time.Now().Add(sa.config.SessionTTL),
+		Labels:     labels,
+	}
+	dp, err := sa.db.StoreToken(user, dbVal, true)
+	if err != nil {
+		glog.Errorf("Failed to record server token: %s", err)
+		http.Error(rw, "Failed to record server token", http.StatusInternalServerError)
+		return
+	}
+	if err := sa.tmplResult.Execute(rw, struct {
+		Username, Password, RegistryUrl string
+	}{
+		Username:    user,
+		Password:    dp,
+		RegistryUrl: sa.config.RegistryURL,
+	}); err != nil {
+		http.Error(rw, fmt.Sprintf("Template error: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// parseResponse checks a SAML response to the request with the given ID and returns the user and labels
+// from the assertion in it. Only the parts of the response covered by a valid signature are used.
+func (sa *SAMLAuth) parseResponse(data []byte, requestID string, now time.Time) (string, api.Labels, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return "", nil, err
+	}
+	resp := doc.Root()
+	if resp == nil || resp.Tag != "Response" || resp.NamespaceURI() != samlProtocolNS {
+		return "", nil, errors.New("not a SAML response")
+	}
+	if status := resp.FindElement("./Status/StatusCode"); status == nil || status.SelectAttrValue("Value", "") != samlStatusOK {
+		msg := ""
+		if status != nil {
+			msg = status.SelectAttrValue("Value", "")
+		}
+		if m := resp.FindElement("./Status/StatusMessage"); m != nil {
+			msg += ": " + m.Text()
+		}
+		return "", nil, fmt.Errorf("IdP returned %s", msg)
+	}
+	if len(resp.FindElements("./EncryptedAssertion")) > 0 {
+		return "", nil, errors.New("encrypted assertions are not supported")
+	}
+	if n := len(resp.FindElements("./Assertion")); n != 1 {
+		return "", nil, fmt.Errorf("expected one assertion, got %d", n)
+	}
+	if d := resp.SelectAttrValue("Destination", ""); d != "" && d != sa.config.ACSURL {
+		return "", nil, fmt.Errorf("wrong destination %q", d)
+	}
+
+	// Either the whole response or the assertion has to be signed.
+	var assertion *etree.Element
+	if resp.FindElement("./Signature") != nil {
+		vresp, err := sa.validator.Validate(resp)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad response signature: %s", err)
+		}
+		assertion = vresp.FindElement("./Assertion")
+		if assertion == nil {
+			return "", nil, errors.New("no assertion in the signed response")
+		}
+	} else {
+		va, err := sa.validator.Validate(withNamespaces(resp.FindElement("./Assertion")))
+		if err != nil {
+			return "", nil, fmt.Errorf("bad assertion signature: %s", err)
+		}
+		assertion = va
+	}
+	return sa.checkAssertion(assertion, requestID, now)
+}
+
+func (sa *SAMLAuth) checkAssertion(assertion *etree.Element, requestID string, now time.Time) (string, api.Labels, error) {
+	skew := sa.config.ClockSkew
+	if iss := assertion.FindElement("./Issuer"); iss == nil || strings.TrimSpace(iss.Text()) != sa.idpEntityID {
+		return "", nil, errors.New("assertion is not issued by the IdP")
+	}
+
+	cond := assertion.FindElement("./Conditions")
+	if cond == nil {
+		return "", nil, errors.New("assertion has no conditions")
+	}
+	notOnOrAfter, err := samlTime(cond, "NotOnOrAfter", now.Add(skew))
+	if err != nil {
+		return "", nil, err
+	}
+	if !now.Add(-skew).Before(notOnOrAfter) {
+		return "", nil, errors.New("assertion has expired")
+	}
+	if notBefore, err := samlTime(cond, "NotBefore", now); err != nil {
+		return "", nil, err
+	} else if now.Add(skew).Before(notBefore) {
+		return "", nil, errors.New("assertion is not valid yet")
+	}
+	audienceOK := false
+	for _, a := range cond.FindElements("./AudienceRestriction/Audience") {
+		if strings.TrimSpace(a.Text()) == sa.config.EntityID {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return "", nil, fmt.Errorf("assertion is not for audience %q", sa.config.EntityID)
+	}
+
+	subject := assertion.FindElement("./Subject")
+	if subject == nil {
+		return "", nil, errors.New("assertion has no subject")
+	}
+	confirmed := false
+	for _, sc := range subject.FindElements("./SubjectConfirmation") {
+		scd := sc.FindElement("./SubjectConfirmationData")
+		if sc.SelectAttrValue("Method", "") != samlBearer || scd == nil {
+			continue
+		}
+		if scd.SelectAttrValue("Recipient", "") != sa.config.ACSURL || scd.SelectAttrValue("InResponseTo", "") != requestID {
+			continue
+		}
+		until, err := samlTime(scd, "NotOnOrAfter", time.Time{})
+		if err != nil || !now.Add(-skew).Before(until) {
+			continue
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return "", nil, errors.New("no valid bearer subject confirmation for this request")
+	}
+
+	user := ""
+	if nameID := subject.FindElement("./NameID"); nameID != nil {
+		user = strings.TrimSpace(nameID.Text())
+	}
+	attrs := make(map[string][]string)
+	for _, a := range assertion.FindElements("./AttributeStatement/Attribute") {
+		name := a.SelectAttrValue("Name", "")
+		for _, v := range a.FindElements("./AttributeValue") {
+			attrs[name] = append(attrs[name], strings.TrimSpace(v.Text()))
+		}
+	}
+	if sa.config.UsernameAttribute != "" {
+		user = ""
+		if vs := attrs[sa.config.UsernameAttribute]; len(vs) > 0 {
+			user = vs[0]
+		}
+	}
+	if user == "" {
+		return "", nil, errors.New("assertion has no user name")
+	}
+	var labels api.Labels
+	for _, la := range sa.config.LabelAttributes {
+		if vs := attrs[la.Attribute]; len(vs) > 0 {
+			if labels == nil {
+				labels = api.Labels{}
+			}
+			labels[la.Label] = append(labels[la.Label], vs...)
+		}
+	}
+
+	id := assertion.SelectAttrValue("ID", "")
+	if id == "" {
+		return "", nil, errors.New("assertion has no ID")
+	}
+	if !sa.markUsed(id, notOnOrAfter.Add(skew), now) {
+		return "", nil, fmt.Errorf("assertion %s has already been used", id)
+	}
+	return user, labels, nil
+}
+
+// withNamespaces returns a copy of el that also declares the namespaces it inherits,
+// so that it can be canonicalized on its own.
+func withNamespaces(el *etree.Element) *etree.Element {
+	c := el.Copy()
+	declared := make(map[string]bool)
+	for _, a := range c.Attr {
+		if a.Space == "xmlns" || (a.Space == "" && a.Key == "xmlns") {
+			declared[a.FullKey()] = true
+		}
+	}
+	for p := el.Parent(); p != nil; p = p.Parent() {
+		for _, a := range p.Attr {
+			if (a.Space == "xmlns" || (a.Space == "" && a.Key == "xmlns")) && !declared[a.FullKey()] {
+				declared[a.FullKey()] = true
+				c.CreateAttr(a.FullKey(), a.Value)
+			}
+		}
+	}
+	return c
+}
+
+// samlTime parses a time attribute, returning dflt if it is not present.
+func samlTime(el *etree.Element, attr string, dflt time.Time) (time.Time, error) {
+	v := el.SelectAttrValue(attr, "")
+	if v == "" {
+		if dflt.IsZero() {
+			return dflt, fmt.Errorf("%s.%s is required", el.Tag, attr)
+		}
+		return dflt, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return t, fmt.Errorf("bad %s.%s: %s", el.Tag, attr, err)
+	}
+	return t, nil
+}
+
+// markUsed records the ID of an assertion and tells if it was seen for the first time.
+func (sa *SAMLAuth) markUsed(id string, until, now time.Time) bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	for seen, exp := range sa.seenUntil {
+		if now.After(exp) {
+			delete(sa.seenUntil, seen)
+		}
+	}
+	if _, ok := sa.seenUntil[id]; ok {
+		return false
+	}
+	sa.seenUntil[id] = until
+	return true
+}
+
+/*
+Called by server. Authenticates user with credentials that were given in the docker login command. SAML sessions
+cannot be refreshed, once the token has expired the user has to sign in again.
+*/
+func (sa *SAMLAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	err := sa.db.ValidateToken(user, password)
+	if err == ExpiredToken {
+		glog.V(1).Infof("SAML session of %s has expired", user)
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	v, err := sa.db.GetValue(user)
+	if err != nil || v == nil {
+		if err == nil {
+			err = errors.New("no db value, please sign in again")
+		}
+		return false, nil, err
+	}
+	return true, v.Labels, nil
+}
+
+func (sa *SAMLAuth) Stop() {
+	err := sa.db.Close()
+	if err != nil {
+		glog.Info("Problems at closing the token DB")
+	} else {
+		glog.Info("Token DB closed")
+	}
+}
+
+func (sa *SAMLAuth) Name() string {
+	return "SAML"
+}
@@ -0,0 +1,257 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testSAMLIdP = "https://idp.example.com"
+	testSAMLACS = "https://auth.example.com/saml_auth/acs"
+)
+
+func newTestSAMLAuth(t *testing.T) (*SAMLAuth, dsig.X509KeyStore) {
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := fmt.Sprintf(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID=%q>
+<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data>
+<ds:X509Certificate>%s</ds:X509Certificate>
+</ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="%s/sso"/>
+</md:IDPSSODescriptor>
+</md:EntityDescriptor>`, testSAMLIdP, base64.StdEncoding.EncodeToString(cert), testSAMLIdP)
+	mdFile := filepath.Join(t.TempDir(), "idp.xml")
+	if err := ioutil.WriteFile(mdFile, []byte(md), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &SAMLAuthConfig{
+		IDPMetadataFile: mdFile,
+		EntityID:        "docker-auth",
+		ACSURL:          testSAMLACS,
+		TokenDB:         MemoryTokenDB,
+		LabelAttributes: []SAMLLabelAttribute{{Attribute: "memberOf", Label: "groups"}},
+	}
+	if err := c.Validate("saml_auth"); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := NewSAMLAuth(c)
+	if err != nil {
+		t.Fatalf("NewSAMLAuth: %s", err)
+	}
+	return sa, ks
+}
+
+// testSAMLAssertion holds the parts of an assertion the tests vary.
+type testSAMLAssertion struct {
+	id, issuer, audience, inResponseTo, user string
+	notOnOrAfter                             time.Time
+}
+
+func goodSAMLAssertion(id string, now time.Time) testSAMLAssertion {
+	return testSAMLAssertion{
+		id:           id,
+		issuer:       testSAMLIdP,
+		audience:     "docker-auth",
+		inResponseTo: "req-1",
+		user:         "alice",
+		notOnOrAfter: now.Add(5 * time.Minute),
+	}
+}
+
+func (a testSAMLAssertion) String() string {
+	ts := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+	return fmt.Sprintf(`<saml:Assertion ID=%q Version="2.0" IssueInstant=%q>`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<saml:Subject><saml:NameID>%s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">`+
+		`<saml:SubjectConfirmationData InResponseTo=%q Recipient=%q NotOnOrAfter=%q/>`+
+		`</saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore=%q NotOnOrAfter=%q>`+
+		`<saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AttributeStatement><saml:Attribute Name="memberOf">`+
+		`<saml:AttributeValue>dev</saml:AttributeValue><saml:AttributeValue>ops</saml:AttributeValue>`+
+		`</saml:Attribute></saml:AttributeStatement>`+
+		`</saml:Assertion>`,
+		a.id, ts(a.notOnOrAfter.Add(-5*time.Minute)), a.issuer, a.user,
+		a.inResponseTo, testSAMLACS, ts(a.notOnOrAfter),
+		ts(a.notOnOrAfter.Add(-6*time.Minute)), ts(a.notOnOrAfter), a.audience)
+}
+
+func testSAMLResponse(t *testing.T, body string) *etree.Document {
+	doc := etree.NewDocument()
+	err := doc.ReadFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ` +
+		`xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="resp-1" Version="2.0" ` +
+		`Destination="` + testSAMLACS + `">` +
+		`<saml:Issuer>` + testSAMLIdP + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		body + `</samlp:Response>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// signSAMLAssertion adds an enveloped signature to the assertion in the response.
+func signSAMLAssertion(t *testing.T, ks dsig.X509KeyStore, doc *etree.Document) {
+	a := doc.Root().FindElement("./Assertion")
+	signed, err := dsig.NewDefaultSigningContext(ks).SignEnveloped(withNamespaces(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AddChild(signed.FindElement("./Signature"))
+}
+
+func signSAMLResponse(t *testing.T, ks dsig.X509KeyStore, doc *etree.Document) {
+	signed, err := dsig.NewDefaultSigningContext(ks).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.SetRoot(signed)
+}
+
+func samlBytes(t *testing.T, doc *etree.Document) []byte {
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSAMLParseResponse(t *testing.T) {
+	sa, ks := newTestSAMLAuth(t)
+	now := time.Now()
+
+	for _, signResponse := range []bool{false, true} {
+		doc := testSAMLResponse(t, goodSAMLAssertion(fmt.Sprintf("a-%t", signResponse), now).String())
+		if signResponse {
+			signSAMLResponse(t, ks, doc)
+		} else {
+			signSAMLAssertion(t, ks, doc)
+		}
+		data := samlBytes(t, doc)
+		user, labels, err := sa.parseResponse(data, "req-1", now)
+		if err != nil || user != "alice" || strings.Join(labels["groups"], ",") != "dev,ops" {
+			t.Fatalf("signed response %t: %q, %v, %v", signResponse, user, labels, err)
+		}
+		// Replay.
+		if _, _, err := sa.parseResponse(data, "req-1", now); err == nil || !strings.Contains(err.Error(), "already been used") {
+			t.Errorf("signed response %t: expected a replay to be rejected, got %v", signResponse, err)
+		}
+	}
+}
+
+func TestSAMLParseResponseRejected(t *testing.T) {
+	sa, ks := newTestSAMLAuth(t)
+	_, otherKS := newTestSAMLAuth(t)
+	now := time.Now()
+	signedAssertion := func(a testSAMLAssertion) *etree.Document {
+		doc := testSAMLResponse(t, a.String())
+		signSAMLAssertion(t, ks, doc)
+		return doc
+	}
+
+	cases := []struct {
+		name string
+		doc  func() *etree.Document
+		err  string
+	}{
+		{"unsigned", func() *etree.Document {
+			return testSAMLResponse(t, goodSAMLAssertion("unsigned", now).String())
+		}, "bad assertion signature"},
+		{"signed by another key", func() *etree.Document {
+			doc := testSAMLResponse(t, goodSAMLAssertion("other-key", now).String())
+			signSAMLAssertion(t, otherKS, doc)
+			return doc
+		}, "bad assertion signature"},
+		{"modified after signing", func() *etree.Document {
+			doc := signedAssertion(goodSAMLAssertion("modified", now))
+			doc.Root().FindElement("./Assertion/Subject/NameID").SetText("mallory")
+			return doc
+		}, "bad assertion signature"},
+		{"injected unsigned assertion", func() *etree.Document {
+			doc := signedAssertion(goodSAMLAssertion("signed", now))
+			evil := goodSAMLAssertion("evil", now)
+			evil.user = "mallory"
+			injected := testSAMLResponse(t, evil.String()).Root().FindElement("./Assertion")
+			doc.Root().InsertChildAt(0, injected)
+			return doc
+		}, "expected one assertion"},
+		{"signed assertion wrapped in an unsigned one", func() *etree.Document {
+			// The signature of the genuine assertion is moved onto an evil one with the same ID,
+			// which also carries the genuine assertion so that the reference still resolves.
+			doc := signedAssertion(goodSAMLAssertion("wrapped", now))
+			genuine := doc.Root().FindElement("./Assertion")
+			sig := genuine.FindElement("./Signature")
+			genuine.RemoveChild(sig)
+			evil := goodSAMLAssertion("wrapped", now)
+			evil.user = "mallory"
+			evilEl := testSAMLResponse(t, evil.String()).Root().FindElement("./Assertion")
+			sigCopy := sig.Copy()
+			sigCopy.AddChild(genuine.Copy())
+			evilEl.AddChild(sigCopy)
+			doc.Root().RemoveChild(genuine)
+			doc.Root().AddChild(evilEl)
+			return doc
+		}, "bad assertion signature"},
+		{"signed response with the assertion replaced", func() *etree.Document {
+			doc := testSAMLResponse(t, goodSAMLAssertion("replaced", now).String())
+			signSAMLResponse(t, ks, doc)
+			doc.Root().FindElement("./Assertion/Subject/NameID").SetText("mallory")
+			return doc
+		}, "bad response signature"},
+		{"wrong audience", func() *etree.Document {
+			a := goodSAMLAssertion("audience", now)
+			a.audience = "some-other-sp"
+			return signedAssertion(a)
+		}, "not for audience"},
+		{"wrong issuer", func() *etree.Document {
+			a := goodSAMLAssertion("issuer", now)
+			a.issuer = "https://evil.example.com"
+			return signedAssertion(a)
+		}, "not issued by the IdP"},
+		{"expired", func() *etree.Document {
+			a := goodSAMLAssertion("expired", now)
+			a.notOnOrAfter = now.Add(-2 * time.Minute)
+			return signedAssertion(a)
+		}, "expired"},
+		{"in response to another request", func() *etree.Document {
+			a := goodSAMLAssertion("other-request", now)
+			a.inResponseTo = "req-2"
+			return signedAssertion(a)
+		}, "no valid bearer subject confirmation"},
+	}
+	for _, c := range cases {
+		_, _, err := sa.parseResponse(samlBytes(t, c.doc()), "req-1", now)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
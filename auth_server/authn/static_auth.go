@@ -17,8 +17,17 @@
 package authn
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
+	fsnotify "gopkg.in/fsnotify.v1"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
@@ -26,10 +35,36 @@ import (
 type Requirements struct {
 	Password *api.PasswordString `mapstructure:"password,omitempty" json:"password,omitempty"`
 	Labels   api.Labels          `mapstructure:"labels,omitempty" json:"labels,omitempty"`
+	// Disabled users are kept in the config but cannot log in.
+	Disabled bool `mapstructure:"disabled,omitempty" json:"disabled,omitempty"`
+	// If set, a TOTP code has to be appended to the password: "password:123456".
+	TOTPSecret string `mapstructure:"totp_secret,omitempty" json:"totp_secret,omitempty" yaml:"totp_secret,omitempty"`
 }
 
 type staticUsersAuth struct {
+	mu    sync.RWMutex
 	users map[string]*Requirements
+	// Keys of users that are glob patterns, most specific first.
+	patterns []string
+	// Set by SetCaseInsensitive.
+	caseInsensitive bool
+	// Set by SetDummyHash.
+	dummyHash []byte
+
+	// Set when users are also loaded from files, see NewStaticUserFilesAuth.
+	inline map[string]*Requirements
+	files  []string
+	// Users of each file, as last loaded. Only accessed by the loading goroutine.
+	fileUsers []map[string]*Requirements
+	conflicts string
+	watcher   *fsnotify.Watcher
+
+	// Set by SetRehashCost.
+	rehashCost int
+	// Hashes that have been upgraded or skipped, so that each is only considered once.
+	rehashed map[string]bool
+	// Serializes updates of the users file.
+	writeMu sync.Mutex
 }
 
 func (r Requirements) String() string {
@@ -38,29 +73,180 @@ func (r Requirements) String() string {
 		pm := api.PasswordString("***")
 		r.Password = &pm
 	}
+	if r.TOTPSecret != "" {
+		r.TOTPSecret = "***"
+	}
 	b, _ := json.Marshal(r)
 	r.Password = p
 	return string(b)
 }
 
 func NewStaticUserAuth(users map[string]*Requirements) *staticUsersAuth {
-	return &staticUsersAuth{users: users}
+	return &staticUsersAuth{users: users, patterns: userPatterns(users)}
+}
+
+func isUserPattern(user string) bool {
+	return strings.ContainsAny(user, "*?[")
+}
+
+// ValidateUsers checks that the user names that are glob patterns and the TOTP secrets are well-formed.
+func ValidateUsers(users map[string]*Requirements) error {
+	for user, reqs := range users {
+		if isUserPattern(user) {
+			if _, err := path.Match(user, ""); err != nil {
+				return fmt.Errorf("bad user name pattern %q: %s", user, err)
+			}
+		}
+		if reqs != nil && reqs.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(reqs.TOTPSecret); err != nil {
+				return fmt.Errorf("%s: %s", user, err)
+			}
+		}
+	}
+	return nil
+}
+
+// userPatterns returns the user names that are glob patterns in the order they are tried:
+// longest first, so that e.g. "ci-runner-*" takes precedence over "ci-*", and alphabetically
+// among patterns of the same length.
+func userPatterns(users map[string]*Requirements) []string {
+	var patterns []string
+	for user := range users {
+		if isUserPattern(user) {
+			patterns = append(patterns, user)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns
+}
+
+// SetCaseInsensitive makes user names match regardless of case.
+func (sua *staticUsersAuth) SetCaseInsensitive() {
+	sua.mu.Lock()
+	sua.caseInsensitive = true
+	sua.mu.Unlock()
+}
+
+// SetDummyHash makes unknown and disabled users take as long to reject as wrong passwords, by
+// checking the password against a bcrypt hash of the given cost, so that response times do not tell
+// which user names exist. This costs a bcrypt comparison for every user that is not found here.
+func (sua *staticUsersAuth) SetDummyHash(cost int) error {
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return err
+	}
+	sua.mu.Lock()
+	sua.dummyHash = hash
+	sua.mu.Unlock()
+	return nil
+}
+
+// checkDummyHash spends the time of a password check, if SetDummyHash was called.
+func (sua *staticUsersAuth) checkDummyHash(password api.PasswordString) {
+	sua.mu.RLock()
+	hash := sua.dummyHash
+	sua.mu.RUnlock()
+	if hash != nil {
+		bcrypt.CompareHashAndPassword(hash, []byte(password))
+	}
+}
+
+// SetRehashCost makes bcrypt password hashes of a lower cost be replaced in the users file with
+// hashes of this cost, when the user logs in successfully. Users from the config are not updated.
+func (sua *staticUsersAuth) SetRehashCost(cost int) {
+	sua.mu.Lock()
+	sua.rehashCost = cost
+	sua.rehashed = make(map[string]bool)
+	sua.mu.Unlock()
+}
+
+// lookup returns the requirements for the user: of the exact entry if there is one,
+// otherwise of the first pattern that matches.
+func (sua *staticUsersAuth) lookup(user string) *Requirements {
+	sua.mu.RLock()
+	defer sua.mu.RUnlock()
+	if reqs := sua.users[user]; reqs != nil || user == "" {
+		// Anonymous access is only granted explicitly, not by "*".
+		return reqs
+	}
+	if sua.caseInsensitive {
+		user = strings.ToLower(user)
+		// Static user lists are short, a scan is fine.
+		for name, reqs := range sua.users {
+			if !isUserPattern(name) && strings.ToLower(name) == user {
+				return reqs
+			}
+		}
+	}
+	for _, p := range sua.patterns {
+		pattern := p
+		if sua.caseInsensitive {
+			pattern = strings.ToLower(p)
+		}
+		if ok, _ := path.Match(pattern, user); ok {
+			return sua.users[p]
+		}
+	}
+	return nil
 }
 
 func (sua *staticUsersAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
-	reqs := sua.users[user]
+	reqs := sua.lookup(user)
 	if reqs == nil {
+		if user != "" {
+			sua.checkDummyHash(password)
+		}
 		return false, nil, api.NoMatch
 	}
+	if reqs.Disabled {
+		sua.checkDummyHash(password)
+		return false, nil, nil
+	}
+	code := ""
+	if reqs.TOTPSecret != "" {
+		i := strings.LastIndex(string(password), ":")
+		if i < 0 || !isTOTPCode(string(password[i+1:])) {
+			return false, nil, api.NoTOTPCode
+		}
+		password, code = password[:i], string(password[i+1:])
+	}
 	if reqs.Password != nil {
-		if bcrypt.CompareHashAndPassword([]byte(*reqs.Password), []byte(password)) != nil {
+		ok, err := checkPasswordHash(string(*reqs.Password), []byte(password))
+		if err != nil {
+			return false, nil, fmt.Errorf("bad password hash for %s: %s", user, err)
+		}
+		if !ok {
 			return false, nil, nil
 		}
 	}
+	if code != "" {
+		ok, err := checkTOTP(reqs.TOTPSecret, code, time.Now())
+		if err != nil {
+			return false, nil, fmt.Errorf("bad TOTP secret for %s: %s", user, err)
+		}
+		if !ok {
+			return false, nil, api.WrongTOTPCode
+		}
+	}
+	if reqs.Password != nil {
+		sua.maybeRehash(user, string(*reqs.Password), password)
+	}
 	return true, reqs.Labels, nil
 }
 
 func (sua *staticUsersAuth) Stop() {
+	if sua.watcher != nil {
+		sua.watcher.Close()
+	}
 }
 
 func (sua *staticUsersAuth) Name() string {
@@ -0,0 +1,267 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+	"golang.org/x/crypto/bcrypt"
+	fsnotify "gopkg.in/fsnotify.v1"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// How long to wait for writes to the users file to settle before reloading it.
+const usersFileReloadDelay = 500 * time.Millisecond
+
+// What to do about a user that is in more than one source: the users map of the config and users files.
+const (
+	// The user from the source listed last is used.
+	UsersConflictLastWins = "last_wins"
+	// A user must be in one source only; a file that would add a second one is not loaded.
+	UsersConflictError = "error"
+)
+
+// ReadUsersFile reads a static user map from a YAML (or JSON) file,
+// in the same format as the users section of the config.
+func ReadUsersFile(file string) (map[string]*Requirements, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsersFile(file, data)
+}
+
+func parseUsersFile(file string, data []byte) (map[string]*Requirements, error) {
+	users := make(map[string]*Requirements)
+	if err := yaml.UnmarshalStrict(data, &users); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", file, err)
+	}
+	for user, reqs := range users {
+		if reqs == nil {
+			users[user] = &Requirements{}
+		}
+	}
+	if err := ValidateUsers(users); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return users, nil
+}
+
+// NewStaticUserFileAuth creates a static user authenticator that, in addition to the users given
+// in the config, loads users from a file, which take precedence. The file is watched and reloaded
+// when it changes; if it cannot be read or parsed, the previous set of users remains in effect.
+func NewStaticUserFileAuth(file string, users map[string]*Requirements) (*staticUsersAuth, error) {
+	return NewStaticUserFilesAuth([]string{file}, users, UsersConflictLastWins)
+}
+
+// NewStaticUserFilesAuth is like NewStaticUserFileAuth, with several files. Users that are in more
+// than one of the config and the files are handled according to conflicts, see UsersConflictLastWins
+// and UsersConflictError. Each file is reloaded on its own.
+func NewStaticUserFilesAuth(files []string, users map[string]*Requirements, conflicts string) (*staticUsersAuth, error) {
+	sua := &staticUsersAuth{inline: users, files: files, fileUsers: make([]map[string]*Requirements, len(files)), conflicts: conflicts}
+	loaded := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if sua.fileUsers[i], err = parseUsersFile(file, data); err != nil {
+			return nil, err
+		}
+		loaded[i] = data
+	}
+	if err := sua.merge(sua.fileUsers); err != nil {
+		return nil, err
+	}
+	var err error
+	sua.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher for %s: %s", strings.Join(files, ", "), err)
+	}
+	// Watch the directories rather than the files, so that replacing a file (as editors and
+	// Kubernetes config maps do) is noticed too.
+	for _, file := range files {
+		if err := sua.watcher.Add(filepath.Dir(file)); err != nil {
+			sua.watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %s", file, err)
+		}
+	}
+	go sua.watch(loaded)
+	return sua, nil
+}
+
+// merge swaps in the user map merged from the config and the files.
+func (sua *staticUsersAuth) merge(fileUsers []map[string]*Requirements) error {
+	users := make(map[string]*Requirements, len(sua.inline))
+	source := make(map[string]string, len(sua.inline))
+	for user, reqs := range sua.inline {
+		users[user], source[user] = reqs, "the config"
+	}
+	for i, fu := range fileUsers {
+		for user, reqs := range fu {
+			if prev, ok := source[user]; ok && sua.conflicts == UsersConflictError {
+				return fmt.Errorf("user %s is in both %s and %s", user, prev, sua.files[i])
+			}
+			users[user], source[user] = reqs, sua.files[i]
+		}
+	}
+	patterns := userPatterns(users)
+	sua.mu.Lock()
+	sua.users, sua.patterns = users, patterns
+	sua.mu.Unlock()
+	return nil
+}
+
+// reload parses a changed file and swaps in the merged user map with it.
+func (sua *staticUsersAuth) reload(i int, data []byte) error {
+	users, err := parseUsersFile(sua.files[i], data)
+	if err != nil {
+		return err
+	}
+	fileUsers := append([]map[string]*Requirements(nil), sua.fileUsers...)
+	fileUsers[i] = users
+	if err := sua.merge(fileUsers); err != nil {
+		return err
+	}
+	sua.fileUsers = fileUsers
+	return nil
+}
+
+func (sua *staticUsersAuth) watch(loaded [][]byte) {
+	var reload <-chan time.Time
+	for {
+		select {
+		case _, ok := <-sua.watcher.Events:
+			if !ok {
+				return
+			}
+			// Any change in the directories may be a change of a file, e.g. a symlink swap.
+			// Changes are batched and the contents compared, so that unrelated ones are ignored.
+			reload = time.After(usersFileReloadDelay)
+		case err, ok := <-sua.watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("Error watching %s: %s", strings.Join(sua.files, ", "), err)
+		case <-reload:
+			reload = nil
+			for i, file := range sua.files {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					glog.Errorf("Failed to reload users from %s, keeping the previous ones: %s", file, err)
+					continue
+				}
+				if bytes.Equal(data, loaded[i]) {
+					continue
+				}
+				if err := sua.reload(i, data); err != nil {
+					glog.Errorf("Failed to reload users, keeping the previous ones: %s", err)
+					continue
+				}
+				loaded[i] = data
+				glog.Infof("Reloaded users from %s", file)
+			}
+		}
+	}
+}
+
+// maybeRehash upgrades the password hash in the background if it is a bcrypt hash of lower cost
+// than set by SetRehashCost, which is only possible for users from the users file.
+func (sua *staticUsersAuth) maybeRehash(user, hash string, password api.PasswordString) {
+	sua.mu.Lock()
+	cost := sua.rehashCost
+	if cost == 0 || sua.rehashed[hash] || !isBcryptHash(hash) {
+		sua.mu.Unlock()
+		return
+	}
+	if c, err := bcrypt.Cost([]byte(hash)); err != nil || c >= cost {
+		sua.mu.Unlock()
+		return
+	}
+	sua.rehashed[hash] = true
+	sua.mu.Unlock()
+	go func() {
+		file, err := sua.rehash(hash, password, cost)
+		if err != nil {
+			glog.Warningf("Password hash of %s not upgraded to bcrypt cost %d: %s", user, cost, err)
+			return
+		}
+		glog.Infof("Upgraded password hash of %s in %s to bcrypt cost %d", user, file, cost)
+	}()
+}
+
+// rehash replaces the hash in the users file it is in, keeping the rest of the file as is,
+// and returns the file. The file is then reloaded by the watcher.
+func (sua *staticUsersAuth) rehash(hash string, password api.PasswordString, cost int) (string, error) {
+	if len(sua.files) == 0 {
+		return "", errors.New("users from the config are read-only, only those from users files can be updated")
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	sua.writeMu.Lock()
+	defer sua.writeMu.Unlock()
+	for _, file := range sua.files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		switch bytes.Count(data, []byte(hash)) {
+		case 0:
+			continue
+		case 1:
+		default:
+			return "", fmt.Errorf("the hash occurs more than once in %s", file)
+		}
+		return file, writeFileAtomically(file, bytes.Replace(data, []byte(hash), newHash, 1))
+	}
+	return "", fmt.Errorf("the user is not from %s, users from the config are read-only", strings.Join(sua.files, ", "))
+}
+
+// writeFileAtomically replaces the file by renaming a new one over it, so that it is never seen partially written.
+func writeFileAtomically(file string, data []byte) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(fi.Mode().Perm())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
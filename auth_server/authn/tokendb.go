@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cesanta/glog"
@@ -60,6 +61,11 @@ type TokenDB interface {
 // TokenDB stores tokens using LevelDB
 type TokenDBImpl struct {
 	*leveldb.DB
+
+	// Serializes writes, so that the sweeper does not delete a token that has just been stored.
+	mu        sync.Mutex
+	stopSweep chan struct{}
+	sweepDone chan struct{}
 }
 
 // TokenDBValue is stored in the database, JSON-serialized.
@@ -74,8 +80,11 @@ type TokenDBValue struct {
 	Labels         api.Labels `json:"labels,omitempty"`
 }
 
-// NewTokenDB returns a new TokenDB structure
+// NewTokenDB returns a new TokenDB structure, kept in memory if file is MemoryTokenDB.
 func NewTokenDB(file string) (TokenDB, error) {
+	if file == MemoryTokenDB {
+		return NewMemoryTokenDB(), nil
+	}
 	db, err := leveldb.OpenFile(file, nil)
 	return &TokenDBImpl{
 		DB: db,
@@ -111,7 +120,9 @@ func (db *TokenDBImpl) StoreToken(user string, v *TokenDBValue, updatePassword b
 	if err != nil {
 		return "", err
 	}
+	db.mu.Lock()
 	err = db.Put(getDBKey(user), data, nil)
+	db.mu.Unlock()
 	if err != nil {
 		glog.Errorf("failed to set token data for %s: %s", user, err)
 	}
@@ -138,6 +149,8 @@ func (db *TokenDBImpl) ValidateToken(user string, password api.PasswordString) e
 
 func (db *TokenDBImpl) DeleteToken(user string) error {
 	glog.V(1).Infof("deleting token for %s", user)
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if err := db.Delete(getDBKey(user), nil); err != nil {
 		return fmt.Errorf("failed to delete %s: %s", user, err)
 	}
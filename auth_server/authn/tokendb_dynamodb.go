@@ -0,0 +1,258 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+)
+
+const defaultDynamoDBExpiryGrace = 30 * 24 * time.Hour
+
+type GitHubDynamoDBStoreConfig struct {
+	// The table must have a string partition key named "username".
+	Table  string `mapstructure:"table,omitempty"`
+	Region string `mapstructure:"region,omitempty"`
+	// Endpoint URL, e.g. for DynamoDB Local. Defaults to https://dynamodb.<region>.amazonaws.com.
+	Endpoint string `mapstructure:"endpoint,omitempty"`
+	// Credentials. Default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+	AccessKeyID     string `mapstructure:"access_key_id,omitempty"`
+	SecretAccessKey string `mapstructure:"secret_access_key,omitempty"`
+	SessionToken    string `mapstructure:"session_token,omitempty"`
+	// How long after revalidation is due items are expired by the table's TTL, if enabled on
+	// the "expires" attribute. Until then, expired tokens are revalidated with GitHub. Default is 30 days.
+	ExpiryGrace time.Duration `mapstructure:"expiry_grace,omitempty"`
+	HTTPTimeout time.Duration `mapstructure:"http_timeout,omitempty"`
+}
+
+// Validate checks the config and fills in the defaults.
+func (c *GitHubDynamoDBStoreConfig) Validate(configKey string) error {
+	if c.Table == "" || c.Region == "" {
+		return fmt.Errorf("%s.{table,region} are required", configKey)
+	}
+	if c.ExpiryGrace <= 0 {
+		c.ExpiryGrace = defaultDynamoDBExpiryGrace
+	}
+	if c.HTTPTimeout <= 0 {
+		c.HTTPTimeout = 10 * time.Second
+	}
+	return nil
+}
+
+type dynamoDBTokenDB struct {
+	config   *GitHubDynamoDBStoreConfig
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+type dynamoDBAttr struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type dynamoDBError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoDBError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type[strings.LastIndex(e.Type, "#")+1:], e.Message)
+}
+
+func (e *dynamoDBError) conditionFailed() bool {
+	return strings.HasSuffix(e.Type, "#ConditionalCheckFailedException")
+}
+
+// NewDynamoDBTokenDB returns a new TokenDB structure which uses a DynamoDB table as the storage backend.
+func NewDynamoDBTokenDB(c *GitHubDynamoDBStoreConfig) (TokenDB, error) {
+	creds := awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}
+	if creds.AccessKeyID == "" {
+		creds = awsCredentialsFromEnv()
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("no AWS credentials for the DynamoDB token DB")
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://dynamodb.%s.amazonaws.com", c.Region)
+	}
+	return &dynamoDBTokenDB{
+		config:   c,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/",
+		creds:    creds,
+		client:   &http.Client{Timeout: c.HTTPTimeout},
+	}, nil
+}
+
+func (db *dynamoDBTokenDB) String() string {
+	return fmt.Sprintf("DynamoDB: %s (%s)", db.config.Table, db.config.Region)
+}
+
+// call makes a DynamoDB API request. Errors returned by DynamoDB are *dynamoDBError.
+func (db *dynamoDBTokenDB) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", db.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+action)
+	signAWSRequest(req, body, db.creds, db.config.Region, "dynamodb", time.Now())
+	resp, err := db.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var de dynamoDBError
+		if json.Unmarshal(respBody, &de) != nil || de.Type == "" {
+			return fmt.Errorf("DynamoDB %s: %s", action, resp.Status)
+		}
+		return &de
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+func (db *dynamoDBTokenDB) key(user string) map[string]dynamoDBAttr {
+	return map[string]dynamoDBAttr{"username": {S: user}}
+}
+
+func (db *dynamoDBTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	// Short-circuit calling DynamoDB when the user is anonymous
+	if user == "" {
+		return nil, nil
+	}
+	var out struct {
+		Item map[string]dynamoDBAttr `json:"Item"`
+	}
+	err := db.call("GetItem", map[string]interface{}{
+		"TableName":      db.config.Table,
+		"Key":            db.key(user),
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil {
+		glog.Errorf("Error getting token for user <%s>: %s", user, err)
+		return nil, fmt.Errorf("Error getting token for user <%s>: %s", user, err)
+	}
+	if out.Item == nil {
+		glog.V(2).Infof("No token for user <%s>", user)
+		return nil, nil
+	}
+	var dbv TokenDBValue
+	if err := json.Unmarshal([]byte(out.Item["token"].S), &dbv); err != nil {
+		glog.Errorf("Error parsing value for user <%q>: %s", user, err)
+		return nil, fmt.Errorf("Error parsing value: %v", err)
+	}
+	return &dbv, nil
+}
+
+// StoreToken stores the token. When the password is not updated, i.e. when an existing token is
+// refreshed, the write is conditional on the stored password being unchanged, so that a sign-in
+// that happened in the meantime is not undone.
+func (db *dynamoDBTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (dp string, err error) {
+	if updatePassword {
+		dp = uniuri.New()
+		dph, _ := bcrypt.GenerateFromPassword([]byte(dp), bcrypt.DefaultCost)
+		v.DockerPassword = string(dph)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	in := map[string]interface{}{
+		"TableName": db.config.Table,
+		"Item": map[string]dynamoDBAttr{
+			"username":        {S: user},
+			"token":           {S: string(data)},
+			"docker_password": {S: v.DockerPassword},
+			"expires":         {N: strconv.FormatInt(v.ValidUntil.Add(db.config.ExpiryGrace).Unix(), 10)},
+		},
+	}
+	if !updatePassword {
+		in["ConditionExpression"] = "docker_password = :dp"
+		in["ExpressionAttributeValues"] = map[string]dynamoDBAttr{":dp": {S: v.DockerPassword}}
+	}
+	if err := db.call("PutItem", in, nil); err != nil {
+		if de, ok := err.(*dynamoDBError); ok && de.conditionFailed() {
+			glog.Warningf("Token for user <%s> changed while refreshing it, not storing", user)
+			return "", fmt.Errorf("token for user <%s> was changed concurrently", user)
+		}
+		glog.Errorf("Failed to store token data for user <%s>: %s", user, err)
+		return "", fmt.Errorf("Failed to store token data for user <%s>: %s", user, err)
+	}
+	glog.V(2).Infof("Server tokens for <%s> stored", user)
+	return
+}
+
+func (db *dynamoDBTokenDB) ValidateToken(user string, password api.PasswordString) error {
+	dbv, err := db.GetValue(user)
+	if err != nil {
+		return err
+	}
+	if dbv == nil {
+		return api.NoMatch
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbv.DockerPassword), []byte(password)) != nil {
+		return api.WrongPass
+	}
+	if time.Now().After(dbv.ValidUntil) {
+		return ExpiredToken
+	}
+	return nil
+}
+
+func (db *dynamoDBTokenDB) DeleteToken(user string) error {
+	glog.Infof("Deleting token for user <%s>", user)
+	err := db.call("DeleteItem", map[string]interface{}{"TableName": db.config.Table, "Key": db.key(user)}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to delete token for user <%s>: %s", user, err)
+	}
+	return nil
+}
+
+// CheckHealth checks that the table is accessible.
+func (db *dynamoDBTokenDB) CheckHealth() error {
+	return db.call("DescribeTable", map[string]interface{}{"TableName": db.config.Table}, nil)
+}
+
+func (db *dynamoDBTokenDB) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const encryptedTokenPrefix = "enc:"
+
+// encryptedTokenDB wraps a TokenDB to encrypt the GitHub tokens in stored values with AES-GCM.
+// Values stored before encryption was enabled are read as they are.
+type encryptedTokenDB struct {
+	TokenDB
+	// The first key encrypts, all of them are tried for decryption.
+	keys []cipher.AEAD
+}
+
+// ParseTokenEncryptionKey decodes a base64-encoded 256-bit AES key.
+func ParseTokenEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key: must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// NewEncryptedTokenDB returns a TokenDB that encrypts tokens with the first key before storing them
+// in db, and decrypts them with whichever of the keys they were encrypted with.
+func NewEncryptedTokenDB(db TokenDB, keys ...string) (TokenDB, error) {
+	edb := &encryptedTokenDB{TokenDB: db}
+	for _, k := range keys {
+		key, err := ParseTokenEncryptionKey(k)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		edb.keys = append(edb.keys, aead)
+	}
+	if len(edb.keys) == 0 {
+		return nil, errors.New("no token encryption key")
+	}
+	return edb, nil
+}
+
+func (db *encryptedTokenDB) encrypt(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	aead := db.keys[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encryptedTokenPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(s), nil)), nil
+}
+
+func (db *encryptedTokenDB) decrypt(s string) (string, error) {
+	if !strings.HasPrefix(s, encryptedTokenPrefix) {
+		return s, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s[len(encryptedTokenPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted token: %s", err)
+	}
+	for _, aead := range db.keys {
+		if len(data) < aead.NonceSize() {
+			break
+		}
+		if plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil); err == nil {
+			return string(plain), nil
+		}
+	}
+	return "", errors.New("could not decrypt token, was the encryption key changed?")
+}
+
+func (db *encryptedTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	v, err := db.TokenDB.GetValue(user)
+	if err != nil || v == nil {
+		return v, err
+	}
+	if v.AccessToken, err = db.decrypt(v.AccessToken); err != nil {
+		return nil, fmt.Errorf("access token of %s: %s", user, err)
+	}
+	if v.RefreshToken, err = db.decrypt(v.RefreshToken); err != nil {
+		return nil, fmt.Errorf("refresh token of %s: %s", user, err)
+	}
+	return v, nil
+}
+
+func (db *encryptedTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (string, error) {
+	ev := *v
+	var err error
+	if ev.AccessToken, err = db.encrypt(v.AccessToken); err != nil {
+		return "", err
+	}
+	if ev.RefreshToken, err = db.encrypt(v.RefreshToken); err != nil {
+		return "", err
+	}
+	dp, err := db.TokenDB.StoreToken(user, &ev, updatePassword)
+	// The wrapped DB sets the password hash.
+	v.DockerPassword = ev.DockerPassword
+	return dp, err
+}
+
+// CheckHealth checks the wrapped DB, if it has a remote backend.
+func (db *encryptedTokenDB) CheckHealth() error {
+	if hc, ok := db.TokenDB.(api.HealthChecker); ok {
+		return hc.CheckHealth()
+	}
+	return nil
+}
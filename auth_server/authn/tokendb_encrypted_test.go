@@ -0,0 +1,139 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func testTokenEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newTestEncryptedTokenDB(t *testing.T, backend TokenDB, keys ...string) TokenDB {
+	db, err := NewEncryptedTokenDB(backend, keys...)
+	if err != nil {
+		t.Fatalf("NewEncryptedTokenDB: %s", err)
+	}
+	return db
+}
+
+func TestEncryptedTokenDB(t *testing.T) {
+	backend := NewMemoryTokenDB()
+	db := newTestEncryptedTokenDB(t, backend, testTokenEncryptionKey(1))
+
+	v := &TokenDBValue{AccessToken: "access", RefreshToken: "refresh", ValidUntil: time.Now().Add(time.Hour)}
+	dp, err := db.StoreToken("alice", v, true)
+	if err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if v.AccessToken != "access" || v.DockerPassword == "" {
+		t.Errorf("StoreToken changed the tokens or did not set the password hash: %+v", v)
+	}
+	raw, _ := backend.GetValue("alice")
+	for _, s := range []string{raw.AccessToken, raw.RefreshToken} {
+		if !strings.HasPrefix(s, encryptedTokenPrefix) || strings.Contains(s, "access") || strings.Contains(s, "refresh") {
+			t.Errorf("token stored as %q", s)
+		}
+	}
+	got, err := db.GetValue("alice")
+	if err != nil || got.AccessToken != "access" || got.RefreshToken != "refresh" {
+		t.Fatalf("GetValue: %+v, %v", got, err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != nil {
+		t.Errorf("ValidateToken: %s", err)
+	}
+
+	// Empty tokens stay empty.
+	if _, err := db.StoreToken("bob", &TokenDBValue{AccessToken: "access"}, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if raw, _ := backend.GetValue("bob"); raw.RefreshToken != "" {
+		t.Errorf("empty refresh token stored as %q", raw.RefreshToken)
+	}
+	if got, err := db.GetValue("nobody"); got != nil || err != nil {
+		t.Errorf("GetValue of a missing user: %+v, %v", got, err)
+	}
+}
+
+func TestEncryptedTokenDBKeyRotation(t *testing.T) {
+	backend := NewMemoryTokenDB()
+	oldKey, newKey := testTokenEncryptionKey(1), testTokenEncryptionKey(2)
+	if _, err := newTestEncryptedTokenDB(t, backend, oldKey).StoreToken("alice", &TokenDBValue{AccessToken: "old"}, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+
+	db := newTestEncryptedTokenDB(t, backend, newKey, oldKey)
+	if got, err := db.GetValue("alice"); err != nil || got.AccessToken != "old" {
+		t.Fatalf("GetValue with the old key second: %+v, %v", got, err)
+	}
+	// New values are encrypted with the first key only.
+	if _, err := db.StoreToken("alice", &TokenDBValue{AccessToken: "new"}, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if got, err := newTestEncryptedTokenDB(t, backend, newKey).GetValue("alice"); err != nil || got.AccessToken != "new" {
+		t.Errorf("GetValue with the new key: %+v, %v", got, err)
+	}
+	if _, err := newTestEncryptedTokenDB(t, backend, oldKey).GetValue("alice"); err == nil {
+		t.Errorf("expected a token encrypted with the new key not to decrypt with the old one")
+	}
+}
+
+func TestEncryptedTokenDBLegacyPlaintext(t *testing.T) {
+	backend := NewMemoryTokenDB()
+	if _, err := backend.StoreToken("alice", &TokenDBValue{AccessToken: "plain", RefreshToken: "plain-refresh"}, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	got, err := newTestEncryptedTokenDB(t, backend, testTokenEncryptionKey(1)).GetValue("alice")
+	if err != nil || got.AccessToken != "plain" || got.RefreshToken != "plain-refresh" {
+		t.Errorf("GetValue of a plaintext value: %+v, %v", got, err)
+	}
+}
+
+func TestEncryptedTokenDBErrors(t *testing.T) {
+	backend := NewMemoryTokenDB()
+	if _, err := newTestEncryptedTokenDB(t, backend, testTokenEncryptionKey(1)).StoreToken("alice", &TokenDBValue{AccessToken: "a"}, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if _, err := newTestEncryptedTokenDB(t, backend, testTokenEncryptionKey(3)).GetValue("alice"); err == nil ||
+		!strings.Contains(err.Error(), "could not decrypt") {
+		t.Errorf("GetValue with a wrong key: %v", err)
+	}
+	for _, token := range []string{encryptedTokenPrefix + "!!!", encryptedTokenPrefix + "AAAA"} {
+		backend.StoreToken("bob", &TokenDBValue{AccessToken: token}, false)
+		if _, err := newTestEncryptedTokenDB(t, backend, testTokenEncryptionKey(1)).GetValue("bob"); err == nil {
+			t.Errorf("GetValue of %q succeeded", token)
+		}
+	}
+
+	for _, keys := range [][]string{
+		nil,
+		{"not base64"},
+		{base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		{testTokenEncryptionKey(1), ""},
+	} {
+		if _, err := NewEncryptedTokenDB(backend, keys...); err == nil {
+			t.Errorf("expected keys %q to be rejected", keys)
+		}
+	}
+}
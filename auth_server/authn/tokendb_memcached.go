@@ -0,0 +1,376 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+)
+
+const (
+	defaultMemcachedKeyPrefix   = "docker_auth:"
+	defaultMemcachedExpiryGrace = 30 * 24 * time.Hour
+	// Idle connections kept per server.
+	memcachedMaxIdleConns = 4
+	// Longest key memcached accepts.
+	memcachedMaxKeyLen = 250
+)
+
+// GitHubMemcachedStoreConfig keeps tokens in memcached. It has no replication, so tokens
+// are lost when a server restarts or evicts them and users have to sign in again.
+type GitHubMemcachedStoreConfig struct {
+	// Servers as host:port. Tokens are spread across them by a hash of the key, so all instances
+	// of docker_auth must list the same servers in the same order.
+	Servers []string `mapstructure:"servers,omitempty"`
+	// Prepended to keys, default is "docker_auth:".
+	KeyPrefix string `mapstructure:"key_prefix,omitempty"`
+	// How long after revalidation is due tokens are kept. Until then, expired tokens are
+	// revalidated with GitHub. Default is 30 days.
+	ExpiryGrace time.Duration `mapstructure:"expiry_grace,omitempty"`
+	// Timeout of connecting and of every command. Default is 1s.
+	Timeout time.Duration `mapstructure:"timeout,omitempty"`
+}
+
+// Validate checks the config and fills in the defaults.
+func (c *GitHubMemcachedStoreConfig) Validate(configKey string) error {
+	if len(c.Servers) == 0 {
+		return fmt.Errorf("%s.servers is required", configKey)
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = defaultMemcachedKeyPrefix
+	}
+	if c.ExpiryGrace <= 0 {
+		c.ExpiryGrace = defaultMemcachedExpiryGrace
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second
+	}
+	return nil
+}
+
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// memcachedClient speaks the memcached text protocol, just enough for the token DB.
+type memcachedClient struct {
+	servers []string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*memcachedConn
+}
+
+// memcachedError is an error reported by the server.
+type memcachedError string
+
+func (e memcachedError) Error() string {
+	return "memcached: " + string(e)
+}
+
+func (c *memcachedClient) server(key string) string {
+	return c.servers[crc32.ChecksumIEEE([]byte(key))%uint32(len(c.servers))]
+}
+
+func (c *memcachedClient) getConn(addr string) (*memcachedConn, error) {
+	c.mu.Lock()
+	if conns := c.idle[addr]; len(conns) > 0 {
+		cn := conns[len(conns)-1]
+		c.idle[addr] = conns[:len(conns)-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedConn{Conn: nc, r: bufio.NewReader(nc)}, nil
+}
+
+func (c *memcachedClient) putConn(addr string, cn *memcachedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[addr]) >= memcachedMaxIdleConns {
+		cn.Close()
+		return
+	}
+	c.idle[addr] = append(c.idle[addr], cn)
+}
+
+// do runs f on a connection to addr. Connections are reused unless f fails with
+// an I/O error, after which the state of the connection is unknown.
+func (c *memcachedClient) do(addr string, f func(cn *memcachedConn) error) error {
+	cn, err := c.getConn(addr)
+	if err != nil {
+		return err
+	}
+	cn.SetDeadline(time.Now().Add(c.timeout))
+	err = f(cn)
+	if _, ok := err.(memcachedError); err != nil && !ok {
+		cn.Close()
+		return err
+	}
+	c.putConn(addr, cn)
+	return err
+}
+
+// readLine reads a response line and turns error responses into memcachedError.
+func (cn *memcachedConn) readLine() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR ") || strings.HasPrefix(line, "SERVER_ERROR ") {
+		return "", memcachedError(line)
+	}
+	return line, nil
+}
+
+// get returns the value of key, or nil if there is none.
+func (c *memcachedClient) get(key string) ([]byte, error) {
+	var value []byte
+	err := c.do(c.server(key), func(cn *memcachedConn) error {
+		if _, err := fmt.Fprintf(cn, "get %s\r\n", key); err != nil {
+			return err
+		}
+		for {
+			line, err := cn.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+			// VALUE <key> <flags> <bytes>
+			f := strings.Fields(line)
+			if len(f) != 4 || f[0] != "VALUE" {
+				return fmt.Errorf("memcached: unexpected response %q", line)
+			}
+			n, err := strconv.Atoi(f[3])
+			if err != nil {
+				return fmt.Errorf("memcached: unexpected response %q", line)
+			}
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(cn.r, buf); err != nil {
+				return err
+			}
+			value = buf[:n]
+		}
+	})
+	return value, err
+}
+
+// set stores value under key until expires, or forever if expires is zero.
+func (c *memcachedClient) set(key string, value []byte, expires time.Time) error {
+	var exptime int64
+	if !expires.IsZero() {
+		// Absolute Unix time, the server treats values over 30 days as such.
+		exptime = expires.Unix()
+	}
+	return c.do(c.server(key), func(cn *memcachedConn) error {
+		if _, err := fmt.Fprintf(cn, "set %s 0 %d %d\r\n%s\r\n", key, exptime, len(value), value); err != nil {
+			return err
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+func (c *memcachedClient) delete(key string) error {
+	return c.do(c.server(key), func(cn *memcachedConn) error {
+		if _, err := fmt.Fprintf(cn, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+// ping checks that all the servers respond.
+func (c *memcachedClient) ping() error {
+	for _, addr := range c.servers {
+		err := c.do(addr, func(cn *memcachedConn) error {
+			if _, err := io.WriteString(cn, "version\r\n"); err != nil {
+				return err
+			}
+			line, err := cn.readLine()
+			if err == nil && !strings.HasPrefix(line, "VERSION ") {
+				err = fmt.Errorf("memcached: unexpected response %q", line)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", addr, err)
+		}
+	}
+	return nil
+}
+
+func (c *memcachedClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conns := range c.idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}
+	c.idle = map[string][]*memcachedConn{}
+}
+
+type memcachedTokenDB struct {
+	config *GitHubMemcachedStoreConfig
+	client *memcachedClient
+}
+
+// NewMemcachedTokenDB returns a new TokenDB structure which uses memcached as the storage backend.
+// All the servers have to be reachable.
+func NewMemcachedTokenDB(c *GitHubMemcachedStoreConfig) (TokenDB, error) {
+	db := &memcachedTokenDB{
+		config: c,
+		client: &memcachedClient{servers: c.Servers, timeout: c.Timeout, idle: map[string][]*memcachedConn{}},
+	}
+	if err := db.client.ping(); err != nil {
+		db.client.close()
+		return nil, fmt.Errorf("memcached token DB is unreachable: %s", err)
+	}
+	return db, nil
+}
+
+func (db *memcachedTokenDB) String() string {
+	return fmt.Sprintf("memcached: %s", strings.Join(db.config.Servers, ","))
+}
+
+// key returns the memcached key for user. Keys cannot contain spaces or control characters
+// and are limited in length, user names that would not fit are hashed.
+func (db *memcachedTokenDB) key(user string) string {
+	key := db.config.KeyPrefix + string(getDBKey(user))
+	if len(key) > memcachedMaxKeyLen || strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		h := sha256.Sum256([]byte(user))
+		key = db.config.KeyPrefix + string(getDBKey("sha256:"+hex.EncodeToString(h[:])))
+	}
+	return key
+}
+
+func (db *memcachedTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	// Short-circuit calling memcached when the user is anonymous
+	if user == "" {
+		return nil, nil
+	}
+	data, err := db.client.get(db.key(user))
+	if err != nil {
+		glog.Errorf("Error getting token for user <%s>: %s", user, err)
+		return nil, fmt.Errorf("Error getting token for user <%s>: %s", user, err)
+	}
+	if data == nil {
+		glog.V(2).Infof("No token for user <%s>", user)
+		return nil, nil
+	}
+	var dbv TokenDBValue
+	if err := json.Unmarshal(data, &dbv); err != nil {
+		glog.Errorf("Error parsing value for user <%q>: %s", user, err)
+		return nil, fmt.Errorf("Error parsing value: %v", err)
+	}
+	return &dbv, nil
+}
+
+func (db *memcachedTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (dp string, err error) {
+	if updatePassword {
+		dp = uniuri.New()
+		dph, _ := bcrypt.GenerateFromPassword([]byte(dp), bcrypt.DefaultCost)
+		v.DockerPassword = string(dph)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var expires time.Time
+	if !v.ValidUntil.IsZero() {
+		expires = v.ValidUntil.Add(db.config.ExpiryGrace)
+	}
+	if err := db.client.set(db.key(user), data, expires); err != nil {
+		glog.Errorf("Failed to store token data for user <%s>: %s", user, err)
+		return "", fmt.Errorf("Failed to store token data for user <%s>: %s", user, err)
+	}
+	glog.V(2).Infof("Server tokens for <%s> stored", user)
+	return
+}
+
+func (db *memcachedTokenDB) ValidateToken(user string, password api.PasswordString) error {
+	dbv, err := db.GetValue(user)
+	if err != nil {
+		return err
+	}
+	if dbv == nil {
+		return api.NoMatch
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbv.DockerPassword), []byte(password)) != nil {
+		return api.WrongPass
+	}
+	if time.Now().After(dbv.ValidUntil) {
+		return ExpiredToken
+	}
+	return nil
+}
+
+func (db *memcachedTokenDB) DeleteToken(user string) error {
+	glog.Infof("Deleting token for user <%s>", user)
+	if err := db.client.delete(db.key(user)); err != nil {
+		return fmt.Errorf("Failed to delete token for user <%s>: %s", user, err)
+	}
+	return nil
+}
+
+// CheckHealth checks that all the servers respond.
+func (db *memcachedTokenDB) CheckHealth() error {
+	return db.client.ping()
+}
+
+func (db *memcachedTokenDB) Close() error {
+	db.client.close()
+	return nil
+}
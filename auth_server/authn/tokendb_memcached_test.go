@@ -0,0 +1,261 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakeMemcached serves enough of the memcached text protocol for the token DB.
+type fakeMemcached struct {
+	addr string
+
+	mu       sync.Mutex
+	items    map[string][]byte
+	commands []string
+	// If set, returned instead of the normal reply to the next command.
+	reply string
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	m := &fakeMemcached{addr: l.Addr().String(), items: make(map[string][]byte)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(c)
+		}
+	}()
+	return m
+}
+
+func (m *fakeMemcached) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			fmt.Fprintf(c, "CLIENT_ERROR line not terminated by CRLF\r\n")
+			return
+		}
+		f := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+		var data []byte
+		if f[0] == "set" && len(f) == 5 {
+			n, _ := strconv.Atoi(f[4])
+			data = make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			if string(data[n:]) != "\r\n" {
+				fmt.Fprintf(c, "CLIENT_ERROR bad data chunk\r\n")
+				return
+			}
+			data = data[:n]
+		}
+		m.mu.Lock()
+		m.commands = append(m.commands, strings.TrimSuffix(line, "\r\n"))
+		reply := m.reply
+		m.reply = ""
+		if reply == "" {
+			reply = m.handle(f, data)
+		}
+		m.mu.Unlock()
+		io.WriteString(c, reply)
+	}
+}
+
+func (m *fakeMemcached) handle(f []string, data []byte) string {
+	switch {
+	case f[0] == "version":
+		return "VERSION 1.6.0\r\n"
+	case f[0] == "get" && len(f) == 2:
+		v, ok := m.items[f[1]]
+		if !ok {
+			return "END\r\n"
+		}
+		return fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\nEND\r\n", f[1], len(v), v)
+	case f[0] == "set" && len(f) == 5:
+		m.items[f[1]] = data
+		return "STORED\r\n"
+	case f[0] == "delete" && len(f) == 2:
+		if _, ok := m.items[f[1]]; !ok {
+			return "NOT_FOUND\r\n"
+		}
+		delete(m.items, f[1])
+		return "DELETED\r\n"
+	}
+	return "ERROR\r\n"
+}
+
+func (m *fakeMemcached) lastCommand() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.commands[len(m.commands)-1]
+}
+
+func (m *fakeMemcached) item(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.items[key]
+}
+
+func (m *fakeMemcached) setItem(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = value
+}
+
+func (m *fakeMemcached) setReply(reply string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reply = reply
+}
+
+func newTestMemcachedTokenDB(t *testing.T, m *fakeMemcached) *memcachedTokenDB {
+	c := &GitHubMemcachedStoreConfig{Servers: []string{m.addr}}
+	if err := c.Validate("memcached"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewMemcachedTokenDB(c)
+	if err != nil {
+		t.Fatalf("NewMemcachedTokenDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db.(*memcachedTokenDB)
+}
+
+func TestMemcachedTokenDB(t *testing.T) {
+	m := newFakeMemcached(t)
+	db := newTestMemcachedTokenDB(t, m)
+
+	validUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	dp, err := db.StoreToken("alice", &TokenDBValue{AccessToken: "at", ValidUntil: validUntil,
+		Labels: api.Labels{"teams": {"a b", "c\r\nd"}}}, true)
+	if err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	key := "docker_auth:" + string(getDBKey("alice"))
+	exptime := validUntil.Add(defaultMemcachedExpiryGrace).Unix()
+	if cmd, want := m.lastCommand(), fmt.Sprintf("set %s 0 %d %d", key, exptime, len(m.item(key))); cmd != want {
+		t.Errorf("got %q, want %q", cmd, want)
+	}
+	v, err := db.GetValue("alice")
+	if err != nil || v == nil || v.AccessToken != "at" || !v.ValidUntil.Equal(validUntil) || v.Labels["teams"][1] != "c\r\nd" {
+		t.Fatalf("GetValue: %+v, %v", v, err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != nil {
+		t.Errorf("ValidateToken: %s", err)
+	}
+	if err := db.ValidateToken("alice", "wrong"); err != api.WrongPass {
+		t.Errorf("ValidateToken with a wrong password: %v", err)
+	}
+	if err := db.ValidateToken("bob", api.PasswordString(dp)); err != api.NoMatch {
+		t.Errorf("ValidateToken of an unknown user: %v", err)
+	}
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("DeleteToken: %s", err)
+	}
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("GetValue after DeleteToken: %+v, %v", v, err)
+	}
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("DeleteToken of a missing token: %s", err)
+	}
+	if err := db.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth: %s", err)
+	}
+}
+
+func TestMemcachedTokenDBKey(t *testing.T) {
+	db := &memcachedTokenDB{config: &GitHubMemcachedStoreConfig{KeyPrefix: "p:"}}
+	if got, want := db.key("alice"), "p:"+string(getDBKey("alice")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, user := range []string{"a b", "a\r\nget x", "a\x00", "a\x7f", strings.Repeat("a", 250)} {
+		key := db.key(user)
+		if len(key) > memcachedMaxKeyLen || strings.ContainsAny(key, " \r\n\x00\x7f") || !strings.HasPrefix(key, "p:") {
+			t.Errorf("%q: bad key %q", user, key)
+		}
+		if key == db.key(user+"x") {
+			t.Errorf("%q: key %q is not unique", user, key)
+		}
+	}
+}
+
+func TestMemcachedTokenDBErrors(t *testing.T) {
+	m := newFakeMemcached(t)
+	db := newTestMemcachedTokenDB(t, m)
+
+	for _, reply := range []string{"SERVER_ERROR out of memory storing object\r\n", "NOT_STORED\r\n"} {
+		m.setReply(reply)
+		if _, err := db.StoreToken("alice", &TokenDBValue{ValidUntil: time.Now()}, true); err == nil ||
+			!strings.Contains(err.Error(), strings.TrimSuffix(reply, "\r\n")) {
+			t.Errorf("StoreToken with %q: %v", reply, err)
+		}
+	}
+	m.setReply("CLIENT_ERROR bad command line format\r\n")
+	if _, err := db.GetValue("alice"); err == nil || !strings.Contains(err.Error(), "CLIENT_ERROR") {
+		t.Errorf("GetValue with an error: %v", err)
+	}
+	m.setReply("VALUE x 0\r\n")
+	if _, err := db.GetValue("alice"); err == nil || !strings.Contains(err.Error(), "unexpected response") {
+		t.Errorf("GetValue with a malformed reply: %v", err)
+	}
+	m.setReply("SERVER_ERROR busy\r\n")
+	if err := db.DeleteToken("alice"); err == nil {
+		t.Errorf("DeleteToken with an error succeeded")
+	}
+	m.setReply("ERROR\r\n")
+	if err := db.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth with an error succeeded")
+	}
+
+	// Connections survive server errors and are replaced after I/O errors.
+	m.setItem(db.key("alice"), []byte("not json"))
+	if _, err := db.GetValue("alice"); err == nil || !strings.Contains(err.Error(), "parsing") {
+		t.Errorf("GetValue of a malformed value: %v", err)
+	}
+	if err := db.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth after errors: %s", err)
+	}
+
+	c := &GitHubMemcachedStoreConfig{Servers: []string{m.addr, "127.0.0.1:1"}}
+	c.Validate("memcached")
+	if _, err := NewMemcachedTokenDB(c); err == nil {
+		t.Errorf("expected an unreachable server to be reported")
+	}
+}
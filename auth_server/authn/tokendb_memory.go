@@ -0,0 +1,105 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/glog"
+	"github.com/dchest/uniuri"
+)
+
+// MemoryTokenDB is the token_db value that selects the in-memory token DB.
+const MemoryTokenDB = ":memory:"
+
+// memoryTokenDB keeps tokens in memory, for tests and deployments where users
+// signing in again after a restart is acceptable.
+type memoryTokenDB struct {
+	mu sync.Mutex
+	// JSON-serialized, like in the other backends, so that callers cannot modify stored values.
+	values map[string][]byte
+}
+
+// NewMemoryTokenDB returns a new TokenDB structure which keeps tokens in memory.
+func NewMemoryTokenDB() TokenDB {
+	return &memoryTokenDB{values: make(map[string][]byte)}
+}
+
+func (db *memoryTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	db.mu.Lock()
+	data, found := db.values[user]
+	db.mu.Unlock()
+	if !found {
+		return nil, nil
+	}
+	var dbv TokenDBValue
+	if err := json.Unmarshal(data, &dbv); err != nil {
+		return nil, err
+	}
+	return &dbv, nil
+}
+
+func (db *memoryTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (dp string, err error) {
+	if updatePassword {
+		dp = uniuri.New()
+		dph, _ := bcrypt.GenerateFromPassword([]byte(dp), bcrypt.DefaultCost)
+		v.DockerPassword = string(dph)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	db.mu.Lock()
+	db.values[user] = data
+	db.mu.Unlock()
+	glog.V(2).Infof("Server tokens for %s stored in memory", user)
+	return
+}
+
+func (db *memoryTokenDB) ValidateToken(user string, password api.PasswordString) error {
+	dbv, err := db.GetValue(user)
+	if err != nil {
+		return err
+	}
+	if dbv == nil {
+		return api.NoMatch
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbv.DockerPassword), []byte(password)) != nil {
+		return api.WrongPass
+	}
+	if time.Now().After(dbv.ValidUntil) {
+		return ExpiredToken
+	}
+	return nil
+}
+
+func (db *memoryTokenDB) DeleteToken(user string) error {
+	glog.V(1).Infof("deleting token for %s", user)
+	db.mu.Lock()
+	delete(db.values, user)
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *memoryTokenDB) Close() error {
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestMemoryTokenDB(t *testing.T) {
+	db, err := NewTokenDB(MemoryTokenDB)
+	if err != nil {
+		t.Fatalf("NewTokenDB: %s", err)
+	}
+	defer db.Close()
+
+	v := &TokenDBValue{AccessToken: "at", ValidUntil: time.Now().Add(time.Hour), Labels: api.Labels{"teams": {"a"}}}
+	dp, err := db.StoreToken("alice", v, true)
+	if err != nil || dp == "" {
+		t.Fatalf("StoreToken: %q, %v", dp, err)
+	}
+	// Stored values are copies, changing them afterwards has no effect.
+	v.Labels["teams"][0] = "b"
+	got, err := db.GetValue("alice")
+	if err != nil || got == nil || got.AccessToken != "at" || got.Labels["teams"][0] != "a" {
+		t.Fatalf("GetValue: %+v, %v", got, err)
+	}
+	got.AccessToken = "changed"
+	if got, _ := db.GetValue("alice"); got.AccessToken != "at" {
+		t.Errorf("expected the stored value not to change, got %+v", got)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != nil {
+		t.Errorf("ValidateToken: %s", err)
+	}
+	if err := db.ValidateToken("alice", "wrong"); err != api.WrongPass {
+		t.Errorf("ValidateToken with a wrong password: %v", err)
+	}
+	if err := db.ValidateToken("bob", api.PasswordString(dp)); err != api.NoMatch {
+		t.Errorf("ValidateToken of an unknown user: %v", err)
+	}
+
+	// Storing without updating the password keeps the stored hash.
+	got, _ = db.GetValue("alice")
+	got.ValidUntil = time.Now().Add(-time.Minute)
+	if dp2, err := db.StoreToken("alice", got, false); dp2 != "" || err != nil {
+		t.Fatalf("StoreToken: %q, %v", dp2, err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != ExpiredToken {
+		t.Errorf("ValidateToken of an expired token: %v", err)
+	}
+
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("DeleteToken: %s", err)
+	}
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("GetValue after DeleteToken: %+v, %v", v, err)
+	}
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("DeleteToken of a missing token: %s", err)
+	}
+
+	// Each DB has its own tokens.
+	other, _ := NewTokenDB(MemoryTokenDB)
+	db.StoreToken("carol", &TokenDBValue{}, false)
+	if v, err := other.GetValue("carol"); v != nil || err != nil {
+		t.Errorf("expected DBs not to share tokens, got %+v, %v", v, err)
+	}
+}
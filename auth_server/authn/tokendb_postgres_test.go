@@ -0,0 +1,232 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// fakePostgres is a database/sql driver that understands just the statements of the token DB.
+type fakePostgres struct {
+	mu      sync.Mutex
+	queries []string
+	rows    map[string][]byte
+	// If set, returned by the next statement.
+	err error
+}
+
+func (f *fakePostgres) Connect(context.Context) (driver.Conn, error) {
+	return &fakePostgresConn{f}, nil
+}
+func (f *fakePostgres) Driver() driver.Driver { return nil }
+
+func (f *fakePostgres) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakePostgres) lastQuery() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[len(f.queries)-1]
+}
+
+type fakePostgresConn struct{ f *fakePostgres }
+
+func (c *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostgresStmt{c.f, query}, nil
+}
+func (c *fakePostgresConn) Close() error              { return nil }
+func (c *fakePostgresConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakePostgresStmt struct {
+	f     *fakePostgres
+	query string
+}
+
+func (s *fakePostgresStmt) Close() error  { return nil }
+func (s *fakePostgresStmt) NumInput() int { return -1 }
+
+func (s *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, err := s.run(args)
+	return driver.RowsAffected(1), err
+}
+
+func (s *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.run(args)
+}
+
+func (s *fakePostgresStmt) run(args []driver.Value) (*fakePostgresRows, error) {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := strings.Join(strings.Fields(s.query), " ")
+	f.queries = append(f.queries, q)
+	if err := f.err; err != nil {
+		f.err = nil
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(q, "CREATE TABLE"):
+	case strings.HasPrefix(q, "SELECT token FROM"):
+		if v, ok := f.rows[args[0].(string)]; ok {
+			return &fakePostgresRows{values: [][]byte{v}}, nil
+		}
+	case strings.HasPrefix(q, "INSERT INTO"):
+		if _, ok := args[2].(time.Time); !ok {
+			return nil, errors.New("valid_until is not a time")
+		}
+		f.rows[args[0].(string)] = []byte(args[1].(string))
+	case strings.HasPrefix(q, "DELETE FROM"):
+		delete(f.rows, args[0].(string))
+	default:
+		return nil, errors.New("unexpected statement " + q)
+	}
+	return &fakePostgresRows{}, nil
+}
+
+type fakePostgresRows struct{ values [][]byte }
+
+func (r *fakePostgresRows) Columns() []string { return []string{"token"} }
+func (r *fakePostgresRows) Close() error      { return nil }
+
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func newTestPostgresTokenDB(t *testing.T, table string) (*postgresTokenDB, *fakePostgres) {
+	f := &fakePostgres{rows: make(map[string][]byte)}
+	db, err := newPostgresTokenDB(sql.OpenDB(f), table)
+	if err != nil {
+		t.Fatalf("newPostgresTokenDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+func TestPostgresTokenDB(t *testing.T) {
+	db, f := newTestPostgresTokenDB(t, "Tokens")
+	if q := f.lastQuery(); !strings.HasPrefix(q, `CREATE TABLE IF NOT EXISTS "Tokens" (`) {
+		t.Errorf("unexpected %q", q)
+	}
+
+	validUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	dp, err := db.StoreToken("alice", &TokenDBValue{AccessToken: "at", ValidUntil: validUntil,
+		Labels: api.Labels{"teams": {"a"}}}, true)
+	if err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if q := f.lastQuery(); !strings.HasPrefix(q, `INSERT INTO "Tokens" (username, token, valid_until) VALUES ($1, $2, $3) ON CONFLICT`) {
+		t.Errorf("unexpected %q", q)
+	}
+	v, err := db.GetValue("alice")
+	if err != nil || v == nil || v.AccessToken != "at" || !v.ValidUntil.Equal(validUntil) || v.Labels["teams"][0] != "a" {
+		t.Fatalf("GetValue: %+v, %v", v, err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != nil {
+		t.Errorf("ValidateToken: %s", err)
+	}
+	if err := db.ValidateToken("alice", "wrong"); err != api.WrongPass {
+		t.Errorf("ValidateToken with a wrong password: %v", err)
+	}
+	if err := db.ValidateToken("bob", api.PasswordString(dp)); err != api.NoMatch {
+		t.Errorf("ValidateToken of an unknown user: %v", err)
+	}
+
+	// Updating the token keeps the password.
+	v.AccessToken = "at2"
+	v.ValidUntil = time.Now().Add(-time.Minute)
+	if _, err := db.StoreToken("alice", v, false); err != nil {
+		t.Fatalf("StoreToken: %s", err)
+	}
+	if err := db.ValidateToken("alice", api.PasswordString(dp)); err != ExpiredToken {
+		t.Errorf("ValidateToken of an expired token: %v", err)
+	}
+
+	if err := db.DeleteToken("alice"); err != nil {
+		t.Errorf("DeleteToken: %s", err)
+	}
+	if q := f.lastQuery(); q != `DELETE FROM "Tokens" WHERE username = $1` {
+		t.Errorf("unexpected %q", q)
+	}
+	if v, err := db.GetValue("alice"); v != nil || err != nil {
+		t.Errorf("GetValue after DeleteToken: %+v, %v", v, err)
+	}
+	if v, err := db.GetValue(""); v != nil || err != nil {
+		t.Errorf("GetValue of the anonymous user: %+v, %v", v, err)
+	}
+	if err := db.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth: %s", err)
+	}
+}
+
+func TestPostgresTokenDBErrors(t *testing.T) {
+	f := &fakePostgres{rows: make(map[string][]byte), err: errors.New("permission denied")}
+	if _, err := newPostgresTokenDB(sql.OpenDB(f), "tokens"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected a failure to create the table to be reported, got %v", err)
+	}
+
+	db, f := newTestPostgresTokenDB(t, "tokens")
+	f.setErr(errors.New("connection reset"))
+	if _, err := db.StoreToken("alice", &TokenDBValue{}, true); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("StoreToken: %v", err)
+	}
+	f.setErr(errors.New("connection reset"))
+	if _, err := db.GetValue("alice"); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("GetValue: %v", err)
+	}
+	f.setErr(errors.New("connection reset"))
+	if err := db.DeleteToken("alice"); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("DeleteToken: %v", err)
+	}
+	f.rows["alice"] = []byte("not json")
+	if _, err := db.GetValue("alice"); err == nil || !strings.Contains(err.Error(), "parsing") {
+		t.Errorf("GetValue of a malformed value: %v", err)
+	}
+}
+
+func TestPostgresStoreConfig(t *testing.T) {
+	c := &GitHubPostgresStoreConfig{DSN: "postgres://localhost/db"}
+	if err := c.Validate("postgres_token_db"); err != nil || c.Table != defaultPostgresTokenTable {
+		t.Errorf("Validate: %v, table %q", err, c.Table)
+	}
+	for _, c := range []*GitHubPostgresStoreConfig{
+		{},
+		{DSN: "postgres://localhost/db", Table: "tokens; DROP TABLE users"},
+		{DSN: "postgres://localhost/db", Table: `a"b`},
+		{DSN: "postgres://localhost/db", Table: "1tokens"},
+	} {
+		if err := c.Validate("postgres_token_db"); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
@@ -19,6 +19,8 @@ package authn
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -33,46 +35,173 @@ type RedisClient interface {
 	Get(key string) *redis.StringCmd
 	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
 	Del(keys ...string) *redis.IntCmd
+	Ping() *redis.StatusCmd
+	Close() error
 }
 
-// NewRedisTokenDB returns a new TokenDB structure which uses Redis as the storage backend.
-//
-func NewRedisTokenDB(options *GitHubRedisStoreConfig) (TokenDB, error) {
-	var client RedisClient
-	if options.ClusterOptions != nil {
-		if options.ClientOptions != nil {
-			glog.Infof("Both redis_token_db.configs and redis_token_db.cluster_configs have been set. Only the latter will be used")
-		}
-		client = redis.NewClusterClient(options.ClusterOptions)
-	} else {
-		client = redis.NewClient(options.ClientOptions)
+// RedisPoolConfig tunes the connection pool of the Redis client. Zero values keep the defaults of go-redis.
+type RedisPoolConfig struct {
+	// Maximum number of connections, per node in the cluster mode. Default is 10 per CPU.
+	Size int `mapstructure:"size,omitempty"`
+	// Number of idle connections to keep open, to avoid connecting under load.
+	MinIdleConns int `mapstructure:"min_idle_conns,omitempty"`
+	// Connections are closed after this long, or when idle for idle_timeout (default 5m).
+	MaxConnAge  time.Duration `mapstructure:"max_conn_age,omitempty"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout,omitempty"`
+	// How long to wait for a connection when all are busy. Default is read_timeout + 1s.
+	PoolTimeout  time.Duration `mapstructure:"pool_timeout,omitempty"`
+	DialTimeout  time.Duration `mapstructure:"dial_timeout,omitempty"`
+	ReadTimeout  time.Duration `mapstructure:"read_timeout,omitempty"`
+	WriteTimeout time.Duration `mapstructure:"write_timeout,omitempty"`
+	MaxRetries   int           `mapstructure:"max_retries,omitempty"`
+}
+
+func (p *RedisPoolConfig) apply(o *redis.Options) {
+	setIfNonZero(&o.PoolSize, p.Size)
+	setIfNonZero(&o.MinIdleConns, p.MinIdleConns)
+	setIfNonZero(&o.MaxRetries, p.MaxRetries)
+	setDurationIfNonZero(&o.MaxConnAge, p.MaxConnAge)
+	setDurationIfNonZero(&o.IdleTimeout, p.IdleTimeout)
+	setDurationIfNonZero(&o.PoolTimeout, p.PoolTimeout)
+	setDurationIfNonZero(&o.DialTimeout, p.DialTimeout)
+	setDurationIfNonZero(&o.ReadTimeout, p.ReadTimeout)
+	setDurationIfNonZero(&o.WriteTimeout, p.WriteTimeout)
+}
+
+func (p *RedisPoolConfig) applyCluster(o *redis.ClusterOptions) {
+	setIfNonZero(&o.PoolSize, p.Size)
+	setIfNonZero(&o.MinIdleConns, p.MinIdleConns)
+	setIfNonZero(&o.MaxRetries, p.MaxRetries)
+	setDurationIfNonZero(&o.MaxConnAge, p.MaxConnAge)
+	setDurationIfNonZero(&o.IdleTimeout, p.IdleTimeout)
+	setDurationIfNonZero(&o.PoolTimeout, p.PoolTimeout)
+	setDurationIfNonZero(&o.DialTimeout, p.DialTimeout)
+	setDurationIfNonZero(&o.ReadTimeout, p.ReadTimeout)
+	setDurationIfNonZero(&o.WriteTimeout, p.WriteTimeout)
+}
+
+func setIfNonZero(dst *int, v int) {
+	if v != 0 {
+		*dst = v
 	}
+}
 
-	return &redisTokenDB{client}, nil
+func setDurationIfNonZero(dst *time.Duration, v time.Duration) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+// NewRedisTokenDB returns a new TokenDB structure which uses Redis as the storage backend.
+// Redis has to be reachable.
+func NewRedisTokenDB(options *GitHubRedisStoreConfig) (TokenDB, error) {
+	return newRedisTokenDB(options.ClientOptions, options.ClusterOptions, options.Pool, options.HealthCheckInterval)
 }
 
 // NewRedisTokenDB returns a new TokenDB structure which uses Redis as the storage backend.
-//
+// Redis has to be reachable.
 func NewRedisGitlabTokenDB(options *GitlabRedisStoreConfig) (TokenDB, error) {
-	var client RedisClient
-	if options.ClusterOptions != nil {
-		if options.ClientOptions != nil {
-			glog.Infof("Both redis_token_db.configs and redis_token_db.cluster_configs have been set. Only the latter will be used")
+	return newRedisTokenDB(options.ClientOptions, options.ClusterOptions, options.Pool, options.HealthCheckInterval)
+}
+
+// redisClientFactory returns a function that creates clients with the given options, cluster options
+// taking precedence, and the addresses they connect to.
+func redisClientFactory(clientOptions *redis.Options, clusterOptions *redis.ClusterOptions, pool *RedisPoolConfig) (func() RedisClient, []string) {
+	if clusterOptions != nil {
+		opts := *clusterOptions
+		if pool != nil {
+			pool.applyCluster(&opts)
 		}
-		client = redis.NewClusterClient(options.ClusterOptions)
-	} else {
-		client = redis.NewClient(options.ClientOptions)
+		return func() RedisClient { return redis.NewClusterClient(&opts) }, opts.Addrs
 	}
+	opts := *clientOptions
+	if pool != nil {
+		pool.apply(&opts)
+	}
+	return func() RedisClient { return redis.NewClient(&opts) }, []string{opts.Addr}
+}
 
-	return &redisTokenDB{client}, nil
+// NewRedisClient connects to Redis configured the same way as the token DBs and checks that it is reachable.
+func NewRedisClient(clientOptions *redis.Options, clusterOptions *redis.ClusterOptions, pool *RedisPoolConfig) (RedisClient, error) {
+	newClient, addrs := redisClientFactory(clientOptions, clusterOptions, pool)
+	client := newClient()
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis at %s is unreachable: %s", strings.Join(addrs, ","), err)
+	}
+	return client, nil
+}
+
+func newRedisTokenDB(clientOptions *redis.Options, clusterOptions *redis.ClusterOptions, pool *RedisPoolConfig, interval time.Duration) (TokenDB, error) {
+	if clusterOptions != nil && clientOptions != nil {
+		glog.Infof("Both redis_token_db.configs and redis_token_db.cluster_configs have been set. Only the latter will be used")
+	}
+	newClient, addrs := redisClientFactory(clientOptions, clusterOptions, pool)
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	client := newClient()
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis token DB at %s is unreachable: %s", strings.Join(addrs, ","), err)
+	}
+	db := &redisTokenDB{client: client, newClient: newClient, stop: make(chan struct{})}
+	go db.healthCheck(interval)
+	return db, nil
 }
 
 type redisTokenDB struct {
+	mu     sync.RWMutex
 	client RedisClient
+	// Result of the last health check.
+	healthErr error
+
+	newClient func() RedisClient
+	stop      chan struct{}
+}
+
+// healthCheck pings Redis periodically. If that fails, the client is replaced with a new one, so that
+// all the connections are reestablished, e.g. with a failed over server behind the same name.
+func (db *redisTokenDB) healthCheck(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-t.C:
+		}
+		err := db.getClient().Ping().Err()
+		if err != nil {
+			glog.Errorf("Redis token DB health check failed, reconnecting: %s", err)
+			client := db.newClient()
+			if err = client.Ping().Err(); err != nil {
+				glog.Errorf("Failed to reconnect to the Redis token DB: %s", err)
+				client.Close()
+			} else {
+				db.mu.Lock()
+				old := db.client
+				db.client = client
+				db.mu.Unlock()
+				old.Close()
+				glog.Infof("Reconnected to the Redis token DB")
+			}
+		}
+		db.mu.Lock()
+		db.healthErr = err
+		db.mu.Unlock()
+	}
+}
+
+func (db *redisTokenDB) getClient() RedisClient {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.client
 }
 
 func (db *redisTokenDB) String() string {
-	return fmt.Sprintf("%v", db.client)
+	return fmt.Sprintf("%v", db.getClient())
 }
 
 func (db *redisTokenDB) GetValue(user string) (*TokenDBValue, error) {
@@ -83,7 +212,7 @@ func (db *redisTokenDB) GetValue(user string) (*TokenDBValue, error) {
 
 	key := string(getDBKey(user))
 
-	result, err := db.client.Get(key).Result()
+	result, err := db.getClient().Get(key).Result()
 	if err == redis.Nil {
 		glog.V(2).Infof("Key <%s> doesn't exist\n", key)
 		return nil, nil
@@ -117,7 +246,7 @@ func (db *redisTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword
 
 	key := string(getDBKey(user))
 
-	err = db.client.Set(key, data, 0).Err()
+	err = db.getClient().Set(key, data, 0).Err()
 	if err != nil {
 		glog.Errorf("Failed to store token data for user <%s>: %s\n", user, err)
 		return "", fmt.Errorf("Failed to store token data for user <%s>: %s", user, err)
@@ -153,13 +282,21 @@ func (db *redisTokenDB) DeleteToken(user string) error {
 	glog.Infof("Deleting token for user <%s>\n", user)
 
 	key := string(getDBKey(user))
-	err := db.client.Del(key).Err()
+	err := db.getClient().Del(key).Err()
 	if err != nil {
 		return fmt.Errorf("Failed to delete token for user <%s>: %s", user, err)
 	}
 	return nil
 }
 
+// CheckHealth returns the result of the last periodic health check.
+func (db *redisTokenDB) CheckHealth() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.healthErr
+}
+
 func (db *redisTokenDB) Close() error {
-	return nil
+	close(db.stop)
+	return db.getClient().Close()
 }
\ No newline at end of file
@@ -0,0 +1,144 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeRedisClient is a RedisClient which only answers pings.
+type fakeRedisClient struct {
+	mu      sync.Mutex
+	pingErr error
+	closed  bool
+}
+
+func (c *fakeRedisClient) Get(key string) *redis.StringCmd {
+	return redis.NewStringResult("", redis.Nil)
+}
+
+func (c *fakeRedisClient) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *fakeRedisClient) Del(keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func (c *fakeRedisClient) Ping() *redis.StatusCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return redis.NewStatusResult("PONG", c.pingErr)
+}
+
+func (c *fakeRedisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeRedisClient) setPingErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pingErr = err
+}
+
+func (c *fakeRedisClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestRedisPoolConfig(t *testing.T) {
+	p := &RedisPoolConfig{Size: 50, MinIdleConns: 5, IdleTimeout: time.Minute, ReadTimeout: 2 * time.Second}
+	o := &redis.Options{Addr: "redis:6379", PoolSize: 10, MaxRetries: 3, WriteTimeout: time.Second}
+	p.apply(o)
+	if o.PoolSize != 50 || o.MinIdleConns != 5 || o.IdleTimeout != time.Minute || o.ReadTimeout != 2*time.Second {
+		t.Errorf("pool settings not applied: %+v", o)
+	}
+	if o.Addr != "redis:6379" || o.MaxRetries != 3 || o.WriteTimeout != time.Second {
+		t.Errorf("expected unset pool settings to be kept: %+v", o)
+	}
+	co := &redis.ClusterOptions{PoolSize: 10, MaxRetries: 3}
+	p.applyCluster(co)
+	if co.PoolSize != 50 || co.MinIdleConns != 5 || co.MaxRetries != 3 {
+		t.Errorf("pool settings not applied to the cluster options: %+v", co)
+	}
+}
+
+func TestRedisTokenDBUnreachable(t *testing.T) {
+	opts := &redis.Options{Addr: "127.0.0.1:1"}
+	c := &GitHubRedisStoreConfig{ClientOptions: opts, Pool: &RedisPoolConfig{Size: 1}}
+	if _, err := NewRedisTokenDB(c); err == nil || !strings.Contains(err.Error(), "127.0.0.1:1 is unreachable") {
+		t.Errorf("expected an unreachable Redis to be reported, got %v", err)
+	}
+	if opts.PoolSize != 0 {
+		t.Errorf("expected the configured options not to be modified, got %+v", opts)
+	}
+}
+
+func TestRedisTokenDBHealthCheck(t *testing.T) {
+	first := &fakeRedisClient{}
+	var mu sync.Mutex
+	var next *fakeRedisClient
+	db := &redisTokenDB{client: first, stop: make(chan struct{}), newClient: func() RedisClient {
+		mu.Lock()
+		defer mu.Unlock()
+		return next
+	}}
+	setNext := func(c *fakeRedisClient) {
+		mu.Lock()
+		next = c
+		mu.Unlock()
+	}
+	go db.healthCheck(5 * time.Millisecond)
+	defer db.Close()
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	// Reconnecting fails as well, the old client is kept.
+	down := errors.New("connection refused")
+	failed := &fakeRedisClient{pingErr: down}
+	setNext(failed)
+	first.setPingErr(down)
+	waitFor("the health check to fail", func() bool { return db.CheckHealth() == down })
+	waitFor("the new client to be closed", failed.isClosed)
+	if db.getClient() != first || first.isClosed() {
+		t.Errorf("expected the old client to be kept")
+	}
+
+	// Reconnected, the old client is replaced and closed.
+	second := &fakeRedisClient{}
+	setNext(second)
+	waitFor("the health check to pass", func() bool { return db.CheckHealth() == nil })
+	if db.getClient() != second || !first.isClosed() {
+		t.Errorf("expected the client to be replaced")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const DefaultTokenDBSweepGrace = 30 * 24 * time.Hour
+
+// StartSweeper deletes, every interval, the tokens that were due for revalidation more than grace ago.
+// Until then, expired tokens are still revalidated on use rather than requiring users to sign in again.
+// The sweeper is stopped by Close.
+func (db *TokenDBImpl) StartSweeper(interval, grace time.Duration) {
+	db.stopSweep = make(chan struct{})
+	db.sweepDone = make(chan struct{})
+	go func() {
+		defer close(db.sweepDone)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				db.sweep(time.Now().Add(-grace))
+			case <-db.stopSweep:
+				return
+			}
+		}
+	}()
+}
+
+// sweep deletes the tokens that were valid until before the cutoff.
+func (db *TokenDBImpl) sweep(cutoff time.Time) {
+	var expired []string
+	it := db.NewIterator(util.BytesPrefix([]byte(tokenDBPrefix)), nil)
+	for it.Next() {
+		var dbv TokenDBValue
+		if err := json.Unmarshal(it.Value(), &dbv); err != nil {
+			continue
+		}
+		if dbv.ValidUntil.Before(cutoff) {
+			expired = append(expired, string(it.Key()[len(tokenDBPrefix):]))
+		}
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		glog.Errorf("Token DB sweep failed: %s", err)
+		return
+	}
+
+	deleted := 0
+	for _, user := range expired {
+		if db.deleteIfExpired(user, cutoff) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		glog.Infof("Token DB sweep: deleted %d expired token(s)", deleted)
+	}
+}
+
+// deleteIfExpired deletes the token of the user if it is still expired, i.e. the user has not
+// signed in again since the scan.
+func (db *TokenDBImpl) deleteIfExpired(user string, cutoff time.Time) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	dbv, err := db.GetValue(user)
+	if err != nil || dbv == nil || !dbv.ValidUntil.Before(cutoff) {
+		return false
+	}
+	if err := db.Delete(getDBKey(user), nil); err != nil {
+		glog.Errorf("Token DB sweep: failed to delete %s: %s", user, err)
+		return false
+	}
+	return true
+}
+
+// Close stops the sweeper, if running, and closes the DB.
+func (db *TokenDBImpl) Close() error {
+	if db.stopSweep != nil {
+		close(db.stopSweep)
+		<-db.sweepDone
+		db.stopSweep = nil
+	}
+	return db.DB.Close()
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTokenDB(t *testing.T) *TokenDBImpl {
+	db, err := NewTokenDB(filepath.Join(t.TempDir(), "tokens.ldb"))
+	if err != nil {
+		t.Fatalf("NewTokenDB: %s", err)
+	}
+	return db.(*TokenDBImpl)
+}
+
+func TestTokenDBSweep(t *testing.T) {
+	db := newTestTokenDB(t)
+	defer db.Close()
+	now := time.Now()
+	for user, validUntil := range map[string]time.Time{
+		"current": now.Add(time.Hour),
+		"expired": now.Add(-time.Hour),
+		"old":     now.Add(-48 * time.Hour),
+	} {
+		if _, err := db.StoreToken(user, &TokenDBValue{AccessToken: user, ValidUntil: validUntil}, false); err != nil {
+			t.Fatalf("StoreToken: %s", err)
+		}
+	}
+	// Not tokens, must be left alone.
+	db.Put([]byte(tokenDBPrefix+"malformed"), []byte("{"), nil)
+	db.Put([]byte("other"), []byte(`{"valid_until":"2000-01-01T00:00:00Z"}`), nil)
+
+	db.sweep(now.Add(-24 * time.Hour))
+	for user, kept := range map[string]bool{"current": true, "expired": true, "old": false} {
+		if v, err := db.GetValue(user); err != nil || (v != nil) != kept {
+			t.Errorf("%s: expected kept=%t, got %+v, %v", user, kept, v, err)
+		}
+	}
+	for _, key := range []string{tokenDBPrefix + "malformed", "other"} {
+		if _, err := db.Get([]byte(key), nil); err != nil {
+			t.Errorf("expected %q not to be deleted", key)
+		}
+	}
+
+	// A user who signed in again since the scan keeps the new token.
+	db.StoreToken("again", &TokenDBValue{ValidUntil: now.Add(time.Hour)}, false)
+	if db.deleteIfExpired("again", now) {
+		t.Errorf("expected a renewed token not to be deleted")
+	}
+	if db.deleteIfExpired("missing", now) {
+		t.Errorf("expected a missing token not to be reported as deleted")
+	}
+}
+
+func TestTokenDBSweeper(t *testing.T) {
+	db := newTestTokenDB(t)
+	db.StoreToken("old", &TokenDBValue{ValidUntil: time.Now().Add(-time.Hour)}, false)
+	db.StartSweeper(10*time.Millisecond, time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, _ := db.GetValue("old"); v == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sweeper to delete the old token")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Close stops the sweeper before closing the DB.
+	if err := db.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	select {
+	case <-db.sweepDone:
+	default:
+		t.Errorf("expected the sweeper to be stopped")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// Codes of this many steps before and after the current one are accepted too.
+	totpSkew = 1
+)
+
+// decodeTOTPSecret decodes a base32 TOTP secret as shown by authenticator apps,
+// ignoring case, spaces and padding.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("bad TOTP secret: %s", err)
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("TOTP secret is too short, must be at least 80 bits")
+	}
+	return key, nil
+}
+
+// isTOTPCode tells if s looks like a TOTP code.
+func isTOTPCode(s string) bool {
+	if len(s) != totpDigits {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTOTP checks a code against the secret (RFC 6238, HMAC-SHA1, 30 second steps).
+func checkTOTP(secret string, code string, now time.Time) (bool, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return false, err
+	}
+	counter := now.Unix() / int64(totpStep/time.Second)
+	ok := 0
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		ok |= subtle.ConstantTimeCompare([]byte(hotp(key, uint64(counter+i))), []byte(code))
+	}
+	return ok == 1, nil
+}
+
+// hotp computes the code for a counter value (RFC 4226).
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
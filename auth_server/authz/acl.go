@@ -2,13 +2,16 @@ package authz
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"path"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cesanta/glog"
 	"github.com/schwarmco/go-cartesian-product"
@@ -18,27 +21,104 @@ import (
 
 type ACL []ACLEntry
 
+// Resource types and names of the registry token scopes, see
+// https://github.com/distribution/distribution/blob/main/docs/spec/auth/scope.md
+const (
+	repositoryType = "repository"
+	registryType   = "registry"
+	catalogName    = "catalog"
+)
+
 type ACLEntry struct {
 	Match   *MatchConditions `mapstructure:"match"`
 	Actions *[]string        `mapstructure:"actions,flow"`
 	Comment *string          `mapstructure:"comment,omitempty"`
+	// Entries with higher priority are tried first, unset is 0. See ValidateACL.
+	Priority *int `mapstructure:"priority,omitempty"`
+	// If set, the following entries are also evaluated for the requested actions this one does
+	// not allow, and the actions allowed by all the matching entries are granted.
+	Continue bool `mapstructure:"continue,omitempty"`
 }
 
 type MatchConditions struct {
 	Account *string           `mapstructure:"account,omitempty" json:"account,omitempty"`
 	Type    *string           `mapstructure:"type,omitempty" json:"type,omitempty"`
+	Class   *string           `mapstructure:"class,omitempty" json:"class,omitempty"`
 	Name    *string           `mapstructure:"name,omitempty" json:"name,omitempty"`
-	IP      *string           `mapstructure:"ip,omitempty" json:"ip,omitempty"`
+	IP      IPPatterns        `mapstructure:"ip,omitempty" json:"ip,omitempty"`
 	Service *string           `mapstructure:"service,omitempty" json:"service,omitempty"`
 	Labels  map[string]string `mapstructure:"labels,omitempty" json:"labels,omitempty"`
+	Time    *TimeWindow       `mapstructure:"time,omitempty" json:"time,omitempty"`
+	// If set, only matches the source repository of a cross-repository blob mount
+	// into a repository that matches this pattern.
+	MountTo *string `mapstructure:"mount_to,omitempty" json:"mount_to,omitempty" bson:"mount_to,omitempty"`
+
+	// Set by ValidateACL.
+	regexps regexpCache
+}
+
+// regexpCache holds the compiled regexes of the patterns that do not depend on the request,
+// keyed by the expression.
+type regexpCache map[string]*regexp.Regexp
+
+func (rc regexpCache) compile(expr string) (*regexp.Regexp, error) {
+	if re := rc[expr]; re != nil {
+		return re, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// compile fills the regexp cache. Patterns with variables are still compiled when matching.
+func (mc *MatchConditions) compile() {
+	rc := make(regexpCache)
+	patterns := []*string{mc.Account, mc.Type, mc.Class, mc.Name, mc.Service, mc.MountTo}
+	for _, v := range mc.Labels {
+		v := v
+		patterns = append(patterns, &v)
+	}
+	for _, p := range patterns {
+		if p == nil || !isRegexPattern(*p) || strings.Contains(*p, "${") {
+			continue
+		}
+		expr := (*p)[1 : len(*p)-1]
+		if re, err := regexp.Compile(expr); err == nil {
+			rc[expr] = re
+		}
+	}
+	mc.regexps = rc
+}
+
+// IPPatterns is a list of IP addresses and subnets in the "prefix/mask" notation.
+// In the config it may also be given as a single string.
+type IPPatterns []string
+
+// UnmarshalJSON accepts a single pattern as well as a list, for entries stored before lists were supported.
+func (ipp *IPPatterns) UnmarshalJSON(data []byte) error {
+	var p *string
+	if err := json.Unmarshal(data, &p); err == nil {
+		if p == nil {
+			*ipp = nil
+			return nil
+		}
+		*ipp = IPPatterns{*p}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(ipp))
 }
 
 type aclAuthorizer struct {
 	acl ACL
 }
 
+func isRegexPattern(p string) bool {
+	return len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/'
+}
+
 func validatePattern(p string) error {
-	if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
+	if err := validatePlaceholders(p); err != nil {
+		return err
+	}
+	if isRegexPattern(p) {
 		_, err := regexp.Compile(p[1 : len(p)-1])
 		if err != nil {
 			return fmt.Errorf("invalid regex pattern: %s", err)
@@ -67,7 +147,7 @@ func parseIPPattern(ipp string) (*net.IPNet, error) {
 }
 
 func validateMatchConditions(mc *MatchConditions) error {
-	for _, p := range []*string{mc.Account, mc.Type, mc.Name, mc.Service} {
+	for _, p := range []*string{mc.Account, mc.Type, mc.Class, mc.Name, mc.Service, mc.MountTo} {
 		if p == nil {
 			continue
 		}
@@ -76,8 +156,14 @@ func validateMatchConditions(mc *MatchConditions) error {
 			return fmt.Errorf("invalid pattern %q: %s", *p, err)
 		}
 	}
-	if mc.IP != nil {
-		_, err := parseIPPattern(*mc.IP)
+	if err := validateCatalogMatch(mc); err != nil {
+		return err
+	}
+	if mc.IP != nil && len(mc.IP) == 0 {
+		return errors.New("empty list of IP patterns")
+	}
+	for _, ipp := range mc.IP {
+		_, err := parseIPPattern(ipp)
 		if err != nil {
 			return fmt.Errorf("invalid IP pattern: %s", err)
 		}
@@ -88,22 +174,88 @@ func validateMatchConditions(mc *MatchConditions) error {
 			return fmt.Errorf("invalid match pattern %q for label %s: %s", v, k, err)
 		}
 	}
+	if mc.Time != nil {
+		if err := mc.Time.validate(); err != nil {
+			return fmt.Errorf("invalid time window: %s", err)
+		}
+	}
+	return nil
+}
+
+// Catalog listing is requested as "registry:catalog:*". A rule for it has to restrict the type,
+// otherwise it also matches the repository named "catalog".
+func validateCatalogMatch(mc *MatchConditions) error {
+	if mc.Name == nil || *mc.Name != catalogName {
+		return nil
+	}
+	if mc.Type == nil {
+		return fmt.Errorf("name %q without a type also matches the repository %q, set type to %q or %q",
+			catalogName, catalogName, registryType, repositoryType)
+	}
+	if strings.Contains(*mc.Type, "${") {
+		return nil
+	}
+	if matchString(mc.Type, registryType, nil, mc.regexps) && matchString(mc.Type, repositoryType, nil, mc.regexps) {
+		return fmt.Errorf("type %q matches both %q and %q, so name %q matches the catalog as well as the repository",
+			*mc.Type, registryType, repositoryType, catalogName)
+	}
 	return nil
 }
 
-func ValidateACL(acl ACL) error {
+// validateRegistryActions checks that an entry for the registry resource type can grant something:
+// the only scope of this type, the catalog, is requested with the "*" action.
+func validateRegistryActions(e *ACLEntry) error {
+	if e.Match.Type == nil || *e.Match.Type != registryType || e.Actions == nil || len(*e.Actions) == 0 {
+		return nil
+	}
+	for _, a := range *e.Actions {
+		if a == "*" {
+			return nil
+		}
+	}
+	return fmt.Errorf("actions %v never match, catalog listing is requested with the \"*\" action", *e.Actions)
+}
+
+func (e *ACLEntry) priority() int {
+	if e.Priority == nil {
+		return 0
+	}
+	return *e.Priority
+}
+
+// ValidateACL checks the entries and sorts them in place by descending priority.
+// Entries with equal priority, including all of those without one, keep their original order.
+// Two entries with the same explicit priority are an error, unless allowDuplicatePriorities is set.
+func ValidateACL(acl ACL, allowDuplicatePriorities bool) error {
+	priorities := make(map[int]int)
 	for i, e := range acl {
 		err := validateMatchConditions(e.Match)
 		if err != nil {
 			return fmt.Errorf("entry %d, invalid match conditions: %s", i, err)
 		}
+		if err := validateRegistryActions(&e); err != nil {
+			return fmt.Errorf("entry %d: %s", i, err)
+		}
+		if e.Priority == nil || allowDuplicatePriorities {
+			continue
+		}
+		if j, found := priorities[*e.Priority]; found {
+			return fmt.Errorf("entry %d has the same priority (%d) as entry %d", i, *e.Priority, j)
+		}
+		priorities[*e.Priority] = i
 	}
+	for _, e := range acl {
+		e.Match.compile()
+	}
+	sort.SliceStable(acl, func(i, j int) bool {
+		return acl[i].priority() > acl[j].priority()
+	})
 	return nil
 }
 
 // NewACLAuthorizer Creates a new static authorizer with ACL that have been read from the config file
-func NewACLAuthorizer(acl ACL) (api.Authorizer, error) {
-	if err := ValidateACL(acl); err != nil {
+func NewACLAuthorizer(acl ACL, allowDuplicatePriorities bool) (api.Authorizer, error) {
+	if err := ValidateACL(acl, allowDuplicatePriorities); err != nil {
 		return nil, err
 	}
 	glog.V(1).Infof("Created ACL Authorizer with %d entries", len(acl))
@@ -111,6 +263,7 @@ func NewACLAuthorizer(acl ACL) (api.Authorizer, error) {
 }
 
 func (aa *aclAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	var granted []string
 	for _, e := range aa.acl {
 		matched := e.Matches(ai)
 		if matched {
@@ -119,12 +272,28 @@ func (aa *aclAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
 				comment = *e.Comment
 			}
 			glog.V(2).Infof("%s matched %s (Comment: %s)", ai, e, comment)
+			ai.MatchedRule = e.String()
+			if e.Comment != nil {
+				ai.MatchedRuleName = *e.Comment
+			}
+			var allowed []string
 			if len(*e.Actions) == 1 && (*e.Actions)[0] == "*" {
-				return ai.Actions, nil
+				allowed = ai.Actions
+			} else {
+				allowed = StringSetIntersection(ai.Actions, *e.Actions)
+			}
+			if granted == nil && !e.Continue {
+				return allowed, nil
+			}
+			granted = StringSetUnion(granted, allowed)
+			if !e.Continue || makeSet(ai.Actions).IsSubset(makeSet(granted)) {
+				return granted, nil
 			}
-			return StringSetIntersection(ai.Actions, *e.Actions), nil
 		}
 	}
+	if granted != nil {
+		return granted, nil
+	}
 	return nil, api.NoMatch
 }
 
@@ -143,7 +312,7 @@ func (e ACLEntry) String() string {
 	return string(b)
 }
 
-func matchString(pp *string, s string, vars []string) bool {
+func matchString(pp *string, s string, vars []string, rc regexpCache) bool {
 	if pp == nil {
 		return true
 	}
@@ -151,70 +320,96 @@ func matchString(pp *string, s string, vars []string) bool {
 
 	var matched bool
 	var err error
-	if len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/' {
-		matched, err = regexp.Match(p[1:len(p)-1], []byte(s))
+	if isRegexPattern(p) {
+		var re *regexp.Regexp
+		if re, err = rc.compile(p[1 : len(p)-1]); err == nil {
+			matched = re.MatchString(s)
+		}
 	} else {
 		matched, err = path.Match(p, s)
 	}
 	return err == nil && matched
 }
 
-func matchStringWithLabelPermutations(pp *string, s string, vars []string, labelMap *map[string][]string) bool {
-	var matched bool
-	// First try basic matching
-	matched = matchString(pp, s, vars)
-	// If basic matching fails then try with label permuations
-	if !matched {
-		// Take the labelMap and build the structure required for the cartesian library
-		var labelSets [][]interface{}
-		for placeholder, labels := range *labelMap {
-			// Don't bother generating perumations for placeholders not in match string
-			// Since the label permuations are a cartesian product this can have
-			// a huge impact on performance
-			if strings.Contains(*pp, placeholder) {
-				var labelSet []interface{}
-				for _, label := range labels {
-					labelSet = append(labelSet, []string{placeholder, label})
-				}
-				labelSets = append(labelSets, labelSet)
-			}
+func matchStringWithLabelPermutations(pp *string, s string, vars []string, labelMap *map[string][]string, rc regexpCache) bool {
+	if pp == nil || !strings.Contains(*pp, "${labels:") {
+		return matchString(pp, s, vars, rc)
+	}
+	// A pattern that refers to a label the user does not have never matches.
+	for _, placeholder := range labelPlaceholderRegex.FindAllString(*pp, -1) {
+		if len((*labelMap)[placeholder]) == 0 {
+			return false
 		}
-		if len(labelSets) > 0 {
-			for permuation := range cartesian.Iter(labelSets...) {
-				var labelVars []string
-				for _, val := range permuation {
-					labelVars = append(labelVars, val.([]string)...)
-				}
-				matched = matchString(pp, s, append(vars, labelVars...))
-				if matched {
-					break
-				}
+	}
+	// Take the labelMap and build the structure required for the cartesian library
+	var labelSets [][]interface{}
+	for placeholder, labels := range *labelMap {
+		// Don't bother generating perumations for placeholders not in match string
+		// Since the label permuations are a cartesian product this can have
+		// a huge impact on performance
+		if strings.Contains(*pp, placeholder) {
+			var labelSet []interface{}
+			for _, label := range labels {
+				labelSet = append(labelSet, []string{placeholder, label})
 			}
+			labelSets = append(labelSets, labelSet)
 		}
 	}
-	return matched
+	for permuation := range cartesian.Iter(labelSets...) {
+		var labelVars []string
+		for _, val := range permuation {
+			labelVars = append(labelVars, val.([]string)...)
+		}
+		if matchString(pp, s, append(vars, labelVars...), rc) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMountTarget(pp *string, target string, vars []string, labelMap *map[string][]string, rc regexpCache) bool {
+	if pp == nil {
+		return true
+	}
+	return target != "" && matchStringWithLabelPermutations(pp, target, vars, labelMap, rc)
 }
 
-func matchIP(ipp *string, ip net.IP) bool {
-	if ipp == nil {
+func matchIP(ipps IPPatterns, ip net.IP) bool {
+	if ipps == nil {
 		return true
 	}
 	if ip == nil {
 		return false
 	}
-	ipnet, err := parseIPPattern(*ipp)
+	for _, ipp := range ipps {
+		ipnet, err := parseIPPattern(ipp)
+		if err != nil { // Can't happen, it supposed to have been validated
+			glog.Fatalf("Invalid IP pattern: %s", ipp)
+		}
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTime(tw *TimeWindow, t time.Time) bool {
+	if tw == nil {
+		return true
+	}
+	matched, err := tw.contains(t)
 	if err != nil { // Can't happen, it supposed to have been validated
-		glog.Fatalf("Invalid IP pattern: %s", *ipp)
+		glog.Fatalf("Invalid time window %+v: %s", *tw, err)
 	}
-	return ipnet.Contains(ip)
+	return matched
 }
 
-func matchLabels(ml map[string]string, rl api.Labels, vars []string) bool {
+func matchLabels(ml map[string]string, rl api.Labels, vars []string, rc regexpCache) bool {
 	for label, pattern := range ml {
 		labelValues := rl[label]
 		matched := false
 		for _, lv := range labelValues {
-			if matchString(&pattern, lv, vars) {
+			if matchString(&pattern, lv, vars, rc) {
 				matched = true
 				break
 			}
@@ -227,6 +422,22 @@ func matchLabels(ml map[string]string, rl api.Labels, vars []string) bool {
 }
 
 var captureGroupRegex = regexp.MustCompile(`\$\{(.+?):(\d+)\}`)
+var labelPlaceholderRegex = regexp.MustCompile(`\$\{labels:[^}]+\}`)
+var placeholderRegex = regexp.MustCompile(`\$\{([^}]*)\}`)
+var validPlaceholderRegex = regexp.MustCompile(`^((account|type|name|service)(:\d+)?|labels:.+)$`)
+
+// validatePlaceholders checks that all the variables in the pattern are known and well-formed.
+func validatePlaceholders(p string) error {
+	for _, m := range placeholderRegex.FindAllStringSubmatch(p, -1) {
+		if !validPlaceholderRegex.MatchString(m[1]) {
+			return fmt.Errorf("unknown variable %s", m[0])
+		}
+	}
+	if strings.Count(p, "${") != len(placeholderRegex.FindAllString(p, -1)) {
+		return errors.New("unterminated variable")
+	}
+	return nil
+}
 
 func getField(i interface{}, name string) (string, bool) {
 	s := reflect.Indirect(reflect.ValueOf(i))
@@ -257,7 +468,7 @@ func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
 			if len(field) < 2 || field[0] != '/' || field[len(field)-1] != '/' {
 				continue
 			}
-			regex, err := regexp.Compile(field[1 : len(field)-1])
+			regex, err := mc.regexps.compile(field[1 : len(field)-1])
 			if err != nil {
 				glog.Errorf("Invalid regex in '%s' of MatchConditions", key)
 				continue
@@ -283,12 +494,15 @@ func (mc *MatchConditions) Matches(ai *api.AuthRequestInfo) bool {
 		}
 		labelMap[fmt.Sprintf("${labels:%s}", label)] = labelSet
 	}
-	return matchStringWithLabelPermutations(mc.Account, ai.Account, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Type, ai.Type, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Name, ai.Name, vars, &labelMap) &&
-		matchStringWithLabelPermutations(mc.Service, ai.Service, vars, &labelMap) &&
+	return matchStringWithLabelPermutations(mc.Account, ai.Account, vars, &labelMap, mc.regexps) &&
+		matchStringWithLabelPermutations(mc.Type, ai.Type, vars, &labelMap, mc.regexps) &&
+		matchString(mc.Class, ai.Class, vars, mc.regexps) &&
+		matchStringWithLabelPermutations(mc.Name, ai.Name, vars, &labelMap, mc.regexps) &&
+		matchStringWithLabelPermutations(mc.Service, ai.Service, vars, &labelMap, mc.regexps) &&
+		matchMountTarget(mc.MountTo, ai.MountTarget, vars, &labelMap, mc.regexps) &&
 		matchIP(mc.IP, ai.IP) &&
-		matchLabels(mc.Labels, ai.Labels, vars)
+		matchLabels(mc.Labels, ai.Labels, vars, mc.regexps) &&
+		matchTime(mc.Time, timeNow())
 }
 
 func (e *ACLEntry) Matches(ai *api.AuthRequestInfo) bool {
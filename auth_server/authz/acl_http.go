@@ -0,0 +1,257 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	defaultACLHTTPPollInterval = time.Minute
+	defaultACLHTTPTimeout      = 10 * time.Second
+)
+
+// ACLHTTPConfig configures an ACL that is fetched from a URL and periodically refreshed.
+type ACLHTTPConfig struct {
+	// The ACL is a list of entries in the same format as the acl section of the config, in JSON or YAML.
+	URL string `mapstructure:"url,omitempty"`
+	// Value of the Authorization header, e.g. "Bearer xyz".
+	AuthHeader string `mapstructure:"auth_header,omitempty"`
+	// Read the Authorization header value from a file instead, re-read before every request.
+	AuthHeaderFile string        `mapstructure:"auth_header_file,omitempty"`
+	PollInterval   time.Duration `mapstructure:"poll_interval,omitempty"`
+	Timeout        time.Duration `mapstructure:"timeout,omitempty"`
+}
+
+// Validate checks the config and fills in the defaults.
+func (c *ACLHTTPConfig) Validate(configKey string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.url must be an http or https URL", configKey)
+	}
+	if c.AuthHeader != "" && c.AuthHeaderFile != "" {
+		return fmt.Errorf("%s: auth_header and auth_header_file are mutually exclusive", configKey)
+	}
+	if c.PollInterval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("%s: poll_interval and timeout must not be negative", configKey)
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = defaultACLHTTPPollInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultACLHTTPTimeout
+	}
+	return nil
+}
+
+type aclHTTPAuthorizer struct {
+	config *ACLHTTPConfig
+	client *http.Client
+
+	lock             sync.RWMutex
+	lastUpdate       time.Time
+	staticAuthorizer api.Authorizer
+
+	// Only used by the update goroutine.
+	etag string
+
+	updateTicker *time.Ticker
+	stop         chan struct{}
+}
+
+// NewACLHTTPAuthorizer creates an authorizer with the ACL fetched from a URL.
+// The initial fetch must succeed; later failures are logged and the last good ACL stays in effect.
+func NewACLHTTPAuthorizer(c *ACLHTTPConfig) (api.Authorizer, error) {
+	ha := &aclHTTPAuthorizer{
+		config: c,
+		client: &http.Client{Timeout: c.Timeout},
+		stop:   make(chan struct{}),
+	}
+	if err := ha.updateACL(); err != nil {
+		return nil, err
+	}
+	ha.updateTicker = time.NewTicker(c.PollInterval)
+	go ha.continuouslyUpdateACL()
+	return ha, nil
+}
+
+func (ha *aclHTTPAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	ha.lock.RLock()
+	defer ha.lock.RUnlock()
+	return ha.staticAuthorizer.Authorize(ai)
+}
+
+func (ha *aclHTTPAuthorizer) continuouslyUpdateACL() {
+	for {
+		select {
+		case <-ha.updateTicker.C:
+			if err := ha.updateACL(); err != nil {
+				ha.lock.RLock()
+				age := time.Since(ha.lastUpdate)
+				ha.lock.RUnlock()
+				glog.Errorf("Failed to update ACL from %s, using the previous one (age: %s): %s", ha.config.URL, age, err)
+			}
+		case <-ha.stop:
+			return
+		}
+	}
+}
+
+// updateACL fetches the ACL and installs it if it is valid. An unchanged ACL is not downloaded again
+// if the server supports ETags.
+func (ha *aclHTTPAuthorizer) updateACL() error {
+	req, err := http.NewRequest(http.MethodGet, ha.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json, application/yaml")
+	authHeader := ha.config.AuthHeader
+	if ha.config.AuthHeaderFile != "" {
+		contents, err := ioutil.ReadFile(ha.config.AuthHeaderFile)
+		if err != nil {
+			return err
+		}
+		authHeader = strings.TrimSpace(string(contents))
+	}
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	if ha.etag != "" {
+		req.Header.Set("If-None-Match", ha.etag)
+	}
+	resp, err := ha.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		ha.lock.Lock()
+		ha.lastUpdate = time.Now()
+		ha.lock.Unlock()
+		glog.V(2).Infof("ACL at %s has not changed", ha.config.URL)
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", ha.config.URL, resp.Status)
+	}
+	acl, err := parseACL(body)
+	if err != nil {
+		return fmt.Errorf("could not parse ACL from %s: %s", ha.config.URL, err)
+	}
+	newStaticAuthorizer, err := NewACLAuthorizer(acl, false)
+	if err != nil {
+		return fmt.Errorf("invalid ACL from %s: %s", ha.config.URL, err)
+	}
+
+	ha.lock.Lock()
+	ha.lastUpdate = time.Now()
+	ha.staticAuthorizer = newStaticAuthorizer
+	ha.lock.Unlock()
+	ha.etag = resp.Header.Get("ETag")
+
+	glog.V(2).Infof("Got new ACL from %s: %s", ha.config.URL, acl)
+	glog.V(1).Infof("Installed new ACL from %s (%d entries)", ha.config.URL, len(acl))
+	return nil
+}
+
+// parseACL parses an ACL in JSON or YAML. The field names are the same as in the config file.
+func parseACL(data []byte) (ACL, error) {
+	// JSON is YAML too. The result is converted to JSON, for which the ACL types have field names.
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := yamlToJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.([]interface{}); !ok {
+		return nil, errors.New("expected a list of ACL entries")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var acl ACL
+	if err := json.Unmarshal(j, &acl); err != nil {
+		return nil, err
+	}
+	// Unlike the config file, the served ACL is not reviewed by the operator before use.
+	for i, e := range acl {
+		if e.Match == nil || e.Actions == nil {
+			return nil, fmt.Errorf("entry %d must have match and actions", i)
+		}
+	}
+	return acl, nil
+}
+
+// yamlToJSONValue converts the maps produced by the YAML parser to ones that can be marshaled to JSON.
+func yamlToJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected key %v", k)
+			}
+			je, err := yamlToJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = je
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			je, err := yamlToJSONValue(e)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = je
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+func (ha *aclHTTPAuthorizer) Stop() {
+	ha.updateTicker.Stop()
+	close(ha.stop)
+}
+
+func (ha *aclHTTPAuthorizer) Name() string {
+	return "HTTP ACL"
+}
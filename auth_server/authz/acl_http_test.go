@@ -0,0 +1,113 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestACLHTTP(t *testing.T) {
+	var mu sync.Mutex
+	body, etag := `[{"match": {"account": "foo"}, "actions": ["pull"]}]`, `"1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Write([]byte(body))
+	}))
+	defer srv.Close()
+	setACL := func(b, e string) {
+		mu.Lock()
+		body, etag = b, e
+		mu.Unlock()
+	}
+
+	cfg := &ACLHTTPConfig{URL: srv.URL, AuthHeader: "Bearer secret"}
+	if err := cfg.Validate("acl_http"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewACLHTTPAuthorizer(cfg)
+	if err != nil {
+		t.Fatalf("NewACLHTTPAuthorizer: %s", err)
+	}
+	defer a.Stop()
+	ha := a.(*aclHTTPAuthorizer)
+	check := func(account string, want []string, wantErr error) {
+		t.Helper()
+		got, err := ha.Authorize(&api.AuthRequestInfo{Account: account, Type: "repository", Name: "x", Actions: []string{"pull", "push"}})
+		if err != wantErr || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, %v, got %v, %v", account, want, wantErr, got, err)
+		}
+	}
+	check("foo", []string{"pull"}, nil)
+	check("bar", nil, api.NoMatch)
+
+	// YAML works too.
+	setACL("- match: {account: bar}\n  actions: [\"*\"]\n", `"2"`)
+	if err := ha.updateACL(); err != nil {
+		t.Fatalf("updateACL: %s", err)
+	}
+	check("foo", nil, api.NoMatch)
+	check("bar", []string{"pull", "push"}, nil)
+
+	// Not modified.
+	if err := ha.updateACL(); err != nil {
+		t.Fatalf("updateACL: %s", err)
+	}
+	check("bar", []string{"pull", "push"}, nil)
+
+	// Invalid ACLs are not installed.
+	for _, b := range []string{
+		`{"match": {"account": "foo"}, "actions": ["pull"]}`,
+		`[{"match": {"account": "/foo(/"}, "actions": ["pull"]}]`,
+		`[{"match": {"account": "foo"}}]`,
+		`[{"match": {"ip": "foo"}, "actions": ["pull"]}]`,
+		`not an ACL`,
+	} {
+		setACL(b, `"3"`)
+		if err := ha.updateACL(); err == nil {
+			t.Errorf("expected %s to be rejected", b)
+		}
+		check("bar", []string{"pull", "push"}, nil)
+	}
+}
+
+func TestACLHTTPConfig(t *testing.T) {
+	for _, cfg := range []*ACLHTTPConfig{
+		{},
+		{URL: "ftp://example.com/acl.json"},
+		{URL: "https://example.com/acl.json", AuthHeader: "Bearer x", AuthHeaderFile: "/token"},
+	} {
+		if err := cfg.Validate("acl_http"); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
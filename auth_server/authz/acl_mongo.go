@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/cesanta/glog"
+	mongobson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2/bson"
@@ -25,6 +27,21 @@ type MongoACLEntry struct {
 	Seq      *int
 }
 
+// UnmarshalBSONValue accepts a single IP pattern as well as a list, like UnmarshalJSON.
+func (ipp *IPPatterns) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	rv := mongobson.RawValue{Type: t, Value: data}
+	if p, ok := rv.StringValueOK(); ok {
+		*ipp = IPPatterns{p}
+		return nil
+	}
+	var ps []string
+	if err := rv.Unmarshal(&ps); err != nil {
+		return err
+	}
+	*ipp = ps
+	return nil
+}
+
 type ACLMongoConfig struct {
 	MongoConfig *mgo_session.Config `mapstructure:"dial_info,omitempty"`
 	Collection  string              `mapstructure:"collection,omitempty"`
@@ -98,6 +115,13 @@ func (c *ACLMongoConfig) Validate(configKey string) error {
 	return nil
 }
 
+// CheckHealth pings the MongoDB server.
+func (ma *aclMongoAuthorizer) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return ma.session.Ping(ctx, nil)
+}
+
 func (ma *aclMongoAuthorizer) Stop() {
 	// This causes the background go routine which updates the ACL to stop
 	ma.updateTicker.Stop()
@@ -193,7 +217,7 @@ func (ma *aclMongoAuthorizer) updateACLCache() error {
 		retACL = append(retACL, e.ACLEntry)
 	}
 
-	newStaticAuthorizer, err := NewACLAuthorizer(retACL)
+	newStaticAuthorizer, err := NewACLAuthorizer(retACL, false)
 	if err != nil {
 		return err
 	}
@@ -1,8 +1,12 @@
 package authz
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 )
@@ -30,21 +34,45 @@ func TestValidation(t *testing.T) {
 		{MatchConditions{Service: sp("foo")}, true},
 		{MatchConditions{Service: sp("foo?*")}, true},
 		{MatchConditions{Service: sp("/foo.*/")}, true},
-		{MatchConditions{IP: sp("192.168.0.1")}, true},
-		{MatchConditions{IP: sp("192.168.0.0/16")}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::/48")}, true},
+		{MatchConditions{IP: IPPatterns{"192.168.0.1"}}, true},
+		{MatchConditions{IP: IPPatterns{"192.168.0.0/16"}}, true},
+		{MatchConditions{IP: IPPatterns{"2001:db8::1"}}, true},
+		{MatchConditions{IP: IPPatterns{"2001:db8::/48"}}, true},
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, true},
 		// Invalid stuff
 		{MatchConditions{Account: sp("/foo?*/")}, false},
 		{MatchConditions{Type: sp("/foo?*/")}, false},
 		{MatchConditions{Name: sp("/foo?*/")}, false},
 		{MatchConditions{Service: sp("/foo?*/")}, false},
-		{MatchConditions{IP: sp("192.168.0.1/100")}, false},
-		{MatchConditions{IP: sp("192.168.0.*")}, false},
-		{MatchConditions{IP: sp("foo")}, false},
-		{MatchConditions{IP: sp("2001:db8::/222")}, false},
+		{MatchConditions{IP: IPPatterns{"192.168.0.1/100"}}, false},
+		{MatchConditions{IP: IPPatterns{"192.168.0.*"}}, false},
+		{MatchConditions{IP: IPPatterns{"foo"}}, false},
+		{MatchConditions{IP: IPPatterns{"2001:db8::/222"}}, false},
+		{MatchConditions{IP: IPPatterns{"10.0.0.0/8", "192.168.0.1/100"}}, false},
+		{MatchConditions{IP: IPPatterns{}}, false},
 		{MatchConditions{Labels: map[string]string{"foo": "/bar?*/"}}, false},
+		{MatchConditions{Name: sp("${account}/${labels:team}-*")}, true},
+		{MatchConditions{Account: sp(`/^(.+)@test\.com$/`), Name: sp("${account:1}/*")}, true},
+		{MatchConditions{Name: sp("${labels:team/*")}, false},
+		{MatchConditions{Name: sp("${labels:}/*")}, false},
+		{MatchConditions{Name: sp("${user}/*")}, false},
+		{MatchConditions{Labels: map[string]string{"team": "${acount}"}}, false},
+		{MatchConditions{Time: &TimeWindow{Days: []string{"mon-fri", "Sunday"}, Hours: []string{"09:00-17:30", "22:00-24:00"}, Timezone: "Europe/Dublin"}}, true},
+		{MatchConditions{Time: &TimeWindow{Days: []string{"funday"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Days: []string{"mon-"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"9-17"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"09:00-25:00"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Hours: []string{"09:00-09:00"}}}, false},
+		{MatchConditions{Time: &TimeWindow{Timezone: "Mars/Olympus_Mons"}}, false},
+		// Catalog rules must not match the repository "catalog"
+		{MatchConditions{Type: sp("registry"), Name: sp("catalog")}, true},
+		{MatchConditions{Type: sp("repository"), Name: sp("catalog")}, true},
+		{MatchConditions{Type: sp("/^registry$/"), Name: sp("catalog")}, true},
+		{MatchConditions{Name: sp("catalog")}, false},
+		{MatchConditions{Type: sp("re*"), Name: sp("catalog")}, false},
+		{MatchConditions{Type: sp("/^re/"), Name: sp("catalog")}, false},
+		{MatchConditions{Name: sp("cat*")}, true},
+		{MatchConditions{Class: sp("/foo?*/")}, false},
 	}
 	for i, c := range cases {
 		result := validateMatchConditions(&c.mc)
@@ -87,18 +115,21 @@ func TestMatching(t *testing.T) {
 		{MatchConditions{Service: sp("notary"), Type: sp("baz")}, ai1, false},
 		{MatchConditions{Service: sp("notary1"), Type: sp("bar")}, ai1, false},
 		// IP matching
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: nil}, false},
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
-		{MatchConditions{IP: sp("127.0.0.1")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, false},
-		{MatchConditions{IP: sp("127.0.0.2")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, false},
-		{MatchConditions{IP: sp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
-		{MatchConditions{IP: sp("127.0.0.0/8")}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: nil}, false},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::1")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, false},
-		{MatchConditions{IP: sp("2001:db8::2")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, false},
-		{MatchConditions{IP: sp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
-		{MatchConditions{IP: sp("2001:db8::/48")}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		{MatchConditions{IP: IPPatterns{"127.0.0.1"}}, api.AuthRequestInfo{IP: nil}, false},
+		{MatchConditions{IP: IPPatterns{"127.0.0.1"}}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{MatchConditions{IP: IPPatterns{"127.0.0.1"}}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, false},
+		{MatchConditions{IP: IPPatterns{"127.0.0.2"}}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, false},
+		{MatchConditions{IP: IPPatterns{"127.0.0.0/8"}}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{MatchConditions{IP: IPPatterns{"127.0.0.0/8"}}, api.AuthRequestInfo{IP: net.IPv4(127, 0, 0, 2)}, true},
+		{MatchConditions{IP: IPPatterns{"2001:db8::1"}}, api.AuthRequestInfo{IP: nil}, false},
+		{MatchConditions{IP: IPPatterns{"2001:db8::1"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
+		{MatchConditions{IP: IPPatterns{"2001:db8::1"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, false},
+		{MatchConditions{IP: IPPatterns{"2001:db8::2"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, false},
+		{MatchConditions{IP: IPPatterns{"2001:db8::/48"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::1")}, true},
+		{MatchConditions{IP: IPPatterns{"2001:db8::/48"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		{MatchConditions{IP: IPPatterns{"10.0.0.0/8", "2001:db8::/48"}}, api.AuthRequestInfo{IP: net.IPv4(10, 1, 2, 3)}, true},
+		{MatchConditions{IP: IPPatterns{"10.0.0.0/8", "2001:db8::/48"}}, api.AuthRequestInfo{IP: net.ParseIP("2001:db8::2")}, true},
+		{MatchConditions{IP: IPPatterns{"10.0.0.0/8", "2001:db8::/48"}}, api.AuthRequestInfo{IP: net.IPv4(192, 168, 0, 1)}, false},
 		// Label matching
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, ai1, false},
 		{MatchConditions{Labels: map[string]string{"foo": "bar"}}, ai2, false},
@@ -117,6 +148,23 @@ func TestMatching(t *testing.T) {
 		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai4, true},  // multiple label match success
 		{MatchConditions{Name: sp("${labels:group}/${labels:noexist}")}, ai4, false}, // multiple label match fail wrong label
 		{MatchConditions{Name: sp("${labels:group}/${labels:project}")}, ai5, false}, // multiple label match fail. right label, wrong value
+		{MatchConditions{Name: sp("/^${labels:group}/.+$/")}, api.AuthRequestInfo{Name: "admins/foo", Labels: api.Labels{"group": {"admins"}}}, true},
+		{MatchConditions{Name: sp("${labels:group}*")}, api.AuthRequestInfo{Name: "${labels:group}", Labels: api.Labels{"team": {"foo"}}}, false},                         // unresolved label fails closed
+		{MatchConditions{Name: sp("${labels:group}/${labels:team}")}, api.AuthRequestInfo{Name: "admins/${labels:team}", Labels: api.Labels{"group": {"admins"}}}, false}, // one label missing
+		// Cross-repository mounts
+		{MatchConditions{Name: sp("team-a/*"), MountTo: sp("team-b/*")}, api.AuthRequestInfo{Name: "team-a/base", MountTarget: "team-b/app"}, true},
+		{MatchConditions{Name: sp("team-a/*"), MountTo: sp("team-b/*")}, api.AuthRequestInfo{Name: "team-a/base", MountTarget: "team-c/app"}, false},
+		{MatchConditions{Name: sp("team-a/*"), MountTo: sp("team-b/*")}, api.AuthRequestInfo{Name: "team-a/base"}, false}, // not a mount
+		{MatchConditions{Name: sp("team-a/*")}, api.AuthRequestInfo{Name: "team-a/base", MountTarget: "team-b/app"}, true},
+		{MatchConditions{MountTo: sp("${labels:team}/*")}, api.AuthRequestInfo{Name: "shared/base", MountTarget: "b/app", Labels: api.Labels{"team": {"b"}}}, true},
+		// Catalog and resource classes
+		{MatchConditions{Type: sp("registry"), Name: sp("catalog")}, api.AuthRequestInfo{Type: "registry", Name: "catalog"}, true},
+		{MatchConditions{Type: sp("registry"), Name: sp("catalog")}, api.AuthRequestInfo{Type: "repository", Name: "catalog"}, false},
+		{MatchConditions{Type: sp("repository"), Name: sp("catalog")}, api.AuthRequestInfo{Type: "registry", Name: "catalog"}, false},
+		{MatchConditions{Class: sp("plugin")}, api.AuthRequestInfo{Type: "repository", Class: "plugin", Name: "foo"}, true},
+		{MatchConditions{Class: sp("plugin")}, api.AuthRequestInfo{Type: "repository", Name: "foo"}, false},
+		{MatchConditions{Class: sp("")}, api.AuthRequestInfo{Type: "repository", Class: "plugin", Name: "foo"}, false},
+		{MatchConditions{}, api.AuthRequestInfo{Type: "repository", Class: "plugin", Name: "foo"}, true},
 	}
 	for i, c := range cases {
 		if result := c.mc.Matches(&c.ai); result != c.matches {
@@ -124,3 +172,216 @@ func TestMatching(t *testing.T) {
 		}
 	}
 }
+
+func pri(i int) *int {
+	return &i
+}
+
+func TestPriority(t *testing.T) {
+	acl := ACL{
+		{Match: &MatchConditions{}, Comment: sp("a")},
+		{Match: &MatchConditions{}, Comment: sp("b"), Priority: pri(10)},
+		{Match: &MatchConditions{}, Comment: sp("c"), Priority: pri(-1)},
+		{Match: &MatchConditions{}, Comment: sp("d")},
+		{Match: &MatchConditions{}, Comment: sp("e"), Priority: pri(20)},
+	}
+	if err := ValidateACL(acl, false); err != nil {
+		t.Fatalf("ValidateACL: %s", err)
+	}
+	var order string
+	for _, e := range acl {
+		order += *e.Comment
+	}
+	// Unset is 0, ties keep the original order.
+	if order != "ebadc" {
+		t.Errorf("expected order ebadc, got %s", order)
+	}
+
+	dups := ACL{
+		{Match: &MatchConditions{}, Comment: sp("a"), Priority: pri(10)},
+		{Match: &MatchConditions{}, Comment: sp("b"), Priority: pri(10)},
+		{Match: &MatchConditions{}, Comment: sp("c"), Priority: pri(20)},
+	}
+	if err := ValidateACL(dups, false); err == nil {
+		t.Errorf("expected duplicate priorities to be rejected")
+	}
+	if err := ValidateACL(dups, true); err != nil {
+		t.Fatalf("ValidateACL: %s", err)
+	}
+	if *dups[0].Comment != "c" || *dups[1].Comment != "a" || *dups[2].Comment != "b" {
+		t.Errorf("expected order cab, got %s%s%s", *dups[0].Comment, *dups[1].Comment, *dups[2].Comment)
+	}
+}
+
+func TestRegistryActions(t *testing.T) {
+	for _, c := range []struct {
+		actions []string
+		ok      bool
+	}{
+		{[]string{"*"}, true},
+		{[]string{}, true},
+		{[]string{"pull", "*"}, true},
+		{[]string{"pull"}, false},
+	} {
+		acl := ACL{{Match: &MatchConditions{Type: sp("registry"), Name: sp("catalog")}, Actions: &c.actions}}
+		if err := ValidateACL(acl, false); (err == nil) != c.ok {
+			t.Errorf("%v: expected ok=%t, got %v", c.actions, c.ok, err)
+		}
+	}
+	// An entry without actions grants nothing, so there is nothing to check.
+	if err := ValidateACL(ACL{{Match: &MatchConditions{Type: sp("registry"), Name: sp("catalog")}}}, false); err != nil {
+		t.Errorf("expected an entry without actions to pass, got %v", err)
+	}
+	aa, err := NewACLAuthorizer(ACL{
+		{Match: &MatchConditions{Account: sp("viewer"), Type: sp("registry"), Name: sp("catalog")}, Actions: &[]string{}},
+		{Match: &MatchConditions{Type: sp("registry"), Name: sp("catalog")}, Actions: &[]string{"*"}},
+		{Match: &MatchConditions{}, Actions: &[]string{"pull"}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	for _, c := range []struct {
+		ai      api.AuthRequestInfo
+		granted []string
+	}{
+		{api.AuthRequestInfo{Account: "user", Type: "registry", Name: "catalog", Actions: []string{"*"}}, []string{"*"}},
+		{api.AuthRequestInfo{Account: "viewer", Type: "registry", Name: "catalog", Actions: []string{"*"}}, []string{}},
+		{api.AuthRequestInfo{Account: "viewer", Type: "repository", Name: "catalog", Actions: []string{"pull", "push"}}, []string{"pull"}},
+	} {
+		granted, err := aa.Authorize(&c.ai)
+		if err != nil || !reflect.DeepEqual(granted, c.granted) {
+			t.Errorf("%s: expected %v, got %v, %v", c.ai, c.granted, granted, err)
+		}
+	}
+}
+
+func TestContinue(t *testing.T) {
+	aa, err := NewACLAuthorizer(ACL{
+		{Match: &MatchConditions{Account: sp("guest")}, Actions: &[]string{}},
+		{Match: &MatchConditions{Account: sp("/.+/")}, Actions: &[]string{"pull"}, Continue: true},
+		{Match: &MatchConditions{Labels: map[string]string{"group": "dev"}}, Actions: &[]string{"push"}, Continue: true},
+		{Match: &MatchConditions{Labels: map[string]string{"group": "admin"}}, Actions: &[]string{"*"}},
+		{Match: &MatchConditions{Name: sp("scratch/*")}, Actions: &[]string{"delete"}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	for i, c := range []struct {
+		ai      api.AuthRequestInfo
+		granted []string // nil for no match
+	}{
+		// A subset of the requested actions.
+		{api.AuthRequestInfo{Account: "user", Name: "foo", Actions: []string{"pull", "push"}}, []string{"pull"}},
+		// Aggregated across entries.
+		{api.AuthRequestInfo{Account: "user", Name: "foo", Actions: []string{"pull", "push"}, Labels: api.Labels{"group": {"dev"}}}, []string{"pull", "push"}},
+		{api.AuthRequestInfo{Account: "user", Name: "foo", Actions: []string{"delete", "pull", "push"}, Labels: api.Labels{"group": {"dev"}}}, []string{"pull", "push"}},
+		{api.AuthRequestInfo{Account: "user", Name: "scratch/foo", Actions: []string{"delete", "pull", "push"}, Labels: api.Labels{"group": {"dev"}}}, []string{"delete", "pull", "push"}},
+		{api.AuthRequestInfo{Account: "user", Name: "foo", Actions: []string{"delete", "pull"}, Labels: api.Labels{"group": {"admin"}}}, []string{"delete", "pull"}},
+		// Entries without continue end the evaluation.
+		{api.AuthRequestInfo{Account: "guest", Name: "scratch/foo", Actions: []string{"delete", "pull"}}, []string{}},
+		{api.AuthRequestInfo{Account: "", Name: "foo", Actions: []string{"pull"}}, nil},
+	} {
+		granted, err := aa.Authorize(&c.ai)
+		if c.granted == nil {
+			if err != api.NoMatch {
+				t.Errorf("%d: expected no match, got %v, %v", i, granted, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(granted, c.granted) {
+			t.Errorf("%d: expected %v, got %v, %v", i, c.granted, granted, err)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	ai := api.AuthRequestInfo{Account: "foo"}
+	businessHours := MatchConditions{Time: &TimeWindow{Days: []string{"mon-fri"}, Hours: []string{"09:00-17:00"}, Timezone: "America/New_York"}}
+	overnight := MatchConditions{Time: &TimeWindow{Days: []string{"sat"}, Hours: []string{"22:00-06:00"}}}
+	workdays := MatchConditions{Time: &TimeWindow{Days: []string{"mon-fri"}, Timezone: "America/New_York"}}
+	weekend := MatchConditions{Time: &TimeWindow{Days: []string{"sat-sun"}}}
+	cases := []struct {
+		mc      MatchConditions
+		now     string
+		matches bool
+	}{
+		{businessHours, "2026-10-14T13:00:00Z", true},  // Wednesday, 9:00 in New York
+		{businessHours, "2026-10-14T12:59:00Z", false}, // 8:59 in New York
+		{businessHours, "2026-10-14T20:59:00Z", true},
+		{businessHours, "2026-10-14T21:00:00Z", false}, // The end is exclusive
+		{businessHours, "2026-10-17T15:00:00Z", false}, // Saturday
+		{workdays, "2026-10-17T02:00:00Z", true},       // Friday evening in New York
+		{workdays, "2026-10-19T03:00:00Z", false},
+		{overnight, "2026-10-17T23:00:00Z", true},
+		{overnight, "2026-10-17T05:59:00Z", true}, // Days and hours are checked separately
+		{overnight, "2026-10-18T01:00:00Z", false},
+		{overnight, "2026-10-17T12:00:00Z", false},
+		{weekend, "2026-10-18T12:00:00Z", true},
+		{weekend, "2026-10-19T00:00:00Z", false},
+	}
+	for i, c := range cases {
+		now, err := time.Parse(time.RFC3339, c.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timeNow = func() time.Time { return now }
+		if result := c.mc.Matches(&ai); result != c.matches {
+			t.Errorf("%d: %+v at %s: expected %t, got %t", i, *c.mc.Time, c.now, c.matches, result)
+		}
+	}
+}
+
+func TestIPPatternsJSON(t *testing.T) {
+	for _, c := range []struct {
+		json string
+		ipp  IPPatterns
+	}{
+		{`{"ip": "10.0.0.0/8"}`, IPPatterns{"10.0.0.0/8"}},
+		{`{"ip": ["10.0.0.0/8", "::1"]}`, IPPatterns{"10.0.0.0/8", "::1"}},
+		{`{}`, nil},
+		{`{"ip": null}`, nil},
+	} {
+		var mc MatchConditions
+		if err := json.Unmarshal([]byte(c.json), &mc); err != nil {
+			t.Fatalf("%s: %s", c.json, err)
+		}
+		if !reflect.DeepEqual(mc.IP, c.ipp) {
+			t.Errorf("%s: expected %#v, got %#v", c.json, c.ipp, mc.IP)
+		}
+	}
+}
+
+func BenchmarkAuthorize(b *testing.B) {
+	newACL := func() ACL {
+		var acl ACL
+		for i := 0; i < 100; i++ {
+			acl = append(acl, ACLEntry{
+				Match:   &MatchConditions{Account: sp(fmt.Sprintf("/^user%d(-[a-z]+)?$/", i)), Name: sp(`/^(library|team-[0-9]+)/.+$/`)},
+				Actions: &[]string{"pull"},
+			})
+		}
+		return acl
+	}
+	ai := &api.AuthRequestInfo{Account: "user99-ci", Type: "repository", Name: "team-1/app", Service: "registry", Actions: []string{"pull", "push"}}
+	b.Run("uncompiled", func(b *testing.B) {
+		// Not validated, so nothing is precompiled.
+		aa := &aclAuthorizer{acl: newACL()}
+		for i := 0; i < b.N; i++ {
+			if _, err := aa.Authorize(ai); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		aa, err := NewACLAuthorizer(newACL(), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			if _, err := aa.Authorize(ai); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow restricts an ACL entry to certain days of the week and times of day.
+type TimeWindow struct {
+	// Days of the week, e.g. "mon", "tuesday" or a range such as "mon-fri". Empty means every day.
+	Days []string `mapstructure:"days,omitempty" json:"days,omitempty"`
+	// Times of day as "HH:MM-HH:MM", the end is exclusive. A range that ends before it starts,
+	// e.g. "22:00-06:00", spans midnight. Empty means all day.
+	Hours []string `mapstructure:"hours,omitempty" json:"hours,omitempty"`
+	// IANA time zone name, e.g. "Europe/Dublin". Default is UTC.
+	Timezone string `mapstructure:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// Replaced in tests.
+var timeNow = time.Now
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	d, found := weekdays[strings.ToLower(strings.TrimSpace(s))]
+	if !found {
+		return 0, fmt.Errorf("invalid day of week %q", s)
+	}
+	return d, nil
+}
+
+// parseDays returns the set of days as a bitmask indexed by time.Weekday.
+func parseDays(days []string) (uint8, error) {
+	var mask uint8
+	for _, d := range days {
+		parts := strings.SplitN(d, "-", 2)
+		first, err := parseWeekday(parts[0])
+		if err != nil {
+			return 0, err
+		}
+		last := first
+		if len(parts) == 2 {
+			if last, err = parseWeekday(parts[1]); err != nil {
+				return 0, err
+			}
+		}
+		// Ranges may wrap around the end of the week, e.g. "fri-mon".
+		for wd := first; ; wd = (wd + 1) % 7 {
+			mask |= 1 << uint(wd)
+			if wd == last {
+				break
+			}
+		}
+	}
+	return mask, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight. "24:00" is allowed as the end of a day.
+func parseTimeOfDay(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type minuteRange struct {
+	start, end int
+}
+
+func (r minuteRange) contains(minute int) bool {
+	if r.start <= r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+func parseHours(hours []string) ([]minuteRange, error) {
+	var ranges []minuteRange
+	for _, h := range hours {
+		parts := strings.Split(h, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", h)
+		}
+		start, err := parseTimeOfDay(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("empty time range %q", h)
+		}
+		ranges = append(ranges, minuteRange{start, end})
+	}
+	return ranges, nil
+}
+
+func (tw *TimeWindow) validate() error {
+	if _, err := parseDays(tw.Days); err != nil {
+		return err
+	}
+	if _, err := parseHours(tw.Hours); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(tw.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %s", tw.Timezone, err)
+	}
+	return nil
+}
+
+// contains checks whether t falls within the window. Days and hours are checked separately,
+// so the part of "22:00-06:00" after midnight belongs to the next day.
+func (tw *TimeWindow) contains(t time.Time) (bool, error) {
+	loc, err := time.LoadLocation(tw.Timezone)
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+	if len(tw.Days) > 0 {
+		days, err := parseDays(tw.Days)
+		if err != nil {
+			return false, err
+		}
+		if days&(1<<uint(t.Weekday())) == 0 {
+			return false, nil
+		}
+	}
+	if len(tw.Hours) == 0 {
+		return true, nil
+	}
+	ranges, err := parseHours(tw.Hours)
+	if err != nil {
+		return false, err
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range ranges {
+		if r.contains(minute) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -145,7 +145,7 @@ func (xa *aclXormAuthz) updateACLCache() error {
 		retACL = append(retACL, e.ACLEntry)
 	}
 
-	newStaticAuthorizer, err := NewACLAuthorizer(retACL)
+	newStaticAuthorizer, err := NewACLAuthorizer(retACL, false)
 	if err != nil {
 		return err
 	}
@@ -17,14 +17,21 @@ package authz
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/cesanta/docker_auth/auth_server/api"
+	fsnotify "gopkg.in/fsnotify.v1"
 )
 
 type CasbinAuthzConfig struct {
-	ModelFilePath  string `yaml:"model_path"`
-	PolicyFilePath string `yaml:"policy_path"`
+	ModelFilePath  string `yaml:"model_path" mapstructure:"model_path"`
+	PolicyFilePath string `yaml:"policy_path" mapstructure:"policy_path"`
+	// Reload the model and policy when the files change.
+	Watch bool `yaml:"watch" mapstructure:"watch,omitempty"`
+	// Also check the files for changes periodically, for filesystems that do not deliver change notifications.
+	ReloadInterval time.Duration `yaml:"reload_interval" mapstructure:"reload_interval,omitempty"`
 }
 
 // labelMatch determines whether lbl1 matches lbl2.
@@ -81,8 +88,14 @@ func stringToLabels(str string) api.Labels {
 }
 
 type casbinAuthorizer struct {
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
 	acl      ACL
+
+	// Set when the enforcer is reloaded from files, see NewCasbinFileAuthorizer.
+	config  *CasbinAuthzConfig
+	watcher *fsnotify.Watcher
+	stop    chan struct{}
 }
 
 // NewCasbinAuthorizer creates a new casbin authorizer.
@@ -95,8 +108,11 @@ func NewCasbinAuthorizer(enforcer *casbin.Enforcer) (api.Authorizer, error) {
 func (a *casbinAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
 	actions := []string{}
 
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
 	for _, action := range ai.Actions {
-		if ok, _ := a.enforcer.Enforce(ai.Account, ai.Type, ai.Name, ai.Service, ai.IP.String(), action, labelsToString(ai.Labels)); ok {
+		if ok, _ := enforcer.Enforce(ai.Account, ai.Type, ai.Name, ai.Service, ai.IP.String(), action, labelsToString(ai.Labels)); ok {
 			actions = append(actions, action)
 		}
 	}
@@ -107,7 +123,9 @@ func (a *casbinAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error)
 
 // Stop stops the middleware.
 func (a *casbinAuthorizer) Stop() {
-	// Nothing to do.
+	if a.stop != nil {
+		close(a.stop)
+	}
 }
 
 // Name returns the name of the middleware.
@@ -16,9 +16,13 @@ package authz
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/util"
@@ -113,3 +117,50 @@ func TestPermissions(t *testing.T) {
 	testRequest(t, a, "admin", "book", "book1", "bookstore1", "1.2.3.4", map[string][]string{"a": {"c"}}, []string{"write", "read", "delete"}, []string{"write", "read", "delete"})
 	testRequest(t, a, "admin", "book", "book1", "bookstore1", "1.2.3.4", map[string][]string{"a": {"b", "c"}}, []string{"write", "read", "delete"}, []string{"write", "read", "delete"})
 }
+
+func TestCasbinReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_auth_casbin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	model, err := ioutil.ReadFile("../../examples/casbin_authz_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &CasbinAuthzConfig{
+		ModelFilePath:  filepath.Join(dir, "model.conf"),
+		PolicyFilePath: filepath.Join(dir, "policy.csv"),
+		Watch:          true,
+	}
+	write := func(file, s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(cfg.ModelFilePath, string(model))
+	write(cfg.PolicyFilePath, `p, alice, book, book1, bookstore1, 1.2.3.4, read, "{""a"":[""b""]}"`+"\n")
+	if err := cfg.Validate("casbin_authz"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewCasbinFileAuthorizer(cfg)
+	if err != nil {
+		t.Fatalf("NewCasbinFileAuthorizer: %s", err)
+	}
+	defer a.Stop()
+	labels := map[string][]string{"a": {"b"}}
+	testRequest(t, a, "alice", "book", "book1", "bookstore1", "1.2.3.4", labels, []string{"write", "read"}, []string{"read"})
+
+	write(cfg.PolicyFilePath, "x, alice\n")
+	time.Sleep(1500 * time.Millisecond)
+	testRequest(t, a, "alice", "book", "book1", "bookstore1", "1.2.3.4", labels, []string{"write", "read"}, []string{"read"})
+
+	write(cfg.PolicyFilePath, `p, alice, book, book1, bookstore1, 1.2.3.4, write, "{""a"":[""b""]}"`+"\n")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if actions, _ := a.Authorize(&api.AuthRequestInfo{Account: "alice", Type: "book", Name: "book1", Service: "bookstore1",
+			IP: net.ParseIP("1.2.3.4"), Actions: []string{"write"}, Labels: labels}); len(actions) == 1 {
+			break
+		}
+	}
+	testRequest(t, a, "alice", "book", "book1", "bookstore1", "1.2.3.4", labels, []string{"write", "read"}, []string{"write"})
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/cesanta/glog"
+	fsnotify "gopkg.in/fsnotify.v1"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// How long to wait for writes to the model and policy files to settle before reloading them.
+const casbinReloadDelay = 500 * time.Millisecond
+
+// Validate checks the config.
+func (c *CasbinAuthzConfig) Validate(configKey string) error {
+	if c.ModelFilePath == "" || c.PolicyFilePath == "" {
+		return fmt.Errorf("%s: model_path and policy_path are required", configKey)
+	}
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("%s.reload_interval must not be negative", configKey)
+	}
+	return nil
+}
+
+// NewCasbinFileAuthorizer creates a casbin authorizer with the model and policy read from files.
+// If configured, the files are reloaded when they change; if the new model or policy cannot be
+// loaded, the previous one remains in effect.
+func NewCasbinFileAuthorizer(c *CasbinAuthzConfig) (api.Authorizer, error) {
+	contents, err := readCasbinFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	enforcer, err := newCasbinEnforcer(c)
+	if err != nil {
+		return nil, err
+	}
+	a := &casbinAuthorizer{enforcer: enforcer, config: c}
+	if !c.Watch && c.ReloadInterval == 0 {
+		return a, nil
+	}
+	if c.Watch {
+		if a.watcher, err = fsnotify.NewWatcher(); err != nil {
+			return nil, fmt.Errorf("failed to create casbin policy watcher: %s", err)
+		}
+		// Watch the directories rather than the files, so that replacing the files is noticed too.
+		for _, f := range []string{c.ModelFilePath, c.PolicyFilePath} {
+			if err := a.watcher.Add(filepath.Dir(f)); err != nil {
+				a.watcher.Close()
+				return nil, fmt.Errorf("failed to watch %s: %s", f, err)
+			}
+		}
+	}
+	a.stop = make(chan struct{})
+	go a.watch(contents)
+	return a, nil
+}
+
+func readCasbinFiles(c *CasbinAuthzConfig) ([]byte, error) {
+	model, err := ioutil.ReadFile(c.ModelFilePath)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ioutil.ReadFile(c.PolicyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(model, 0), policy...), nil
+}
+
+// newCasbinEnforcer creates a new enforcer rather than reloading the policy of the current one,
+// because a failed reload would leave it with no or partial policy.
+func newCasbinEnforcer(c *CasbinAuthzConfig) (e *casbin.Enforcer, err error) {
+	defer func() {
+		// The file adapter panics on some malformed policy lines.
+		if r := recover(); r != nil {
+			e, err = nil, fmt.Errorf("invalid casbin policy %s: %v", c.PolicyFilePath, r)
+		}
+	}()
+	e, err = casbin.NewEnforcer(c.ModelFilePath, c.PolicyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	e.AddFunction("labelMatch", labelMatchFunc)
+	return e, nil
+}
+
+func (a *casbinAuthorizer) watch(loaded []byte) {
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if a.watcher != nil {
+		defer a.watcher.Close()
+		events, watchErrors = a.watcher.Events, a.watcher.Errors
+	}
+	var tick <-chan time.Time
+	if a.config.ReloadInterval > 0 {
+		ticker := time.NewTicker(a.config.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var reload <-chan time.Time
+	// Contents that failed to load, not to retry and log the same error over and over.
+	var failed []byte
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-events:
+			// Changes are batched and the contents compared, so that unrelated ones are ignored.
+			reload = time.After(casbinReloadDelay)
+		case err := <-watchErrors:
+			glog.Errorf("Error watching casbin policy: %s", err)
+		case <-tick:
+			if reload == nil {
+				reload = time.After(0)
+			}
+		case <-reload:
+			reload = nil
+			contents, err := readCasbinFiles(a.config)
+			if err != nil {
+				glog.Errorf("Failed to reload casbin policy, keeping the previous one: %s", err)
+				continue
+			}
+			if bytes.Equal(contents, loaded) || bytes.Equal(contents, failed) {
+				continue
+			}
+			enforcer, err := newCasbinEnforcer(a.config)
+			if err != nil {
+				glog.Errorf("Failed to reload casbin policy, keeping the previous one: %s", err)
+				failed = contents
+				continue
+			}
+			a.mu.Lock()
+			a.enforcer = enforcer
+			a.mu.Unlock()
+			loaded = contents
+			glog.Infof("Reloaded casbin policy from %s", a.config.PolicyFilePath)
+		}
+	}
+}
@@ -35,6 +35,13 @@ type ExtAuthzConfig struct {
 
 type ExtAuthzStatus int
 
+// ExtAuthzResponse is what the command may print to stdout when it denies the request. Optional,
+// output that is not in this format is ignored, as by commands that predate it.
+type ExtAuthzResponse struct {
+	// Why the request was denied, logged and told to clients if server.deny_reasons is enabled.
+	Reason string `json:"reason,omitempty"`
+}
+
 const (
 	ExtAuthzAllowed ExtAuthzStatus = 0
 	ExtAuthzDenied  ExtAuthzStatus = 1
@@ -86,6 +93,11 @@ func (ea *ExtAuthz) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
 	case ExtAuthzAllowed:
 		return ai.Actions, nil
 	case ExtAuthzDenied:
+		if reason := extAuthzDenyReason(output); reason != "" {
+			glog.Infof("External authz denied %s: %s", ai, reason)
+			ai.MatchedRule = "ext_authz: " + reason
+			ai.MatchedRuleName = reason
+		}
 		return []string{}, nil
 	default:
 		glog.Errorf("Ext command error: %d %s", es, et)
@@ -93,6 +105,15 @@ func (ea *ExtAuthz) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
 	return nil, fmt.Errorf("bad return code from command: %d", es)
 }
 
+// extAuthzDenyReason returns the reason in the output of a command that denied a request, if any.
+func extAuthzDenyReason(output []byte) string {
+	var resp ExtAuthzResponse
+	if len(output) == 0 || json.Unmarshal(output, &resp) != nil {
+		return ""
+	}
+	return strings.TrimSpace(resp.Reason)
+}
+
 func (sua *ExtAuthz) Stop() {
 }
 
@@ -0,0 +1,59 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestExtAuthzDenyReason(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "authz.sh")
+	// Denies pushes with a reason and anything else without, as commands that predate reasons do.
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+read j
+case "$j" in
+*push*) echo '{"reason": "pushes are frozen"}'; exit 1;;
+*delete*) echo "not json"; exit 1;;
+*) exit 1;;
+esac
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewExtAuthzAuthorizer(&ExtAuthzConfig{Command: script})
+	for _, tc := range []struct {
+		action, rule string
+	}{
+		{"push", "pushes are frozen"},
+		{"delete", ""},
+		{"pull", ""},
+	} {
+		ai := &api.AuthRequestInfo{Account: "foo", Type: "repository", Name: "bar", Actions: []string{tc.action}}
+		actions, err := a.Authorize(ai)
+		if err != nil || !reflect.DeepEqual(actions, []string{}) {
+			t.Errorf("%s: expected a deny, got %v, %v", tc.action, actions, err)
+		}
+		if ai.MatchedRuleName != tc.rule {
+			t.Errorf("%s: expected reason %q, got %q", tc.action, tc.rule, ai.MatchedRuleName)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const (
+	defaultOPAQuery   = "data.docker_auth.allowed_actions"
+	defaultOPATimeout = 5 * time.Second
+)
+
+// OPAAuthzConfig configures authorization by an Open Policy Agent policy, either queried from
+// an OPA server or evaluated by running "opa eval" on a policy file.
+type OPAAuthzConfig struct {
+	// Base URL of the OPA server, e.g. http://localhost:8181.
+	URL string `mapstructure:"url,omitempty"`
+	// Rego policy file to evaluate with the opa binary, instead of a server.
+	PolicyFile string `mapstructure:"policy_file,omitempty"`
+	OPABinary  string `mapstructure:"opa_binary,omitempty"`
+	// The rule that yields the list of allowed actions. Default is data.docker_auth.allowed_actions.
+	Query   string        `mapstructure:"query,omitempty"`
+	Timeout time.Duration `mapstructure:"timeout,omitempty"`
+}
+
+// Validate checks the config and fills in the defaults.
+func (c *OPAAuthzConfig) Validate(configKey string) error {
+	if (c.URL == "") == (c.PolicyFile == "") {
+		return fmt.Errorf("%s: exactly one of url and policy_file must be set", configKey)
+	}
+	if c.Query == "" {
+		c.Query = defaultOPAQuery
+	}
+	if c.Query != "data" && !strings.HasPrefix(c.Query, "data.") {
+		return fmt.Errorf("%s.query must be a rule under data, e.g. %s", configKey, defaultOPAQuery)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultOPATimeout
+	}
+	if c.PolicyFile != "" {
+		if _, err := os.Stat(c.PolicyFile); err != nil {
+			return fmt.Errorf("%s.policy_file: %s", configKey, err)
+		}
+		if c.OPABinary == "" {
+			c.OPABinary = "opa"
+		}
+		if _, err := exec.LookPath(c.OPABinary); err != nil {
+			return fmt.Errorf("%s.opa_binary: %s", configKey, err)
+		}
+	}
+	return nil
+}
+
+// opaInput is the input document the policy is evaluated against.
+type opaInput struct {
+	Account string     `json:"account"`
+	Type    string     `json:"type"`
+	Class   string     `json:"class"`
+	Name    string     `json:"name"`
+	Service string     `json:"service"`
+	IP      string     `json:"ip"`
+	Actions []string   `json:"actions"`
+	Labels  api.Labels `json:"labels"`
+}
+
+type OPAAuthz struct {
+	cfg    *OPAAuthzConfig
+	client *http.Client
+}
+
+func NewOPAAuthorizer(cfg *OPAAuthzConfig) *OPAAuthz {
+	if cfg.URL != "" {
+		glog.Infof("OPA authorization: %s at %s", cfg.Query, cfg.URL)
+	} else {
+		glog.Infof("OPA authorization: %s in %s", cfg.Query, cfg.PolicyFile)
+	}
+	return &OPAAuthz{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Authorize returns the requested actions that the policy allows.
+// If the rule is undefined for the input, the decision is left to the next authorizer.
+func (oa *OPAAuthz) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	input := opaInput{
+		Account: ai.Account,
+		Type:    ai.Type,
+		Class:   ai.Class,
+		Name:    ai.Name,
+		Service: ai.Service,
+		Actions: ai.Actions,
+		Labels:  ai.Labels,
+	}
+	if ai.IP != nil {
+		input.IP = ai.IP.String()
+	}
+	var result json.RawMessage
+	var err error
+	if oa.cfg.URL != "" {
+		result, err = oa.queryServer(&input)
+	} else {
+		result, err = oa.eval(&input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, api.NoMatch
+	}
+	var allowed []string
+	if err := json.Unmarshal(result, &allowed); err != nil {
+		return nil, fmt.Errorf("%s must be a list of actions, got %s", oa.cfg.Query, result)
+	}
+	ai.MatchedRule = oa.cfg.Query
+	return StringSetIntersection(ai.Actions, allowed), nil
+}
+
+// queryServer asks the OPA server for the value of the query with its Data API.
+func (oa *OPAAuthz) queryServer(input *opaInput) (json.RawMessage, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(oa.cfg.URL, "/") + "/v1/" + strings.Replace(oa.cfg.Query, ".", "/", -1)
+	resp, err := oa.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("OPA request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("OPA request failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OPA returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return nil, fmt.Errorf("could not parse OPA response: %s", err)
+	}
+	return out.Result, nil
+}
+
+// eval evaluates the query in the policy file with "opa eval".
+func (oa *OPAAuthz) eval(input *opaInput) (json.RawMessage, error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oa.cfg.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, oa.cfg.OPABinary, "eval", "--format", "json", "--stdin-input", "--data", oa.cfg.PolicyFile, oa.cfg.Query)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	glog.V(2).Infof("%s %s -> %s %s", cmd.Path, cmd.Args, output, err)
+	if err != nil {
+		return nil, fmt.Errorf("opa eval failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var out struct {
+		Result []struct {
+			Expressions []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("could not parse opa eval output: %s", err)
+	}
+	if len(out.Result) == 0 {
+		return nil, nil
+	}
+	if len(out.Result[0].Expressions) == 0 {
+		return nil, errors.New("opa eval returned no expressions")
+	}
+	return out.Result[0].Expressions[0].Value, nil
+}
+
+func (oa *OPAAuthz) Stop() {
+}
+
+func (oa *OPAAuthz) Name() string {
+	return "OPA"
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+func TestOPAAuthzServer(t *testing.T) {
+	// Allows pull to everyone and push of images to members of the "dev" group, leaves "undefined/*" undecided.
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/data/docker_auth/allowed_actions" {
+			http.NotFound(rw, req)
+			return
+		}
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatalf("bad request: %s", err)
+		}
+		if body.Input.IP != "192.168.0.1" || body.Input.Service != "registry" {
+			t.Errorf("unexpected input: %+v", body.Input)
+		}
+		if body.Input.Name == "undefined/repo" {
+			rw.Write([]byte(`{}`))
+			return
+		}
+		allowed := []string{"pull"}
+		for _, g := range body.Input.Labels["group"] {
+			if g == "dev" && body.Input.Class == "" {
+				allowed = append(allowed, "push")
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"result": allowed})
+	}))
+	defer srv.Close()
+
+	cfg := &OPAAuthzConfig{URL: srv.URL}
+	if err := cfg.Validate("opa_authz"); err != nil {
+		t.Fatal(err)
+	}
+	oa := NewOPAAuthorizer(cfg)
+	for _, c := range []struct {
+		name   string
+		class  string
+		labels api.Labels
+		want   []string
+		err    error
+	}{
+		{"team/repo", "", nil, []string{"pull"}, nil},
+		{"team/repo", "", api.Labels{"group": {"dev"}}, []string{"pull", "push"}, nil},
+		{"team/chart", "helm", api.Labels{"group": {"dev"}}, []string{"pull"}, nil},
+		{"undefined/repo", "", nil, nil, api.NoMatch},
+	} {
+		ai := &api.AuthRequestInfo{
+			Account: "user", Type: "repository", Class: c.class, Name: c.name, Service: "registry",
+			IP: net.ParseIP("192.168.0.1"), Actions: []string{"pull", "push"}, Labels: c.labels,
+		}
+		got, err := oa.Authorize(ai)
+		if err != c.err || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %v: expected %v, %v, got %v, %v", c.name, c.labels, c.want, c.err, got, err)
+		}
+	}
+}
+
+func TestOPAAuthzConfig(t *testing.T) {
+	for _, cfg := range []*OPAAuthzConfig{
+		{},
+		{URL: "http://localhost:8181", PolicyFile: "policy.rego"},
+		{URL: "http://localhost:8181", Query: "docker_auth.allow"},
+	} {
+		if err := cfg.Validate("opa_authz"); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
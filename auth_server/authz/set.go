@@ -24,3 +24,12 @@ func StringSetIntersection(a, b []string) []string {
 	sort.Strings(d)
 	return d
 }
+
+func StringSetUnion(a, b []string) []string {
+	d := []string{}
+	for s := range makeSet(a).Union(makeSet(b)).Iter() {
+		d = append(d, s.(string))
+	}
+	sort.Strings(d)
+	return d
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/server"
+)
+
+// labelsFlag collects repeated --label key=value flags.
+type labelsFlag api.Labels
+
+func (lf labelsFlag) String() string {
+	var kvs []string
+	for k, vs := range lf {
+		for _, v := range vs {
+			kvs = append(kvs, k+"="+v)
+		}
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (lf labelsFlag) Set(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", kv)
+	}
+	lf[parts[0]] = append(lf[parts[0]], parts[1])
+	return nil
+}
+
+// checkACL implements the check-acl subcommand, which evaluates a request against the static
+// ACL of a config file and prints the matching rule and granted actions for every scope.
+// It returns the exit status, which is 1 if any requested action is denied.
+func checkACL(args []string) int {
+	fs := flag.NewFlagSet("check-acl", flag.ContinueOnError)
+	account := fs.String("account", "", "Account making the request, empty for anonymous requests")
+	service := fs.String("service", "", "Service the token is requested for")
+	ip := fs.String("ip", "127.0.0.1", "Client IP address")
+	envPrefix := fs.String("env-prefix", "REGAUTH", "Prefix of environment variables overriding the config")
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "Label of the account as key=value, may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-acl [flags] config.yml scope...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Prints the static ACL rule matching each scope, e.g. repository:foo/bar:pull,push, and the granted actions.\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+	req := &server.ACLCheckRequest{
+		Account: *account,
+		Service: *service,
+		IP:      net.ParseIP(*ip),
+		Labels:  api.Labels(labels),
+		Scopes:  fs.Args()[1:],
+	}
+	if req.IP == nil {
+		fmt.Fprintf(os.Stderr, "Invalid IP address %q\n", *ip)
+		return 2
+	}
+	c, err := server.LoadConfig(fs.Arg(0), *envPrefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %s\n", err)
+		return 1
+	}
+	results, err := server.CheckACL(c, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	status := 0
+	for _, r := range results {
+		fmt.Printf("%s\n", r.Scope)
+		switch {
+		case r.RuleName != "" && r.RuleName != r.Rule:
+			fmt.Printf("  rule:    %s (%s)\n", r.Rule, r.RuleName)
+		case r.Rule != "":
+			fmt.Printf("  rule:    %s\n", r.Rule)
+		default:
+			fmt.Printf("  rule:    none matched\n")
+		}
+		fmt.Printf("  granted: %s\n", strings.Join(r.Granted, ","))
+		if r.DenyReason != "" {
+			fmt.Printf("  denied:  %s\n", r.DenyReason)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2015 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+// hashPassword implements the hash-password subcommand, which prints a hash of a password for
+// the users and users_file sections of the config. It returns the exit status.
+func hashPassword(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	algo := fs.String("algo", authn.HashBcrypt, "Hash algorithm: bcrypt or argon2id")
+	cost := fs.Int("cost", bcrypt.DefaultCost, "Cost of bcrypt hashes")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s hash-password [--algo bcrypt|argon2id] [--cost N]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Reads a password from the terminal, or the first line of standard input, and prints its hash.\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	password, err := readPassword()
+	if err == nil && password == "" {
+		err = errors.New("empty password")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read password: %s\n", err)
+		return 1
+	}
+	hash, err := authn.HashPassword(*algo, []byte(password), *cost)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+// readPassword prompts for the password twice if standard input is a terminal,
+// otherwise it reads the first line.
+func readPassword() (string, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return "", err
+	}
+	in := bufio.NewReader(os.Stdin)
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return readLine(in)
+	}
+	// Not echoing the password is best effort, stty is not everywhere.
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := readLine(in)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "\nRepeat password: ")
+	again, err := readLine(in)
+	if err != nil {
+		return "", err
+	}
+	if again != password {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
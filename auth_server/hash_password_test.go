@@ -0,0 +1,117 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+// runHashPassword runs the subcommand with the input as standard input and returns its exit status
+// and standard output.
+func runHashPassword(t *testing.T, input string, args ...string) (int, string) {
+	dir := t.TempDir()
+	stdin, stdout := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout")
+	if err := ioutil.WriteFile(stdin, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	savedIn, savedOut, savedErr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = in, out, out
+	status := hashPassword(args)
+	os.Stdin, os.Stdout, os.Stderr = savedIn, savedOut, savedErr
+	output, err := ioutil.ReadFile(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(output)
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		args   []string
+		prefix string
+	}{
+		{"secret\n", []string{"--cost", "4"}, "$2a$04$"},
+		// Only the first line counts.
+		{"secret\r\nother\n", []string{"--cost", "4"}, "$2a$04$"},
+		// It does not need a newline.
+		{"secret", []string{"--algo", "argon2id"}, "$argon2id$"},
+	} {
+		status, output := runHashPassword(t, tc.input, tc.args...)
+		hash := strings.TrimSuffix(output, "\n")
+		if status != 0 || !strings.HasPrefix(hash, tc.prefix) {
+			t.Errorf("%q %q: got %d %q", tc.input, tc.args, status, output)
+			continue
+		}
+		// The hash is accepted for static users.
+		pw := api.PasswordString(hash)
+		users := authn.NewStaticUserAuth(map[string]*authn.Requirements{"alice": {Password: &pw}})
+		if ok, _, err := users.Authenticate("alice", "secret"); !ok || err != nil {
+			t.Errorf("%q %q: hash %q not accepted: %t %v", tc.input, tc.args, hash, ok, err)
+		}
+	}
+}
+
+func TestHashPasswordErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		args   []string
+		status int
+		output string
+	}{
+		{"", nil, 1, "Failed to read password: EOF"},
+		{"\n", nil, 1, "Failed to read password: empty password"},
+		{"secret\n", []string{"--algo", "md5"}, 1, "md5"},
+		{"secret\n", []string{"--cost", "32"}, 1, "cost"},
+		{"secret\n", []string{"--unknown"}, 2, "Usage:"},
+		{"secret\n", []string{"secret"}, 2, "Usage:"},
+	} {
+		if status, output := runHashPassword(t, tc.input, tc.args...); status != tc.status || !strings.Contains(output, tc.output) {
+			t.Errorf("%q %q: got %d %q", tc.input, tc.args, status, output)
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("a\r\nb"))
+	for _, want := range []string{"a", "b"} {
+		if line, err := readLine(r); line != want || err != nil {
+			t.Errorf("got %q %v, want %q", line, err, want)
+		}
+	}
+	if _, err := readLine(r); err == nil {
+		t.Errorf("expected an error at the end of the input")
+	}
+}
@@ -20,12 +20,15 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -41,13 +44,37 @@ var (
 	Version = ""
 	// BuildID comment
 	BuildID = ""
+
+	checkConfig  = flag.Bool("check-config", false, "Validate the config file and exit without starting the server")
+	configSchema = flag.Bool("config-schema", false, "Print the JSON Schema of the config file and exit")
 )
 
 type RestartableServer struct {
 	configFile string
 	envPrefix  string
-	authServer *server.AuthServer
-	hs         *http.Server
+	servers    []*http.Server
+	// How long to keep serving after failing readiness checks, and how long
+	// to wait for requests in flight on shutdown.
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+
+	// The live auth server (*server.AuthServer) and server certificate (*tls.Certificate),
+	// which are swapped on SIGHUP without touching the listener. Requests and TLS handshakes
+	// read them without locking, so that a reload never waits for them or holds them up.
+	authServer atomic.Value
+	cert       atomic.Value
+
+	// Used to stop and wake up the OCSP stapling goroutine, if running.
+	ocspStop chan struct{}
+	ocspKick chan struct{}
+
+	// Whether the read-only mode is on and the revoked tokens, kept across reloads.
+	readOnly    server.ReadOnlyState
+	revocations server.RevocationStore
+
+	// Flushes and stops the trace exporter, if tracing is enabled.
+	// Tracing is set up once at startup and is not affected by reloads.
+	shutdownTracing func(context.Context) error
 }
 
 func stringToUint16(s string) uint16 {
@@ -58,18 +85,23 @@ func stringToUint16(s string) uint16 {
 	return uint16(v)
 }
 
-func ServeOnce(c *server.Config, cf string) (*server.AuthServer, *http.Server) {
-	glog.Infof("Config from %s (%d users, %d ACL static entries)", cf, len(c.Users), len(c.ACL))
-	as, err := server.NewAuthServer(c)
+func (rs *RestartableServer) ServeOnce(c *server.Config) {
+	glog.Infof("Config from %s (%d users, %d ACL static entries)", rs.configFile, len(c.Users), len(c.ACL))
+	as, err := server.NewAuthServer(c, &rs.readOnly, rs.revocations)
 	if err != nil {
 		glog.Exitf("Failed to create auth server: %s", err)
 	}
 
+	if rs.ocspStop != nil {
+		close(rs.ocspStop)
+		rs.ocspStop, rs.ocspKick = nil, nil
+	}
+
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
 	}
-	if c.Server.HSTS {
-		glog.Info("HTTP Strict Transport Security enabled")
+	if c.Server.HSTS != nil {
+		glog.Infof("HTTP Strict Transport Security enabled: %s", c.Server.HSTS.Header())
 	}
 	if c.Server.TLSMinVersion != "" {
 		value, found := server.TLSVersionValues[c.Server.TLSMinVersion]
@@ -103,17 +135,29 @@ func ServeOnce(c *server.Config, cf string) (*server.AuthServer, *http.Server) {
 		tlsConfig.CipherSuites = values
 		glog.Infof("TLS CipherSuites: %s", c.Server.TLSCipherSuites)
 	}
-	if c.Server.CertFile != "" || c.Server.KeyFile != "" {
-		// Check for partial configuration.
-		if c.Server.CertFile == "" || c.Server.KeyFile == "" {
-			glog.Exitf("Failed to load certificate and key: both were not provided")
+	if cert := c.Server.TLSCertificate(); cert != nil {
+		// Already loaded and checked by LoadConfig.
+		if c.Server.CertFile != "" {
+			glog.Infof("Cert file: %s", c.Server.CertFile)
 		}
-		glog.Infof("Cert file: %s", c.Server.CertFile)
-		glog.Infof("Key file : %s", c.Server.KeyFile)
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(c.Server.CertFile, c.Server.KeyFile)
-		if err != nil {
-			glog.Exitf("Failed to load certificate and key: %s", err)
+		if c.Server.KeyFile != "" {
+			glog.Infof("Key file : %s", c.Server.KeyFile)
+		}
+		rs.cert.Store(cert)
+		// Serve the certificate through a callback so that it can be rotated on reload.
+		tlsConfig.GetCertificate = rs.getCertificate
+		if c.Server.OCSPStapling {
+			rs.ocspStop, rs.ocspKick = make(chan struct{}), make(chan struct{}, 1)
+			go rs.stapleOCSP(rs.ocspStop, rs.ocspKick)
+		}
+		if c.Server.ClientCAFile != "" {
+			tlsConfig.ClientCAs = c.Server.ClientCAs()
+			if c.Server.RequireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			glog.Infof("Client CA file: %s (required: %t)", c.Server.ClientCAFile, c.Server.RequireClientCert)
 		}
 	} else if c.Server.LetsEncrypt.Email != "" {
 		m := &autocert.Manager{
@@ -131,52 +175,96 @@ func ServeOnce(c *server.Config, cf string) (*server.AuthServer, *http.Server) {
 		tlsConfig = nil
 	}
 
-	hs := &http.Server{
-		Addr:      c.Server.ListenAddress,
-		Handler:   as,
-		TLSConfig: tlsConfig,
+	rs.authServer.Store(as)
+	rs.shutdownDelay = c.Server.ShutdownDelay
+	rs.shutdownTimeout = c.Server.ShutdownTimeout
+	rs.servers = nil
+	for _, l := range c.Server.Listeners {
+		lc := tlsConfig
+		if !l.UseTLS() {
+			lc = nil
+		}
+		hs := &http.Server{
+			Addr:              l.ListenAddress,
+			Handler:           rs,
+			TLSConfig:         lc,
+			ReadTimeout:       c.Server.ReadTimeout,
+			ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+			WriteTimeout:      c.Server.WriteTimeout,
+			IdleTimeout:       c.Server.IdleTimeout,
+		}
+		listener := listen(l)
+		go func() {
+			var err error
+			if hs.TLSConfig == nil {
+				err = hs.Serve(listener)
+			} else {
+				err = hs.ServeTLS(listener, "", "")
+			}
+			if err != nil && err != http.ErrServerClosed {
+				glog.Errorf("Serving on %s: %s", hs.Addr, err)
+			}
+		}()
+		glog.Infof("Serving on %s (%s, TLS: %t)", l.ListenAddress, l.Net, l.UseTLS())
+		rs.servers = append(rs.servers, hs)
 	}
+}
 
-	var listener net.Listener
-	if c.Server.Net == "unix" {
-		// Remove socket, if exists
-		if _, err := os.Stat(c.Server.ListenAddress); err == nil {
-			if err := os.Remove(c.Server.ListenAddress); err != nil {
-				glog.Fatal(err.Error())
-			}
-		}
-		listener, err = net.Listen("unix", c.Server.ListenAddress)
+// listen creates the listener described by l, exiting if that fails.
+func listen(l server.ListenerConfig) net.Listener {
+	if l.Net != "unix" {
+		listener, err := net.Listen("tcp", l.ListenAddress)
 		if err != nil {
 			glog.Fatal(err.Error())
 		}
-	} else {
-		listener, err = net.Listen("tcp", c.Server.ListenAddress)
-		if err != nil {
+		return listener
+	}
+	// Remove socket, if exists
+	if _, err := os.Stat(l.ListenAddress); err == nil {
+		if err := os.Remove(l.ListenAddress); err != nil {
 			glog.Fatal(err.Error())
 		}
 	}
-
-	go func() {
-		if c.Server.CertFile == "" && c.Server.KeyFile == "" {
-			if err := hs.Serve(listener); err != nil {
-				if err == http.ErrServerClosed {
-					return
-				}
-			}
-		} else {
-			if err := hs.ServeTLS(listener, c.Server.CertFile, c.Server.KeyFile); err != nil {
-				if err == http.ErrServerClosed {
-					return
-				}
-			}
+	listener, err := net.Listen("unix", l.ListenAddress)
+	if err != nil {
+		glog.Fatal(err.Error())
+	}
+	if l.SocketMode != 0 {
+		if err := os.Chmod(l.ListenAddress, l.SocketMode); err != nil {
+			glog.Fatal(err.Error())
 		}
-	}()
-	glog.Infof("Serving on %s", c.Server.ListenAddress)
-	return as, hs
+	}
+	if l.SocketUID != nil || l.SocketGID != nil {
+		// -1 leaves the owner or group unchanged.
+		uid, gid := -1, -1
+		if l.SocketUID != nil {
+			uid = *l.SocketUID
+		}
+		if l.SocketGID != nil {
+			gid = *l.SocketGID
+		}
+		if err := os.Chown(l.ListenAddress, uid, gid); err != nil {
+			glog.Fatal(err.Error())
+		}
+	}
+	return listener
+}
+
+// liveAuthServer returns the auth server that new requests are served by.
+func (rs *RestartableServer) liveAuthServer() *server.AuthServer {
+	return rs.authServer.Load().(*server.AuthServer)
+}
+
+func (rs *RestartableServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rs.liveAuthServer().ServeHTTP(rw, req)
+}
+
+func (rs *RestartableServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return rs.cert.Load().(*tls.Certificate), nil
 }
 
 func (rs *RestartableServer) Serve(c *server.Config) {
-	rs.authServer, rs.hs = ServeOnce(c, rs.configFile)
+	rs.ServeOnce(c)
 	rs.WatchConfig()
 }
 
@@ -190,13 +278,16 @@ func (rs *RestartableServer) WatchConfig() {
 	stopSignals := make(chan os.Signal, 1)
 	signal.Notify(stopSignals, syscall.SIGTERM, syscall.SIGINT)
 
-	err = w.Add(rs.configFile)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+
+	err = rs.watchConfigFiles(w)
 	watching, needRestart := (err == nil), false
 	for {
 		select {
 		case <-time.After(1 * time.Second):
 			if !watching {
-				err = w.Add(rs.configFile)
+				err = rs.watchConfigFiles(w)
 				if err != nil {
 					glog.Errorf("Failed to set up config watcher: %s", err)
 				} else {
@@ -208,24 +299,114 @@ func (rs *RestartableServer) WatchConfig() {
 			}
 		case ev := <-w.Events:
 			if ev.Op == fsnotify.Remove {
-				glog.Warningf("Config file disappeared, serving continues")
-				w.Remove(rs.configFile)
+				glog.Warningf("Config file %s disappeared, serving continues", ev.Name)
+				for _, f := range server.ConfigFiles(rs.configFile) {
+					w.Remove(f)
+				}
 				watching, needRestart = false, false
 			} else if ev.Op == fsnotify.Write {
 				needRestart = true
 			}
+		case <-reloadSignals:
+			rs.Reload()
 		case s := <-stopSignals:
 			signal.Stop(stopSignals)
 			glog.Infof("Signal: %s", s)
-			if err := rs.hs.Shutdown(context.Background()); err != nil {
-				glog.Errorf("HTTP server Shutdown: %v", err)
-			}
-			rs.authServer.Stop()
+			rs.Shutdown()
 			glog.Exitf("Exiting")
 		}
 	}
 }
 
+// watchConfigFiles adds all of the config files to the watcher.
+func (rs *RestartableServer) watchConfigFiles(w *fsnotify.Watcher) error {
+	for _, f := range server.ConfigFiles(rs.configFile) {
+		if err := w.Add(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stapleOCSP keeps an OCSP response stapled to the server certificate until stop is closed.
+// Failures are logged and the certificate is served without a staple in the meantime.
+func (rs *RestartableServer) stapleOCSP(stop, kick chan struct{}) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var expires time.Time
+	for {
+		cert := rs.cert.Load().(*tls.Certificate)
+		next := 5 * time.Minute
+		staple, resp, err := server.FetchOCSPStaple(cert, client)
+		if err != nil {
+			glog.Warningf("Failed to fetch OCSP response: %s", err)
+			if len(cert.OCSPStaple) > 0 && time.Now().After(expires) {
+				staple = nil
+			} else {
+				staple = cert.OCSPStaple
+			}
+		} else {
+			expires = resp.NextUpdate
+			next = time.Hour
+			if !expires.IsZero() {
+				// Refresh halfway to expiry, so that there is time to retry.
+				next = time.Until(expires) / 2
+			}
+			if next < time.Minute {
+				next = time.Minute
+			}
+			glog.V(2).Infof("OCSP response stapled, next update at %s", expires)
+		}
+		// Unless the certificate was replaced by a reload in the meantime.
+		stapled := *cert
+		stapled.OCSPStaple = staple
+		rs.cert.CompareAndSwap(cert, &stapled)
+		select {
+		case <-stop:
+			return
+		case <-kick:
+		case <-time.After(next):
+		}
+	}
+}
+
+// Shutdown fails readiness checks for server.shutdown_delay, then stops accepting new
+// connections on all listeners and waits up to server.shutdown_timeout for requests
+// in flight to complete, then stops the auth server, closing token DBs
+// and other resources held by authenticators and authorizers.
+func (rs *RestartableServer) Shutdown() {
+	rs.liveAuthServer().Drain()
+	if rs.shutdownDelay > 0 {
+		glog.Infof("Draining for %s", rs.shutdownDelay)
+		time.Sleep(rs.shutdownDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rs.shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, hs := range rs.servers {
+		wg.Add(1)
+		go func(hs *http.Server) {
+			defer wg.Done()
+			if err := hs.Shutdown(ctx); err != nil {
+				glog.Errorf("HTTP server Shutdown (%s): %v", hs.Addr, err)
+				hs.Close()
+			}
+		}(hs)
+	}
+	wg.Wait()
+	if rs.ocspStop != nil {
+		close(rs.ocspStop)
+		rs.ocspStop, rs.ocspKick = nil, nil
+	}
+	rs.liveAuthServer().Stop()
+	if rs.shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), rs.shutdownTimeout)
+		defer cancel()
+		if err := rs.shutdownTracing(ctx); err != nil {
+			glog.Errorf("Failed to flush traces: %s", err)
+		}
+	}
+}
+
 func (rs *RestartableServer) MaybeRestart() {
 	glog.Infof("Validating new config")
 	c, err := server.LoadConfig(rs.configFile, rs.envPrefix)
@@ -234,17 +415,71 @@ func (rs *RestartableServer) MaybeRestart() {
 		return
 	}
 	glog.Infof("Config ok, restarting server")
-	rs.hs.Close()
-	rs.authServer.Stop()
-	rs.authServer, rs.hs = ServeOnce(c, rs.configFile)
+	for _, hs := range rs.servers {
+		hs.Close()
+	}
+	rs.liveAuthServer().Stop()
+	rs.ServeOnce(c)
+}
+
+// Reload re-reads the config and atomically swaps in a new auth server built from it.
+// The listener is left alone, so in-flight and subsequent connections are not dropped.
+// If the new config cannot be loaded, the current one stays in effect.
+// Listener settings (address, network, TLS options) still require a restart to change.
+func (rs *RestartableServer) Reload() {
+	glog.Infof("SIGHUP received, reloading config from %s", rs.configFile)
+	c, err := server.LoadConfig(rs.configFile, rs.envPrefix)
+	if err != nil {
+		glog.Errorf("Failed to reload config (old config remains in effect): %s", err)
+		return
+	}
+	cert := c.Server.TLSCertificate()
+	as, err := server.NewAuthServer(c, &rs.readOnly, rs.revocations)
+	if err != nil {
+		glog.Errorf("Failed to create auth server (old config remains in effect): %s", err)
+		return
+	}
+	old := rs.liveAuthServer()
+	rs.authServer.Store(as)
+	rs.shutdownDelay = c.Server.ShutdownDelay
+	rs.shutdownTimeout = c.Server.ShutdownTimeout
+	if cert != nil && rs.cert.Load() != nil {
+		rs.cert.Store(cert)
+	}
+	if rs.ocspKick != nil {
+		select {
+		case rs.ocspKick <- struct{}{}:
+		default:
+		}
+	}
+	// Requests in flight on the old server are given as long to finish as on shutdown
+	// before its token DBs and other resources are closed.
+	time.AfterFunc(c.Server.ShutdownTimeout, old.Stop)
+	glog.Infof("Config reloaded (%d users, %d ACL static entries)", len(c.Users), len(c.ACL))
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			os.Exit(hashPassword(os.Args[2:]))
+		case "check-acl":
+			os.Exit(checkACL(os.Args[2:]))
+		}
+	}
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
 	glog.CopyStandardLogTo("INFO")
 
 	glog.Infof("docker_auth %s build %s", Version, BuildID)
+	server.Version, server.BuildID = Version, BuildID
+
+	if *configSchema {
+		if err := server.WriteConfigSchema(os.Stdout); err != nil {
+			glog.Exitf("Failed to write config schema: %s", err)
+		}
+		os.Exit(0)
+	}
 
 	cf := flag.Arg(0)
 	if cf == "" {
@@ -256,12 +491,32 @@ func main() {
 		envPrefix = "REGAUTH"
 	}
 
+	if *checkConfig {
+		errs := server.CheckConfig(cf, envPrefix)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cf, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config ok\n", cf)
+		os.Exit(0)
+	}
+
 	config, err := server.LoadConfig(cf, envPrefix)
 	if err != nil {
 		glog.Exitf("Failed to load config: %s", err)
 	}
 	rs := RestartableServer{
-		configFile: cf,
+		configFile:  cf,
+		envPrefix:   envPrefix,
+		revocations: server.NewMemoryRevocationStore(),
+	}
+	if config.Server.Tracing != nil {
+		rs.shutdownTracing, err = server.InitTracing(config.Server.Tracing)
+		if err != nil {
+			glog.Exitf("Failed to set up tracing: %s", err)
+		}
 	}
 	rs.Serve(config)
 }
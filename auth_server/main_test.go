@@ -0,0 +1,136 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/server"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "auth.sock")
+	// A socket left behind by a previous run is replaced.
+	if err := ioutil.WriteFile(addr, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	gid := os.Getgid()
+	l := listen(server.ListenerConfig{ListenAddress: addr, Net: "unix", SocketMode: 0640, SocketGID: &gid})
+	defer l.Close()
+	fi, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected a socket with mode 0640, got %s", fi.Mode())
+	}
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("expected the socket to accept connections, got %s", err)
+	}
+	c.Close()
+}
+
+// serveSlowly starts serving on rs a handler that blocks until release is closed.
+func serveSlowly(t *testing.T, rs *RestartableServer, release chan struct{}) (url string, started chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started = make(chan struct{}, 1)
+	hs := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		rw.Write([]byte("done"))
+	})}
+	go hs.Serve(l)
+	rs.servers = append(rs.servers, hs)
+	rs.authServer.Store(&server.AuthServer{})
+	return "http://" + l.Addr().String(), started
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	rs := &RestartableServer{shutdownTimeout: 10 * time.Second}
+	release := make(chan struct{})
+	url, started := serveSlowly(t, rs, release)
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "done" {
+				err = fmt.Errorf("unexpected body %q", body)
+			}
+		}
+		result <- err
+	}()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		rs.Shutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("expected shutdown to wait for the request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("expected the request in flight to complete, got %s", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected shutdown to complete after the request")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	rs := &RestartableServer{shutdownTimeout: 100 * time.Millisecond}
+	release := make(chan struct{})
+	defer close(release)
+	url, started := serveSlowly(t, rs, release)
+	go http.Get(url)
+	<-started
+	start := time.Now()
+	rs.Shutdown()
+	if d := time.Since(start); d < 100*time.Millisecond || d > 5*time.Second {
+		t.Errorf("expected shutdown to give up after shutdown_timeout, took %s", d)
+	}
+}
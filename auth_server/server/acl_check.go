@@ -0,0 +1,109 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+// ACLCheckRequest describes a token request to evaluate against the static ACL.
+type ACLCheckRequest struct {
+	Account string
+	Service string
+	IP      net.IP
+	Labels  api.Labels
+	// Requested scopes, e.g. "repository:foo/bar:pull,push".
+	Scopes []string
+}
+
+// ACLCheckResult is the decision for one requested scope.
+type ACLCheckResult struct {
+	Scope     string
+	Requested []string
+	Granted   []string
+	// The rule that made the decision and its comment, empty if no rule matched.
+	Rule     string
+	RuleName string
+	// Describes the denied actions, empty if all were granted.
+	DenyReason string
+}
+
+// CheckACL evaluates a request against the static ACL of the config the same way the server
+// authorizes token requests, without starting the server or any of the authenticators.
+// Other authorizers, such as acl_mongo or ext_authz, are not consulted. Read-only mode is
+// applied if enabled in the config.
+func CheckACL(c *Config, req *ACLCheckRequest) ([]ACLCheckResult, error) {
+	if c.ACL == nil {
+		return nil, fmt.Errorf("no static ACL configured")
+	}
+	aa, err := authz.NewACLAuthorizer(c.ACL, c.ACLAllowDuplicatePriorities)
+	if err != nil {
+		return nil, err
+	}
+	as := &AuthServer{
+		config:      c,
+		authorizers: []api.Authorizer{aa},
+		log:         newEventLogger(c.Server.LogFormat),
+		readOnly:    &ReadOnlyState{},
+	}
+	as.readOnly.configure(c.ReadOnly)
+	ar := &authRequest{
+		User:     req.Account,
+		Account:  req.Account,
+		Service:  req.Service,
+		RemoteIP: req.IP,
+		Labels:   req.Labels,
+		ctx:      context.Background(),
+	}
+	if ar.RemoteIP != nil {
+		ar.RemoteAddr = ar.RemoteIP.String()
+	}
+	for _, s := range req.Scopes {
+		for _, scopeStr := range strings.Fields(s) {
+			scope, err := parseScopeSpec(scopeStr)
+			if err != nil {
+				return nil, err
+			}
+			ar.Scopes = append(ar.Scopes, scope)
+		}
+	}
+	if len(ar.Scopes) == 0 {
+		return nil, fmt.Errorf("no scopes to check")
+	}
+	ares, err := as.Authorize(ar)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ACLCheckResult, len(ares))
+	for i, r := range ares {
+		results[i] = ACLCheckResult{
+			Scope:      r.scope.spec(),
+			Requested:  r.scope.Actions,
+			Granted:    r.autorizedActions,
+			Rule:       r.rule,
+			RuleName:   r.ruleName,
+			DenyReason: r.denyReason(),
+		}
+	}
+	return results, nil
+}
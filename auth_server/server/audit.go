@@ -0,0 +1,199 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"os"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// AuditConfig configures the audit log, which records one entry per token request.
+// Exactly one of File and Syslog must be set.
+type AuditConfig struct {
+	// Entries are appended to this file as JSON lines.
+	File   string             `mapstructure:"file,omitempty"`
+	Syslog *AuditSyslogConfig `mapstructure:"syslog,omitempty"`
+	// Number of entries that can be waiting to be written.
+	// When the buffer is full, entries are dropped and counted in docker_auth_audit_dropped_total.
+	BufferSize int `mapstructure:"buffer_size,omitempty"`
+}
+
+// AuditSyslogConfig sends audit entries to syslog, with the AUTH facility.
+type AuditSyslogConfig struct {
+	// Network and address of the syslog server, e.g. "udp" and "syslog:514".
+	// If empty, the local syslog daemon is used.
+	Network string `mapstructure:"network,omitempty"`
+	Address string `mapstructure:"address,omitempty"`
+	Tag     string `mapstructure:"tag,omitempty"`
+}
+
+func (ac *AuditConfig) validate() []error {
+	var errs []error
+	if (ac.File == "") == (ac.Syslog == nil) {
+		errs = append(errs, errors.New("server.audit: exactly one of file and syslog must be set"))
+	}
+	if ac.Syslog != nil && ac.Syslog.Tag == "" {
+		ac.Syslog.Tag = "docker_auth"
+	}
+	if ac.BufferSize < 0 {
+		errs = append(errs, errors.New("server.audit.buffer_size must not be negative"))
+	} else if ac.BufferSize == 0 {
+		ac.BufferSize = 1000
+	}
+	return errs
+}
+
+var auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "docker_auth_audit_dropped_total",
+	Help: "Audit log entries dropped because the audit buffer was full.",
+})
+
+func init() {
+	prometheus.MustRegister(auditDropped)
+}
+
+// auditEntry is a record of a token request and its outcome.
+// It deliberately has no room for credentials.
+type auditEntry struct {
+	Time          time.Time    `json:"time"`
+	RequestID     string       `json:"request_id,omitempty"`
+	Subject       string       `json:"subject"`
+	RemoteIP      string       `json:"remote_ip"`
+	Service       string       `json:"service"`
+	Authenticator string       `json:"authenticator,omitempty"`
+	Decision      string       `json:"decision"`
+	Scopes        []auditScope `json:"scopes"`
+}
+
+type auditScope struct {
+	Requested string   `json:"requested"`
+	Granted   []string `json:"granted"`
+	// The ACL rule that made the decision, if the authorizer reports it.
+	Rule string `json:"rule,omitempty"`
+}
+
+func newAuditEntry(ar *authRequest, ares []authzResult, decision string) *auditEntry {
+	e := &auditEntry{
+		Time:          time.Now().UTC(),
+		RequestID:     api.RequestID(ar.context()),
+		Subject:       ar.Account,
+		RemoteIP:      ar.RemoteIP.String(),
+		Service:       ar.Service,
+		Authenticator: ar.authenticator,
+		Decision:      decision,
+		Scopes:        []auditScope{},
+	}
+	// Authorization results, if any, are in the order of the requested scopes.
+	for i, s := range ar.Scopes {
+		as := auditScope{Requested: s.spec(), Granted: []string{}}
+		if i < len(ares) {
+			if ares[i].autorizedActions != nil {
+				as.Granted = ares[i].autorizedActions
+			}
+			as.Rule = ares[i].rule
+		}
+		e.Scopes = append(e.Scopes, as)
+	}
+	return e
+}
+
+// auditLog writes audit entries in the background, so that slow storage does not hold up responses.
+type auditLog struct {
+	write   func([]byte) error
+	close   func() error
+	entries chan *auditEntry
+	done    chan struct{}
+}
+
+func newAuditLog(ac *AuditConfig) (*auditLog, error) {
+	al := &auditLog{
+		entries: make(chan *auditEntry, ac.BufferSize),
+		done:    make(chan struct{}),
+	}
+	if ac.File != "" {
+		f, err := os.OpenFile(ac.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %s", err)
+		}
+		al.write = func(b []byte) error {
+			_, err := f.Write(append(b, '\n'))
+			return err
+		}
+		al.close = f.Close
+	} else {
+		sc := ac.Syslog
+		w, err := syslog.Dial(sc.Network, sc.Address, syslog.LOG_INFO|syslog.LOG_AUTH, sc.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog for audit log: %s", err)
+		}
+		al.write = func(b []byte) error {
+			_, err := w.Write(b)
+			return err
+		}
+		al.close = w.Close
+	}
+	go al.run()
+	return al, nil
+}
+
+// Record queues an entry for writing. It never blocks; if the buffer is full, the entry is dropped.
+func (al *auditLog) Record(e *auditEntry) {
+	if al == nil {
+		return
+	}
+	select {
+	case al.entries <- e:
+	default:
+		auditDropped.Inc()
+		glog.Errorf("Audit buffer full, dropped entry for %s", e.Subject)
+	}
+}
+
+func (al *auditLog) run() {
+	defer close(al.done)
+	for e := range al.entries {
+		b, err := json.Marshal(e)
+		if err == nil {
+			err = al.write(b)
+		}
+		if err != nil {
+			glog.Errorf("Failed to write audit entry for %s: %s", e.Subject, err)
+		}
+	}
+}
+
+// Close writes out the entries still buffered and closes the sink.
+// There must be no Record calls in flight or after it.
+func (al *auditLog) Close() {
+	if al == nil {
+		return
+	}
+	close(al.entries)
+	<-al.done
+	if err := al.close(); err != nil {
+		glog.Errorf("Failed to close audit log: %s", err)
+	}
+}
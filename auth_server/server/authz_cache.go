@@ -0,0 +1,145 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/go-redis/redis"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+const (
+	defaultAuthzCacheTTL       = 10 * time.Second
+	maxAuthzCacheTTL           = 5 * time.Minute
+	defaultAuthzCacheKeyPrefix = "docker_auth:authz:"
+)
+
+// AuthzCacheConfig enables a cache of authorization decisions in Redis, which can be shared by
+// several replicas of the server. Repeated requests for the same scope by the same user, with the
+// same labels and from the same address, are then answered without evaluating the authorizers.
+type AuthzCacheConfig struct {
+	ClientOptions  *redis.Options        `mapstructure:"redis_options,omitempty"`
+	ClusterOptions *redis.ClusterOptions `mapstructure:"redis_cluster_options,omitempty"`
+	// Connection pool settings, applied to either of the above.
+	Pool *authn.RedisPoolConfig `mapstructure:"pool,omitempty"`
+	// How long decisions are cached, and so how long changes of policies stored outside of the config
+	// take to have effect. Default is 10s, at most 5m.
+	TTL time.Duration `mapstructure:"ttl,omitempty"`
+	// Prefix of the keys, default is "docker_auth:authz:".
+	KeyPrefix string `mapstructure:"key_prefix,omitempty"`
+}
+
+func (c *AuthzCacheConfig) Validate(configKey string) error {
+	if c.ClientOptions == nil && c.ClusterOptions == nil {
+		return fmt.Errorf("%s.{redis_options,redis_cluster_options} is required", configKey)
+	}
+	if c.TTL < 0 || c.TTL > maxAuthzCacheTTL {
+		return fmt.Errorf("%s.ttl must be between 0 and %s", configKey, maxAuthzCacheTTL)
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultAuthzCacheTTL
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = defaultAuthzCacheKeyPrefix
+	}
+	return nil
+}
+
+type authzCache struct {
+	client authn.RedisClient
+	ttl    time.Duration
+	// Key prefix, including the version of the ACL in the config.
+	prefix string
+}
+
+type authzCacheEntry struct {
+	Actions  []string `json:"actions"`
+	Rule     string   `json:"rule,omitempty"`
+	RuleName string   `json:"rule_name,omitempty"`
+}
+
+func newAuthzCache(c *AuthzCacheConfig, acl authz.ACL) (*authzCache, error) {
+	client, err := authn.NewRedisClient(c.ClientOptions, c.ClusterOptions, c.Pool)
+	if err != nil {
+		return nil, fmt.Errorf("authz cache: %s", err)
+	}
+	return &authzCache{client: client, ttl: c.TTL, prefix: c.KeyPrefix + aclVersion(acl) + ":"}, nil
+}
+
+// aclVersion identifies the ACL of the config, so that a changed ACL takes effect as soon as the config
+// is reloaded instead of when the cached decisions expire, even if other replicas still use the old one.
+func aclVersion(acl authz.ACL) string {
+	h := sha256.New()
+	for _, e := range acl {
+		fmt.Fprintln(h, e.String())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// key hashes the parts of the request that the authorizers can use.
+func (c *authzCache) key(ai *api.AuthRequestInfo) string {
+	b, _ := json.Marshal(ai)
+	h := sha256.Sum256(b)
+	return c.prefix + hex.EncodeToString(h[:])
+}
+
+// get returns the cached decision for the request, if there is one, and sets the matched rule of ai.
+func (c *authzCache) get(ctx context.Context, ai *api.AuthRequestInfo) ([]string, bool) {
+	data, err := c.client.Get(c.key(ai)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			authzCacheResults.WithLabelValues("miss").Inc()
+		} else {
+			authzCacheResults.WithLabelValues("error").Inc()
+			glog.Errorf("%sFailed to read the authz cache: %s", api.LogPrefix(ctx), err)
+		}
+		return nil, false
+	}
+	var e authzCacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		authzCacheResults.WithLabelValues("error").Inc()
+		glog.Errorf("%sInvalid authz cache entry: %s", api.LogPrefix(ctx), err)
+		return nil, false
+	}
+	authzCacheResults.WithLabelValues("hit").Inc()
+	ai.MatchedRule, ai.MatchedRuleName = e.Rule, e.RuleName
+	glog.V(2).Infof("%sAuthz %s -> %s (cached)", api.LogPrefix(ctx), *ai, e.Actions)
+	return e.Actions, true
+}
+
+func (c *authzCache) set(ctx context.Context, ai *api.AuthRequestInfo, actions []string) {
+	data, _ := json.Marshal(authzCacheEntry{Actions: actions, Rule: ai.MatchedRule, RuleName: ai.MatchedRuleName})
+	if err := c.client.Set(c.key(ai), data, c.ttl).Err(); err != nil {
+		glog.Errorf("%sFailed to update the authz cache: %s", api.LogPrefix(ctx), err)
+	}
+}
+
+func (c *authzCache) Close() {
+	if c != nil {
+		c.client.Close()
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cesanta/glog"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// AuthzLogSamplingConfig logs a sample of authorization decisions at info level, counted per
+// repository (or other resource) and decision, and the rest at debug level (-v=2).
+type AuthzLogSamplingConfig struct {
+	// Log 1 in this many denies of each resource. Default is 1, all of them.
+	Deny int `mapstructure:"deny,omitempty"`
+	// Log 1 in this many allows of each resource. Default is 1, all of them.
+	Allow int `mapstructure:"allow,omitempty"`
+}
+
+func (c *AuthzLogSamplingConfig) Validate(configKey string) error {
+	if c.Deny < 0 || c.Allow < 0 {
+		return fmt.Errorf("%s.{deny,allow} must not be negative", configKey)
+	}
+	return nil
+}
+
+// Counters are reset when there are more than this many resources, to bound memory use.
+const maxSampledResources = 10000
+
+// authzLogSampler picks the decisions to log at info level.
+type authzLogSampler struct {
+	config *AuthzLogSamplingConfig
+	mu     sync.Mutex
+	// Decisions so far by decision and resource.
+	counts map[string]uint64
+}
+
+func newAuthzLogSampler(c *AuthzLogSamplingConfig) *authzLogSampler {
+	return &authzLogSampler{config: c, counts: map[string]uint64{}}
+}
+
+// sample tells if a decision ("allow" or "deny") about a resource is to be logged at info level.
+// The first one is, then every n-th.
+func (s *authzLogSampler) sample(decision, resource string) bool {
+	n := s.config.Allow
+	if decision == "deny" {
+		n = s.config.Deny
+	}
+	if n <= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.counts) >= maxSampledResources {
+		s.counts = map[string]uint64{}
+	}
+	key := decision + " " + resource
+	count := s.counts[key]
+	s.counts[key] = count + 1
+	return count%uint64(n) == 0
+}
+
+// logAuthzDecision logs the decision about a scope of the request, if sampling is enabled.
+func (as *AuthServer) logAuthzDecision(ar *authRequest, r *authzResult) {
+	if as.authzLogSampler == nil {
+		return
+	}
+	resource := r.scope.Type + ":" + r.scope.Name
+	decision, reason := "allow", r.denyReason()
+	if reason != "" {
+		decision = "deny"
+	}
+	if !as.authzLogSampler.sample(decision, resource) {
+		glog.V(2).Infof("%sAuthz %s for %s: granted [%s] %s", api.LogPrefix(ar.context()), resource, ar.Account, strings.Join(r.autorizedActions, ","), reason)
+		return
+	}
+	f := logFields{"scope": resource, "decision": decision, "granted": r.autorizedActions}
+	if r.rule != "" {
+		f["rule"] = r.rule
+	}
+	if reason == "" {
+		as.log.Info(ar.logFields(f), "Authz %s for %s: granted [%s]", resource, ar.Account, strings.Join(r.autorizedActions, ","))
+	} else {
+		as.log.Info(ar.logFields(f), "Authz %s for %s: %s", resource, ar.Account, reason)
+	}
+}
@@ -17,61 +17,303 @@
 package server
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cesanta/docker_auth/auth_server/api"
 	"github.com/cesanta/docker_auth/auth_server/authn"
 	"github.com/cesanta/docker_auth/auth_server/authz"
 	"github.com/docker/libtrust"
+	"github.com/hashicorp/hcl"
+	toml "github.com/pelletier/go-toml"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Server      ServerConfig                   `mapstructure:"server"`
-	Token       TokenConfig                    `mapstructure:"token"`
-	Users       map[string]*authn.Requirements `mapstructure:"users,omitempty"`
-	GoogleAuth  *authn.GoogleAuthConfig        `mapstructure:"google_auth,omitempty"`
-	GitHubAuth  *authn.GitHubAuthConfig        `mapstructure:"github_auth,omitempty"`
-	OIDCAuth    *authn.OIDCAuthConfig          `mapstructure:"oidc_auth,omitempty"`
-	GitlabAuth  *authn.GitlabAuthConfig        `mapstructure:"gitlab_auth,omitempty"`
-	LDAPAuth    *authn.LDAPAuthConfig          `mapstructure:"ldap_auth,omitempty"`
-	MongoAuth   *authn.MongoAuthConfig         `mapstructure:"mongo_auth,omitempty"`
-	XormAuthn   *authn.XormAuthnConfig         `mapstructure:"xorm_auth,omitempty"`
-	ExtAuth     *authn.ExtAuthConfig           `mapstructure:"ext_auth,omitempty"`
-	PluginAuthn *authn.PluginAuthnConfig       `mapstructure:"plugin_authn,omitempty"`
-	ACL         authz.ACL                      `mapstructure:"acl,omitempty"`
-	ACLMongo    *authz.ACLMongoConfig          `mapstructure:"acl_mongo,omitempty"`
-	ACLXorm     *authz.XormAuthzConfig         `mapstructure:"acl_xorm,omitempty"`
-	ExtAuthz    *authz.ExtAuthzConfig          `mapstructure:"ext_authz,omitempty"`
-	PluginAuthz *authz.PluginAuthzConfig       `mapstructure:"plugin_authz,omitempty"`
-	CasbinAuthz *authz.CasbinAuthzConfig       `mapstructure:"casbin_authz,omitempty"`
+	Server         ServerConfig                   `mapstructure:"server"`
+	Token          TokenConfig                    `mapstructure:"token"`
+	Users          map[string]*authn.Requirements `mapstructure:"users,omitempty"`
+	UsersFile      string                         `mapstructure:"users_file,omitempty"`
+	UsersFiles     []string                       `mapstructure:"users_files,omitempty"`
+	HtpasswdAuth   *authn.HtpasswdAuthConfig      `mapstructure:"htpasswd_auth,omitempty"`
+	GoogleAuth     *authn.GoogleAuthConfig        `mapstructure:"google_auth,omitempty"`
+	GitHubAuth     *authn.GitHubAuthConfig        `mapstructure:"github_auth,omitempty"`
+	OIDCAuth       *authn.OIDCAuthConfig          `mapstructure:"oidc_auth,omitempty"`
+	SAMLAuth       *authn.SAMLAuthConfig          `mapstructure:"saml_auth,omitempty"`
+	GitlabAuth     *authn.GitlabAuthConfig        `mapstructure:"gitlab_auth,omitempty"`
+	LDAPAuth       *authn.LDAPAuthConfig          `mapstructure:"ldap_auth,omitempty"`
+	PAMAuth        *authn.PAMAuthConfig           `mapstructure:"pam_auth,omitempty"`
+	MongoAuth      *authn.MongoAuthConfig         `mapstructure:"mongo_auth,omitempty"`
+	XormAuthn      *authn.XormAuthnConfig         `mapstructure:"xorm_auth,omitempty"`
+	ExtAuth        *authn.ExtAuthConfig           `mapstructure:"ext_auth,omitempty"`
+	PluginAuthn    *authn.PluginAuthnConfig       `mapstructure:"plugin_authn,omitempty"`
+	ClientCertAuth *authn.ClientCertAuthConfig    `mapstructure:"client_cert_auth,omitempty"`
+	ACL            authz.ACL                      `mapstructure:"acl,omitempty"`
+	ACLMongo       *authz.ACLMongoConfig          `mapstructure:"acl_mongo,omitempty"`
+	ACLXorm        *authz.XormAuthzConfig         `mapstructure:"acl_xorm,omitempty"`
+	ACLHTTP        *authz.ACLHTTPConfig           `mapstructure:"acl_http,omitempty"`
+	ExtAuthz       *authz.ExtAuthzConfig          `mapstructure:"ext_authz,omitempty"`
+	PluginAuthz    *authz.PluginAuthzConfig       `mapstructure:"plugin_authz,omitempty"`
+	CasbinAuthz    *authz.CasbinAuthzConfig       `mapstructure:"casbin_authz,omitempty"`
+	OPAAuthz       *authz.OPAAuthzConfig          `mapstructure:"opa_authz,omitempty"`
+	Vault          *VaultConfig                   `mapstructure:"vault,omitempty"`
+	Introspection  *IntrospectionConfig           `mapstructure:"introspection,omitempty"`
+	Revocation     *RevocationConfig              `mapstructure:"revocation,omitempty"`
+	ReadOnly       *ReadOnlyConfig                `mapstructure:"read_only,omitempty"`
+	Version        *VersionConfig                 `mapstructure:"version,omitempty"`
+	AuthzCache     *AuthzCacheConfig              `mapstructure:"authz_cache,omitempty"`
+	Anonymous      *AnonymousConfig               `mapstructure:"anonymous,omitempty"`
+	MFA            *authn.MFAConfig               `mapstructure:"mfa,omitempty"`
+	// Log a sample of authorization decisions at info level.
+	AuthzLogSampling *AuthzLogSamplingConfig `mapstructure:"authz_log_sampling,omitempty"`
+
+	// What to do about users in more than one of users, users_file and users_files: last_wins (default) or error.
+	UsersConflicts string `mapstructure:"users_conflicts,omitempty"`
+	// Match static user names and GitHub logins regardless of case, and lowercase authenticated accounts.
+	CaseInsensitiveUsernames bool `mapstructure:"case_insensitive_usernames,omitempty"`
+	// If set, bcrypt hashes of a lower cost in users_file are upgraded to it when users log in.
+	BcryptCost int `mapstructure:"bcrypt_cost,omitempty"`
+	// Check passwords of unknown static users against a dummy hash, so that timing does not tell them apart.
+	UnknownUserDummyHash bool `mapstructure:"unknown_user_dummy_hash,omitempty"`
+	// Allow ACL entries with the same priority, which are then tried in the order they are listed.
+	ACLAllowDuplicatePriorities bool `mapstructure:"acl_allow_duplicate_priorities,omitempty"`
+	// The order in which authenticators are tried. If set, it must list all configured authenticators.
+	AuthnOrder []AuthnOrderEntry `mapstructure:"authn_order,omitempty"`
+}
+
+// What to do when an authenticator does not know the user.
+const (
+	// Try the next authenticator.
+	OnNoMatchContinue = "continue"
+	// Deny the request without trying the others.
+	OnNoMatchStop = "stop"
+)
+
+// AuthnOrderEntry is an authenticator in authn_order.
+type AuthnOrderEntry struct {
+	// Config key of the authenticator, e.g. "ldap_auth", or "users" for the static users
+	// of users, users_file and users_files.
+	Name string `mapstructure:"name"`
+	// continue (default) or stop.
+	OnNoMatch string `mapstructure:"on_no_match,omitempty"`
+}
+
+// authenticators returns the config keys of the configured authenticators in the default order.
+func (c *Config) authenticators() []string {
+	var names []string
+	for _, a := range []struct {
+		name       string
+		configured bool
+	}{
+		{"client_cert_auth", c.ClientCertAuth != nil},
+		{"users", c.Users != nil || len(c.usersFiles()) > 0},
+		{"htpasswd_auth", c.HtpasswdAuth != nil},
+		{"ext_auth", c.ExtAuth != nil},
+		{"google_auth", c.GoogleAuth != nil},
+		{"github_auth", c.GitHubAuth != nil},
+		{"oidc_auth", c.OIDCAuth != nil},
+		{"saml_auth", c.SAMLAuth != nil},
+		{"gitlab_auth", c.GitlabAuth != nil},
+		{"ldap_auth", c.LDAPAuth != nil},
+		{"pam_auth", c.PAMAuth != nil},
+		{"mongo_auth", c.MongoAuth != nil},
+		{"xorm_auth", c.XormAuthn != nil},
+		{"plugin_authn", c.PluginAuthn != nil},
+	} {
+		if a.configured {
+			names = append(names, a.name)
+		}
+	}
+	return names
+}
+
+// authnOrder returns authn_order, or the configured authenticators in the default order if not set.
+func (c *Config) authnOrder() []AuthnOrderEntry {
+	if c.AuthnOrder != nil {
+		return c.AuthnOrder
+	}
+	var order []AuthnOrderEntry
+	for _, name := range c.authenticators() {
+		order = append(order, AuthnOrderEntry{Name: name, OnNoMatch: OnNoMatchContinue})
+	}
+	return order
+}
+
+func validateAuthnOrder(c *Config) []error {
+	var errs []error
+	configured := map[string]bool{}
+	for _, name := range c.authenticators() {
+		configured[name] = true
+	}
+	listed := map[string]bool{}
+	for i := range c.AuthnOrder {
+		e := &c.AuthnOrder[i]
+		switch {
+		case !configured[e.Name]:
+			errs = append(errs, fmt.Errorf("authn_order: %q is not a configured authenticator", e.Name))
+		case listed[e.Name]:
+			errs = append(errs, fmt.Errorf("authn_order: %q is listed more than once", e.Name))
+		}
+		listed[e.Name] = true
+		switch e.OnNoMatch {
+		case "":
+			e.OnNoMatch = OnNoMatchContinue
+		case OnNoMatchContinue, OnNoMatchStop:
+		default:
+			errs = append(errs, fmt.Errorf("authn_order: on_no_match of %q must be %s or %s, got %q", e.Name, OnNoMatchContinue, OnNoMatchStop, e.OnNoMatch))
+		}
+	}
+	for _, name := range c.authenticators() {
+		if !listed[name] {
+			errs = append(errs, fmt.Errorf("authn_order: %s is configured but not listed", name))
+		}
+	}
+	return errs
+}
+
+// usersFiles returns users_file, if set, followed by users_files.
+func (c *Config) usersFiles() []string {
+	if c.UsersFile == "" {
+		return c.UsersFiles
+	}
+	return append([]string{c.UsersFile}, c.UsersFiles...)
+}
+
+// AnonymousConfig allows requests without credentials. They skip the authenticators and are
+// authorized as the account "", whatever the ACL grants them is limited to Actions.
+type AnonymousConfig struct {
+	// Actions that can be granted to anonymous requests, default is ["pull"].
+	Actions []string `mapstructure:"actions,omitempty"`
 }
 
 type ServerConfig struct {
 	ListenAddress       string            `mapstructure:"addr,omitempty"`
 	Net                 string            `mapstructure:"net,omitempty"`
+	SocketMode          os.FileMode       `mapstructure:"socket_mode,omitempty"`
+	SocketUID           *int              `mapstructure:"socket_uid,omitempty"`
+	SocketGID           *int              `mapstructure:"socket_gid,omitempty"`
 	PathPrefix          string            `mapstructure:"path_prefix,omitempty"`
 	RealIPHeader        string            `mapstructure:"real_ip_header,omitempty"`
 	RealIPPos           int               `mapstructure:"real_ip_pos,omitempty"`
 	CertFile            string            `mapstructure:"certificate,omitempty"`
 	KeyFile             string            `mapstructure:"key,omitempty"`
-	HSTS                bool              `mapstructure:"hsts,omitempty"`
+	CertPEM             string            `mapstructure:"cert_pem,omitempty"`
+	KeyPEM              string            `mapstructure:"key_pem,omitempty"`
+	HSTS                *HSTSConfig       `mapstructure:"hsts,omitempty"`
+	CORS                *CORSConfig       `mapstructure:"cors,omitempty"`
+	RateLimit           *RateLimitConfig  `mapstructure:"rate_limit,omitempty"`
 	TLSMinVersion       string            `mapstructure:"tls_min_version,omitempty"`
 	TLSCurvePreferences []string          `mapstructure:"tls_curve_preferences,omitempty"`
 	TLSCipherSuites     []string          `mapstructure:"tls_cipher_suites,omitempty"`
 	LetsEncrypt         LetsEncryptConfig `mapstructure:"letsencrypt,omitempty"`
+	ClientCAFile        string            `mapstructure:"client_ca_file,omitempty"`
+	RequireClientCert   bool              `mapstructure:"require_client_cert,omitempty"`
+	OCSPStapling        bool              `mapstructure:"ocsp_stapling,omitempty"`
+	ReadTimeout         time.Duration     `mapstructure:"read_timeout,omitempty"`
+	ReadHeaderTimeout   time.Duration     `mapstructure:"read_header_timeout,omitempty"`
+	WriteTimeout        time.Duration     `mapstructure:"write_timeout,omitempty"`
+	IdleTimeout         time.Duration     `mapstructure:"idle_timeout,omitempty"`
+	ShutdownTimeout     time.Duration     `mapstructure:"shutdown_timeout,omitempty"`
+	ShutdownDelay       time.Duration     `mapstructure:"shutdown_delay,omitempty"`
+	Metrics             bool              `mapstructure:"metrics,omitempty"`
+	LogFormat           string            `mapstructure:"log_format,omitempty"`
+	Audit               *AuditConfig      `mapstructure:"audit,omitempty"`
+	Webhook             *WebhookConfig    `mapstructure:"webhook,omitempty"`
+	Tracing             *TracingConfig    `mapstructure:"tracing,omitempty"`
+	Listeners           []ListenerConfig  `mapstructure:"listeners,omitempty"`
+	DenyReasons         bool              `mapstructure:"deny_reasons,omitempty"`
 
+	tlsCert    *tls.Certificate
 	publicKey  libtrust.PublicKey
 	privateKey libtrust.PrivateKey
+	clientCAs  *x509.CertPool
+}
+
+// TLSCertificate returns the server certificate, if configured.
+func (sc *ServerConfig) TLSCertificate() *tls.Certificate {
+	return sc.tlsCert
+}
+
+// ClientCAs returns the pool of CAs that client certificates are verified against, if configured.
+func (sc *ServerConfig) ClientCAs() *x509.CertPool {
+	return sc.clientCAs
+}
+
+// ListenerConfig describes one of the addresses the server listens on.
+// If server.listeners is not set, a single listener is made from server.addr and friends.
+type ListenerConfig struct {
+	ListenAddress string      `mapstructure:"addr,omitempty"`
+	Net           string      `mapstructure:"net,omitempty"`
+	TLS           *bool       `mapstructure:"tls,omitempty"`
+	SocketMode    os.FileMode `mapstructure:"socket_mode,omitempty"`
+	SocketUID     *int        `mapstructure:"socket_uid,omitempty"`
+	SocketGID     *int        `mapstructure:"socket_gid,omitempty"`
+}
+
+// UseTLS reports whether the listener serves TLS. It defaults to true if the server
+// has a certificate or uses LetsEncrypt.
+func (lc *ListenerConfig) UseTLS() bool {
+	return lc.TLS != nil && *lc.TLS
+}
+
+func (lc *ListenerConfig) validate(prefix string, tlsAvailable bool) []error {
+	var errs []error
+	if lc.ListenAddress == "" {
+		errs = append(errs, fmt.Errorf("%s.addr is required", prefix))
+	}
+	if lc.Net != "unix" && lc.Net != "tcp" {
+		if lc.Net == "" {
+			lc.Net = "tcp"
+		} else {
+			errs = append(errs, fmt.Errorf("%s.net must be unix or tcp", prefix))
+		}
+	}
+	if lc.Net != "unix" && (lc.SocketMode != 0 || lc.SocketUID != nil || lc.SocketGID != nil) {
+		errs = append(errs, fmt.Errorf("%s.socket_{mode,uid,gid} are only valid with %s.net: unix", prefix, prefix))
+	}
+	if lc.SocketMode&^os.ModePerm != 0 {
+		errs = append(errs, fmt.Errorf("%s.socket_mode %#o is not a valid permission mode", prefix, uint32(lc.SocketMode)))
+	}
+	if lc.TLS == nil {
+		lc.TLS = &tlsAvailable
+	} else if *lc.TLS && !tlsAvailable {
+		errs = append(errs, fmt.Errorf("%s.tls requires a server certificate and key or letsencrypt", prefix))
+	}
+	return errs
+}
+
+type HSTSConfig struct {
+	MaxAge            int  `mapstructure:"max_age,omitempty"`
+	IncludeSubDomains bool `mapstructure:"include_subdomains,omitempty"`
+	Preload           bool `mapstructure:"preload,omitempty"`
+}
+
+// Header returns the value of the Strict-Transport-Security header.
+func (hc *HSTSConfig) Header() string {
+	h := fmt.Sprintf("max-age=%d", hc.MaxAge)
+	if hc.IncludeSubDomains {
+		h += "; includeSubDomains"
+	}
+	if hc.Preload {
+		h += "; preload"
+	}
+	return h
 }
 
 type LetsEncryptConfig struct {
@@ -81,13 +323,110 @@ type LetsEncryptConfig struct {
 }
 
 type TokenConfig struct {
-	Issuer     string `mapstructure:"issuer,omitempty"`
-	CertFile   string `mapstructure:"certificate,omitempty"`
-	KeyFile    string `mapstructure:"key,omitempty"`
-	Expiration int64  `mapstructure:"expiration,omitempty"`
+	Issuer     string           `mapstructure:"issuer,omitempty"`
+	CertFile   string           `mapstructure:"certificate,omitempty"`
+	KeyFile    string           `mapstructure:"key,omitempty"`
+	CertPEM    string           `mapstructure:"cert_pem,omitempty"`
+	KeyPEM     string           `mapstructure:"key_pem,omitempty"`
+	Keys       []TokenKeyConfig `mapstructure:"keys,omitempty"`
+	Expiration int64            `mapstructure:"expiration,omitempty"`
+	// Per-action expiration overrides, in seconds.
+	ActionExpiration map[string]int64 `mapstructure:"action_expiration,omitempty"`
+	// One of SigningAlgorithms. If not set, it is derived from the key.
+	SigningAlgorithm string `mapstructure:"signing_algorithm,omitempty"`
+	// If set, tokens are only issued for these services.
+	AllowedAudiences []string `mapstructure:"allowed_audiences,omitempty"`
+	// Labels to add to the token as custom claims, label name -> claim name.
+	LabelClaims map[string]string `mapstructure:"label_claims,omitempty"`
+	// How far in the past to set nbf, to allow for registry clocks that are behind. Default is 10s.
+	NotBeforeSkew time.Duration `mapstructure:"not_before_skew,omitempty"`
+	// Sign with a key held by a KMS or HSM instead of key or key_pem.
+	KMS *TokenKMSConfig `mapstructure:"kms,omitempty"`
 
+	// The key that new tokens are signed with.
 	publicKey  libtrust.PublicKey
 	privateKey libtrust.PrivateKey
+	// Hash to sign with, 0 for the key's default.
+	signingHash crypto.Hash
+	// All of the configured keys, including the signing key.
+	// Tokens signed with any of them are still valid until they expire.
+	publicKeys []libtrust.PublicKey
+	// Signs new tokens, with privateKey or the KMS.
+	signer TokenSigner
+}
+
+// Clocks that are off by more than this need fixing rather than tokens that are valid before they are issued.
+const maxNotBeforeSkew = 5 * time.Minute
+
+// notBefore returns the nbf claim for a token issued at now (in seconds since the epoch).
+func (tc *TokenConfig) notBefore(now int64) int64 {
+	skew := tc.NotBeforeSkew
+	if skew == 0 {
+		skew = 10 * time.Second
+	}
+	return now - int64(math.Ceil(skew.Seconds()))
+}
+
+// audienceAllowed reports whether tokens may be issued for the service.
+func (tc *TokenConfig) audienceAllowed(service string) bool {
+	return len(tc.AllowedAudiences) == 0 || containsString(tc.AllowedAudiences, service)
+}
+
+// maxExpiration returns the longest lifetime a token can have.
+func (tc *TokenConfig) maxExpiration() int64 {
+	exp := tc.Expiration
+	for _, ae := range tc.ActionExpiration {
+		if ae > exp {
+			exp = ae
+		}
+	}
+	return exp
+}
+
+// expirationFor returns the lifetime of a token granting the given actions:
+// the shortest of their overrides, with Expiration used for actions without one.
+func (tc *TokenConfig) expirationFor(actions []string) int64 {
+	if len(actions) == 0 {
+		return tc.Expiration
+	}
+	var exp int64
+	for _, a := range actions {
+		ae, found := tc.ActionExpiration[a]
+		if !found {
+			ae = tc.Expiration
+		}
+		if exp == 0 || ae < exp {
+			exp = ae
+		}
+	}
+	return exp
+}
+
+// Claims set by the server itself, which label_claims must not override.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true, "access": true,
+}
+
+// SigningAlgorithms maps JWS algorithm names to the hash used with them.
+// RSA keys support all of the RS* algorithms, while EC keys only support
+// the ES* algorithm matching their curve.
+var SigningAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// TokenKeyConfig is one of the token signing keys. The last one listed is used for signing,
+// so keys can be rotated by appending a new pair and removing the old one once
+// tokens signed with it have expired.
+type TokenKeyConfig struct {
+	CertFile string `mapstructure:"certificate,omitempty"`
+	KeyFile  string `mapstructure:"key,omitempty"`
+	CertPEM  string `mapstructure:"cert_pem,omitempty"`
+	KeyPEM   string `mapstructure:"key_pem,omitempty"`
 }
 
 // TLSCipherSuitesValues maps CipherSuite names as strings to the actual values
@@ -149,75 +488,361 @@ var TLSCurveIDValues = map[string]tls.CurveID{
 	"X25519": tls.X25519,
 }
 
-func validate(c *Config) error {
-	if c.Server.ListenAddress == "" {
-		return errors.New("server.addr is required")
+// ConfigErrors lists every problem found in a config rather than just the first one.
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, len(ce))
+	for i, err := range ce {
+		msgs[i] = err.Error()
 	}
-	if c.Server.Net != "unix" && c.Server.Net != "tcp" {
-		if c.Server.Net == "" {
-			c.Server.Net = "tcp"
-		} else {
-			return errors.New("server.net must be unix or tcp")
+	return strings.Join(msgs, "; ")
+}
+
+func (ce ConfigErrors) orNil() error {
+	if len(ce) == 0 {
+		return nil
+	}
+	return ce
+}
+
+// tlsValue looks up a TLS parameter given by name or numeric value in known,
+// which maps names to values (see TLSCipherSuitesValues and friends).
+func tlsValue(s string, known interface{}) (uint16, bool) {
+	m := reflect.ValueOf(known)
+	if v := m.MapIndex(reflect.ValueOf(s)); v.IsValid() {
+		return uint16(v.Uint()), true
+	}
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, false
+	}
+	for _, k := range m.MapKeys() {
+		if m.MapIndex(k).Uint() == n {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+func unknownTLSNames(names []string, known interface{}) []string {
+	var unknown []string
+	for _, s := range names {
+		if _, ok := tlsValue(s, known); !ok {
+			unknown = append(unknown, s)
+		}
+	}
+	return unknown
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validate(c *Config) error {
+	var errs ConfigErrors
+	serverCert := c.Server.CertFile != "" || c.Server.CertPEM != ""
+	tlsAvailable := serverCert || c.Server.LetsEncrypt.Email != ""
+	if len(c.Server.Listeners) == 0 {
+		// Single listener configured with server.addr, server.net etc.
+		lc := ListenerConfig{
+			ListenAddress: c.Server.ListenAddress,
+			Net:           c.Server.Net,
+			SocketMode:    c.Server.SocketMode,
+			SocketUID:     c.Server.SocketUID,
+			SocketGID:     c.Server.SocketGID,
+		}
+		errs = append(errs, lc.validate("server", tlsAvailable)...)
+		c.Server.Net = lc.Net
+		c.Server.Listeners = []ListenerConfig{lc}
+	} else {
+		if c.Server.ListenAddress != "" || c.Server.Net != "" ||
+			c.Server.SocketMode != 0 || c.Server.SocketUID != nil || c.Server.SocketGID != nil {
+			errs = append(errs, errors.New("server.listeners cannot be combined with server.addr, server.net or server.socket_*"))
+		}
+		for i := range c.Server.Listeners {
+			errs = append(errs, c.Server.Listeners[i].validate(fmt.Sprintf("server.listeners[%d]", i), tlsAvailable)...)
 		}
 	}
 	if c.Server.PathPrefix != "" && !strings.HasPrefix(c.Server.PathPrefix, "/") {
-		return errors.New("server.path_prefix must be an absolute path")
+		errs = append(errs, errors.New("server.path_prefix must be an absolute path"))
+	}
+	if v := c.Server.TLSMinVersion; v != "" {
+		if value, ok := tlsValue(v, TLSVersionValues); !ok {
+			errs = append(errs, fmt.Errorf("server.tls_min_version: unknown version %s", v))
+		} else if value == tls.VersionTLS13 && c.Server.TLSCipherSuites != nil {
+			errs = append(errs, errors.New("TLS 1.3 ciphersuites are not configurable"))
+		}
 	}
-	if (c.Server.TLSMinVersion == "0x0304" || c.Server.TLSMinVersion == "TLS13") && c.Server.TLSCipherSuites != nil {
-		return errors.New("TLS 1.3 ciphersuites are not configurable")
+	if unknown := unknownTLSNames(c.Server.TLSCipherSuites, TLSCipherSuitesValues); len(unknown) > 0 {
+		errs = append(errs, fmt.Errorf("server.tls_cipher_suites: unknown cipher suites %s", strings.Join(unknown, ", ")))
+	}
+	if unknown := unknownTLSNames(c.Server.TLSCurvePreferences, TLSCurveIDValues); len(unknown) > 0 {
+		errs = append(errs, fmt.Errorf("server.tls_curve_preferences: unknown curves %s", strings.Join(unknown, ", ")))
 	}
 	if c.Token.Issuer == "" {
-		return errors.New("token.issuer is required")
+		errs = append(errs, errors.New("token.issuer is required"))
 	}
 	if c.Token.Expiration <= 0 {
-		return fmt.Errorf("expiration must be positive, got %d", c.Token.Expiration)
+		errs = append(errs, fmt.Errorf("expiration must be positive, got %d", c.Token.Expiration))
+	}
+	if c.Token.NotBeforeSkew < 0 || c.Token.NotBeforeSkew > maxNotBeforeSkew {
+		errs = append(errs, fmt.Errorf("token.not_before_skew must be between 0 and %s, got %s", maxNotBeforeSkew, c.Token.NotBeforeSkew))
+	} else if c.Token.NotBeforeSkew == 0 {
+		c.Token.NotBeforeSkew = 10 * time.Second
+	}
+	for action, exp := range c.Token.ActionExpiration {
+		if exp <= 0 {
+			errs = append(errs, fmt.Errorf("token.action_expiration.%s must be positive, got %d", action, exp))
+		}
+	}
+	for label, claim := range c.Token.LabelClaims {
+		if claim == "" {
+			errs = append(errs, fmt.Errorf("token.label_claims.%s: claim name is required", label))
+		} else if reservedClaims[claim] {
+			errs = append(errs, fmt.Errorf("token.label_claims.%s: %s is a reserved claim", label, claim))
+		}
+	}
+	if alg := c.Token.SigningAlgorithm; alg != "" {
+		if _, found := SigningAlgorithms[alg]; !found {
+			errs = append(errs, fmt.Errorf("token.signing_algorithm %q is not supported", alg))
+		}
+	}
+	if err := authn.ValidateUsers(c.Users); err != nil {
+		errs = append(errs, fmt.Errorf("users: %s", err))
+	}
+	if c.BcryptCost != 0 && (c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost) {
+		errs = append(errs, fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if c.UsersFile != "" {
+		if _, err := authn.ReadUsersFile(c.UsersFile); err != nil {
+			errs = append(errs, fmt.Errorf("users_file: %s", err))
+		}
+	}
+	for _, file := range c.UsersFiles {
+		if _, err := authn.ReadUsersFile(file); err != nil {
+			errs = append(errs, fmt.Errorf("users_files: %s", err))
+		}
 	}
-	if c.Users == nil && c.ExtAuth == nil && c.GoogleAuth == nil && c.GitHubAuth == nil && c.GitlabAuth == nil && c.OIDCAuth == nil && c.LDAPAuth == nil && c.MongoAuth == nil && c.XormAuthn == nil && c.PluginAuthn == nil {
-		return errors.New("no auth methods are configured, this is probably a mistake. Use an empty user map if you really want to deny everyone.")
+	switch c.UsersConflicts {
+	case "":
+		c.UsersConflicts = authn.UsersConflictLastWins
+	case authn.UsersConflictLastWins, authn.UsersConflictError:
+	default:
+		errs = append(errs, fmt.Errorf("users_conflicts must be %s or %s, got %q", authn.UsersConflictLastWins, authn.UsersConflictError, c.UsersConflicts))
+	}
+	if c.HtpasswdAuth != nil {
+		if err := c.HtpasswdAuth.Validate("htpasswd_auth"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Anonymous != nil && c.Anonymous.Actions == nil {
+		c.Anonymous.Actions = []string{"pull"}
+	}
+	if c.Users == nil && len(c.usersFiles()) == 0 && c.Anonymous == nil && c.HtpasswdAuth == nil && c.ClientCertAuth == nil && c.ExtAuth == nil && c.GoogleAuth == nil && c.GitHubAuth == nil && c.GitlabAuth == nil && c.OIDCAuth == nil && c.SAMLAuth == nil && c.LDAPAuth == nil && c.PAMAuth == nil && c.MongoAuth == nil && c.XormAuthn == nil && c.PluginAuthn == nil {
+		errs = append(errs, errors.New("no auth methods are configured, this is probably a mistake. Use an empty user map if you really want to deny everyone."))
+	}
+	if c.AuthnOrder != nil {
+		errs = append(errs, validateAuthnOrder(c)...)
 	}
 	if c.MongoAuth != nil {
 		if err := c.MongoAuth.Validate("mongo_auth"); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 	if c.XormAuthn != nil {
 		if err := c.XormAuthn.Validate("xorm_auth"); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	if gac := c.GoogleAuth; gac != nil {
-		if gac.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(gac.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", gac.ClientSecretFile, err)
+	for _, t := range []struct {
+		name     string
+		value    *time.Duration
+		defValue time.Duration
+	}{
+		{"read_timeout", &c.Server.ReadTimeout, 30 * time.Second},
+		{"read_header_timeout", &c.Server.ReadHeaderTimeout, 10 * time.Second},
+		{"write_timeout", &c.Server.WriteTimeout, 30 * time.Second},
+		{"idle_timeout", &c.Server.IdleTimeout, 120 * time.Second},
+		{"shutdown_timeout", &c.Server.ShutdownTimeout, 30 * time.Second},
+	} {
+		if *t.value < 0 {
+			errs = append(errs, fmt.Errorf("server.%s must not be negative", t.name))
+		} else if *t.value == 0 {
+			*t.value = t.defValue
+		}
+	}
+	if c.Server.Tracing != nil {
+		errs = append(errs, c.Server.Tracing.validate()...)
+	}
+	if c.Server.Audit != nil {
+		errs = append(errs, c.Server.Audit.validate()...)
+	}
+	if c.Server.Webhook != nil {
+		errs = append(errs, c.Server.Webhook.validate()...)
+	}
+	if c.Server.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("server.shutdown_delay must not be negative"))
+	}
+	switch c.Server.LogFormat {
+	case "":
+		c.Server.LogFormat = "text"
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("server.log_format must be text or json, got %q", c.Server.LogFormat))
+	}
+	if hc := c.Server.HSTS; hc != nil {
+		if hc.MaxAge < 0 {
+			errs = append(errs, errors.New("server.hsts.max_age must not be negative"))
+		} else if hc.MaxAge == 0 {
+			hc.MaxAge = 63072000 // Two years.
+		}
+	}
+	if cc := c.Server.CORS; cc != nil {
+		if len(cc.AllowedOrigins) == 0 {
+			errs = append(errs, errors.New("server.cors.allowed_origins is required"))
+		}
+		if len(cc.AllowedMethods) == 0 {
+			cc.AllowedMethods = []string{"GET", "POST", "OPTIONS"}
+		}
+		if len(cc.AllowedHeaders) == 0 {
+			cc.AllowedHeaders = []string{"Authorization", "Content-Type"}
+		}
+		if cc.MaxAge < 0 {
+			errs = append(errs, errors.New("server.cors.max_age must not be negative"))
+		}
+	}
+	if rc := c.Server.RateLimit; rc != nil {
+		if err := rc.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Server.ClientCAFile != "" && !serverCert {
+		errs = append(errs, errors.New("server.client_ca_file requires a server certificate and key"))
+	}
+	if c.Server.OCSPStapling && !serverCert {
+		errs = append(errs, errors.New("server.ocsp_stapling requires a server certificate and key"))
+	}
+	if c.Server.RequireClientCert && c.Server.ClientCAFile == "" {
+		errs = append(errs, errors.New("server.require_client_cert requires server.client_ca_file"))
+	}
+	if c.ClientCertAuth != nil {
+		if c.Server.ClientCAFile == "" {
+			errs = append(errs, errors.New("client_cert_auth requires server.client_ca_file"))
+		}
+		if err := c.ClientCertAuth.Validate("client_cert_auth"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if ic := c.Introspection; ic != nil && len(ic.AllowedClients) == 0 {
+		errs = append(errs, errors.New("introspection.allowed_clients is required"))
+	}
+	if rc := c.Revocation; rc != nil && len(rc.AllowedClients) == 0 {
+		errs = append(errs, errors.New("revocation.allowed_clients is required"))
+	}
+	if vc := c.Version; vc != nil && len(vc.AllowedClients) == 0 {
+		errs = append(errs, errors.New("version.allowed_clients is required"))
+	}
+	if kc := c.Token.KMS; kc != nil {
+		if err := kc.Validate("token.kms"); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Token.KeyFile != "" || c.Token.KeyPEM != "" {
+			errs = append(errs, errors.New("token.kms and token.{key,key_pem} are mutually exclusive"))
+		}
+		if c.Token.CertFile == "" && c.Token.CertPEM == "" {
+			errs = append(errs, errors.New("token.kms requires token.certificate or token.cert_pem"))
+		}
+	}
+	if c.AuthzLogSampling != nil {
+		if err := c.AuthzLogSampling.Validate("authz_log_sampling"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.MFA != nil {
+		if err := c.MFA.Validate("mfa"); err != nil {
+			errs = append(errs, err)
+		}
+		for account := range c.MFA.TOTPSecrets {
+			if reqs := c.Users[account]; reqs != nil && reqs.TOTPSecret != "" {
+				errs = append(errs, fmt.Errorf("mfa.totp_secrets: %s already has a totp_secret in users", account))
 			}
-			gac.ClientSecret = strings.TrimSpace(string(contents))
 		}
+	}
+	if gac := c.GoogleAuth; gac != nil {
 		if gac.ClientId == "" || gac.ClientSecret == "" || gac.TokenDB == "" {
-			return errors.New("google_auth.{client_id,client_secret,token_db} are required.")
+			errs = append(errs, errors.New("google_auth.{client_id,client_secret,token_db} are required."))
 		}
 		if gac.HTTPTimeout <= 0 {
 			gac.HTTPTimeout = 10
 		}
 	}
 	if ghac := c.GitHubAuth; ghac != nil {
-		if ghac.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(ghac.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", ghac.ClientSecretFile, err)
+		// token_db is only used when none of these is set.
+		var tokenDBs []string
+		for _, db := range []struct {
+			name       string
+			configured bool
+		}{
+			{"gcs_token_db", ghac.GCSTokenDB != nil},
+			{"redis_token_db", ghac.RedisTokenDB != nil},
+			{"postgres_token_db", ghac.PostgresTokenDB != nil},
+			{"dynamodb_token_db", ghac.DynamoDBTokenDB != nil},
+			{"memcached_token_db", ghac.MemcachedTokenDB != nil},
+		} {
+			if db.configured {
+				tokenDBs = append(tokenDBs, db.name)
 			}
-			ghac.ClientSecret = strings.TrimSpace(string(contents))
 		}
-		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.TokenDB == "" && (ghac.GCSTokenDB == nil && ghac.RedisTokenDB == nil)) {
-			return errors.New("github_auth.{client_id,client_secret,token_db} are required")
+		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.TokenDB == "" && len(tokenDBs) == 0) {
+			errs = append(errs, errors.New("github_auth.{client_id,client_secret,token_db} are required"))
+		} else if len(tokenDBs) > 1 {
+			errs = append(errs, fmt.Errorf("github_auth: only one token DB can be configured, got %s", strings.Join(tokenDBs, ", ")))
+		} else if ghac.GCSTokenDB != nil && (ghac.GCSTokenDB.Bucket == "" || ghac.GCSTokenDB.ClientSecretFile == "") {
+			errs = append(errs, errors.New("github_auth.{client_id,client_secret,gcs_token_db{bucket,client_secret_file}} are required"))
+		} else if ghac.RedisTokenDB != nil && ghac.RedisTokenDB.ClientOptions == nil && ghac.RedisTokenDB.ClusterOptions == nil {
+			errs = append(errs, errors.New("github_auth.{client_id,client_secret,redis_token_db.{redis_options,redis_cluster_options}} are required"))
+		} else if ghac.PostgresTokenDB != nil {
+			if err := ghac.PostgresTokenDB.Validate("github_auth.postgres_token_db"); err != nil {
+				errs = append(errs, err)
+			}
+		} else if ghac.MemcachedTokenDB != nil {
+			if err := ghac.MemcachedTokenDB.Validate("github_auth.memcached_token_db"); err != nil {
+				errs = append(errs, err)
+			}
+		} else if ghac.DynamoDBTokenDB != nil {
+			if err := ghac.DynamoDBTokenDB.Validate("github_auth.dynamodb_token_db"); err != nil {
+				errs = append(errs, err)
+			}
 		}
-
-		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.GCSTokenDB != nil && (ghac.GCSTokenDB.Bucket == "" || ghac.GCSTokenDB.ClientSecretFile == "")) {
-			return errors.New("github_auth.{client_id,client_secret,gcs_token_db{bucket,client_secret_file}} are required")
+		for _, key := range append([]string{ghac.TokenEncryptionKey}, ghac.TokenEncryptionOldKeys...) {
+			if key == "" {
+				continue
+			}
+			if _, err := authn.ParseTokenEncryptionKey(key); err != nil {
+				errs = append(errs, fmt.Errorf("github_auth.token_encryption_key: %s", err))
+			}
 		}
-
-		if ghac.ClientId == "" || ghac.ClientSecret == "" || (ghac.RedisTokenDB != nil && ghac.RedisTokenDB.ClientOptions == nil && ghac.RedisTokenDB.ClusterOptions == nil) {
-			return errors.New("github_auth.{client_id,client_secret,redis_token_db.{redis_options,redis_cluster_options}} are required")
+		if len(ghac.TokenEncryptionOldKeys) > 0 && ghac.TokenEncryptionKey == "" {
+			errs = append(errs, errors.New("github_auth.token_encryption_old_keys requires token_encryption_key"))
+		}
+		if app := ghac.App; app != nil {
+			if app.AppID == 0 || app.InstallationID == 0 || app.PrivateKey == "" {
+				errs = append(errs, errors.New("github_auth.app.{app_id,installation_id,private_key} are required"))
+			}
+			numOrgs := len(ghac.Organizations)
+			if ghac.Organization != "" {
+				numOrgs++
+			}
+			// An installation belongs to a single organization.
+			if numOrgs != 1 {
+				errs = append(errs, errors.New("github_auth.app requires a single organization"))
+			}
 		}
 
 		if ghac.HTTPTimeout <= 0 {
@@ -227,40 +852,63 @@ func validate(c *Config) error {
 			// Token expires after 1 hour by default
 			ghac.RevalidateAfter = time.Duration(1 * time.Hour)
 		}
-	}
-	if oidc := c.OIDCAuth; oidc != nil {
-		if oidc.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(oidc.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", oidc.ClientSecretFile, err)
+		if ghac.HTTPProxy != "" {
+			if u, err := url.Parse(ghac.HTTPProxy); err != nil || u.Scheme == "" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("github_auth.http_proxy must be a URL such as http://proxy:3128, got %q", ghac.HTTPProxy))
 			}
-			oidc.ClientSecret = strings.TrimSpace(string(contents))
 		}
-		if oidc.ClientId == "" || oidc.ClientSecret == "" || oidc.TokenDB == "" || oidc.Issuer == "" || oidc.RedirectURL == "" {
-			return errors.New("oidc_auth.{issuer,redirect_url,client_id,client_secret,token_db} are required")
+		if ghac.TeamPageConcurrency <= 0 {
+			ghac.TeamPageConcurrency = 4
+		}
+		if ghac.PageSize == 0 {
+			ghac.PageSize = 100
+		} else if ghac.PageSize < 1 || ghac.PageSize > 100 {
+			errs = append(errs, fmt.Errorf("github_auth.page_size must be between 1 and 100, got %d", ghac.PageSize))
+		}
+		if ghac.RateLimitMaxAttempts <= 0 {
+			ghac.RateLimitMaxAttempts = 3
+		}
+		if ghac.RateLimitMaxDelay <= 0 {
+			ghac.RateLimitMaxDelay = 5 * time.Second
+		}
+		if ghac.Scopes == nil {
+			ghac.Scopes = []string{"user:email", "read:org"}
+		}
+		if ghac.ResultRedirectURL != "" {
+			if u, err := url.Parse(ghac.ResultRedirectURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("github_auth.result_redirect_url must be an https URL, got %q", ghac.ResultRedirectURL))
+			}
+			if ghac.ResultTemplate != "" {
+				errs = append(errs, errors.New("github_auth.result_template and result_redirect_url are mutually exclusive"))
+			}
+		}
+	}
+	if oidc := c.OIDCAuth; oidc != nil {
+		// The client secret is optional, public clients rely on PKCE.
+		if oidc.ClientId == "" || oidc.TokenDB == "" || oidc.Issuer == "" || oidc.RedirectURL == "" {
+			errs = append(errs, errors.New("oidc_auth.{issuer,redirect_url,client_id,token_db} are required"))
 		}
 		if oidc.HTTPTimeout <= 0 {
 			oidc.HTTPTimeout = 10
 		}
 	}
-	if glab := c.GitlabAuth; glab != nil {
-		if glab.ClientSecretFile != "" {
-			contents, err := ioutil.ReadFile(glab.ClientSecretFile)
-			if err != nil {
-				return fmt.Errorf("could not read %s: %s", glab.ClientSecretFile, err)
-			}
-			glab.ClientSecret = strings.TrimSpace(string(contents))
+	if c.SAMLAuth != nil {
+		if err := c.SAMLAuth.Validate("saml_auth"); err != nil {
+			errs = append(errs, err)
 		}
-		if glab.ClientId == "" || glab.ClientSecret == "" || (glab.TokenDB == "" && (glab.GCSTokenDB == nil && glab.RedisTokenDB == nil)) {
-			return errors.New("gitlab_auth.{client_id,client_secret,token_db} are required")
-		}
-
-		if glab.ClientId == "" || glab.ClientSecret == "" || (glab.GCSTokenDB != nil && (glab.GCSTokenDB.Bucket == "" || glab.GCSTokenDB.ClientSecretFile == "")) {
-			return errors.New("gitlab_auth.{client_id,client_secret,gcs_token_db{bucket,client_secret_file}} are required")
+	}
+	if c.PAMAuth != nil {
+		if err := c.PAMAuth.Validate("pam_auth"); err != nil {
+			errs = append(errs, err)
 		}
-
-		if glab.ClientId == "" || glab.ClientSecret == "" || (glab.RedisTokenDB != nil && glab.RedisTokenDB.ClientOptions == nil && glab.RedisTokenDB.ClusterOptions == nil) {
-			return errors.New("gitlab_auth.{client_id,client_secret,redis_token_db.{redis_options,redis_cluster_options}} are required")
+	}
+	if glab := c.GitlabAuth; glab != nil {
+		if glab.ClientId == "" || glab.ClientSecret == "" || (glab.TokenDB == "" && (glab.GCSTokenDB == nil && glab.RedisTokenDB == nil)) {
+			errs = append(errs, errors.New("gitlab_auth.{client_id,client_secret,token_db} are required"))
+		} else if glab.GCSTokenDB != nil && (glab.GCSTokenDB.Bucket == "" || glab.GCSTokenDB.ClientSecretFile == "") {
+			errs = append(errs, errors.New("gitlab_auth.{client_id,client_secret,gcs_token_db{bucket,client_secret_file}} are required"))
+		} else if glab.RedisTokenDB != nil && glab.RedisTokenDB.ClientOptions == nil && glab.RedisTokenDB.ClusterOptions == nil {
+			errs = append(errs, errors.New("gitlab_auth.{client_id,client_secret,redis_token_db.{redis_options,redis_cluster_options}} are required"))
 		}
 
 		if glab.HTTPTimeout <= 0 {
@@ -273,51 +921,126 @@ func validate(c *Config) error {
 	}
 	if c.ExtAuth != nil {
 		if err := c.ExtAuth.Validate(); err != nil {
-			return fmt.Errorf("bad ext_auth config: %s", err)
+			errs = append(errs, fmt.Errorf("bad ext_auth config: %s", err))
 		}
 	}
-	if c.ACL == nil && c.ACLXorm == nil && c.ACLMongo == nil && c.ExtAuthz == nil && c.PluginAuthz == nil {
-		return errors.New("ACL is empty, this is probably a mistake. Use an empty list if you really want to deny all actions")
+	if c.ACL == nil && c.ACLXorm == nil && c.ACLMongo == nil && c.ACLHTTP == nil && c.ExtAuthz == nil && c.PluginAuthz == nil && c.OPAAuthz == nil {
+		errs = append(errs, errors.New("ACL is empty, this is probably a mistake. Use an empty list if you really want to deny all actions"))
 	}
 
 	if c.ACL != nil {
-		if err := authz.ValidateACL(c.ACL); err != nil {
-			return fmt.Errorf("invalid ACL: %s", err)
+		if err := authz.ValidateACL(c.ACL, c.ACLAllowDuplicatePriorities); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ACL: %s", err))
 		}
 	}
 	if c.ACLMongo != nil {
 		if err := c.ACLMongo.Validate("acl_mongo"); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 	if c.ACLXorm != nil {
 		if err := c.ACLXorm.Validate("acl_xorm"); err != nil {
-			return err
+			errs = append(errs, err)
+		}
+	}
+	if c.ACLHTTP != nil {
+		if err := c.ACLHTTP.Validate("acl_http"); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	if c.ExtAuthz != nil {
 		if err := c.ExtAuthz.Validate(); err != nil {
-			return err
+			errs = append(errs, err)
+		}
+	}
+	if c.CasbinAuthz != nil {
+		if err := c.CasbinAuthz.Validate("casbin_authz"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.OPAAuthz != nil {
+		if err := c.OPAAuthz.Validate("opa_authz"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.AuthzCache != nil {
+		if err := c.AuthzCache.Validate("authz_cache"); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	if c.PluginAuthn != nil {
 		if err := c.PluginAuthn.Validate(); err != nil {
-			return fmt.Errorf("bad plugin_authn config: %s", err)
+			errs = append(errs, fmt.Errorf("bad plugin_authn config: %s", err))
 		}
 	}
 	if c.PluginAuthz != nil {
 		if err := c.PluginAuthz.Validate(); err != nil {
-			return fmt.Errorf("bad plugin_authz config: %s", err)
+			errs = append(errs, fmt.Errorf("bad plugin_authz config: %s", err))
 		}
 	}
-	return nil
+	return errs.orNil()
 }
 
-func loadCertAndKey(certFile string, keyFile string) (pk libtrust.PublicKey, prk libtrust.PrivateKey, err error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// loadCertAndKey loads a certificate and key, each either from a file or inline PEM.
+// Returns nil if neither is configured.
+func loadCertAndKey(certFile, keyFile, certPEM, keyPEM string) (*tls.Certificate, error) {
+	if certFile != "" && certPEM != "" {
+		return nil, errors.New("certificate and cert_pem are mutually exclusive")
+	}
+	if keyFile != "" && keyPEM != "" {
+		return nil, errors.New("key and key_pem are mutually exclusive")
+	}
+	haveCert, haveKey := certFile != "" || certPEM != "", keyFile != "" || keyPEM != ""
+	if !haveCert && !haveKey {
+		return nil, nil
+	}
+	// Check for partial configuration.
+	if !haveCert || !haveKey {
+		return nil, errors.New("both were not provided")
+	}
+	certPEMBlock, keyPEMBlock := []byte(certPEM), []byte(keyPEM)
+	var err error
+	if certFile != "" {
+		if certPEMBlock, err = ioutil.ReadFile(certFile); err != nil {
+			return nil, err
+		}
+	}
+	if keyFile != "" {
+		if keyPEMBlock, err = ioutil.ReadFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &cert, nil
+}
+
+// loadPublicKey loads the public key of a certificate, either from a file or inline PEM.
+func loadPublicKey(certFile, certPEM string) (crypto.PublicKey, error) {
+	if certFile != "" && certPEM != "" {
+		return nil, errors.New("certificate and cert_pem are mutually exclusive")
+	}
+	data := []byte(certPEM)
+	if certFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(certFile); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return cert.PublicKey, nil
+}
+
+func libtrustKeys(cert *tls.Certificate) (pk libtrust.PublicKey, prk libtrust.PrivateKey, err error) {
 	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
 		return
@@ -329,12 +1052,163 @@ func loadCertAndKey(certFile string, keyFile string) (pk libtrust.PublicKey, prk
 	prk, err = libtrust.FromCryptoPrivateKey(cert.PrivateKey)
 	return
 }
+
+// upgradeSettings converts options that changed type to their current form.
+func upgradeSettings(settings map[string]interface{}) {
+	if sc, ok := settings["server"].(map[string]interface{}); ok {
+		// hsts used to be a bool that enabled a fixed header.
+		if enabled, ok := sc["hsts"].(bool); ok {
+			if enabled {
+				sc["hsts"] = map[string]interface{}{"include_subdomains": true}
+			} else {
+				delete(sc, "hsts")
+			}
+		}
+	}
+}
+
+// expandEnv replaces ${VAR} and $VAR references to environment variables in all string values.
+// Strings that refer to unset variables are left as they are, because the same syntax is used for
+// placeholders like ${account} in LDAP filters. $$ is replaced with $.
+// Passwords (which are typically bcrypt hashes full of $) and ACLs (which have their own placeholders)
+// are left alone.
+func expandEnv(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			expandEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				expandEnv(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type() == reflect.TypeOf(authz.ACL{}) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			expandEnv(v.Index(i))
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			// Map values are not addressable, so expand a copy.
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			expandEnv(e)
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		if v.CanSet() && v.Type() != reflect.TypeOf(api.PasswordString("")) {
+			v.SetString(expandEnvString(v.String()))
+		}
+	}
+}
+
+func expandEnvString(s string) string {
+	unset := false
+	expanded := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, found := os.LookupEnv(name)
+		unset = unset || !found
+		return value
+	})
+	if unset {
+		return s
+	}
+	return expanded
+}
+
+// configKey returns the config key that a struct field is decoded from, following mapstructure rules.
+// squash is set for embedded structs whose fields are decoded from the parent's keys.
+func configKey(f reflect.StructField) (name string, squash bool, ok bool) {
+	if f.PkgPath != "" {
+		return "", false, false
+	}
+	tag := strings.Split(f.Tag.Get("mapstructure"), ",")
+	if tag[0] == "-" {
+		return "", false, false
+	} else if tag[0] != "" {
+		return tag[0], false, true
+	}
+	for _, opt := range tag[1:] {
+		if opt == "squash" {
+			return "", true, true
+		}
+	}
+	return strings.ToLower(f.Name), false, true
+}
+
+// resolveSecretFiles allows any string option to be read from a file:
+// if "<option>_file" is set, "<option>" in settings is replaced with the trimmed contents of that file.
+// Only options that map to string fields of t are considered, so paths that are
+// consumed as-is (e.g. gcs_token_db.client_secret_file) are left alone.
+func resolveSecretFiles(t reflect.Type, settings map[string]interface{}) error {
+	return resolveStringOptions("", t, settings, "_file", func(key, fileName string) (string, error) {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %s", key, err)
+		}
+		return string(contents), nil
+	})
+}
+
+// resolveStringOptions walks settings along the fields of t and, for every string option
+// that has a non-empty "<option><suffix>" sibling, replaces it with the trimmed result of resolve.
+// resolve is given the full key of the sibling (for error messages) and its value.
+func resolveStringOptions(prefix string, t reflect.Type, settings map[string]interface{}, suffix string, resolve func(key, ref string) (string, error)) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, squash, ok := configKey(f)
+		if !ok {
+			continue
+		} else if squash {
+			if err := resolveStringOptions(prefix, f.Type, settings, suffix, resolve); err != nil {
+				return err
+			}
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.String:
+			ref, _ := settings[name+suffix].(string)
+			if ref == "" {
+				continue
+			}
+			value, err := resolve(prefix+name+suffix, ref)
+			if err != nil {
+				return err
+			}
+			settings[name] = strings.TrimSpace(value)
+		case reflect.Struct:
+			if sub, ok := settings[name].(map[string]interface{}); ok {
+				if err := resolveStringOptions(prefix+name+".", ft, sub, suffix, resolve); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func processEnvVars(envPrefix, fileName string) error {
 	ext := filepath.Ext(fileName)
 	ext = ext[1:]
 
 	switch ext {
-	case "yaml", "json", "yml":
+	case "yaml", "json", "yml", "toml", "hcl":
 	default:
 		return fmt.Errorf("unsupported config type: %s", ext)
 	}
@@ -358,6 +1232,19 @@ func processEnvVars(envPrefix, fileName string) error {
 			parseErr = yaml.Unmarshal([]byte(keyVal[1]), &val)
 		case "json":
 			parseErr = json.Unmarshal([]byte(keyVal[1]), &val)
+		case "toml", "hcl":
+			// Neither format has bare values, so parse it as an assignment.
+			m := map[string]interface{}{}
+			if ext == "toml" {
+				parseErr = toml.Unmarshal([]byte("v = "+keyVal[1]), &m)
+			} else {
+				parseErr = hcl.Unmarshal([]byte("v = "+keyVal[1]), &m)
+			}
+			val = m["v"]
+			// HCL decodes objects as lists of maps.
+			if l, ok := val.([]map[string]interface{}); ok && len(l) == 1 {
+				val = l[0]
+			}
 		}
 		if parseErr != nil {
 			return fmt.Errorf("could not parse env var %s as %s: %v", ks[0], ext, parseErr)
@@ -368,77 +1255,230 @@ func processEnvVars(envPrefix, fileName string) error {
 
 	return nil
 }
-func LoadConfig(fileName string, envPrefix string) (*Config, error) {
-	configFile, err := os.Open(fileName)
-	if err != nil {
-		return nil, fmt.Errorf("could not open %s: %s", fileName, err)
+
+// ConfigFiles splits a comma-separated list of config file names.
+func ConfigFiles(fileName string) []string {
+	var files []string
+	for _, f := range strings.Split(fileName, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
 	}
-	viper.SetConfigFile(fileName)
+	return files
+}
+
+// readConfig reads one or more comma-separated config files, deep-merging them in order.
+// Later files override earlier ones key by key: maps (such as users) are merged,
+// while scalars and lists (such as acl) are replaced wholesale.
+func readConfig(fileName string, envPrefix string) (*Config, error) {
+	files := ConfigFiles(fileName)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file specified")
+	}
+	viper.SetConfigFile(files[0])
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "__"))
 	viper.SetEnvPrefix(envPrefix)
 
-	if err := viper.ReadConfig(configFile); err != nil {
-		return nil, fmt.Errorf("could not read %s: %s", fileName, err)
-
+	for i, f := range files {
+		if err := readConfigFile(f, i > 0); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := processEnvVars(envPrefix, fileName); err != nil {
+	if err := processEnvVars(envPrefix, files[0]); err != nil {
 		return nil, fmt.Errorf("could not process env variables: %s", err)
 	}
 
+	settings := viper.AllSettings()
+	upgradeSettings(settings)
+	if err := resolveSecretFiles(reflect.TypeOf(Config{}), settings); err != nil {
+		return nil, err
+	}
+	if err := resolveVaultSecrets(reflect.TypeOf(Config{}), settings); err != nil {
+		return nil, err
+	}
+	// Resolved secrets go into a separate instance so they don't stick to the global one across reloads.
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("could not merge secrets: %s", err)
+	}
+
 	c := &Config{}
-	if err = viper.Unmarshal(c); err != nil {
+	if err := v.Unmarshal(c); err != nil {
 		return nil, fmt.Errorf("could not parse config: %s", err)
 	}
-	if err = validate(c); err != nil {
-		return nil, fmt.Errorf("invalid config: %s", err)
+	expandEnv(reflect.ValueOf(c))
+	return c, nil
+}
+
+func readConfigFile(fileName string, merge bool) error {
+	configFile, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", fileName, err)
+	}
+	defer configFile.Close()
+	// Files may be of different formats, so the type is set per file.
+	ext := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	switch ext {
+	case "yaml", "json", "yml", "toml", "hcl":
+	default:
+		return fmt.Errorf("unsupported config type: %s", ext)
+	}
+	viper.SetConfigType(ext)
+	if merge {
+		err = viper.MergeConfig(configFile)
+	} else {
+		err = viper.ReadConfig(configFile)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", fileName, err)
 	}
+	return nil
+}
+
+func loadKeys(c *Config) error {
+	var err error
 	serverConfigured := false
-	if c.Server.CertFile != "" || c.Server.KeyFile != "" {
-		// Check for partial configuration.
-		if c.Server.CertFile == "" || c.Server.KeyFile == "" {
-			return nil, fmt.Errorf("failed to load server cert and key: both were not provided")
-		}
-		c.Server.publicKey, c.Server.privateKey, err = loadCertAndKey(c.Server.CertFile, c.Server.KeyFile)
+	c.Server.tlsCert, err = loadCertAndKey(c.Server.CertFile, c.Server.KeyFile, c.Server.CertPEM, c.Server.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load server cert and key: %s", err)
+	}
+	if c.Server.tlsCert != nil {
+		c.Server.publicKey, c.Server.privateKey, err = libtrustKeys(c.Server.tlsCert)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load server cert and key: %s", err)
+			return fmt.Errorf("failed to load server cert and key: %s", err)
 		}
 		serverConfigured = true
 	}
+	if c.Server.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.Server.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client CAs: %s", err)
+		}
+		c.Server.clientCAs = x509.NewCertPool()
+		if !c.Server.clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to load client CAs: no certificates found in %s", c.Server.ClientCAFile)
+		}
+	}
 	tokenConfigured := false
-	if c.Token.CertFile != "" || c.Token.KeyFile != "" {
-		// Check for partial configuration.
-		if c.Token.CertFile == "" || c.Token.KeyFile == "" {
-			return nil, fmt.Errorf("failed to load token cert and key: both were not provided")
+	certFile, certPEM := c.Token.CertFile, c.Token.CertPEM
+	if c.Token.KMS != nil {
+		// The certificate is that of the KMS key, loaded after token.keys as it is the one to sign with.
+		certFile, certPEM = "", ""
+	}
+	tokenCert, err := loadCertAndKey(certFile, c.Token.KeyFile, certPEM, c.Token.KeyPEM)
+	if err == nil && tokenCert != nil {
+		c.Token.publicKey, c.Token.privateKey, err = libtrustKeys(tokenCert)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load token cert and key: %s", err)
+	}
+	if tokenCert != nil {
+		c.Token.publicKeys = append(c.Token.publicKeys, c.Token.publicKey)
+		tokenConfigured = true
+	}
+	for i, k := range c.Token.Keys {
+		keyCert, err := loadCertAndKey(k.CertFile, k.KeyFile, k.CertPEM, k.KeyPEM)
+		if err == nil && keyCert == nil {
+			err = errors.New("both were not provided")
+		}
+		if err == nil {
+			c.Token.publicKey, c.Token.privateKey, err = libtrustKeys(keyCert)
 		}
-		c.Token.publicKey, c.Token.privateKey, err = loadCertAndKey(c.Token.CertFile, c.Token.KeyFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load token cert and key: %s", err)
+			return fmt.Errorf("failed to load token.keys[%d] cert and key: %s", i, err)
+		}
+		c.Token.publicKeys = append(c.Token.publicKeys, c.Token.publicKey)
+		tokenConfigured = true
+	}
+	if kc := c.Token.KMS; kc != nil {
+		pub, err := loadPublicKey(c.Token.CertFile, c.Token.CertPEM)
+		if err == nil {
+			c.Token.publicKey, err = libtrust.FromCryptoPublicKey(pub)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load token certificate: %s", err)
+		}
+		c.Token.privateKey = nil
+		c.Token.publicKeys = append(c.Token.publicKeys, c.Token.publicKey)
+		if c.Token.signer, err = newKMSSigner(kc, pub, c.Token.SigningAlgorithm); err != nil {
+			return fmt.Errorf("token.kms: %s", err)
 		}
 		tokenConfigured = true
 	}
 
 	if serverConfigured && !tokenConfigured {
 		c.Token.publicKey, c.Token.privateKey = c.Server.publicKey, c.Server.privateKey
+		c.Token.publicKeys = []libtrust.PublicKey{c.Token.publicKey}
 		tokenConfigured = true
 	}
 
 	if !tokenConfigured {
-		return nil, fmt.Errorf("failed to load token cert and key: none provided")
+		return fmt.Errorf("failed to load token cert and key: none provided")
+	}
+	if alg := c.Token.SigningAlgorithm; alg != "" && c.Token.signer == nil {
+		c.Token.signingHash = SigningAlgorithms[alg]
+		// Key types determine the algorithm, so check that the key actually produces the one configured.
+		_, keyAlg, err := c.Token.privateKey.Sign(strings.NewReader("dummy"), c.Token.signingHash)
+		if err != nil {
+			return fmt.Errorf("failed to sign with token key: %s", err)
+		}
+		if keyAlg != alg {
+			return fmt.Errorf("token.signing_algorithm %s is incompatible with the %s token key, which signs with %s", alg, c.Token.privateKey.KeyType(), keyAlg)
+		}
+	}
+	if c.Token.signer == nil {
+		if c.Token.signer, err = newLocalSigner(c.Token.privateKey, c.Token.signingHash); err != nil {
+			return err
+		}
 	}
 
 	if !serverConfigured && c.Server.LetsEncrypt.Email != "" {
 		if c.Server.LetsEncrypt.CacheDir == "" {
-			return nil, fmt.Errorf("server.letsencrypt.cache_dir is required")
+			return fmt.Errorf("server.letsencrypt.cache_dir is required")
 		}
 		// We require that LetsEncrypt is an existing directory, because we really don't want it
 		// to be misconfigured and obtained certificates to be lost.
 		fi, err := os.Stat(c.Server.LetsEncrypt.CacheDir)
 		if err != nil || !fi.IsDir() {
-			return nil, fmt.Errorf("server.letsencrypt.cache_dir (%s) does not exist or is not a directory", c.Server.LetsEncrypt.CacheDir)
+			return fmt.Errorf("server.letsencrypt.cache_dir (%s) does not exist or is not a directory", c.Server.LetsEncrypt.CacheDir)
 		}
 	}
+	return nil
+}
 
+func LoadConfig(fileName string, envPrefix string) (*Config, error) {
+	c, err := readConfig(fileName, envPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err = validate(c); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	if err = loadKeys(c); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
+
+// CheckConfig performs the same checks as LoadConfig without starting anything,
+// but instead of stopping at the first problem it returns all of them.
+func CheckConfig(fileName string, envPrefix string) []error {
+	c, err := readConfig(fileName, envPrefix)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	if err = validate(c); err != nil {
+		if ce, ok := err.(ConfigErrors); ok {
+			errs = append(errs, ce...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	if err = loadKeys(c); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Enumerated values for options that only accept names from a fixed set.
+// Numeric values are accepted by the server as well, but are not offered by the schema.
+var schemaEnums = map[string][]string{
+	"server.tls_min_version":       sortedKeys(TLSVersionValues),
+	"server.tls_curve_preferences": sortedKeys(TLSCurveIDValues),
+	"server.tls_cipher_suites":     sortedKeys(TLSCipherSuitesValues),
+	"token.signing_algorithm":      sortedKeys(SigningAlgorithms),
+}
+
+// Options that also accept a legacy form, in addition to the one derived from their type.
+var schemaAlternatives = map[string]map[string]interface{}{
+	"server.hsts": {"type": "boolean"},
+}
+
+// WriteConfigSchema writes a JSON Schema describing the config file to w.
+// Editors can use it to validate and autocomplete YAML configs.
+func WriteConfigSchema(w io.Writer) error {
+	schema := structSchema("", reflect.TypeOf(Config{}), map[reflect.Type]bool{})
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "docker_auth configuration"
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
+
+func structSchema(path string, t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	props := map[string]interface{}{}
+	addStructProperties(path, t, props, seen)
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	// Structs from other packages (e.g. Redis options) are decoded case-insensitively
+	// and may have fields we don't know about, so only our own are strict.
+	if strings.HasPrefix(t.PkgPath(), "github.com/cesanta/docker_auth/") {
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
+
+func addStructProperties(path string, t reflect.Type, props map[string]interface{}, seen map[reflect.Type]bool) {
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, squash, ok := configKey(f)
+		if !ok {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if squash {
+			if ft.Kind() == reflect.Struct && !seen[ft] {
+				addStructProperties(path, ft, props, seen)
+			}
+			continue
+		}
+		key := name
+		if path != "" {
+			key = path + "." + name
+		}
+		s := typeSchema(key, ft, seen)
+		if s == nil {
+			continue
+		}
+		if alt, ok := schemaAlternatives[key]; ok {
+			s = map[string]interface{}{"oneOf": []interface{}{alt, s}}
+		}
+		props[name] = s
+		if ft.Kind() == reflect.String {
+			// See resolveSecretFiles and resolveVaultSecrets.
+			for _, suffix := range []string{"_file", "_vault"} {
+				if _, ok := props[name+suffix]; !ok {
+					props[name+suffix] = map[string]interface{}{"type": "string"}
+				}
+			}
+		}
+	}
+}
+
+// typeSchema returns the schema for a value of type t, or nil if it can't be set from config.
+func typeSchema(path string, t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// Either a string like "10s" or a number of nanoseconds.
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		if enum, ok := schemaEnums[path]; ok {
+			return map[string]interface{}{"type": "string", "enum": enum}
+		}
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		items := typeSchema(path, t.Elem(), seen)
+		if items == nil {
+			return nil
+		}
+		return map[string]interface{}{"type": "array", "items": items}
+	case reflect.Map:
+		values := typeSchema(path+".*", t.Elem(), seen)
+		if values == nil {
+			return nil
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		return structSchema(path, t, seen)
+	case reflect.Interface:
+		return map[string]interface{}{}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map with string keys.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type CORSConfig struct {
+	AllowedOrigins   []string `mapstructure:"allowed_origins,omitempty"`
+	AllowedMethods   []string `mapstructure:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `mapstructure:"allowed_headers,omitempty"`
+	AllowCredentials bool     `mapstructure:"allow_credentials,omitempty"`
+	MaxAge           int      `mapstructure:"max_age,omitempty"`
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header for the given origin,
+// or an empty string if the origin is not allowed.
+func (cc *CORSConfig) allowOrigin(origin string) string {
+	for _, o := range cc.AllowedOrigins {
+		if o == "*" {
+			if cc.AllowCredentials {
+				// Browsers reject a wildcard for credentialed requests.
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// handle adds CORS headers to the response if the request comes from an allowed origin.
+// It returns true if the request was a preflight request, which has been answered and
+// needs no further processing.
+func (cc *CORSConfig) handle(rw http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	h := rw.Header()
+	h.Add("Vary", "Origin")
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if ao := cc.allowOrigin(origin); ao != "" {
+		h.Set("Access-Control-Allow-Origin", ao)
+		if cc.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", strings.Join(cc.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(cc.AllowedHeaders, ", "))
+			if cc.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(cc.MaxAge))
+			}
+		}
+	}
+	if preflight {
+		rw.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
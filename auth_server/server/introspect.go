@@ -0,0 +1,146 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cesanta/glog"
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// IntrospectionConfig enables the RFC 7662 token introspection endpoint.
+// Clients authenticate like any other user and must be listed in AllowedClients.
+type IntrospectionConfig struct {
+	AllowedClients []string `mapstructure:"allowed_clients,omitempty"`
+}
+
+// introspectionResponse is the RFC 7662 response. Only Active is set for inactive tokens.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Expiry    int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	JWTID     string `json:"jti,omitempty"`
+}
+
+// authenticateClient checks that a POST request comes from one of the allowed accounts.
+// If not, an error response is sent and false is returned.
+func (as *AuthServer) authenticateClient(rw http.ResponseWriter, req *http.Request, allowed []string) (string, bool) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	return as.checkClient(rw, req, allowed)
+}
+
+// checkClient is authenticateClient for requests of any method.
+func (as *AuthServer) checkClient(rw http.ResponseWriter, req *http.Request, allowed []string) (string, bool) {
+	ar, err := as.ParseRequest(req)
+	if err != nil {
+		glog.Warningf("%sBad request: %s", api.LogPrefix(req.Context()), err)
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		return "", false
+	}
+	authnResult, _, err := as.Authenticate(ar)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusInternalServerError)
+		return "", false
+	}
+	if !authnResult || ar.anonymous || !containsString(allowed, ar.Account) {
+		glog.Warningf("%sClient %q denied access to %s", api.LogPrefix(req.Context()), ar.Account, req.URL.Path)
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, as.config.Token.Issuer))
+		http.Error(rw, "Client authentication failed", http.StatusUnauthorized)
+		return "", false
+	}
+	return ar.Account, true
+}
+
+func (as *AuthServer) doIntrospect(rw http.ResponseWriter, req *http.Request) {
+	account, ok := as.authenticateClient(rw, req, as.config.Introspection.AllowedClients)
+	if !ok {
+		return
+	}
+	resp := as.introspect(req.Context(), req.PostFormValue("token"))
+	glog.V(2).Infof("%sIntrospection by %s: %+v", api.LogPrefix(req.Context()), account, resp)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// introspect verifies the signature, issuer and validity period of a token issued by this server.
+func (as *AuthServer) introspect(ctx context.Context, rawToken string) *introspectionResponse {
+	inactive := &introspectionResponse{Active: false}
+	t, err := token.NewToken(rawToken)
+	if err != nil {
+		glog.V(2).Infof("%sIntrospection: %s", api.LogPrefix(ctx), err)
+		return inactive
+	}
+	tc := &as.config.Token
+	trustedKeys := make(map[string]libtrust.PublicKey, len(tc.publicKeys))
+	for _, k := range tc.publicKeys {
+		trustedKeys[k.KeyID()] = k
+	}
+	audiences := tc.AllowedAudiences
+	if len(audiences) == 0 {
+		// Any service the token was issued for is fine.
+		audiences = []string{t.Claims.Audience}
+	}
+	err = t.Verify(token.VerifyOptions{
+		TrustedIssuers:    []string{tc.Issuer},
+		AcceptedAudiences: audiences,
+		TrustedKeys:       trustedKeys,
+	})
+	if err != nil {
+		glog.V(2).Infof("%sIntrospection: %s", api.LogPrefix(ctx), err)
+		return inactive
+	}
+	if revoked, err := as.isRevoked(t.Claims); err != nil || revoked {
+		if err != nil {
+			glog.Errorf("%sFailed to check token revocation: %s", api.LogPrefix(ctx), err)
+		}
+		return inactive
+	}
+	var scopes []string
+	for _, ra := range t.Claims.Access {
+		scopes = append(scopes, fmt.Sprintf("%s:%s:%s", ra.Type, ra.Name, strings.Join(ra.Actions, ",")))
+	}
+	return &introspectionResponse{
+		Active:    true,
+		Scope:     strings.Join(scopes, " "),
+		TokenType: "Bearer",
+		Subject:   t.Claims.Subject,
+		Audience:  t.Claims.Audience,
+		Issuer:    t.Claims.Issuer,
+		Expiry:    t.Claims.Expiration,
+		IssuedAt:  t.Claims.IssuedAt,
+		NotBefore: t.Claims.NotBefore,
+		JWTID:     t.Claims.JWTID,
+	}
+}
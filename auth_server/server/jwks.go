@@ -0,0 +1,67 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cesanta/glog"
+	"github.com/docker/libtrust"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// How long clients may cache the key set. New signing keys have to be added to token.keys
+// at least this long before they are used for them to be picked up.
+const jwksMaxAge = 300
+
+type jwkSet struct {
+	Keys []map[string]interface{} `json:"keys"`
+}
+
+// jwks returns the public keys that tokens may be signed with, as a JSON Web Key Set (RFC 7517).
+// Key IDs are those in the "kid" header of the tokens.
+func jwks(keys []libtrust.PublicKey) (*jwkSet, error) {
+	set := &jwkSet{Keys: []map[string]interface{}{}}
+	for _, k := range keys {
+		data, err := json.Marshal(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode key %s: %s", k.KeyID(), err)
+		}
+		var jwk map[string]interface{}
+		if err := json.Unmarshal(data, &jwk); err != nil {
+			return nil, fmt.Errorf("failed to encode key %s: %s", k.KeyID(), err)
+		}
+		jwk["use"] = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+func (as *AuthServer) doJWKS(rw http.ResponseWriter, req *http.Request) {
+	set, err := jwks(as.config.Token.publicKeys)
+	if err != nil {
+		glog.Errorf("%s%s", api.LogPrefix(req.Context()), err)
+		http.Error(rw, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", jwksMaxAge))
+	json.NewEncoder(rw).Encode(set)
+}
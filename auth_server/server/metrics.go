@@ -0,0 +1,71 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+var (
+	authnResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_auth_authn_total",
+		Help: "Authentication attempts, by authenticator and result (success, failure, no_match or error).",
+	}, []string{"authenticator", "result"})
+	authnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_auth_authn_duration_seconds",
+		Help:    "Time taken by authenticators.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"authenticator"})
+	authzDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_auth_authz_duration_seconds",
+		Help:    "Time taken by authorizers, per scope.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"authorizer"})
+	authzCacheResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_auth_authz_cache_total",
+		Help: "Lookups in the authz cache, by result (hit, miss or error).",
+	}, []string{"result"})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "docker_auth_rate_limited_total",
+		Help: "Requests rejected because the client was over server.rate_limit.",
+	})
+	tokenDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "docker_auth_token_issue_duration_seconds",
+		Help:    "Time taken to create and sign tokens.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authnResults, authnDuration, authzDuration, authzCacheResults, rateLimited, tokenDuration)
+}
+
+// authnResult returns the result label for the outcome of an authenticator.
+func authnResult(result bool, err error) string {
+	switch {
+	case err == api.NoMatch:
+		return "no_match"
+	case api.IsWrongCredentials(err) || (err == nil && !result):
+		return "failure"
+	case err != nil:
+		return "error"
+	default:
+		return "success"
+	}
+}
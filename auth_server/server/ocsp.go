@@ -0,0 +1,74 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// FetchOCSPStaple queries the OCSP responder of the certificate's issuer and returns the raw
+// response, suitable for tls.Certificate.OCSPStaple, along with its parsed form.
+// The issuer certificate must be included in the chain.
+func FetchOCSPStaple(cert *tls.Certificate, client *http.Client) ([]byte, *ocsp.Response, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("certificate chain does not include the issuer")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate does not specify an OCSP responder")
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %s returned %s", leaf.OCSPServer[0], resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP status is not good (%d)", r.Status)
+	}
+	return body, r, nil
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often buckets that have refilled are dropped, so that the map does not grow without bound.
+const rateLimitSweepInterval = time.Minute
+
+type RateLimitConfig struct {
+	// Requests per second allowed from a client IP, on average.
+	Rate float64 `mapstructure:"rate,omitempty"`
+	// Requests a client IP can make in quick succession, before being held to Rate.
+	Burst int `mapstructure:"burst,omitempty"`
+}
+
+func (rc *RateLimitConfig) Validate() error {
+	if rc.Rate <= 0 {
+		return errors.New("server.rate_limit.rate must be positive")
+	}
+	if rc.Burst < 0 {
+		return errors.New("server.rate_limit.burst must not be negative")
+	}
+	if rc.Burst == 0 {
+		rc.Burst = int(math.Ceil(rc.Rate))
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client IP.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rc *RateLimitConfig) *rateLimiter {
+	return &rateLimiter{rate: rc.Rate, burst: float64(rc.Burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the client's bucket. If there is none, it returns false
+// and how long it takes for the next one to become available.
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+	b := rl.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(rl.burst, b.tokens+elapsed.Seconds()*rl.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that are full by now, they are the same as new ones.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for client, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// limit answers the request with 429 Too Many Requests if the client is over the limit.
+// It returns true if it did.
+func (as *AuthServer) limit(rw http.ResponseWriter, req *http.Request) bool {
+	addr := as.realRemoteAddr(req)
+	client := addr
+	if ip := parseRemoteAddr(addr); ip != nil {
+		client = ip.String()
+	}
+	ok, wait := as.rateLimiter.allow(client, time.Now())
+	if ok {
+		return false
+	}
+	rateLimited.Inc()
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+	return true
+}
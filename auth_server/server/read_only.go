@@ -0,0 +1,127 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/cesanta/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// ReadOnlyConfig controls the read-only maintenance mode, in which push, delete and "*"
+// are stripped from the actions granted on every scope. Pulls and catalog reads are unaffected.
+type ReadOnlyConfig struct {
+	// Whether the mode is on when the config is loaded.
+	Enabled bool `mapstructure:"enabled,omitempty"`
+	// Accounts that may toggle the mode at /read_only. The endpoint is disabled if empty.
+	AllowedClients []string `mapstructure:"allowed_clients,omitempty"`
+}
+
+var readOnlyGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "docker_auth_read_only",
+	Help: "1 if the read-only maintenance mode is on.",
+})
+
+func init() {
+	prometheus.MustRegister(readOnlyGauge)
+}
+
+// ReadOnlyState is whether the read-only mode is on. The caller of NewAuthServer keeps one and
+// passes it to every AuthServer it creates, so that toggling the mode at runtime survives config
+// reloads. The config applies again only if its enabled setting changes. The zero value is off.
+type ReadOnlyState struct {
+	mu         sync.Mutex
+	on         bool
+	configured bool
+}
+
+func (s *ReadOnlyState) enabled() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.on
+}
+
+func (s *ReadOnlyState) set(on bool, by string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if on != s.on {
+		if on {
+			glog.Warningf("Read-only mode enabled by %s, push and delete are denied", by)
+		} else {
+			glog.Warningf("Read-only mode disabled by %s", by)
+		}
+	}
+	s.on = on
+	if on {
+		readOnlyGauge.Set(1)
+	} else {
+		readOnlyGauge.Set(0)
+	}
+}
+
+func (s *ReadOnlyState) configure(c *ReadOnlyConfig) {
+	enabled := c != nil && c.Enabled
+	s.mu.Lock()
+	changed := enabled != s.configured
+	s.configured = enabled
+	s.mu.Unlock()
+	if changed {
+		s.set(enabled, "config")
+	}
+}
+
+// readOnlyActions removes the actions that modify the registry from those granted on scope.
+// The registry catalog is requested with "*", which is left alone.
+func readOnlyActions(scope authScope, actions []string) []string {
+	allowed := []string{}
+	for _, a := range actions {
+		if a == "push" || a == "delete" || (a == "*" && scope.Type != "registry") {
+			continue
+		}
+		allowed = append(allowed, a)
+	}
+	return allowed
+}
+
+// doReadOnly reports the read-only mode and turns it on or off if "enabled" is posted.
+func (as *AuthServer) doReadOnly(rw http.ResponseWriter, req *http.Request) {
+	account, ok := as.authenticateClient(rw, req, as.config.ReadOnly.AllowedClients)
+	if !ok {
+		return
+	}
+	if v := req.PostFormValue("enabled"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(rw, "Bad request: enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		glog.Infof("%sRead-only mode set to %t by %s", api.LogPrefix(req.Context()), on, account)
+		as.readOnly.set(on, account)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]bool{"read_only": as.readOnly.enabled()})
+}
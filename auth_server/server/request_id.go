@@ -0,0 +1,55 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID attaches an ID to the request, for correlating log messages about it.
+// A well-formed ID set by the client or a proxy in front of us is kept, otherwise a new one is generated.
+// The ID is echoed back in the response.
+func withRequestID(rw http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	rw.Header().Set(requestIDHeader, id)
+	return req.WithContext(api.WithRequestID(req.Context(), id))
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters without spaces,
+// which is enough for UUIDs and the usual proxy-generated IDs and safe to put in logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
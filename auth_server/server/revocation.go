@@ -0,0 +1,152 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/docker/distribution/registry/auth/token"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// RevocationConfig enables the token revocation endpoint.
+// Clients authenticate like any other user and must be listed in AllowedClients.
+type RevocationConfig struct {
+	AllowedClients []string `mapstructure:"allowed_clients,omitempty"`
+}
+
+// RevocationStore keeps track of revoked tokens until they would have expired anyway.
+// Keys are "jti:<token ID>" for single tokens and "sub:<account>" for all tokens of an account.
+// Implementations must be goroutine-safe.
+type RevocationStore interface {
+	// Revoke records that key was revoked at revokedAt. It can be forgotten after expires.
+	Revoke(key string, revokedAt, expires time.Time) error
+
+	// RevokedAt returns the time key was revoked, or zero time if it was not.
+	RevokedAt(key string) (time.Time, error)
+}
+
+type revocation struct {
+	revokedAt time.Time
+	expires   time.Time
+}
+
+type memoryRevocationStore struct {
+	mu          sync.Mutex
+	revocations map[string]revocation
+}
+
+// NewMemoryRevocationStore returns a RevocationStore that keeps revocations in memory.
+// They are lost when the process exits. The store is to be passed to every AuthServer,
+// so that revocations survive config reloads.
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{revocations: make(map[string]revocation)}
+}
+
+func (s *memoryRevocationStore) Revoke(key string, revokedAt, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, r := range s.revocations {
+		if now.After(r.expires) {
+			delete(s.revocations, k)
+		}
+	}
+	if r, found := s.revocations[key]; found && r.revokedAt.After(revokedAt) {
+		revokedAt = r.revokedAt
+	}
+	s.revocations[key] = revocation{revokedAt: revokedAt, expires: expires}
+	return nil
+}
+
+func (s *memoryRevocationStore) RevokedAt(key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, found := s.revocations[key]
+	if !found || time.Now().After(r.expires) {
+		return time.Time{}, nil
+	}
+	return r.revokedAt, nil
+}
+
+// isRevoked checks the token ID and the subject against the revocation store.
+func (as *AuthServer) isRevoked(claims *token.ClaimSet) (bool, error) {
+	if as.revocations == nil {
+		return false, nil
+	}
+	if claims.JWTID != "" {
+		t, err := as.revocations.RevokedAt("jti:" + claims.JWTID)
+		if err != nil || !t.IsZero() {
+			return err == nil, err
+		}
+	}
+	t, err := as.revocations.RevokedAt("sub:" + claims.Subject)
+	if err != nil || t.IsZero() {
+		return false, err
+	}
+	// Revoking a subject revokes tokens issued up to and including the second of revocation.
+	return claims.IssuedAt <= t.Unix(), nil
+}
+
+// doRevoke revokes a single token, given as "token" or by its ID as "jti",
+// and/or all tokens issued so far to the account given as "sub".
+func (as *AuthServer) doRevoke(rw http.ResponseWriter, req *http.Request) {
+	account, ok := as.authenticateClient(rw, req, as.config.Revocation.AllowedClients)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	tc := &as.config.Token
+	// Tokens issued before now expire no later than this.
+	maxExpires := now.Add(time.Duration(tc.maxExpiration()) * time.Second)
+	var revoked []string
+	if raw := req.PostFormValue("token"); raw != "" {
+		resp := as.introspect(req.Context(), raw)
+		if !resp.Active {
+			// Per RFC 7009, invalid tokens need no revocation.
+			glog.V(2).Infof("%sRevocation of an inactive token by %s", api.LogPrefix(req.Context()), account)
+		} else {
+			key := "jti:" + resp.JWTID
+			if err := as.revocations.Revoke(key, now, time.Unix(resp.Expiry, 0)); err != nil {
+				http.Error(rw, fmt.Sprintf("Failed to revoke token: %s", err), http.StatusInternalServerError)
+				return
+			}
+			revoked = append(revoked, key)
+		}
+	}
+	for _, f := range []string{"jti", "sub"} {
+		v := req.PostFormValue(f)
+		if v == "" {
+			continue
+		}
+		key := f + ":" + v
+		if err := as.revocations.Revoke(key, now, maxExpires); err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to revoke %s: %s", key, err), http.StatusInternalServerError)
+			return
+		}
+		revoked = append(revoked, key)
+	}
+	glog.Infof("%sRevoked by %s: %v", api.LogPrefix(req.Context()), account, revoked)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string][]string{"revoked": revoked})
+}
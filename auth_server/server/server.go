@@ -17,20 +17,29 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/http"
 	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/casbin/casbin/v2"
 	"github.com/cesanta/glog"
 	"github.com/docker/distribution/registry/auth/token"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/cesanta/docker_auth/auth_server/api"
 	"github.com/cesanta/docker_auth/auth_server/authn"
@@ -49,16 +58,51 @@ type AuthServer struct {
 	ga             *authn.GoogleAuth
 	gha            *authn.GitHubAuth
 	oidc           *authn.OIDCAuth
+	saml           *authn.SAMLAuth
 	glab           *authn.GitlabAuth
+	// Set when the server is about to shut down, to fail readiness checks.
+	draining int32
+	// Revoked tokens, if revocation is enabled.
+	revocations RevocationStore
+	log         eventLogger
+	// Audit log of token requests, if enabled.
+	audit *auditLog
+	// Cache of authorization decisions, if enabled.
+	authzCache *authzCache
+	// Notified of authentications, if enabled.
+	webhook *webhook
+	// Per client IP request limits, if enabled.
+	rateLimiter *rateLimiter
+	// Reported at /version.
+	configHash string
+	// Set for the authenticators after which requests they return api.NoMatch for are denied.
+	authnStop []bool
+	// Second factor enforcement, if enabled.
+	mfa *authn.MFA
+	// Picks the authorization decisions to log, if enabled.
+	authzLogSampler *authzLogSampler
+	// Shared with the servers created on config reloads.
+	readOnly *ReadOnlyState
 }
 
-func NewAuthServer(c *Config) (*AuthServer, error) {
+// NewAuthServer creates a server for the config. readOnly and revocations are kept by the caller
+// across config reloads, revocations are only used if revocation is enabled.
+func NewAuthServer(c *Config, readOnly *ReadOnlyState, revocations RevocationStore) (*AuthServer, error) {
 	as := &AuthServer{
 		config:      c,
 		authorizers: []api.Authorizer{},
+		log:         newEventLogger(c.Server.LogFormat),
+		configHash:  configHash(c),
+		readOnly:    readOnly,
 	}
+	glog.Infof("Config hash %s", as.configHash)
+	if c.Revocation != nil {
+		as.revocations = revocations
+	}
+	as.readOnly.configure(c.ReadOnly)
+	glog.Infof("Signing tokens with key %s (%d key(s) configured)", c.Token.publicKey.KeyID(), len(c.Token.publicKeys))
 	if c.ACL != nil {
-		staticAuthorizer, err := authz.NewACLAuthorizer(c.ACL)
+		staticAuthorizer, err := authz.NewACLAuthorizer(c.ACL, c.ACLAllowDuplicatePriorities)
 		if err != nil {
 			return nil, err
 		}
@@ -78,22 +122,69 @@ func NewAuthServer(c *Config) (*AuthServer, error) {
 		}
 		as.authorizers = append(as.authorizers, xormAuthorizer)
 	}
+	if c.ACLHTTP != nil {
+		httpAuthorizer, err := authz.NewACLHTTPAuthorizer(c.ACLHTTP)
+		if err != nil {
+			return nil, err
+		}
+		as.authorizers = append(as.authorizers, httpAuthorizer)
+	}
 	if c.ExtAuthz != nil {
 		extAuthorizer := authz.NewExtAuthzAuthorizer(c.ExtAuthz)
 		as.authorizers = append(as.authorizers, extAuthorizer)
 	}
-	if c.Users != nil {
-		as.authenticators = append(as.authenticators, authn.NewStaticUserAuth(c.Users))
+	// Configured authenticators by config key, see Config.authenticators.
+	authns := map[string]api.Authenticator{}
+	if c.ClientCertAuth != nil {
+		authns["client_cert_auth"] = authn.NewClientCertAuth(c.ClientCertAuth)
+	}
+	if files := c.usersFiles(); len(files) > 0 || c.Users != nil {
+		sua := authn.NewStaticUserAuth(c.Users)
+		if len(files) > 0 {
+			var err error
+			if sua, err = authn.NewStaticUserFilesAuth(files, c.Users, c.UsersConflicts); err != nil {
+				return nil, err
+			}
+		}
+		if c.CaseInsensitiveUsernames {
+			sua.SetCaseInsensitive()
+		}
+		if c.BcryptCost > 0 {
+			sua.SetRehashCost(c.BcryptCost)
+		}
+		if c.UnknownUserDummyHash {
+			cost := c.BcryptCost
+			if cost == 0 {
+				cost = bcrypt.DefaultCost
+			}
+			if err := sua.SetDummyHash(cost); err != nil {
+				return nil, fmt.Errorf("failed to create the dummy password hash: %s", err)
+			}
+		}
+		authns["users"] = sua
+		if c.MFA != nil {
+			as.mfa = authn.NewMFA(c.MFA, sua)
+		}
+	}
+	if c.MFA != nil && as.mfa == nil {
+		as.mfa = authn.NewMFA(c.MFA, nil)
+	}
+	if c.HtpasswdAuth != nil {
+		ha, err := authn.NewHtpasswdAuth(c.HtpasswdAuth)
+		if err != nil {
+			return nil, err
+		}
+		authns["htpasswd_auth"] = ha
 	}
 	if c.ExtAuth != nil {
-		as.authenticators = append(as.authenticators, authn.NewExtAuth(c.ExtAuth))
+		authns["ext_auth"] = authn.NewExtAuth(c.ExtAuth)
 	}
 	if c.GoogleAuth != nil {
 		ga, err := authn.NewGoogleAuth(c.GoogleAuth)
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, ga)
+		authns["google_auth"] = ga
 		as.ga = ga
 	}
 	if c.GitHubAuth != nil {
@@ -101,7 +192,10 @@ func NewAuthServer(c *Config) (*AuthServer, error) {
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, gha)
+		if c.CaseInsensitiveUsernames {
+			gha.SetCaseInsensitive()
+		}
+		authns["github_auth"] = gha
 		as.gha = gha
 	}
 	if c.OIDCAuth != nil {
@@ -109,15 +203,23 @@ func NewAuthServer(c *Config) (*AuthServer, error) {
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, oidc)
+		authns["oidc_auth"] = oidc
 		as.oidc = oidc
 	}
+	if c.SAMLAuth != nil {
+		saml, err := authn.NewSAMLAuth(c.SAMLAuth)
+		if err != nil {
+			return nil, err
+		}
+		authns["saml_auth"] = saml
+		as.saml = saml
+	}
 	if c.GitlabAuth != nil {
 		glab, err := authn.NewGitlabAuth(c.GitlabAuth)
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, glab)
+		authns["gitlab_auth"] = glab
 		as.glab = glab
 	}
 	if c.LDAPAuth != nil {
@@ -125,28 +227,39 @@ func NewAuthServer(c *Config) (*AuthServer, error) {
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, la)
+		authns["ldap_auth"] = la
+	}
+	if c.PAMAuth != nil {
+		pa, err := authn.NewPAMAuth(c.PAMAuth)
+		if err != nil {
+			return nil, err
+		}
+		authns["pam_auth"] = pa
 	}
 	if c.MongoAuth != nil {
 		ma, err := authn.NewMongoAuth(c.MongoAuth)
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, ma)
+		authns["mongo_auth"] = ma
 	}
 	if c.XormAuthn != nil {
 		xa, err := authn.NewXormAuth(c.XormAuthn)
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, xa)
+		authns["xorm_auth"] = xa
 	}
 	if c.PluginAuthn != nil {
 		pluginAuthn, err := authn.NewPluginAuthn(c.PluginAuthn)
 		if err != nil {
 			return nil, err
 		}
-		as.authenticators = append(as.authenticators, pluginAuthn)
+		authns["plugin_authn"] = pluginAuthn
+	}
+	for _, e := range c.authnOrder() {
+		as.authenticators = append(as.authenticators, authns[e.Name])
+		as.authnStop = append(as.authnStop, e.OnNoMatch == OnNoMatchStop)
 	}
 	if c.PluginAuthz != nil {
 		pluginAuthz, err := authz.NewPluginAuthzAuthorizer(c.PluginAuthz)
@@ -156,15 +269,37 @@ func NewAuthServer(c *Config) (*AuthServer, error) {
 		as.authorizers = append(as.authorizers, pluginAuthz)
 	}
 	if c.CasbinAuthz != nil {
-		enforcer, err := casbin.NewEnforcer(c.CasbinAuthz.ModelFilePath, c.CasbinAuthz.PolicyFilePath)
+		casbinAuthz, err := authz.NewCasbinFileAuthorizer(c.CasbinAuthz)
 		if err != nil {
 			return nil, err
 		}
-		casbinAuthz, err := authz.NewCasbinAuthorizer(enforcer)
+		as.authorizers = append(as.authorizers, casbinAuthz)
+	}
+	if c.OPAAuthz != nil {
+		as.authorizers = append(as.authorizers, authz.NewOPAAuthorizer(c.OPAAuthz))
+	}
+	if c.Server.Audit != nil {
+		audit, err := newAuditLog(c.Server.Audit)
 		if err != nil {
 			return nil, err
 		}
-		as.authorizers = append(as.authorizers, casbinAuthz)
+		as.audit = audit
+	}
+	if c.AuthzCache != nil {
+		cache, err := newAuthzCache(c.AuthzCache, c.ACL)
+		if err != nil {
+			return nil, err
+		}
+		as.authzCache = cache
+	}
+	if c.Server.RateLimit != nil {
+		as.rateLimiter = newRateLimiter(c.Server.RateLimit)
+	}
+	if c.AuthzLogSampling != nil {
+		as.authzLogSampler = newAuthzLogSampler(c.AuthzLogSampling)
+	}
+	if c.Server.Webhook != nil {
+		as.webhook = newWebhook(c.Server.Webhook)
 	}
 	return as, nil
 }
@@ -179,6 +314,23 @@ type authRequest struct {
 	Service        string
 	Scopes         []authScope
 	Labels         api.Labels
+	ClientCert     *api.ClientCert
+
+	// Context of the HTTP request, carrying the trace span.
+	ctx context.Context
+	// When the request was received.
+	start time.Time
+	// Name of the authenticator that accepted the request.
+	authenticator string
+	// Set when the request has no credentials and anonymous access is enabled.
+	anonymous bool
+}
+
+func (ar *authRequest) context() context.Context {
+	if ar.ctx == nil {
+		return context.Background()
+	}
+	return ar.ctx
 }
 
 type authScope struct {
@@ -188,9 +340,68 @@ type authScope struct {
 	Actions []string
 }
 
+// spec formats the scope the way it is requested, e.g. "repository:foo/bar:pull,push".
+func (s authScope) spec() string {
+	t := s.Type
+	if s.Class != "" {
+		t += "(" + s.Class + ")"
+	}
+	return fmt.Sprintf("%s:%s:%s", t, s.Name, strings.Join(s.Actions, ","))
+}
+
 type authzResult struct {
 	scope            authScope
 	autorizedActions []string
+	// The rule that made the decision, if the authorizer reports it.
+	rule     string
+	ruleName string
+}
+
+// Longest rule name included in a deny reason.
+const maxDenyReasonRuleLen = 200
+
+// denyReason describes the requested actions that were not granted and the rule that denied them,
+// or returns "" if all were granted. It only includes what the client asked for and the rule name,
+// never credentials.
+func (r *authzResult) denyReason() string {
+	var denied []string
+	for _, a := range r.scope.Actions {
+		granted := false
+		for _, ga := range r.autorizedActions {
+			if a == ga {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			denied = append(denied, a)
+		}
+	}
+	if len(denied) == 0 {
+		return ""
+	}
+	reason := "no matching rule"
+	if name := r.ruleName; name != "" {
+		if len(name) > maxDenyReasonRuleLen {
+			name = name[:maxDenyReasonRuleLen] + "..."
+		}
+		// Quoted as ASCII, header values must not contain control characters.
+		reason = fmt.Sprintf("rule %+q", name)
+	}
+	return fmt.Sprintf("%s:%s:%s denied by %s", r.scope.Type, r.scope.Name, strings.Join(denied, ","), reason)
+}
+
+// logFields adds the fields identifying the request to f, for structured logging.
+func (ar *authRequest) logFields(f logFields) logFields {
+	if id := api.RequestID(ar.context()); id != "" {
+		f["request_id"] = id
+	}
+	f["user"] = ar.Account
+	f["remote_ip"] = ar.RemoteIP.String()
+	if !ar.start.IsZero() {
+		f["duration_ms"] = time.Since(ar.start).Milliseconds()
+	}
+	return f
 }
 
 func (ar authRequest) String() string {
@@ -226,22 +437,64 @@ func parseScope(scope string) (string, string, error) {
 	}
 }
 
-func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
-	ar := &authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: req.RemoteAddr}
-	if as.config.Server.RealIPHeader != "" {
-		hv := req.Header.Get(as.config.Server.RealIPHeader)
-		ips := strings.Split(hv, ",")
+// parseScopeSpec parses a single requested scope, e.g. "repository:foo/bar:pull,push".
+func parseScopeSpec(scopeStr string) (authScope, error) {
+	parts := strings.Split(scopeStr, ":")
+	var scope authScope
+
+	scopeType, scopeClass, err := parseScope(parts[0])
+	if err != nil {
+		return scope, err
+	}
+
+	switch len(parts) {
+	case 3:
+		scope = authScope{
+			Type:    scopeType,
+			Class:   scopeClass,
+			Name:    parts[1],
+			Actions: strings.Split(parts[2], ","),
+		}
+	case 4:
+		scope = authScope{
+			Type:    scopeType,
+			Class:   scopeClass,
+			Name:    parts[1] + ":" + parts[2],
+			Actions: strings.Split(parts[3], ","),
+		}
+	default:
+		return scope, fmt.Errorf("invalid scope: %q", scopeStr)
+	}
+	sort.Strings(scope.Actions)
+	return scope, nil
+}
+
+// realRemoteAddr returns the client address from the real_ip_header, if configured,
+// or that of the connection. It is empty if the header does not provide one.
+func (as *AuthServer) realRemoteAddr(req *http.Request) string {
+	if as.config.Server.RealIPHeader == "" {
+		return req.RemoteAddr
+	}
+	hv := req.Header.Get(as.config.Server.RealIPHeader)
+	ips := strings.Split(hv, ",")
 
-		realIPPos := as.config.Server.RealIPPos
+	realIPPos := as.config.Server.RealIPPos
+	if realIPPos < 0 {
+		realIPPos = len(ips) + realIPPos
 		if realIPPos < 0 {
-			realIPPos = len(ips) + realIPPos
-			if realIPPos < 0 {
-				realIPPos = 0
-			}
+			realIPPos = 0
 		}
+	}
 
-		ar.RemoteAddr = strings.TrimSpace(ips[realIPPos])
-		glog.V(3).Infof("Conn ip %s, %s: %s, addr: %s", ar.RemoteAddr, as.config.Server.RealIPHeader, hv, ar.RemoteAddr)
+	addr := strings.TrimSpace(ips[realIPPos])
+	glog.V(3).Infof("%sConn ip %s, %s: %s, addr: %s", api.LogPrefix(req.Context()), req.RemoteAddr, as.config.Server.RealIPHeader, hv, addr)
+	return addr
+}
+
+func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
+	ar := &authRequest{RemoteConnAddr: req.RemoteAddr, RemoteAddr: req.RemoteAddr, ctx: req.Context(), start: time.Now()}
+	if as.config.Server.RealIPHeader != "" {
+		ar.RemoteAddr = as.realRemoteAddr(req)
 		if ar.RemoteAddr == "" {
 			return nil, fmt.Errorf("client address not provided")
 		}
@@ -269,6 +522,21 @@ func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
 	} else if haveBasicAuth && ar.Account != ar.User {
 		return nil, fmt.Errorf("user and account are not the same (%q vs %q)", ar.User, ar.Account)
 	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		leaf := req.TLS.VerifiedChains[0][0]
+		ar.ClientCert = &api.ClientCert{
+			CommonName:     leaf.Subject.CommonName,
+			DNSNames:       leaf.DNSNames,
+			EmailAddresses: leaf.EmailAddresses,
+		}
+		for _, u := range leaf.URIs {
+			ar.ClientCert.URIs = append(ar.ClientCert.URIs, u.String())
+		}
+		// Requests without credentials are made on behalf of the certificate subject.
+		if ar.Account == "" && as.config.ClientCertAuth != nil {
+			ar.Account = ar.ClientCert.CommonName
+		}
+	}
 	ar.Service = req.FormValue("service")
 	if err := req.ParseForm(); err != nil {
 		return nil, fmt.Errorf("invalid form value")
@@ -277,33 +545,10 @@ func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
 	if req.FormValue("scope") != "" {
 		for _, scopeValue := range req.Form["scope"] {
 			for _, scopeStr := range strings.Split(scopeValue, " ") {
-				parts := strings.Split(scopeStr, ":")
-				var scope authScope
-
-				scopeType, scopeClass, err := parseScope(parts[0])
+				scope, err := parseScopeSpec(scopeStr)
 				if err != nil {
 					return nil, err
 				}
-
-				switch len(parts) {
-				case 3:
-					scope = authScope{
-						Type:    scopeType,
-						Class:   scopeClass,
-						Name:    parts[1],
-						Actions: strings.Split(parts[2], ","),
-					}
-				case 4:
-					scope = authScope{
-						Type:    scopeType,
-						Class:   scopeClass,
-						Name:    parts[1] + ":" + parts[2],
-						Actions: strings.Split(parts[3], ","),
-					}
-				default:
-					return nil, fmt.Errorf("invalid scope: %q", scopeStr)
-				}
-				sort.Strings(scope.Actions)
 				ar.Scopes = append(ar.Scopes, scope)
 			}
 		}
@@ -311,81 +556,257 @@ func (as *AuthServer) ParseRequest(req *http.Request) (*authRequest, error) {
 	return ar, nil
 }
 
-func (as *AuthServer) Authenticate(ar *authRequest) (bool, api.Labels, error) {
+func (as *AuthServer) Authenticate(ar *authRequest) (allowed bool, _ api.Labels, authnErr error) {
+	// The authenticator that made the decision, if any.
+	authenticator := ""
+	if as.webhook != nil {
+		defer func() { as.webhook.Notify(newAuthnEvent(ar, authenticator, allowed, authnErr)) }()
+	}
+	if as.config.Anonymous != nil && ar.User == "" && ar.Password == "" && ar.ClientCert == nil {
+		if ar.Account != "" {
+			// Without credentials the account would be taken on the client's word.
+			as.log.Warning(ar.logFields(logFields{"authenticator": "anonymous", "decision": "deny"}),
+				"Anonymous request for account %q", ar.Account)
+			return false, nil, nil
+		}
+		ar.anonymous = true
+		ar.authenticator = "anonymous"
+		authenticator = "anonymous"
+		as.log.Info(ar.logFields(logFields{"authenticator": "anonymous", "decision": "allow"}), "Anonymous request")
+		return true, nil, nil
+	}
+	// The password without a TOTP code appended to it, if any.
+	password, code := ar.Password, ""
+	if as.mfa != nil {
+		password, code = as.mfa.SplitCode(ar.Account, ar.Password)
+	}
 	for i, a := range as.authenticators {
-		result, labels, err := a.Authenticate(ar.Account, ar.Password)
-		glog.V(2).Infof("Authn %s %s -> %t, %+v, %v", a.Name(), ar.Account, result, labels, err)
+		var result bool
+		var labels api.Labels
+		var err error
+		cca, isCCA := a.(api.ClientCertAuthenticator)
+		if isCCA && ar.ClientCert == nil {
+			continue
+		}
+		authenticator = a.Name()
+		start := time.Now()
+		ctx, span := tracer.Start(ar.context(), "authn "+a.Name())
+		if isCCA {
+			result, labels, err = cca.AuthenticateClientCert(ar.Account, ar.ClientCert)
+		} else if ctxa, ok := a.(api.ContextAuthenticator); ok {
+			result, labels, err = ctxa.AuthenticateContext(ctx, ar.Account, password)
+		} else {
+			result, labels, err = a.Authenticate(ar.Account, password)
+		}
+		resultLabel := authnResult(result, err)
+		span.SetAttributes(attribute.String("authn.result", resultLabel))
+		if resultLabel == "error" {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		authnDuration.WithLabelValues(a.Name()).Observe(time.Since(start).Seconds())
+		authnResults.WithLabelValues(a.Name(), resultLabel).Inc()
+		glog.V(2).Infof("%sAuthn %s %s -> %t, %+v, %v", api.LogPrefix(ar.context()), a.Name(), ar.Account, result, labels, err)
 		if err != nil {
 			if err == api.NoMatch {
+				if i < len(as.authnStop) && as.authnStop[i] {
+					as.log.Warning(ar.logFields(logFields{"authenticator": a.Name(), "decision": "deny"}),
+						"%s does not know %s, not trying other authenticators", a.Name(), ar.Account)
+					return false, nil, nil
+				}
 				continue
-			} else if err == api.WrongPass {
-				glog.Warningf("Failed authentication with %s: %s", err, ar.Account)
+			} else if api.IsWrongCredentials(err) {
+				as.log.Warning(ar.logFields(logFields{"authenticator": a.Name(), "decision": "deny"}),
+					"Failed authentication with %s: %s", err, ar.Account)
 				return false, nil, nil
 			}
 			err = fmt.Errorf("authn #%d returned error: %s", i+1, err)
-			glog.Errorf("%s: %s", ar, err)
+			as.log.Error(ar.logFields(logFields{"authenticator": a.Name(), "decision": "error", "error": err}),
+				"%s: %s", ar, err)
 			return false, nil, err
 		}
+		if result && as.mfa != nil && as.mfa.Required(labels) {
+			if err := as.mfa.Check(a, ar.Account, code); err != nil {
+				as.log.Warning(ar.logFields(logFields{"authenticator": a.Name(), "decision": "deny"}),
+					"Second factor required for %s: %s", ar.Account, err)
+				return false, nil, nil
+			}
+		}
+		if result {
+			if as.config.CaseInsensitiveUsernames {
+				// So that ACL entries, tokens and the admin endpoints see one spelling of the name.
+				ar.Account = strings.ToLower(ar.Account)
+			}
+			ar.authenticator = a.Name()
+			as.log.Info(ar.logFields(logFields{"authenticator": a.Name(), "decision": "allow"}),
+				"Authenticated %s with %s", ar.Account, a.Name())
+		} else {
+			as.log.Warning(ar.logFields(logFields{"authenticator": a.Name(), "decision": "deny"}),
+				"Failed authentication with %s: %s", a.Name(), ar.Account)
+		}
 		return result, labels, nil
 	}
 	// Deny by default.
-	glog.Warningf("%s did not match any authn rule", ar)
+	authenticator = ""
+	as.log.Warning(ar.logFields(logFields{"decision": "deny"}), "%s did not match any authn rule", ar)
 	return false, nil, nil
 }
 
-func (as *AuthServer) authorizeScope(ai *api.AuthRequestInfo) ([]string, error) {
+func (as *AuthServer) authorizeScope(ctx context.Context, ai *api.AuthRequestInfo) ([]string, error) {
+	if as.authzCache != nil {
+		if actions, found := as.authzCache.get(ctx, ai); found {
+			return actions, nil
+		}
+	}
+	actions, err := as.runAuthorizers(ctx, ai)
+	if err == nil && as.authzCache != nil {
+		as.authzCache.set(ctx, ai, actions)
+	}
+	return actions, err
+}
+
+func (as *AuthServer) runAuthorizers(ctx context.Context, ai *api.AuthRequestInfo) ([]string, error) {
 	for i, a := range as.authorizers {
+		start := time.Now()
 		result, err := a.Authorize(ai)
-		glog.V(2).Infof("Authz %s %s -> %s, %s", a.Name(), *ai, result, err)
+		authzDuration.WithLabelValues(a.Name()).Observe(time.Since(start).Seconds())
+		glog.V(2).Infof("%sAuthz %s %s -> %s, %s", api.LogPrefix(ctx), a.Name(), *ai, result, err)
 		if err != nil {
 			if err == api.NoMatch {
 				continue
 			}
 			err = fmt.Errorf("authz #%d returned error: %s", i+1, err)
-			glog.Errorf("%s: %s", *ai, err)
+			as.log.Error(logFields{"request_id": api.RequestID(ctx), "user": ai.Account, "remote_ip": ai.IP.String(), "authorizer": a.Name(), "decision": "error", "error": err},
+				"%s: %s", *ai, err)
 			return nil, err
 		}
 		return result, nil
 	}
-	// Deny by default.
-	glog.Warningf("%s did not match any authz rule", *ai)
+	// Deny by default. With sampling, the decision is logged by logAuthzDecision instead.
+	if as.authzLogSampler == nil {
+		as.log.Warning(logFields{"request_id": api.RequestID(ctx), "user": ai.Account, "remote_ip": ai.IP.String(), "scope": ai.Type + ":" + ai.Name, "decision": "deny"},
+			"%s did not match any authz rule", *ai)
+	}
 	return nil, nil
 }
 
+// mountScopes recognizes a cross-repository blob mount, for which clients request pull on the
+// source repositories and push on the target in one request. It returns the index of the target
+// scope and those of the sources, or -1 if the request is not a mount.
+func mountScopes(scopes []authScope) (int, []int) {
+	target := -1
+	var sources []int
+	for i, s := range scopes {
+		if s.Type != "repository" {
+			continue
+		}
+		if containsString(s.Actions, "push") {
+			if target >= 0 {
+				// Pushing to several repositories is ambiguous.
+				return -1, nil
+			}
+			target = i
+		} else if len(s.Actions) == 1 && s.Actions[0] == "pull" {
+			sources = append(sources, i)
+		}
+	}
+	if target < 0 || len(sources) == 0 {
+		return -1, nil
+	}
+	return target, sources
+}
+
 func (as *AuthServer) Authorize(ar *authRequest) ([]authzResult, error) {
-	ares := []authzResult{}
-	for _, scope := range ar.Scopes {
+	ares := make([]authzResult, len(ar.Scopes))
+	// The target of a mount is authorized first, the sources are then marked as such
+	// if push to it has been granted.
+	order := make([]int, 0, len(ar.Scopes))
+	mountTarget, mountSources := mountScopes(ar.Scopes)
+	if mountTarget >= 0 {
+		order = append(order, mountTarget)
+	}
+	for i := range ar.Scopes {
+		if i != mountTarget {
+			order = append(order, i)
+		}
+	}
+	for _, i := range order {
+		scope := ar.Scopes[i]
 		ai := &api.AuthRequestInfo{
 			Account: ar.Account,
 			Type:    scope.Type,
+			Class:   scope.Class,
 			Name:    scope.Name,
 			Service: ar.Service,
 			IP:      ar.RemoteIP,
 			Actions: scope.Actions,
 			Labels:  ar.Labels,
 		}
-		actions, err := as.authorizeScope(ai)
+		if mountTarget >= 0 && containsString(ares[mountTarget].autorizedActions, "push") {
+			for _, j := range mountSources {
+				if i == j {
+					ai.MountTarget = ar.Scopes[mountTarget].Name
+				}
+			}
+		}
+		_, span := tracer.Start(ar.context(), "authz", trace.WithAttributes(
+			attribute.String("authz.scope", fmt.Sprintf("%s:%s:%s", scope.Type, scope.Name, strings.Join(scope.Actions, ","))),
+		))
+		actions, err := as.authorizeScope(ar.context(), ai)
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
 			return nil, err
 		}
-		ares = append(ares, authzResult{scope: scope, autorizedActions: actions})
+		span.SetAttributes(attribute.StringSlice("authz.granted", actions))
+		span.End()
+		ruleName := ai.MatchedRuleName
+		if ruleName == "" {
+			ruleName = ai.MatchedRule
+		}
+		if ar.anonymous && actions != nil {
+			allowed := authz.StringSetIntersection(actions, as.config.Anonymous.Actions)
+			if len(allowed) < len(actions) {
+				ruleName = "anonymous.actions"
+			}
+			actions = allowed
+		}
+		if actions != nil && as.readOnly.enabled() {
+			allowed := readOnlyActions(scope, actions)
+			if len(allowed) < len(actions) {
+				glog.V(1).Infof("%sRead-only mode: %s granted %v instead of %v", api.LogPrefix(ar.context()), scope.spec(), allowed, actions)
+				ruleName = "read_only"
+			}
+			actions = allowed
+		}
+		ares[i] = authzResult{scope: scope, autorizedActions: actions, rule: ai.MatchedRule, ruleName: ruleName}
+		as.logAuthzDecision(ar, &ares[i])
 	}
 	return ares, nil
 }
 
 // https://github.com/docker/distribution/blob/master/docs/spec/auth/token.md#example
+func grantedActions(ares []authzResult) []string {
+	var actions []string
+	for _, a := range ares {
+		actions = append(actions, a.autorizedActions...)
+	}
+	return actions
+}
+
 func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string, error) {
-	now := time.Now().Unix()
+	start := time.Now()
+	_, span := tracer.Start(ar.context(), "token")
+	defer func() {
+		span.End()
+		tokenDuration.Observe(time.Since(start).Seconds())
+	}()
+	now := start.Unix()
 	tc := &as.config.Token
 
-	// Sign something dummy to find out which algorithm is used.
-	_, sigAlg, err := tc.privateKey.Sign(strings.NewReader("dummy"), 0)
-	if err != nil {
-		return "", fmt.Errorf("failed to sign: %s", err)
-	}
 	header := token.Header{
 		Type:       "JWT",
-		SigningAlg: sigAlg,
+		SigningAlg: tc.signer.Algorithm(),
 		KeyID:      tc.publicKey.KeyID(),
 	}
 	headerJSON, err := json.Marshal(header)
@@ -393,14 +814,18 @@ func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string,
 		return "", fmt.Errorf("failed to marshal header: %s", err)
 	}
 
+	jti, err := newTokenID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token ID: %s", err)
+	}
 	claims := token.ClaimSet{
 		Issuer:     tc.Issuer,
 		Subject:    ar.Account,
 		Audience:   ar.Service,
-		NotBefore:  now - 10,
+		NotBefore:  tc.notBefore(now),
 		IssuedAt:   now,
-		Expiration: now + tc.Expiration,
-		JWTID:      fmt.Sprintf("%d", rand.Int63()),
+		Expiration: now + tc.expirationFor(grantedActions(ares)),
+		JWTID:      jti,
 		Access:     []*token.ResourceActions{},
 	}
 	for _, a := range ares {
@@ -419,34 +844,109 @@ func (as *AuthServer) CreateToken(ar *authRequest, ares []authzResult) (string,
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal claims: %s", err)
 	}
+	if len(tc.LabelClaims) > 0 {
+		claimsJSON, err = addLabelClaims(claimsJSON, tc.LabelClaims, ar.Labels)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal claims: %s", err)
+		}
+	}
 
 	payload := fmt.Sprintf("%s%s%s", joseBase64UrlEncode(headerJSON), token.TokenSeparator, joseBase64UrlEncode(claimsJSON))
 
-	sig, sigAlg2, err := tc.privateKey.Sign(strings.NewReader(payload), 0)
-	if err != nil || sigAlg2 != sigAlg {
+	sig, err := tc.signer.Sign([]byte(payload))
+	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %s", err)
 	}
-	glog.Infof("New token for %s %+v: %s", *ar, ar.Labels, claimsJSON)
+	as.log.Info(ar.logFields(logFields{"decision": "allow", "service": ar.Service, "jti": jti, "access": claims.Access, "labels": ar.Labels}),
+		"New token for %s %+v: %s", *ar, ar.Labels, claimsJSON)
 	return fmt.Sprintf("%s%s%s", payload, token.TokenSeparator, joseBase64UrlEncode(sig)), nil
 }
 
+// newTokenID returns a random, unique token ID for the jti claim.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return joseBase64UrlEncode(b), nil
+}
+
+// addLabelClaims adds the labels mapped by labelClaims to the marshaled claim set.
+// Label values are always added as arrays, even if there is only one.
+func addLabelClaims(claimsJSON []byte, labelClaims map[string]string, labels api.Labels) ([]byte, error) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, err
+	}
+	added := false
+	for label, claim := range labelClaims {
+		if values, found := labels[label]; found {
+			claims[claim] = values
+			added = true
+		}
+	}
+	if !added {
+		return claimsJSON, nil
+	}
+	return json.Marshal(claims)
+}
+
 func (as *AuthServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	glog.V(3).Infof("Request: %+v", req)
+	req = withRequestID(rw, req)
+	glog.V(3).Infof("%sRequest: %+v", api.LogPrefix(req.Context()), req)
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, req.URL.Path, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.HTTPMethodKey.String(req.Method),
+		semconv.HTTPTargetKey.String(req.URL.Path),
+	))
+	defer span.End()
+	req = req.WithContext(ctx)
 	path_prefix := as.config.Server.PathPrefix
-	if as.config.Server.HSTS {
-		rw.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	// Per RFC 6797, the header is only sent over secure transport.
+	if as.config.Server.HSTS != nil && req.TLS != nil {
+		rw.Header().Add("Strict-Transport-Security", as.config.Server.HSTS.Header())
+	}
+	if as.config.Server.CORS != nil && as.config.Server.CORS.handle(rw, req) {
+		return
+	}
+	// Health checks must not fail because of clients hammering the server.
+	if as.rateLimiter != nil && req.URL.Path != path_prefix+"/healthz" && req.URL.Path != path_prefix+"/readyz" &&
+		as.limit(rw, req) {
+		return
 	}
 	switch {
 	case req.URL.Path == path_prefix+"/":
 		as.doIndex(rw, req)
+	case req.URL.Path == path_prefix+"/healthz":
+		as.doHealthz(rw, req)
+	case req.URL.Path == path_prefix+"/readyz":
+		as.doReadyz(rw, req)
+	case req.URL.Path == path_prefix+"/metrics" && as.config.Server.Metrics:
+		promhttp.Handler().ServeHTTP(rw, req)
 	case req.URL.Path == path_prefix+"/auth":
 		as.doAuth(rw, req)
+	case req.URL.Path == path_prefix+"/.well-known/jwks.json":
+		as.doJWKS(rw, req)
+	case req.URL.Path == path_prefix+"/version":
+		as.doVersion(rw, req)
+	case req.URL.Path == path_prefix+"/introspect" && as.config.Introspection != nil:
+		as.doIntrospect(rw, req)
+	case req.URL.Path == path_prefix+"/revoke" && as.config.Revocation != nil:
+		as.doRevoke(rw, req)
+	case req.URL.Path == path_prefix+"/read_only" && as.config.ReadOnly != nil && len(as.config.ReadOnly.AllowedClients) > 0:
+		as.doReadOnly(rw, req)
 	case req.URL.Path == path_prefix+"/google_auth" && as.ga != nil:
 		as.ga.DoGoogleAuth(rw, req)
 	case req.URL.Path == path_prefix+"/github_auth" && as.gha != nil:
 		as.gha.DoGitHubAuth(rw, req)
+	case req.URL.Path == path_prefix+"/github_auth/sign_out" && as.gha != nil:
+		as.doGitHubSignOut(rw, req)
 	case req.URL.Path == path_prefix+"/oidc_auth" && as.oidc != nil:
 		as.oidc.DoOIDCAuth(rw, req)
+	case req.URL.Path == path_prefix+"/saml_auth" && as.saml != nil:
+		as.saml.DoSAMLAuth(rw, req)
+	case req.URL.Path == path_prefix+"/saml_auth/acs" && as.saml != nil:
+		as.saml.DoSAMLAuthACS(rw, req)
 	case req.URL.Path == path_prefix+"/gitlab_auth" && as.glab != nil:
 		as.glab.DoGitlabAuth(rw, req)
 	default:
@@ -455,6 +955,54 @@ func (as *AuthServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// doGitHubSignOut deletes the GitHub server token of a user. Users can sign themselves out
+// with their current password, github_auth.sign_out_admins can sign out anyone.
+func (as *AuthServer) doGitHubSignOut(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ar, err := as.ParseRequest(req)
+	if err != nil {
+		glog.Warningf("%sBad request: %s", api.LogPrefix(req.Context()), err)
+		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	user := req.PostFormValue("user")
+	if user == "" {
+		user = ar.Account
+	}
+	if user == "" {
+		http.Error(rw, "Bad request: user is required", http.StatusBadRequest)
+		return
+	}
+	ok := false
+	if user == ar.Account {
+		ok, _, _ = as.gha.AuthenticateContext(ar.context(), ar.Account, ar.Password)
+	}
+	if !ok && containsString(as.config.GitHubAuth.SignOutAdmins, ar.Account) {
+		ok, _, err = as.Authenticate(ar)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Authentication failed (%s)", err), http.StatusInternalServerError)
+			return
+		}
+		ok = ok && !ar.anonymous
+	}
+	if !ok {
+		glog.Warningf("%s%q denied signing out %q", api.LogPrefix(req.Context()), ar.Account, user)
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, as.config.Token.Issuer))
+		http.Error(rw, "Auth failed.", http.StatusUnauthorized)
+		return
+	}
+	if err := as.gha.SignOut(user); err != nil {
+		glog.Errorf("%sFailed to sign out %s: %s", api.LogPrefix(req.Context()), user, err)
+		http.Error(rw, fmt.Sprintf("Failed to sign out: %s", err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("%sGitHub server token of %s deleted by %s", api.LogPrefix(req.Context()), user, ar.Account)
+	fmt.Fprintln(rw, "signed out")
+}
+
 // https://developers.google.com/identity/sign-in/web/server-side-flow
 func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
 	switch {
@@ -468,6 +1016,9 @@ func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
 	case as.oidc != nil:
 		url := as.config.Server.PathPrefix + "/oidc_auth"
 		http.Redirect(rw, req, url, 301)
+	case as.saml != nil:
+		url := as.config.Server.PathPrefix + "/saml_auth"
+		http.Redirect(rw, req, url, 301)
 	case as.glab != nil:
 		url := as.config.Server.PathPrefix + "/gitlab_auth"
 		http.Redirect(rw, req, url, 301)
@@ -477,15 +1028,73 @@ func (as *AuthServer) doIndex(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Liveness check: the process is up and serving.
+func (as *AuthServer) doHealthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(rw, "ok")
+}
+
+// Readiness check: tokens can be issued and all the backends are reachable.
+func (as *AuthServer) doReadyz(rw http.ResponseWriter, req *http.Request) {
+	if err := as.CheckReady(); err != nil {
+		glog.V(2).Infof("%sNot ready: %s", api.LogPrefix(req.Context()), err)
+		http.Error(rw, fmt.Sprintf("Not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(rw, "ok")
+}
+
+// CheckReady returns an error if the server is not ready to serve requests:
+// it is shutting down, has no signing key, or one of the backends is unreachable.
+func (as *AuthServer) CheckReady() error {
+	if atomic.LoadInt32(&as.draining) != 0 {
+		return fmt.Errorf("shutting down")
+	}
+	if as.config.Token.signer == nil {
+		return fmt.Errorf("token signing key is not loaded")
+	}
+	for _, an := range as.authenticators {
+		if hc, ok := an.(api.HealthChecker); ok {
+			if err := hc.CheckHealth(); err != nil {
+				return fmt.Errorf("%s: %s", an.Name(), err)
+			}
+		}
+	}
+	for _, az := range as.authorizers {
+		if hc, ok := az.(api.HealthChecker); ok {
+			if err := hc.CheckHealth(); err != nil {
+				return fmt.Errorf("%s: %s", az.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Drain makes readiness checks fail from now on, so that load balancers stop sending
+// new requests. The server itself keeps serving until it is stopped.
+func (as *AuthServer) Drain() {
+	atomic.StoreInt32(&as.draining, 1)
+}
+
 func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 	ar, err := as.ParseRequest(req)
 	ares := []authzResult{}
 	if err != nil {
-		glog.Warningf("Bad request: %s", err)
+		glog.Warningf("%sBad request: %s", api.LogPrefix(req.Context()), err)
 		http.Error(rw, fmt.Sprintf("Bad request: %s", err), http.StatusBadRequest)
 		return
 	}
-	glog.V(2).Infof("Auth request: %+v", ar)
+	glog.V(2).Infof("%sAuth request: %+v", api.LogPrefix(req.Context()), ar)
+	decision := "error"
+	defer func() { as.audit.Record(newAuditEntry(ar, ares, decision)) }()
+	if !as.config.Token.audienceAllowed(ar.Service) {
+		decision = "deny"
+		as.log.Warning(ar.logFields(logFields{"decision": "deny", "service": ar.Service}),
+			"Service %q is not in token.allowed_audiences: %s", ar.Service, ar)
+		http.Error(rw, fmt.Sprintf("Bad request: service %q is not allowed", ar.Service), http.StatusBadRequest)
+		return
+	}
 	{
 		authnResult, labels, err := as.Authenticate(ar)
 		if err != nil {
@@ -493,7 +1102,8 @@ func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 		if !authnResult {
-			glog.Warningf("Auth failed: %s", *ar)
+			decision = "deny"
+			as.log.Warning(ar.logFields(logFields{"decision": "deny"}), "Auth failed: %s", *ar)
 			rw.Header()["WWW-Authenticate"] = []string{fmt.Sprintf(`Basic realm="%s"`, as.config.Token.Issuer)}
 			http.Error(rw, "Auth failed.", http.StatusUnauthorized)
 			return
@@ -513,7 +1123,7 @@ func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		msg := fmt.Sprintf("Failed to generate token %s", err)
 		http.Error(rw, msg, http.StatusInternalServerError)
-		glog.Errorf("%s: %s", ar, msg)
+		glog.Errorf("%s%s: %s", api.LogPrefix(req.Context()), ar, msg)
 		return
 	}
 	// https://www.oauth.com/oauth2-servers/access-tokens/access-token-response/
@@ -521,7 +1131,15 @@ func (as *AuthServer) doAuth(rw http.ResponseWriter, req *http.Request) {
 	// https://docs.docker.com/registry/spec/auth/token/#token-response-fields
 	// the token should also be in `token` to support older clients
 	result, _ := json.Marshal(&map[string]string{"access_token": token, "token": token})
-	glog.V(3).Infof("%s", result)
+	glog.V(3).Infof("%s%s", api.LogPrefix(req.Context()), result)
+	decision = "allow"
+	if as.config.Server.DenyReasons {
+		for i := range ares {
+			if reason := ares[i].denyReason(); reason != "" {
+				rw.Header().Add("Docker-Auth-Denied", reason)
+			}
+		}
+	}
 	rw.Header().Set("Content-Type", "application/json")
 	rw.Write(result)
 }
@@ -533,6 +1151,9 @@ func (as *AuthServer) Stop() {
 	for _, az := range as.authorizers {
 		az.Stop()
 	}
+	as.audit.Close()
+	as.webhook.Close()
+	as.authzCache.Close()
 	glog.Infof("Server stopped")
 }
 
@@ -0,0 +1,1720 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/auth/token"
+	"github.com/docker/libtrust"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"github.com/cesanta/docker_auth/auth_server/authz"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "HEALTH")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Server.PathPrefix = "/docker"
+	as := &AuthServer{config: c}
+
+	get := func(path string) int {
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw.Code
+	}
+	if code := get("/docker/healthz"); code != http.StatusOK {
+		t.Errorf("healthz: expected 200, got %d", code)
+	}
+	if code := get("/docker/readyz"); code != http.StatusOK {
+		t.Errorf("readyz: expected 200, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusNotFound {
+		t.Errorf("readyz without prefix: expected 404, got %d", code)
+	}
+	as.Drain()
+	if code := get("/docker/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining: expected 503, got %d", code)
+	}
+	if code := get("/docker/healthz"); code != http.StatusOK {
+		t.Errorf("healthz while draining: expected 200, got %d", code)
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "INTROSPECT")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Introspection = &IntrospectionConfig{AllowedClients: []string{"admin"}}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+	}
+	ar := &authRequest{Account: "test", Service: "registry"}
+	ares := []authzResult{{
+		scope:            authScope{Type: "repository", Name: "test/app", Actions: []string{"pull", "push"}},
+		autorizedActions: []string{"pull"},
+	}}
+	tok, err := as.CreateToken(ar, ares)
+	if err != nil {
+		t.Fatalf("CreateToken: %s", err)
+	}
+
+	introspect := func(user, password, tok string) (int, *introspectionResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(url.Values{"token": {tok}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, password)
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		resp := &introspectionResponse{}
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), resp); err != nil {
+				t.Fatalf("bad response %q: %s", rw.Body.String(), err)
+			}
+		}
+		return rw.Code, resp
+	}
+
+	code, resp := introspect("admin", "badmin", tok)
+	if code != http.StatusOK || !resp.Active || resp.Subject != "test" || resp.Audience != "registry" ||
+		resp.Scope != "repository:test/app:pull" {
+		t.Errorf("expected an active token, got %d %+v", code, resp)
+	}
+	if code, resp := introspect("admin", "badmin", tok[:len(tok)-4]+"AAAA"); code != http.StatusOK || resp.Active {
+		t.Errorf("expected a tampered token to be inactive, got %d %+v", code, resp)
+	}
+	if code, _ := introspect("test", "123", tok); code != http.StatusUnauthorized {
+		t.Errorf("expected a client not in allowed_clients to be rejected, got %d", code)
+	}
+	if code, _ := introspect("admin", "wrong", tok); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong client credentials to be rejected, got %d", code)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "JWKS")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Server.PathPrefix = "/docker_auth"
+	as := &AuthServer{config: c}
+	tok, err := as.CreateToken(&authRequest{Account: "test", Service: "registry"}, nil)
+	if err != nil {
+		t.Fatalf("CreateToken: %s", err)
+	}
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/docker_auth/.well-known/jwks.json", nil))
+	if rw.Code != http.StatusOK || rw.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Fatalf("unexpected response: %d %v", rw.Code, rw.Header())
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &set); err != nil || len(set.Keys) != len(c.Token.publicKeys) {
+		t.Fatalf("bad key set %s: %v", rw.Body.String(), err)
+	}
+	trustedKeys := map[string]libtrust.PublicKey{}
+	for _, k := range set.Keys {
+		pk, err := libtrust.UnmarshalPublicKeyJWK(k)
+		if err != nil {
+			t.Fatalf("bad key %s: %s", k, err)
+		}
+		trustedKeys[pk.KeyID()] = pk
+	}
+	t2, err := token.NewToken(tok)
+	if err != nil {
+		t.Fatalf("NewToken: %s", err)
+	}
+	err = t2.Verify(token.VerifyOptions{TrustedIssuers: []string{c.Token.Issuer}, AcceptedAudiences: []string{"registry"}, TrustedKeys: trustedKeys})
+	if err != nil {
+		t.Errorf("expected the token to verify with the published keys: %s", err)
+	}
+}
+
+func TestKMSSigner(t *testing.T) {
+	certFile, keyFile := writeTestCertAndKey(t)
+	defer os.RemoveAll(filepath.Dir(certFile))
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fake KMS holding the key, which signs digests with it in DER as AWS KMS does.
+	var calls int
+	kms := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		var in map[string]string
+		json.NewDecoder(req.Body).Decode(&in)
+		digest, _ := base64.StdEncoding.DecodeString(in["Message"])
+		if req.Header.Get("X-Amz-Target") != "TrentService.Sign" || !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			in["KeyId"] != "alias/docker-auth" || in["MessageType"] != "DIGEST" || in["SigningAlgorithm"] != "ECDSA_SHA_256" || len(digest) != sha256.Size {
+			http.Error(rw, `{"__type": "ValidationException", "message": "bad request"}`, http.StatusBadRequest)
+			return
+		}
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(rw).Encode(map[string]string{"KeyId": in["KeyId"], "Signature": base64.StdEncoding.EncodeToString(sig)})
+	}))
+	defer kms.Close()
+
+	f, err := ioutil.TempFile("", "docker_auth_*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "token:\n  certificate: %q\n  kms:\n    aws: {key_id: alias/docker-auth, region: us-east-1, endpoint: %q, access_key_id: AKID, secret_access_key: secret}\n", certFile, kms.URL)
+	f.Close()
+	c, err := LoadConfig("../../examples/reference.yml,"+f.Name(), "KMS")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	if c.Token.privateKey != nil || c.Token.signer.Algorithm() != "ES256" {
+		t.Fatalf("expected to sign with the KMS using ES256")
+	}
+	as := &AuthServer{config: c}
+	tok, err := as.CreateToken(&authRequest{Account: "test", Service: "registry"}, nil)
+	if err != nil {
+		t.Fatalf("CreateToken: %s", err)
+	}
+	t2, err := token.NewToken(tok)
+	if err != nil {
+		t.Fatalf("NewToken: %s", err)
+	}
+	err = t2.Verify(token.VerifyOptions{TrustedIssuers: []string{c.Token.Issuer}, AcceptedAudiences: []string{"registry"},
+		TrustedKeys: map[string]libtrust.PublicKey{c.Token.publicKey.KeyID(): c.Token.publicKey}})
+	if err != nil || calls != 1 {
+		t.Errorf("expected the token to be signed by the KMS: %v, %d call(s)", err, calls)
+	}
+
+	f, err = ioutil.TempFile("", "docker_auth_*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "token:\n  certificate: %q\n  key: %q\n  kms:\n    aws: {key_id: k}\n", certFile, keyFile)
+	f.Close()
+	errs := CheckConfig("../../examples/reference.yml,"+f.Name(), "KMS")
+	if s := fmt.Sprint(errs); !strings.Contains(s, "token.kms.aws.{key_id,region} are required") || !strings.Contains(s, "mutually exclusive") {
+		t.Errorf("expected a bad kms config to be rejected, got %s", s)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl := newRateLimiter(&RateLimitConfig{Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("10.0.0.1", now); !ok {
+			t.Fatalf("request %d not allowed within the burst", i+1)
+		}
+	}
+	if ok, wait := rl.allow("10.0.0.1", now); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms after the burst, got %t %s", ok, wait)
+	}
+	if ok, _ := rl.allow("10.0.0.2", now); !ok {
+		t.Errorf("expected other clients to have their own bucket")
+	}
+	if ok, _ := rl.allow("10.0.0.1", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("expected a token to be available after 500ms")
+	}
+	rl.allow("10.0.0.1", now.Add(rateLimitSweepInterval))
+	if len(rl.buckets) != 1 {
+		t.Errorf("expected full buckets to be dropped, have %d", len(rl.buckets))
+	}
+
+	c, err := LoadConfig("../../examples/reference.yml", "RATELIMIT")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Server.RealIPHeader = "X-Forwarded-For"
+	as := &AuthServer{config: c, rateLimiter: newRateLimiter(&RateLimitConfig{Rate: 0.1, Burst: 1})}
+	get := func(path, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Forwarded-For", client+", 192.0.2.1")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := get("/.well-known/jwks.json", "192.0.2.2"); rw.Code != http.StatusOK {
+		t.Fatalf("expected the first request to be served, got %d", rw.Code)
+	}
+	if rw := get("/.well-known/jwks.json", "192.0.2.2"); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected 429 with Retry-After: 10, got %d %v", rw.Code, rw.Header())
+	}
+	if rw := get("/healthz", "192.0.2.2"); rw.Code != http.StatusOK {
+		t.Errorf("expected health checks not to be limited, got %d", rw.Code)
+	}
+}
+
+func TestAuthnStopOnNoMatch(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := api.PasswordString(hash)
+	first := authn.NewStaticUserAuth(map[string]*authn.Requirements{"alice": {Password: &pw}})
+	second := authn.NewStaticUserAuth(map[string]*authn.Requirements{"bob": {Password: &pw}})
+	as := &AuthServer{authenticators: []api.Authenticator{first, second}, config: &Config{}}
+	authenticate := func(user string) bool {
+		ok, _, err := as.Authenticate(&authRequest{User: user, Account: user, Password: "secret"})
+		if err != nil {
+			t.Fatalf("Authenticate: %s", err)
+		}
+		return ok
+	}
+	if !authenticate("alice") || !authenticate("bob") {
+		t.Errorf("expected users of both authenticators to be accepted")
+	}
+	as.authnStop = []bool{true, false}
+	if !authenticate("alice") || authenticate("bob") {
+		t.Errorf("expected users unknown to the first authenticator to be denied")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "VERSION")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	Version = "1.2.3"
+	defer func() { Version = "" }()
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		configHash:     configHash(c),
+	}
+	get := func(user, password string) (int, *versionResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/version", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		var resp versionResponse
+		json.Unmarshal(rw.Body.Bytes(), &resp)
+		return rw.Code, &resp
+	}
+	code, resp := get("", "")
+	if code != http.StatusOK || resp.Version != "1.2.3" || !strings.HasPrefix(resp.ConfigHash, "sha256:") {
+		t.Fatalf("unexpected response: %d %+v", code, resp)
+	}
+
+	for _, p := range c.Users {
+		if p.Password != nil {
+			ps := api.PasswordString("changed")
+			p.Password = &ps
+		}
+	}
+	if configHash(c) != resp.ConfigHash {
+		t.Errorf("expected passwords not to change the config hash")
+	}
+	c.Token.Issuer += " (changed)"
+	if configHash(c) == resp.ConfigHash {
+		t.Errorf("expected the token issuer to change the config hash")
+	}
+
+	c.Version = &VersionConfig{AllowedClients: []string{"admin"}}
+	if code, _ := get("", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous requests to be rejected, got %d", code)
+	}
+	if code, _ := get("test", "123"); code != http.StatusUnauthorized {
+		t.Errorf("expected clients not allowed to be rejected, got %d", code)
+	}
+	if code, _ := get("admin", "badmin"); code != http.StatusOK {
+		t.Errorf("expected allowed clients to be served, got %d", code)
+	}
+}
+
+func TestCheckACL(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "CHECKACL")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	results, err := CheckACL(c, &ACLCheckRequest{
+		Account: "test",
+		IP:      net.ParseIP("10.0.0.1"),
+		Scopes:  []string{"repository:test-foo:push,pull repository:other:pull"},
+	})
+	if err != nil {
+		t.Fatalf("CheckACL: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+	if r := results[0]; r.Scope != "repository:test-foo:pull,push" || strings.Join(r.Granted, ",") != "pull,push" ||
+		!strings.HasSuffix(r.RuleName, "(1)") || r.DenyReason != "" {
+		t.Errorf("unexpected result for test-foo: %+v", r)
+	}
+	if r := results[1]; len(r.Granted) != 0 || !strings.HasSuffix(r.RuleName, "(2)") || r.DenyReason == "" {
+		t.Errorf("unexpected result for other: %+v", r)
+	}
+	if _, err := CheckACL(c, &ACLCheckRequest{Account: "test", Scopes: []string{"repository:foo"}}); err == nil {
+		t.Errorf("expected a malformed scope to be rejected")
+	}
+}
+
+func TestCreateTokenLabelClaims(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "LABELCLAIMS")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Token.LabelClaims = map[string]string{"teams": "groups", "missing": "nothing"}
+	as := &AuthServer{config: c}
+	ar := &authRequest{Account: "test", Service: "registry", Labels: api.Labels{"teams": {"dev"}, "other": {"x"}}}
+	tok, err := as.CreateToken(ar, nil)
+	if err != nil {
+		t.Fatalf("CreateToken: %s", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(tok, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if groups, ok := claims["groups"].([]interface{}); !ok || len(groups) != 1 || groups[0] != "dev" {
+		t.Errorf("expected groups claim [dev], got %v", claims["groups"])
+	}
+	for _, claim := range []string{"nothing", "other", "teams"} {
+		if _, found := claims[claim]; found {
+			t.Errorf("unexpected claim %s", claim)
+		}
+	}
+	if claims["sub"] != "test" || claims["exp"].(float64) <= claims["iat"].(float64) {
+		t.Errorf("standard claims are wrong: %v", claims)
+	}
+}
+
+func TestAllowedAudiences(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "AUDIENCES")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Token.AllowedAudiences = []string{"registry"}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+	}
+	for service, want := range map[string]int{
+		"registry":       http.StatusOK,
+		"other-registry": http.StatusBadRequest,
+		"":               http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service="+url.QueryEscape(service), nil)
+		req.SetBasicAuth("admin", "badmin")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("service %q: expected %d, got %d", service, want, rw.Code)
+		}
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "JSONLOG")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	var buf bytes.Buffer
+	jsonLogOut = &buf
+	defer func() { jsonLogOut = os.Stderr }()
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		log:            newEventLogger("json"),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth?service=registry", nil)
+	req.SetBasicAuth("admin", "wrong-password")
+	rw := httptest.NewRecorder()
+	as.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rw.Code)
+	}
+	if strings.Contains(buf.String(), "wrong-password") {
+		t.Errorf("password leaked into the log: %s", buf.String())
+	}
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line %q is not JSON: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("nothing logged")
+	}
+	e := entries[0]
+	for k, want := range map[string]interface{}{
+		"level":         "warning",
+		"user":          "admin",
+		"authenticator": "static",
+		"decision":      "deny",
+		"remote_ip":     "192.0.2.1",
+	} {
+		if e[k] != want {
+			t.Errorf("%s: expected %v, got %v", k, want, e[k])
+		}
+	}
+	if _, ok := e["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing: %v", e)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "AUDIT")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	f := filepath.Join(t.TempDir(), "audit.log")
+	al, err := newAuditLog(&AuditConfig{File: f, BufferSize: 10})
+	if err != nil {
+		t.Fatalf("newAuditLog: %s", err)
+	}
+	acl, err := authz.NewACLAuthorizer(c.ACL, c.ACLAllowDuplicatePriorities)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		authorizers:    []api.Authorizer{acl},
+		audit:          al,
+	}
+	for _, pw := range []string{"123", "wrong-password"} {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service=registry&scope=repository:test-app:pull,push&scope=repository:other:pull", nil)
+		req.SetBasicAuth("test", pw)
+		as.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	as.Stop()
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if strings.Contains(string(b), "wrong-password") || strings.Contains(string(b), `"123"`) {
+		t.Errorf("password leaked into the audit log: %s", b)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %s", len(lines), b)
+	}
+	var e auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("bad entry %q: %s", lines[0], err)
+	}
+	if e.Subject != "test" || e.RemoteIP != "192.0.2.1" || e.Authenticator != "static" || e.Decision != "allow" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	if len(e.Scopes) != 2 {
+		t.Fatalf("expected 2 scopes, got %+v", e.Scopes)
+	}
+	if s := e.Scopes[0]; s.Requested != "repository:test-app:pull,push" || len(s.Granted) != 2 || !strings.Contains(s.Rule, "test-*") {
+		t.Errorf("unexpected scope: %+v", s)
+	}
+	if s := e.Scopes[1]; len(s.Granted) != 0 || !strings.Contains(s.Rule, "nothing else. (2)") {
+		t.Errorf("unexpected scope: %+v", s)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("bad entry %q: %s", lines[1], err)
+	}
+	if e.Decision != "deny" || e.Authenticator != "" || len(e.Scopes[0].Granted) != 0 {
+		t.Errorf("unexpected entry for failed login: %+v", e)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "WEBHOOK")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	var mu sync.Mutex
+	var bodies [][]byte
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// The first delivery fails and is retried.
+		if calls == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if sig := req.Header.Get(webhookSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", sig)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+	wc := &WebhookConfig{URL: srv.URL, Secret: "s3cret"}
+	if errs := wc.validate(); len(errs) > 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	wh := newWebhook(wc)
+	wh.retryDelay = time.Millisecond
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		log:            newEventLogger(""),
+		webhook:        wh,
+	}
+	for _, pw := range []string{"123", "wrong-password"} {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service=registry", nil)
+		req.SetBasicAuth("test", pw)
+		as.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// Delivers the remaining events.
+	as.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 3 || len(bodies) != 2 {
+		t.Fatalf("expected 2 events in 3 calls, got %d calls: %q", calls, bodies)
+	}
+	for i, want := range []string{"allow", "deny"} {
+		if strings.Contains(string(bodies[i]), "wrong-password") || strings.Contains(string(bodies[i]), `"123"`) {
+			t.Errorf("password leaked into the event: %s", bodies[i])
+		}
+		var e authnEvent
+		if err := json.Unmarshal(bodies[i], &e); err != nil {
+			t.Fatalf("bad event %s: %s", bodies[i], err)
+		}
+		if e.User != "test" || e.Authenticator != "static" || e.Decision != want || e.RemoteIP != "192.0.2.1" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "REQUESTID")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	as := &AuthServer{config: c}
+	get := func(id string) string {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Header().Get("X-Request-ID")
+	}
+	if id := get("abc-123"); id != "abc-123" {
+		t.Errorf("expected the incoming ID to be echoed, got %q", id)
+	}
+	id1, id2 := get(""), get("")
+	if id1 == "" || id1 == id2 {
+		t.Errorf("expected unique generated IDs, got %q and %q", id1, id2)
+	}
+	if id := get("bad id\r\n"); id == "" || strings.ContainsAny(id, " \r\n") {
+		t.Errorf("expected a malformed ID to be replaced, got %q", id)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "REVOKE")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Revocation = &RevocationConfig{AllowedClients: []string{"admin"}}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		revocations:    NewMemoryRevocationStore(),
+	}
+	newToken := func(account string) string {
+		tok, err := as.CreateToken(&authRequest{Account: account, Service: "registry"}, nil)
+		if err != nil {
+			t.Fatalf("CreateToken: %s", err)
+		}
+		return tok
+	}
+	revoke := func(form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "badmin")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	tok1, tok2, tok3 := newToken("test"), newToken("test"), newToken("other")
+	jti1 := as.introspect(context.Background(), tok1).JWTID
+	if jti1 == "" || jti1 == as.introspect(context.Background(), tok2).JWTID {
+		t.Fatalf("expected unique token IDs")
+	}
+	if code := revoke(url.Values{"jti": {jti1}}); code != http.StatusOK {
+		t.Fatalf("revoke jti: %d", code)
+	}
+	if as.introspect(context.Background(), tok1).Active || !as.introspect(context.Background(), tok2).Active {
+		t.Errorf("expected only the first token to be revoked")
+	}
+	if code := revoke(url.Values{"sub": {"test"}}); code != http.StatusOK {
+		t.Fatalf("revoke sub: %d", code)
+	}
+	if as.introspect(context.Background(), tok2).Active || !as.introspect(context.Background(), tok3).Active {
+		t.Errorf("expected all tokens of test and none of other to be revoked")
+	}
+	if code := revoke(url.Values{"token": {tok3}}); code != http.StatusOK {
+		t.Fatalf("revoke token: %d", code)
+	}
+	if as.introspect(context.Background(), tok3).Active {
+		t.Errorf("expected the token to be revoked")
+	}
+
+	// Revocations are kept by the store, which a reloaded server shares, and not by the server.
+	reloaded := &AuthServer{config: c, revocations: as.revocations}
+	if reloaded.introspect(context.Background(), tok1).Active {
+		t.Errorf("expected the token to stay revoked after a reload")
+	}
+	other := &AuthServer{config: c, revocations: NewMemoryRevocationStore()}
+	if !other.introspect(context.Background(), tok1).Active {
+		t.Errorf("expected the token not to be revoked for a server with its own store")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "READONLY")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.ReadOnly = &ReadOnlyConfig{AllowedClients: []string{"admin"}}
+	acl, err := authz.NewACLAuthorizer(c.ACL, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		authorizers:    []api.Authorizer{acl},
+		readOnly:       &ReadOnlyState{},
+	}
+	setReadOnly := func(enabled string) int {
+		req := httptest.NewRequest(http.MethodPost, "/read_only", strings.NewReader(url.Values{"enabled": {enabled}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "badmin")
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	granted := func() []string {
+		ar := &authRequest{Account: "admin", Scopes: []authScope{
+			{Type: "repository", Name: "foo", Actions: []string{"delete", "pull", "push"}},
+			{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		}}
+		ares, err := as.Authorize(ar)
+		if err != nil {
+			t.Fatalf("Authorize: %s", err)
+		}
+		return append(ares[0].autorizedActions, ares[1].autorizedActions...)
+	}
+
+	if code := setReadOnly("true"); code != http.StatusOK {
+		t.Fatalf("enable read-only mode: %d", code)
+	}
+	if g := strings.Join(granted(), ","); g != "pull,*" {
+		t.Errorf("expected only pull and the catalog in read-only mode, got %s", g)
+	}
+	if code := setReadOnly("false"); code != http.StatusOK {
+		t.Fatalf("disable read-only mode: %d", code)
+	}
+	if g := strings.Join(granted(), ","); g != "delete,pull,push,*" {
+		t.Errorf("expected everything to be granted, got %s", g)
+	}
+	if code := setReadOnly("maybe"); code != http.StatusBadRequest {
+		t.Errorf("expected a bad value to be rejected, got %d", code)
+	}
+
+	// The mode survives a reload of an unchanged config, but is not shared with other servers.
+	if code := setReadOnly("true"); code != http.StatusOK {
+		t.Fatalf("enable read-only mode: %d", code)
+	}
+	state := as.readOnly
+	as = &AuthServer{config: c, authenticators: as.authenticators, authorizers: as.authorizers, readOnly: state}
+	as.readOnly.configure(c.ReadOnly)
+	if g := strings.Join(granted(), ","); g != "pull,*" {
+		t.Errorf("expected read-only mode to survive a reload, got %s", g)
+	}
+	as.readOnly = &ReadOnlyState{}
+	as.readOnly.configure(c.ReadOnly)
+	if g := strings.Join(granted(), ","); g != "delete,pull,push,*" {
+		t.Errorf("expected read-only mode to be off for another server, got %s", g)
+	}
+	if !state.enabled() {
+		t.Errorf("expected read-only mode to stay on for the first server")
+	}
+}
+
+func TestStaticUsersFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_auth_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.yml")
+	write := func(s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ci:\n  labels: {group: [ci]}\n")
+	c, err := LoadConfig("../../examples/reference.yml", "USERSFILE")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	sua, err := authn.NewStaticUserFileAuth(file, c.Users)
+	if err != nil {
+		t.Fatalf("NewStaticUserFileAuth: %s", err)
+	}
+	defer sua.Stop()
+	authenticate := func(user, password string) bool {
+		ok, _, _ := sua.Authenticate(user, api.PasswordString(password))
+		return ok
+	}
+	if !authenticate("ci", "") || !authenticate("admin", "badmin") {
+		t.Fatalf("expected users from both the file and the config")
+	}
+
+	write("ci: [\n")
+	time.Sleep(1500 * time.Millisecond)
+	if !authenticate("ci", "") {
+		t.Errorf("expected the previous users to remain after an invalid reload")
+	}
+
+	write("ci2: {}\n")
+	for deadline := time.Now().Add(5 * time.Second); !authenticate("ci2", "") && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !authenticate("ci2", "") || authenticate("ci", "") {
+		t.Errorf("expected the users file to be reloaded")
+	}
+	if !authenticate("admin", "badmin") {
+		t.Errorf("expected the users from the config to remain")
+	}
+}
+
+func TestStaticUsersFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	files := []string{
+		write("team-a.yml", "alice: {labels: {team: [a]}}\nshared: {labels: {team: [a]}}\n"),
+		write("team-b.yml", "bob: {labels: {team: [b]}}\nshared: {labels: {team: [b]}}\n"),
+	}
+	team := func(sua api.Authenticator, user string) string {
+		ok, labels, _ := sua.Authenticate(user, "")
+		if !ok || len(labels["team"]) != 1 {
+			return ""
+		}
+		return labels["team"][0]
+	}
+
+	if _, err := authn.NewStaticUserFilesAuth(files, nil, authn.UsersConflictError); err == nil || !strings.Contains(err.Error(), "shared") {
+		t.Errorf("expected an error about the duplicate user, got %v", err)
+	}
+	sua, err := authn.NewStaticUserFilesAuth(files, nil, authn.UsersConflictLastWins)
+	if err != nil {
+		t.Fatalf("NewStaticUserFilesAuth: %s", err)
+	}
+	defer sua.Stop()
+	if team(sua, "alice") != "a" || team(sua, "bob") != "b" || team(sua, "shared") != "b" {
+		t.Errorf("expected users from both files, with the last one winning")
+	}
+
+	write("team-b.yml", "bob: [\n")
+	write("team-a.yml", "alice2: {labels: {team: [a]}}\n")
+	for deadline := time.Now().Add(5 * time.Second); team(sua, "alice2") == "" && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if team(sua, "alice2") != "a" || team(sua, "alice") != "" {
+		t.Errorf("expected the first file to be reloaded")
+	}
+	if team(sua, "bob") != "b" || team(sua, "shared") != "b" {
+		t.Errorf("expected the users of the invalid file to remain")
+	}
+}
+
+func TestBcryptRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_auth_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.yml")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	users := fmt.Sprintf("# CI runners\nci:\n  password: %q  # secret\n", hash)
+	if err := ioutil.WriteFile(file, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig("../../examples/reference.yml", "REHASH")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	sua, err := authn.NewStaticUserFileAuth(file, c.Users)
+	if err != nil {
+		t.Fatalf("NewStaticUserFileAuth: %s", err)
+	}
+	defer sua.Stop()
+	sua.SetRehashCost(bcrypt.MinCost + 2)
+	// The admin's hash is in the config, which is read-only.
+	if ok, _, err := sua.Authenticate("admin", "badmin"); !ok || err != nil {
+		t.Fatalf("expected admin to log in, got %t, %v", ok, err)
+	}
+	if ok, _, err := sua.Authenticate("ci", "secret"); !ok || err != nil {
+		t.Fatalf("expected ci to log in, got %t, %v", ok, err)
+	}
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if data, err = ioutil.ReadFile(file); err == nil && string(data) != users {
+			break
+		}
+	}
+	prefix := fmt.Sprintf("# CI runners\nci:\n  password: \"$2a$%02d$", bcrypt.MinCost+2)
+	if !strings.HasPrefix(string(data), prefix) || !strings.HasSuffix(string(data), "\"  # secret\n") {
+		t.Fatalf("expected the hash to be upgraded in place, got %q", data)
+	}
+	newHash := strings.TrimSuffix(strings.TrimPrefix(string(data), "# CI runners\nci:\n  password: \""), "\"  # secret\n")
+	if err := bcrypt.CompareHashAndPassword([]byte(newHash), []byte("secret")); err != nil {
+		t.Errorf("bad upgraded hash %q: %s", newHash, err)
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_auth_htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	labelsFile := filepath.Join(dir, "labels.yml")
+	write := func(file, s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(file, "# comment\n"+
+		"apr:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n"+ // secret
+		"md5:$1$abc$9dV135Rc3U8Xbm2DxadgF0\n"+ // hunter2
+		"bcrypt:$2y$05$LO.vzwpWC5LZGqThvEfznu8qhb5SGqvBSWY1J3yZ4AxtMRZ3kN5jC\n") // badmin
+	write(labelsFile, "apr: {group: [admins]}\n")
+	c := &authn.HtpasswdAuthConfig{File: file, LabelsFile: labelsFile}
+	if err := c.Validate("htpasswd_auth"); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	ha, err := authn.NewHtpasswdAuth(c)
+	if err != nil {
+		t.Fatalf("NewHtpasswdAuth: %s", err)
+	}
+	defer ha.Stop()
+	authenticate := func(user, password string) bool {
+		ok, _, _ := ha.Authenticate(user, api.PasswordString(password))
+		return ok
+	}
+	if !authenticate("apr", "secret") || !authenticate("md5", "hunter2") || !authenticate("bcrypt", "badmin") {
+		t.Errorf("expected all the hash formats to work")
+	}
+	if authenticate("apr", "Secret") || authenticate("md5", "") || authenticate("bcrypt", "secret") {
+		t.Errorf("expected wrong passwords to fail")
+	}
+	if _, _, err := ha.Authenticate("other", "secret"); err != api.NoMatch {
+		t.Errorf("expected no match for an unknown user, got %v", err)
+	}
+	if _, l, _ := ha.Authenticate("apr", "secret"); len(l["group"]) != 1 || l["group"][0] != "admins" {
+		t.Errorf("expected labels from the labels file, got %v", l)
+	}
+
+	write(file, "plain:secret\n")
+	if err := c.Validate("htpasswd_auth"); err == nil {
+		t.Errorf("expected an unsupported hash to be rejected")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if !authenticate("apr", "secret") {
+		t.Errorf("expected the previous users to remain after an invalid reload")
+	}
+
+	write(file, "apr2:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n")
+	for deadline := time.Now().Add(5 * time.Second); !authenticate("apr2", "secret") && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !authenticate("apr2", "secret") || authenticate("apr", "secret") {
+		t.Errorf("expected the htpasswd file to be reloaded")
+	}
+}
+
+// The secret of the RFC 6238 test vectors, "12345678901234567890".
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// totpCode returns the TOTP code of testTOTPSecret at a time.
+func totpCode(at time.Time) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, []byte("12345678901234567890"))
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func TestStaticUserTOTP(t *testing.T) {
+	const secret = testTOTPSecret
+	code := totpCode
+	badmin := api.PasswordString("$2y$05$LO.vzwpWC5LZGqThvEfznu8qhb5SGqvBSWY1J3yZ4AxtMRZ3kN5jC")
+	users := map[string]*authn.Requirements{"admin": {Password: &badmin, TOTPSecret: secret}}
+	if err := authn.ValidateUsers(users); err != nil {
+		t.Fatalf("ValidateUsers: %s", err)
+	}
+	if err := authn.ValidateUsers(map[string]*authn.Requirements{"admin": {TOTPSecret: "not base32!"}}); err == nil {
+		t.Errorf("expected a bad secret to be rejected")
+	}
+	sua := authn.NewStaticUserAuth(users)
+	now := time.Now()
+	for _, tc := range []struct {
+		password string
+		ok       bool
+		err      error
+	}{
+		{"badmin:" + code(now), true, nil},
+		{"badmin:" + code(now.Add(-30*time.Second)), true, nil},
+		{"badmin:" + code(now.Add(-5*time.Minute)), false, api.WrongTOTPCode},
+		{"badmin", false, api.NoTOTPCode},
+		{"badmin:12345", false, api.NoTOTPCode},
+		{"wrong:" + code(now), false, nil},
+	} {
+		ok, _, err := sua.Authenticate("admin", api.PasswordString(tc.password))
+		if ok != tc.ok || err != tc.err {
+			t.Errorf("%s: expected %t, %v, got %t, %v", tc.password, tc.ok, tc.err, ok, err)
+		}
+	}
+	if s := users["admin"].String(); strings.Contains(s, secret) {
+		t.Errorf("expected the secret to be masked: %s", s)
+	}
+}
+
+func TestConditionalMFA(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := api.PasswordString(hash)
+	admins := api.Labels{"groups": {"admins"}}
+	users := authn.NewStaticUserAuth(map[string]*authn.Requirements{
+		"alice": {Password: &pw, Labels: admins, TOTPSecret: testTOTPSecret},
+		"bob":   {Password: &pw, Labels: api.Labels{"groups": {"devs"}}},
+		"carol": {Password: &pw, Labels: admins},
+	})
+	// Stands in for a federated authenticator, which knows nothing about TOTP.
+	federated := authn.NewStaticUserAuth(map[string]*authn.Requirements{
+		"dave": {Password: &pw, Labels: admins},
+	})
+	mc := &authn.MFAConfig{
+		RequiredLabels: map[string][]string{"groups": {"admins"}},
+		TOTPSecrets:    map[string]string{"dave": testTOTPSecret},
+	}
+	if err := mc.Validate("mfa"); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	if err := (&authn.MFAConfig{RequiredLabels: mc.RequiredLabels, TOTPSecrets: map[string]string{"dave": "not base32!"}}).Validate("mfa"); err == nil {
+		t.Errorf("expected a bad secret to be rejected")
+	}
+	as := &AuthServer{
+		authenticators: []api.Authenticator{users, federated},
+		config:         &Config{},
+		mfa:            authn.NewMFA(mc, users),
+	}
+	now := time.Now()
+	for _, tc := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret:" + totpCode(now), true},
+		{"alice", "secret", false},
+		{"bob", "secret", true},
+		{"carol", "secret", false},
+		{"carol", "secret:" + totpCode(now), false},
+		{"dave", "secret:" + totpCode(now), true},
+		{"dave", "secret:" + totpCode(now.Add(-5*time.Minute)), false},
+		{"dave", "secret", false},
+		{"dave", "wrong:" + totpCode(now), false},
+	} {
+		ok, _, err := as.Authenticate(&authRequest{User: tc.user, Account: tc.user, Password: api.PasswordString(tc.password)})
+		if err != nil || ok != tc.ok {
+			t.Errorf("%s %s: expected %t, got %t, %v", tc.user, tc.password, tc.ok, ok, err)
+		}
+	}
+}
+
+func TestStaticUserPatterns(t *testing.T) {
+	labels := func(group string) *authn.Requirements {
+		return &authn.Requirements{Labels: api.Labels{"group": {group}}}
+	}
+	sua := authn.NewStaticUserAuth(map[string]*authn.Requirements{
+		"ci-runner-01": labels("exact"),
+		"ci-runner-*":  labels("runners"),
+		"ci-*":         labels("ci"),
+	})
+	for user, want := range map[string]string{
+		"ci-runner-01": "exact",
+		"ci-runner-02": "runners",
+		"ci-deploy":    "ci",
+		"":             "",
+		"other":        "",
+	} {
+		ok, l, err := sua.Authenticate(user, "")
+		if want == "" {
+			if ok || err != api.NoMatch {
+				t.Errorf("%q: expected no match, got %t, %v", user, ok, err)
+			}
+		} else if !ok || len(l["group"]) != 1 || l["group"][0] != want {
+			t.Errorf("%q: expected group %s, got %t, %v, %v", user, want, ok, l, err)
+		}
+	}
+}
+
+func TestStaticUserDummyHash(t *testing.T) {
+	const cost = bcrypt.MinCost + 6
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), cost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	pw := api.PasswordString(hash)
+	sua := authn.NewStaticUserAuth(map[string]*authn.Requirements{"alice": {Password: &pw}})
+	timed := func(user string) (time.Duration, error) {
+		start := time.Now()
+		_, _, err := sua.Authenticate(user, "wrong")
+		return time.Since(start), err
+	}
+	known, _ := timed("alice")
+	if d, _ := timed("bob"); d > known/4 {
+		t.Skipf("unknown users are not noticeably faster to reject (%s vs %s), nothing to compare", d, known)
+	}
+	if err := sua.SetDummyHash(cost); err != nil {
+		t.Fatalf("SetDummyHash: %s", err)
+	}
+	d, err := timed("bob")
+	if err != api.NoMatch {
+		t.Errorf("expected no match for an unknown user, got %v", err)
+	}
+	if d < known/2 {
+		t.Errorf("expected an unknown user to take about as long as a wrong password: %s vs %s", d, known)
+	}
+	if ok, _, err := sua.Authenticate("alice", "secret"); !ok || err != nil {
+		t.Errorf("expected alice to authenticate, got %t, %v", ok, err)
+	}
+}
+
+func TestStaticUserCaseInsensitive(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "CASEINSENSITIVE")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Users["ci-*"] = &authn.Requirements{}
+	sua := authn.NewStaticUserAuth(c.Users)
+	if ok, _, _ := sua.Authenticate("Admin", "badmin"); ok {
+		t.Errorf("expected user names to be case sensitive by default")
+	}
+	sua.SetCaseInsensitive()
+	for _, user := range []string{"Admin", "ADMIN", "admin"} {
+		if ok, _, err := sua.Authenticate(user, "badmin"); !ok {
+			t.Errorf("%s: expected to authenticate, got %v", user, err)
+		}
+	}
+	if ok, _, err := sua.Authenticate("CI-Runner", ""); !ok {
+		t.Errorf("expected patterns to match regardless of case, got %v", err)
+	}
+
+	// The ACL sees the same account however the user spelled it.
+	c.CaseInsensitiveUsernames = true
+	c.Server.DenyReasons = true
+	admin := "admin"
+	acl, err := authz.NewACLAuthorizer(authz.ACL{
+		{Match: &authz.MatchConditions{Account: &admin}, Actions: &[]string{"*"}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{sua},
+		authorizers:    []api.Authorizer{acl},
+		log:            newEventLogger(c.Server.LogFormat),
+	}
+	for _, user := range []string{"Admin", "ADMIN", "admin"} {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service=registry&scope=repository:app:pull,push", nil)
+		req.SetBasicAuth(user, "badmin")
+		rr := httptest.NewRecorder()
+		as.ServeHTTP(rr, req)
+		if denied := rr.Header()["Docker-Auth-Denied"]; rr.Code != http.StatusOK || len(denied) != 0 {
+			t.Errorf("%s: expected pull and push to be granted, got %d %q", user, rr.Code, denied)
+		}
+	}
+}
+
+func TestStaticUserDisabled(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "DISABLED")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.Users["admin"].Disabled = true
+	sua := authn.NewStaticUserAuth(c.Users)
+	if ok, _, err := sua.Authenticate("admin", "badmin"); ok || err != nil {
+		t.Errorf("expected a disabled user to be denied, got %t, %v", ok, err)
+	}
+	if s := c.Users["admin"].String(); !strings.Contains(s, `"disabled":true`) || strings.Contains(s, "$2y$") {
+		t.Errorf("unexpected string for a disabled user: %s", s)
+	}
+}
+
+func TestCrossRepositoryMount(t *testing.T) {
+	teamA, teamB := "team-a/*", "team-b/*"
+	acl := authz.ACL{
+		{Match: &authz.MatchConditions{Name: &teamB}, Actions: &[]string{"*"}},
+		{Match: &authz.MatchConditions{Name: &teamA, MountTo: &teamB}, Actions: &[]string{"pull"}},
+	}
+	aa, err := authz.NewACLAuthorizer(acl, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{authorizers: []api.Authorizer{aa}, log: newEventLogger("")}
+	authorize := func(scopes ...string) string {
+		ar := &authRequest{ctx: context.Background()}
+		for _, s := range scopes {
+			parts := strings.Split(s, ":")
+			ar.Scopes = append(ar.Scopes, authScope{Type: "repository", Name: parts[0], Actions: strings.Split(parts[1], ",")})
+		}
+		ares, err := as.Authorize(ar)
+		if err != nil {
+			t.Fatalf("Authorize: %s", err)
+		}
+		var granted []string
+		for _, r := range ares {
+			granted = append(granted, r.scope.Name+":"+strings.Join(r.autorizedActions, ","))
+		}
+		return strings.Join(granted, " ")
+	}
+	// The source is listed first, as docker does.
+	if g := authorize("team-a/base:pull", "team-b/app:pull,push"); g != "team-a/base:pull team-b/app:pull,push" {
+		t.Errorf("expected the mount to be granted, got %s", g)
+	}
+	if g := authorize("team-a/base:pull"); g != "team-a/base:" {
+		t.Errorf("expected a plain pull to be denied, got %s", g)
+	}
+	if g := authorize("team-a/base:pull", "team-c/app:pull,push"); g != "team-a/base: team-c/app:" {
+		t.Errorf("expected a mount into a repository without push to be denied, got %s", g)
+	}
+	if g := authorize("team-a/base:pull", "team-b/app:pull,push", "team-b/other:push"); g != "team-a/base: team-b/app:pull,push team-b/other:push" {
+		t.Errorf("expected an ambiguous mount to be denied, got %s", g)
+	}
+}
+
+func TestDenyReasons(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "DENYREASONS")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	acl, err := authz.NewACLAuthorizer(c.ACL, c.ACLAllowDuplicatePriorities)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		authorizers:    []api.Authorizer{acl},
+		log:            newEventLogger(c.Server.LogFormat),
+	}
+	get := func() http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service=registry&scope=repository:test-app:pull,push&scope=repository:other:pull", nil)
+		req.SetBasicAuth("test", "123")
+		rr := httptest.NewRecorder()
+		as.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected response: %d %s", rr.Code, rr.Body)
+		}
+		return rr.Header()
+	}
+	if h := get()["Docker-Auth-Denied"]; h != nil {
+		t.Errorf("expected no deny reasons by default, got %q", h)
+	}
+	c.Server.DenyReasons = true
+	h := get()["Docker-Auth-Denied"]
+	if len(h) != 1 || h[0] != `repository:other:pull denied by rule "User \"test\" has full access to test-* images but nothing else. (2)"` {
+		t.Errorf("unexpected deny reasons: %q", h)
+	}
+	if strings.Contains(strings.Join(h, " "), "123") {
+		t.Errorf("password leaked into the deny reason: %q", h)
+	}
+
+	r := authzResult{scope: authScope{Type: "repository", Name: "foo", Actions: []string{"pull", "push"}}, autorizedActions: []string{"pull"}}
+	if reason := r.denyReason(); reason != "repository:foo:push denied by no matching rule" {
+		t.Errorf("unexpected deny reason: %s", reason)
+	}
+	r.autorizedActions = []string{"pull", "push"}
+	if reason := r.denyReason(); reason != "" {
+		t.Errorf("expected no deny reason, got %s", reason)
+	}
+}
+
+type fakeRedis struct {
+	values map[string]string
+}
+
+func (r *fakeRedis) Get(key string) *redis.StringCmd {
+	v, found := r.values[key]
+	if !found {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (r *fakeRedis) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	r.values[key] = string(value.([]byte))
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (r *fakeRedis) Del(keys ...string) *redis.IntCmd {
+	for _, k := range keys {
+		delete(r.values, k)
+	}
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func (r *fakeRedis) Ping() *redis.StatusCmd { return redis.NewStatusResult("PONG", nil) }
+func (r *fakeRedis) Close() error           { return nil }
+
+type countingAuthorizer struct {
+	api.Authorizer
+	calls int
+}
+
+func (ca *countingAuthorizer) Authorize(ai *api.AuthRequestInfo) ([]string, error) {
+	ca.calls++
+	return ca.Authorizer.Authorize(ai)
+}
+
+func TestAuthzLogSampling(t *testing.T) {
+	name := "foo/*"
+	aa, err := authz.NewACLAuthorizer(authz.ACL{{Match: &authz.MatchConditions{Name: &name}, Actions: &[]string{"pull"}}}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	var buf bytes.Buffer
+	jsonLogOut = &buf
+	defer func() { jsonLogOut = os.Stderr }()
+	as := &AuthServer{
+		authorizers:     []api.Authorizer{aa},
+		log:             newEventLogger("json"),
+		authzLogSampler: newAuthzLogSampler(&AuthzLogSamplingConfig{Deny: 3, Allow: 2}),
+	}
+	for _, repo := range []string{"foo/bar", "foo/bar", "foo/bar", "foo/bar", "bar/baz", "bar/baz", "bar/baz", "bar/baz", "baz/qux"} {
+		ar := &authRequest{ctx: context.Background(), Account: "alice", RemoteIP: net.IPv4(127, 0, 0, 1),
+			Scopes: []authScope{{Type: "repository", Name: repo, Actions: []string{"pull"}}}}
+		if _, err := as.Authorize(ar); err != nil {
+			t.Fatalf("Authorize: %s", err)
+		}
+	}
+	logged := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line %q is not JSON: %s", line, err)
+		}
+		if e["level"] != "info" {
+			t.Errorf("unexpected entry: %s", line)
+		}
+		logged[fmt.Sprintf("%s %s", e["decision"], e["scope"])]++
+	}
+	// The first decision of each repository is logged, then every n-th.
+	want := map[string]int{"allow repository:foo/bar": 2, "deny repository:bar/baz": 2, "deny repository:baz/qux": 1}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("expected %v to be logged, got %v", want, logged)
+	}
+	if err := (&AuthzLogSamplingConfig{Deny: -1}).Validate("authz_log_sampling"); err == nil {
+		t.Errorf("expected a negative rate to be rejected")
+	}
+}
+
+func TestAuthzCache(t *testing.T) {
+	name, comment := "foo/*", "foo readers"
+	acl := authz.ACL{{Match: &authz.MatchConditions{Name: &name}, Actions: &[]string{"pull"}, Comment: &comment}}
+	aa, err := authz.NewACLAuthorizer(acl, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	ca := &countingAuthorizer{Authorizer: aa}
+	cache := &authzCache{client: &fakeRedis{values: map[string]string{}}, ttl: time.Minute, prefix: "test:" + aclVersion(acl) + ":"}
+	as := &AuthServer{authorizers: []api.Authorizer{ca}, authzCache: cache, log: newEventLogger("")}
+	authorize := func(account, name string) authzResult {
+		ar := &authRequest{ctx: context.Background(), Account: account,
+			Scopes: []authScope{{Type: "repository", Name: name, Actions: []string{"pull", "push"}}}}
+		ares, err := as.Authorize(ar)
+		if err != nil {
+			t.Fatalf("Authorize: %s", err)
+		}
+		return ares[0]
+	}
+	for i := 0; i < 3; i++ {
+		if r := authorize("alice", "foo/bar"); strings.Join(r.autorizedActions, ",") != "pull" || r.ruleName != comment {
+			t.Errorf("%d: expected pull granted by %q, got %v by %q", i, comment, r.autorizedActions, r.ruleName)
+		}
+	}
+	if ca.calls != 1 {
+		t.Errorf("expected the authorizer to be called once, got %d", ca.calls)
+	}
+	// Denials are cached too, each for its own user and scope.
+	for i := 0; i < 2; i++ {
+		if r := authorize("alice", "bar/baz"); r.autorizedActions != nil {
+			t.Errorf("expected a denial, got %v", r.autorizedActions)
+		}
+		authorize("bob", "foo/bar")
+	}
+	if ca.calls != 3 {
+		t.Errorf("expected the authorizer to be called 3 times, got %d", ca.calls)
+	}
+	other := "bar/*"
+	if aclVersion(acl) == aclVersion(authz.ACL{{Match: &authz.MatchConditions{Name: &other}, Actions: &[]string{"pull"}}}) {
+		t.Errorf("expected a different ACL to use different keys")
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "ANONYMOUS")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	delete(c.Users, "")
+	c.Anonymous = &AnonymousConfig{Actions: []string{"pull"}}
+	c.Server.DenyReasons = true
+	anonymous, public, loggedIn := "", "public/*", "/.+/"
+	acl, err := authz.NewACLAuthorizer(authz.ACL{
+		{Match: &authz.MatchConditions{Account: &anonymous, Name: &public}, Actions: &[]string{"*"}},
+		{Match: &authz.MatchConditions{Account: &loggedIn}, Actions: &[]string{"pull"}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		authorizers:    []api.Authorizer{acl},
+		log:            newEventLogger(c.Server.LogFormat),
+	}
+	get := func(user, password, scope string) (int, []string) {
+		req := httptest.NewRequest(http.MethodGet, "/auth?service=registry&scope="+scope, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rr := httptest.NewRecorder()
+		as.ServeHTTP(rr, req)
+		return rr.Code, rr.Header()["Docker-Auth-Denied"]
+	}
+	if code, denied := get("", "", "repository:public/app:delete,pull,push"); code != http.StatusOK ||
+		len(denied) != 1 || denied[0] != `repository:public/app:delete,push denied by rule "anonymous.actions"` {
+		t.Errorf("expected only pull to be granted, got %d %q", code, denied)
+	}
+	if code, denied := get("", "", "repository:private/app:pull"); code != http.StatusOK || len(denied) != 1 {
+		t.Errorf("expected pull of a private repository to be denied, got %d %q", code, denied)
+	}
+	if code, denied := get("test", "123", "repository:private/app:pull"); code != http.StatusOK || len(denied) != 0 {
+		t.Errorf("expected an authenticated pull to be granted, got %d %q", code, denied)
+	}
+	if code, _ := get("test", "wrong", "repository:public/app:pull"); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong credentials to be rejected, got %d", code)
+	}
+	c.Anonymous.Actions = []string{"pull", "push"}
+	if code, denied := get("", "", "repository:public/app:pull,push"); code != http.StatusOK || len(denied) != 0 {
+		t.Errorf("expected push to be granted when allowed, got %d %q", code, denied)
+	}
+
+	// Requests without credentials cannot claim an account, for tokens or the admin endpoints.
+	if code, _ := get("", "", "repository:private/app:pull&account=admin"); code != http.StatusUnauthorized {
+		t.Errorf("expected an anonymous request for an account to be rejected, got %d", code)
+	}
+	c.Introspection = &IntrospectionConfig{AllowedClients: []string{"admin"}}
+	c.Revocation = &RevocationConfig{AllowedClients: []string{"admin"}}
+	c.ReadOnly = &ReadOnlyConfig{AllowedClients: []string{"admin"}}
+	c.Version = &VersionConfig{AllowedClients: []string{"admin"}}
+	for _, path := range []string{"/introspect", "/revoke", "/read_only", "/version"} {
+		req := httptest.NewRequest(http.MethodPost, path+"?account=admin", strings.NewReader("enabled=true&sub=test&token=x"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		as.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected an anonymous client to be rejected, got %d %s", path, rr.Code, rr.Body)
+		}
+	}
+	c.GitHubAuth = &authn.GitHubAuthConfig{SignOutAdmins: []string{"admin"}}
+	req := httptest.NewRequest(http.MethodPost, "/github_auth/sign_out?account=admin", strings.NewReader("user=victim"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	as.doGitHubSignOut(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an anonymous sign out to be rejected, got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := api.PasswordString(hash)
+	c := &Config{ClientCertAuth: &authn.ClientCertAuthConfig{AllowedNames: []string{"*.ci.example.com"}}}
+	as := &AuthServer{config: c, authenticators: []api.Authenticator{
+		authn.NewClientCertAuth(c.ClientCertAuth),
+		authn.NewStaticUserAuth(map[string]*authn.Requirements{"alice": {Password: &pw}}),
+	}}
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "a.ci.example.com"},
+		DNSNames: []string{"b.ci.example.com"},
+		URIs:     []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/ci"}},
+	}
+	authenticate := func(account, user, password string, cert *x509.Certificate) (bool, api.Labels) {
+		req := httptest.NewRequest(http.MethodGet, "/auth?account="+account, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		ar, err := as.ParseRequest(req)
+		if err != nil {
+			t.Fatalf("ParseRequest: %s", err)
+		}
+		ok, labels, err := as.Authenticate(ar)
+		if err != nil {
+			t.Fatalf("Authenticate: %s", err)
+		}
+		return ok, labels
+	}
+	// Without credentials the request is made on behalf of the certificate subject.
+	ok, labels := authenticate("", "", "", leaf)
+	if !ok || !reflect.DeepEqual(labels["cert_uri"], []string{"spiffe://example.com/ci"}) {
+		t.Errorf("expected the certificate subject to be accepted, got %t %v", ok, labels)
+	}
+	if ok, _ := authenticate("b.ci.example.com", "", "", leaf); !ok {
+		t.Errorf("expected a SAN of the certificate to be accepted as the account")
+	}
+	if ok, _ := authenticate("alice", "", "", leaf); ok {
+		t.Errorf("expected an account not named in the certificate to be denied")
+	}
+	if ok, _ := authenticate("", "", "", &x509.Certificate{Subject: pkix.Name{CommonName: "intruder"}}); ok {
+		t.Errorf("expected a certificate name that is not allowed to be denied")
+	}
+	// Password authentication still works, with or without a certificate.
+	if ok, _ := authenticate("", "alice", "secret", leaf); !ok {
+		t.Errorf("expected a password to be accepted alongside a certificate")
+	}
+	if ok, _ := authenticate("", "alice", "secret", nil); !ok {
+		t.Errorf("expected a password to be accepted without a certificate")
+	}
+	if ok, _ := authenticate("", "a.ci.example.com", "", nil); ok {
+		t.Errorf("expected the certificate subject to be denied without a certificate")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	c, err := LoadConfig("../../examples/reference.yml", "TRACING")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	everyone := "/.*/"
+	acl, err := authz.NewACLAuthorizer(authz.ACL{
+		{Match: &authz.MatchConditions{Account: &everyone}, Actions: &[]string{"pull"}},
+	}, false)
+	if err != nil {
+		t.Fatalf("NewACLAuthorizer: %s", err)
+	}
+	as := &AuthServer{
+		config:         c,
+		authenticators: []api.Authenticator{authn.NewStaticUserAuth(c.Users)},
+		authorizers:    []api.Authorizer{acl},
+		log:            newEventLogger(c.Server.LogFormat),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth?service=registry&scope=repository:app:pull", nil)
+	req.SetBasicAuth("test", "123")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	as.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a token, got %d %s", rr.Code, rr.Body)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	root := spans["/auth"]
+	if root == nil {
+		t.Fatalf("expected a span for the request, got %v", sr.Ended())
+	}
+	if root.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the incoming trace context to be continued, got %s parent %s",
+			root.SpanContext().TraceID(), root.Parent().SpanID())
+	}
+	for _, name := range []string{"authn static", "authz", "token"} {
+		s := spans[name]
+		if s == nil {
+			t.Errorf("expected a %q span, got %v", name, sr.Ended())
+		} else if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("expected %q to be a child of the request span", name)
+		}
+	}
+	if s := spans["authn static"]; s != nil {
+		result := ""
+		for _, a := range s.Attributes() {
+			if a.Key == "authn.result" {
+				result = a.Value.AsString()
+			}
+		}
+		if result != "success" {
+			t.Errorf("expected the authn result to be recorded, got %q", result)
+		}
+	}
+}
+
+func TestGitHubSignOut(t *testing.T) {
+	c, err := LoadConfig("../../examples/reference.yml", "GHSIGNOUT")
+	if err != nil {
+		t.Fatalf("LoadConfig: %s", err)
+	}
+	c.GitHubAuth = &authn.GitHubAuthConfig{TokenDB: filepath.Join(t.TempDir(), "tokens.ldb"), SignOutAdmins: []string{"admin"}}
+	db, err := authn.NewTokenDB(c.GitHubAuth.TokenDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := map[string]string{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if passwords[user], err = db.StoreToken(user, &authn.TokenDBValue{ValidUntil: time.Now().Add(time.Hour)}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	gha, err := authn.NewGitHubAuth(c.GitHubAuth)
+	if err != nil {
+		t.Fatalf("NewGitHubAuth: %s", err)
+	}
+	defer gha.Stop()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := api.PasswordString(hash)
+	as := &AuthServer{
+		config: c,
+		gha:    gha,
+		authenticators: []api.Authenticator{
+			authn.NewStaticUserAuth(map[string]*authn.Requirements{"admin": {Password: &pw}}),
+			gha,
+		},
+		log: newEventLogger(c.Server.LogFormat),
+	}
+	signOut := func(method, account, password, user string) int {
+		req := httptest.NewRequest(method, "/github_auth/sign_out", strings.NewReader(url.Values{"user": {user}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if account != "" {
+			req.SetBasicAuth(account, password)
+		}
+		rr := httptest.NewRecorder()
+		as.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	signedIn := func(user string) bool {
+		ok, _, _ := gha.Authenticate(user, api.PasswordString(passwords[user]))
+		return ok
+	}
+
+	if code := signOut(http.MethodGet, "alice", passwords["alice"], ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", code)
+	}
+	if code := signOut(http.MethodPost, "", "", ""); code != http.StatusBadRequest {
+		t.Errorf("expected a request without a user to be rejected, got %d", code)
+	}
+	// Users can sign themselves out, with the password they are signing out.
+	if code := signOut(http.MethodPost, "alice", passwords["alice"], ""); code != http.StatusOK || signedIn("alice") {
+		t.Errorf("expected alice to be signed out, got %d", code)
+	}
+	if code := signOut(http.MethodPost, "bob", "wrong", ""); code != http.StatusUnauthorized || !signedIn("bob") {
+		t.Errorf("expected a wrong password to be rejected, got %d", code)
+	}
+	// Only admins can sign out others.
+	if code := signOut(http.MethodPost, "carol", passwords["carol"], "bob"); code != http.StatusUnauthorized || !signedIn("bob") {
+		t.Errorf("expected carol not to be able to sign out bob, got %d", code)
+	}
+	if code := signOut(http.MethodPost, "admin", "wrong", "bob"); code != http.StatusUnauthorized || !signedIn("bob") {
+		t.Errorf("expected an admin with a wrong password to be rejected, got %d", code)
+	}
+	if code := signOut(http.MethodPost, "admin", "secret", "bob"); code != http.StatusOK || signedIn("bob") {
+		t.Errorf("expected the admin to sign out bob, got %d", code)
+	}
+	if !signedIn("carol") {
+		t.Errorf("expected carol to stay signed in")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/docker/libtrust"
+
+	"github.com/cesanta/docker_auth/auth_server/authn"
+)
+
+// TokenSigner signs tokens. The key may be held outside of the server, e.g. by a KMS or an HSM.
+type TokenSigner interface {
+	// Sign returns the JWS signature of the signing input ("<header>.<claims>").
+	// Implementations must be goroutine-safe.
+	Sign(payload []byte) ([]byte, error)
+	// Algorithm returns the JWS algorithm the signatures are made with, e.g. "RS256".
+	Algorithm() string
+}
+
+// localSigner signs with a private key loaded from token.key or token.key_pem.
+type localSigner struct {
+	key  libtrust.PrivateKey
+	hash crypto.Hash
+	alg  string
+}
+
+func newLocalSigner(key libtrust.PrivateKey, hash crypto.Hash) (*localSigner, error) {
+	// Sign something dummy to find out which algorithm is used.
+	_, alg, err := key.Sign(strings.NewReader("dummy"), hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with token key: %s", err)
+	}
+	return &localSigner{key: key, hash: hash, alg: alg}, nil
+}
+
+func (s *localSigner) Sign(payload []byte) ([]byte, error) {
+	sig, alg, err := s.key.Sign(bytes.NewReader(payload), s.hash)
+	if err == nil && alg != s.alg {
+		err = fmt.Errorf("signed with %s instead of %s", alg, s.alg)
+	}
+	return sig, err
+}
+
+func (s *localSigner) Algorithm() string {
+	return s.alg
+}
+
+// TokenKMSConfig delegates token signing to a key held by a KMS or HSM. The certificate of the key
+// is still configured locally, as token.certificate or token.cert_pem, for the kid and the JWKS.
+// One of aws and command must be set.
+type TokenKMSConfig struct {
+	AWS *AWSKMSConfig `mapstructure:"aws,omitempty"`
+	// Command that reads the JWS signing input from stdin and writes the raw signature to stdout,
+	// e.g. pkcs11-tool for a PKCS#11 HSM. EC signatures can be either DER or r||s.
+	Command string   `mapstructure:"command,omitempty"`
+	Args    []string `mapstructure:"args,omitempty"`
+	// How long to wait for a signature. Default is 5s.
+	Timeout time.Duration `mapstructure:"timeout,omitempty"`
+}
+
+// AWSKMSConfig is an asymmetric signing key in AWS KMS.
+type AWSKMSConfig struct {
+	// Key ID, ARN, alias name or alias ARN.
+	KeyID  string `mapstructure:"key_id,omitempty"`
+	Region string `mapstructure:"region,omitempty"`
+	// Endpoint URL, e.g. a VPC endpoint. Defaults to https://kms.<region>.amazonaws.com.
+	Endpoint string `mapstructure:"endpoint,omitempty"`
+	// Credentials. Default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+	AccessKeyID     string `mapstructure:"access_key_id,omitempty"`
+	SecretAccessKey string `mapstructure:"secret_access_key,omitempty"`
+	SessionToken    string `mapstructure:"session_token,omitempty"`
+}
+
+// Validate checks the config and fills in the defaults.
+func (c *TokenKMSConfig) Validate(configKey string) error {
+	if (c.AWS == nil) == (c.Command == "") {
+		return fmt.Errorf("%s: one of aws and command is required", configKey)
+	}
+	if c.AWS != nil && (c.AWS.KeyID == "" || c.AWS.Region == "") {
+		return fmt.Errorf("%s.aws.{key_id,region} are required", configKey)
+	}
+	if c.Command != "" {
+		if _, err := exec.LookPath(c.Command); err != nil {
+			return fmt.Errorf("%s.command: invalid command %q: %s", configKey, c.Command, err)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("%s.timeout must not be negative", configKey)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	return nil
+}
+
+// kmsAlgorithm returns the JWS algorithm to sign with a key, alg if set.
+func kmsAlgorithm(pub crypto.PublicKey, alg string) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if alg == "" {
+			return "RS256", nil
+		}
+		if strings.HasPrefix(alg, "RS") {
+			return alg, nil
+		}
+		return "", fmt.Errorf("token.signing_algorithm %s is incompatible with the RSA token key", alg)
+	case *ecdsa.PublicKey:
+		keyAlg := map[elliptic.Curve]string{elliptic.P256(): "ES256", elliptic.P384(): "ES384", elliptic.P521(): "ES512"}[k.Curve]
+		if keyAlg == "" {
+			return "", fmt.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
+		}
+		if alg != "" && alg != keyAlg {
+			return "", fmt.Errorf("token.signing_algorithm %s is incompatible with the EC token key, which signs with %s", alg, keyAlg)
+		}
+		return keyAlg, nil
+	}
+	return "", fmt.Errorf("unsupported token key type %T", pub)
+}
+
+// newKMSSigner returns a signer for the key with the given public key.
+func newKMSSigner(c *TokenKMSConfig, pub crypto.PublicKey, alg string) (TokenSigner, error) {
+	alg, err := kmsAlgorithm(pub, alg)
+	if err != nil {
+		return nil, err
+	}
+	if c.AWS != nil {
+		endpoint := c.AWS.Endpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", c.AWS.Region)
+		}
+		return &awsKMSSigner{
+			config:   c.AWS,
+			alg:      alg,
+			endpoint: strings.TrimSuffix(endpoint, "/") + "/",
+			client:   &http.Client{Timeout: c.Timeout},
+		}, nil
+	}
+	return &commandSigner{config: c, alg: alg}, nil
+}
+
+// ecSignatureSize is the length of an r||s signature with alg.
+func ecSignatureSize(alg string) int {
+	switch alg {
+	case "ES256":
+		return 64
+	case "ES384":
+		return 96
+	case "ES512":
+		return 132
+	}
+	return 0
+}
+
+// joseSignature converts an ECDSA signature in DER, as made by KMSs and HSMs, to the r||s form
+// that JWS uses. Signatures of other algorithms and those that are already r||s are returned as they are.
+func joseSignature(alg string, sig []byte) ([]byte, error) {
+	size := ecSignatureSize(alg)
+	if size == 0 || len(sig) == size {
+		return sig, nil
+	}
+	var der struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &der); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("bad %s signature", alg)
+	}
+	out := make([]byte, size)
+	der.R.FillBytes(out[:size/2])
+	der.S.FillBytes(out[size/2:])
+	return out, nil
+}
+
+// awsKMSSigner signs with the Sign API of AWS KMS, which is given the digest, not the whole token.
+type awsKMSSigner struct {
+	config   *AWSKMSConfig
+	alg      string
+	endpoint string
+	client   *http.Client
+}
+
+// KMS signing algorithms and the hashes they are given, by JWS algorithm.
+var awsKMSAlgorithms = map[string]struct {
+	name string
+	hash crypto.Hash
+}{
+	"RS256": {"RSASSA_PKCS1_V1_5_SHA_256", crypto.SHA256},
+	"RS384": {"RSASSA_PKCS1_V1_5_SHA_384", crypto.SHA384},
+	"RS512": {"RSASSA_PKCS1_V1_5_SHA_512", crypto.SHA512},
+	"ES256": {"ECDSA_SHA_256", crypto.SHA256},
+	"ES384": {"ECDSA_SHA_384", crypto.SHA384},
+	"ES512": {"ECDSA_SHA_512", crypto.SHA512},
+}
+
+func (s *awsKMSSigner) Sign(payload []byte) ([]byte, error) {
+	ka := awsKMSAlgorithms[s.alg]
+	h := ka.hash.New()
+	h.Write(payload)
+	body, err := json.Marshal(map[string]string{
+		"KeyId":            s.config.KeyID,
+		"Message":          base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": ka.name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Sign")
+	authn.SignAWSRequest(req, body, s.config.AccessKeyID, s.config.SecretAccessKey, s.config.SessionToken, s.config.Region, "kms")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Sign: %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Sign: %s", err)
+	}
+	var out struct {
+		Signature string
+		Type      string `json:"__type"`
+		Message   string `json:"message"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("KMS Sign: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS Sign: %s %s %s", resp.Status, out.Type, out.Message)
+	}
+	sig, err := base64.StdEncoding.DecodeString(out.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Sign: %s", err)
+	}
+	return joseSignature(s.alg, sig)
+}
+
+func (s *awsKMSSigner) Algorithm() string {
+	return s.alg
+}
+
+// commandSigner signs by running a command, e.g. one that talks to an HSM.
+type commandSigner struct {
+	config *TokenKMSConfig
+	alg    string
+}
+
+func (s *commandSigner) Sign(payload []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.config.Command, s.config.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sig, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s %s", s.config.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(sig) == 0 {
+		return nil, errors.New(s.config.Command + ": no signature")
+	}
+	return joseSignature(s.alg, sig)
+}
+
+func (s *commandSigner) Algorithm() string {
+	return s.alg
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+var tracer = otel.Tracer("github.com/cesanta/docker_auth/auth_server/server")
+
+// TracingConfig configures export of OpenTelemetry traces over OTLP/HTTP.
+type TracingConfig struct {
+	// host:port of the OTLP/HTTP receiver, e.g. "otel-collector:4318".
+	Endpoint    string            `mapstructure:"endpoint,omitempty"`
+	URLPath     string            `mapstructure:"url_path,omitempty"`
+	Insecure    bool              `mapstructure:"insecure,omitempty"`
+	Headers     map[string]string `mapstructure:"headers,omitempty"`
+	ServiceName string            `mapstructure:"service_name,omitempty"`
+	// Fraction of traces to sample, for requests without a sampled parent.
+	SampleRatio *float64 `mapstructure:"sample_ratio,omitempty"`
+}
+
+func (tc *TracingConfig) validate() []error {
+	var errs []error
+	if tc.Endpoint == "" {
+		errs = append(errs, errors.New("server.tracing.endpoint is required"))
+	}
+	if tc.ServiceName == "" {
+		tc.ServiceName = "docker_auth"
+	}
+	if tc.SampleRatio == nil {
+		one := 1.0
+		tc.SampleRatio = &one
+	} else if *tc.SampleRatio < 0 || *tc.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("server.tracing.sample_ratio must be between 0 and 1, got %g", *tc.SampleRatio))
+	}
+	return errs
+}
+
+// InitTracing sets up the global OpenTelemetry tracer provider and W3C trace context propagation.
+// The returned function flushes pending spans and must be called on shutdown.
+func InitTracing(tc *TracingConfig) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tc.Endpoint)}
+	if tc.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(tc.URLPath))
+	}
+	if tc.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(tc.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(tc.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %s", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(tc.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*tc.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
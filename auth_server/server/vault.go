@@ -0,0 +1,214 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// VaultConfig configures access to HashiCorp Vault.
+// Any string option can then be read from a Vault KV secret by setting
+// "<option>_vault" to "<path>#<key>", e.g. client_secret_vault: "secret/data/docker_auth#github_secret".
+type VaultConfig struct {
+	// Defaults to $VAULT_ADDR.
+	Address string `mapstructure:"address,omitempty"`
+	// Defaults to $VAULT_TOKEN. Not needed if AppRole is used.
+	Token     string              `mapstructure:"token,omitempty"`
+	AppRole   *VaultAppRoleConfig `mapstructure:"approle,omitempty"`
+	Namespace string              `mapstructure:"namespace,omitempty"`
+	CAFile    string              `mapstructure:"ca_file,omitempty"`
+	Timeout   time.Duration       `mapstructure:"timeout,omitempty"`
+}
+
+type VaultAppRoleConfig struct {
+	RoleID   string `mapstructure:"role_id,omitempty"`
+	SecretID string `mapstructure:"secret_id,omitempty"`
+	// Mount path of the AppRole auth method, "approle" by default.
+	Mount string `mapstructure:"mount,omitempty"`
+}
+
+type vaultClient struct {
+	config  *VaultConfig
+	client  *http.Client
+	token   string
+	secrets map[string]map[string]interface{}
+}
+
+type vaultResponse struct {
+	Errors []string               `json:"errors"`
+	Data   map[string]interface{} `json:"data"`
+	Auth   *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// resolveVaultSecrets replaces every string option that has a "<option>_vault" sibling
+// with the value read from Vault. It is a no-op if no vault section is configured.
+func resolveVaultSecrets(t reflect.Type, settings map[string]interface{}) error {
+	if _, ok := settings["vault"]; !ok {
+		return nil
+	}
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return err
+	}
+	vc := &VaultConfig{}
+	if err := v.UnmarshalKey("vault", vc); err != nil {
+		return fmt.Errorf("could not parse vault config: %s", err)
+	}
+	var vcl *vaultClient
+	return resolveStringOptions("", t, settings, "_vault", func(key, ref string) (string, error) {
+		// Only talk to Vault if there is something to resolve.
+		if vcl == nil {
+			var err error
+			if vcl, err = newVaultClient(vc); err != nil {
+				return "", err
+			}
+		}
+		value, err := vcl.read(ref)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %s: %s", key, err)
+		}
+		return value, nil
+	})
+}
+
+func newVaultClient(c *VaultConfig) (*vaultClient, error) {
+	if c.Address == "" {
+		c.Address = os.Getenv("VAULT_ADDR")
+	}
+	if c.Address == "" {
+		return nil, fmt.Errorf("vault.address is required")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	vcl := &vaultClient{
+		config:  c,
+		client:  &http.Client{Timeout: c.Timeout},
+		token:   c.Token,
+		secrets: map[string]map[string]interface{}{},
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read vault.ca_file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault.ca_file %s", c.CAFile)
+		}
+		vcl.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	if ar := c.AppRole; ar != nil {
+		mount := ar.Mount
+		if mount == "" {
+			mount = "approle"
+		}
+		body, _ := json.Marshal(map[string]string{"role_id": ar.RoleID, "secret_id": ar.SecretID})
+		resp, err := vcl.do("POST", "auth/"+mount+"/login", body)
+		if err != nil {
+			return nil, fmt.Errorf("vault AppRole login failed: %s", err)
+		}
+		if resp.Auth == nil || resp.Auth.ClientToken == "" {
+			return nil, fmt.Errorf("vault AppRole login failed: no token returned")
+		}
+		vcl.token = resp.Auth.ClientToken
+	}
+	if vcl.token == "" {
+		vcl.token = os.Getenv("VAULT_TOKEN")
+	}
+	if vcl.token == "" {
+		return nil, fmt.Errorf("vault.token or vault.approle is required")
+	}
+	return vcl, nil
+}
+
+// read returns the value of a key in a KV secret, referenced as "<path>#<key>".
+// Both KV v1 and v2 engines are supported; for v2, path must include "data/".
+func (vcl *vaultClient) read(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid vault reference %q, must be <path>#<key>", ref)
+	}
+	path, key := strings.Trim(parts[0], "/"), parts[1]
+	data, ok := vcl.secrets[path]
+	if !ok {
+		resp, err := vcl.do("GET", path, nil)
+		if err != nil {
+			return "", err
+		}
+		data = resp.Data
+		// KV v2 wraps the secret in another data object, next to its metadata.
+		if inner, ok := data["data"].(map[string]interface{}); ok {
+			if _, ok := data["metadata"]; ok {
+				data = inner
+			}
+		}
+		vcl.secrets[path] = data
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %q", path, key)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s key %q is not a string", path, key)
+	}
+	return s, nil
+}
+
+func (vcl *vaultClient) do(method, path string, body []byte) (*vaultResponse, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(vcl.config.Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if vcl.token != "" {
+		req.Header.Set("X-Vault-Token", vcl.token)
+	}
+	if vcl.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vcl.config.Namespace)
+	}
+	resp, err := vcl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	vr := &vaultResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("could not parse vault response for %s: %s", path, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("vault path %s not found", path)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("vault returned %s for %s: %s", resp.Status, path, strings.Join(vr.Errors, "; "))
+	}
+	return vr, nil
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Version and BuildID of the binary, set by main.
+var (
+	Version = ""
+	BuildID = ""
+)
+
+// VersionConfig protects the /version endpoint, which is open to anyone by default.
+// Clients authenticate like any other user and must be listed in AllowedClients.
+type VersionConfig struct {
+	AllowedClients []string `mapstructure:"allowed_clients,omitempty"`
+}
+
+type versionResponse struct {
+	Version    string `json:"version"`
+	BuildID    string `json:"build_id"`
+	GoVersion  string `json:"go_version"`
+	ConfigHash string `json:"config_hash"`
+}
+
+// isSecretKey tells if the value of a config option is a secret, which configHash leaves out.
+func isSecretKey(name string) bool {
+	for _, s := range []string{"password", "secret", "credential", "private_key", "key_pem", "encryption_key", "auth_header", "dsn", "connstring", "conn_string"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return name == "token" || strings.HasSuffix(name, "_token")
+}
+
+// configHash returns a hash of the loaded config, so that replicas running the same config
+// can be told apart from those that are not. Secrets are redacted the same way
+// Requirements.String() does, so changing only a secret does not change the hash.
+func configHash(c *Config) string {
+	b, _ := json.Marshal(redactedConfig(reflect.ValueOf(c), false))
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// redactedConfig converts a config value to plain maps, slices and scalars keyed by the config option
+// names, with secret strings replaced by "***". secret is set for values of secret options.
+func redactedConfig(v reflect.Value, secret bool) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redactedConfig(v.Elem(), secret)
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		redactStruct(v, m)
+		return m
+	case reflect.Map:
+		m := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = redactedConfig(v.MapIndex(k), secret)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = redactedConfig(v.Index(i), secret)
+		}
+		return l
+	case reflect.String:
+		if secret && v.Len() > 0 {
+			return "***"
+		}
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			// api.PasswordString redacts itself.
+			return s.String()
+		}
+		return v.String()
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+func redactStruct(v reflect.Value, m map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, squash, ok := configKey(t.Field(i))
+		if !ok {
+			continue
+		}
+		if squash {
+			if fv := reflect.Indirect(v.Field(i)); fv.Kind() == reflect.Struct {
+				redactStruct(fv, m)
+			}
+			continue
+		}
+		m[name] = redactedConfig(v.Field(i), isSecretKey(name))
+	}
+}
+
+// doVersion reports the version of the binary and the hash of the config it is running with.
+func (as *AuthServer) doVersion(rw http.ResponseWriter, req *http.Request) {
+	if vc := as.config.Version; vc != nil {
+		if _, ok := as.checkClient(rw, req, vc.AllowedClients); !ok {
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(&versionResponse{
+		Version:    Version,
+		BuildID:    BuildID,
+		GoVersion:  runtime.Version(),
+		ConfigHash: as.configHash,
+	})
+}
@@ -0,0 +1,205 @@
+/*
+   Copyright 2026 Cesanta Software Ltd.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       https://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cesanta/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// Header with the HMAC-SHA256 of the body, as "sha256=<hex>", if a secret is configured.
+const webhookSignatureHeader = "X-Docker-Auth-Signature"
+
+// WebhookConfig configures a webhook that is notified of every authentication.
+type WebhookConfig struct {
+	URL string `mapstructure:"url,omitempty"`
+	// If set, requests are signed with it, see webhookSignatureHeader.
+	Secret  string        `mapstructure:"secret,omitempty"`
+	Timeout time.Duration `mapstructure:"timeout,omitempty"`
+	// Attempts per event, including the first. Failed deliveries are retried with exponential backoff.
+	MaxAttempts int `mapstructure:"max_attempts,omitempty"`
+	// Number of events that can be waiting to be delivered.
+	// When the buffer is full, events are dropped and counted in docker_auth_webhook_dropped_total.
+	BufferSize int `mapstructure:"buffer_size,omitempty"`
+}
+
+func (wc *WebhookConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(wc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("server.webhook.url must be an http(s) URL, got %q", wc.URL))
+	}
+	if wc.Timeout < 0 {
+		errs = append(errs, errors.New("server.webhook.timeout must not be negative"))
+	} else if wc.Timeout == 0 {
+		wc.Timeout = 5 * time.Second
+	}
+	if wc.MaxAttempts < 0 {
+		errs = append(errs, errors.New("server.webhook.max_attempts must not be negative"))
+	} else if wc.MaxAttempts == 0 {
+		wc.MaxAttempts = 3
+	}
+	if wc.BufferSize < 0 {
+		errs = append(errs, errors.New("server.webhook.buffer_size must not be negative"))
+	} else if wc.BufferSize == 0 {
+		wc.BufferSize = 1000
+	}
+	return errs
+}
+
+var webhookResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "docker_auth_webhook_total",
+	Help: "Webhook events, by result (delivered, failed or dropped because the buffer was full).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(webhookResults)
+}
+
+// authnEvent is what the webhook is sent after an authentication.
+// Like auditEntry, it deliberately has no room for credentials.
+type authnEvent struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id,omitempty"`
+	User          string    `json:"user"`
+	Authenticator string    `json:"authenticator,omitempty"`
+	// allow, deny or error.
+	Decision string `json:"decision"`
+	RemoteIP string `json:"remote_ip"`
+}
+
+func newAuthnEvent(ar *authRequest, authenticator string, result bool, err error) *authnEvent {
+	e := &authnEvent{
+		Time:          time.Now().UTC(),
+		RequestID:     api.RequestID(ar.context()),
+		User:          ar.Account,
+		Authenticator: authenticator,
+		Decision:      "deny",
+		RemoteIP:      ar.RemoteIP.String(),
+	}
+	if err != nil {
+		e.Decision = "error"
+	} else if result {
+		e.Decision = "allow"
+	}
+	return e
+}
+
+// webhook delivers events in the background, one at a time, so that a slow receiver does not
+// hold up responses.
+type webhook struct {
+	config *WebhookConfig
+	client *http.Client
+	events chan *authnEvent
+	done   chan struct{}
+	// Delay before the first retry, doubled for each further one.
+	retryDelay time.Duration
+}
+
+func newWebhook(wc *WebhookConfig) *webhook {
+	wh := &webhook{
+		config:     wc,
+		client:     &http.Client{Timeout: wc.Timeout},
+		events:     make(chan *authnEvent, wc.BufferSize),
+		done:       make(chan struct{}),
+		retryDelay: time.Second,
+	}
+	go wh.run()
+	return wh
+}
+
+// Notify queues an event for delivery. It never blocks; if the buffer is full, the event is dropped.
+func (wh *webhook) Notify(e *authnEvent) {
+	if wh == nil {
+		return
+	}
+	select {
+	case wh.events <- e:
+	default:
+		webhookResults.WithLabelValues("dropped").Inc()
+		glog.Errorf("Webhook buffer full, dropped event for %s", e.User)
+	}
+}
+
+func (wh *webhook) run() {
+	defer close(wh.done)
+	for e := range wh.events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			glog.Errorf("Failed to encode webhook event for %s: %s", e.User, err)
+			continue
+		}
+		delay := wh.retryDelay
+		for attempt := 1; ; attempt++ {
+			if err = wh.send(body); err == nil {
+				webhookResults.WithLabelValues("delivered").Inc()
+				break
+			}
+			if attempt >= wh.config.MaxAttempts {
+				webhookResults.WithLabelValues("failed").Inc()
+				glog.Errorf("Failed to deliver webhook event for %s after %d attempt(s): %s", e.User, attempt, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (wh *webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.config.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close delivers the events still buffered, retries included.
+// There must be no Notify calls in flight or after it.
+func (wh *webhook) Close() {
+	if wh == nil {
+		return
+	}
+	close(wh.events)
+	<-wh.done
+}
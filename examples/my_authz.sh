@@ -5,5 +5,7 @@
 
 read j;
 
+# Optionally, tell why the request is denied.
+echo '{"reason": "denied by my_authz.sh"}'
 
 exit 1